@@ -0,0 +1,82 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"net"
+)
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	remoteAddrKey
+	identityKey
+)
+
+// ContextErr returns the error to give for a request whose context is done. A request that ran out
+// of time gets ErrTempFailure so the client knows it can try again. A request that was canceled,
+// e.g. because the client hung up, gets the context's error. It returns nil if the context is not
+// done.
+func ContextErr(ctx context.Context) error {
+	switch err := ctx.Err(); err {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return ErrTempFailure
+	default:
+		return err
+	}
+}
+
+// ContextWithUser returns a copy of the context carrying the user the connection has
+// authenticated as
+func ContextWithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// UserFromContext returns the user the connection a request came in on has authenticated as, or
+// an empty string if it hasn't
+func UserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey).(string)
+	return user
+}
+
+// ContextWithRemoteAddr returns a copy of the context carrying the address of the client
+func ContextWithRemoteAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, remoteAddrKey, addr)
+}
+
+// RemoteAddrFromContext returns the address of the client a request came from, or nil if it
+// isn't known
+func RemoteAddrFromContext(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(remoteAddrKey).(net.Addr)
+	return addr
+}
+
+// ContextWithIdentity returns a copy of the context carrying the identity the client proved when
+// it connected, such as the common name of a verified TLS client certificate
+func ContextWithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey, identity)
+}
+
+// IdentityFromContext returns the identity the client a request came from proved when it
+// connected, or an empty string if it didn't prove one. This is separate from the user in
+// UserFromContext and says nothing about whether the connection is authenticated.
+func IdentityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey).(string)
+	return identity
+}
@@ -131,6 +131,29 @@ const (
 
 	// RequestVersion replies with a string designating the current software version
 	RequestVersion
+
+	// RequestIncrement adds a delta to a numeric value stored as a decimal string, optionally
+	// creating the item with an initial value if it does not exist
+	RequestIncrement
+
+	// RequestDecrement subtracts a delta from a numeric value stored as a decimal string. The
+	// result will never go below zero.
+	RequestDecrement
+
+	// RequestFlush invalidates all items in all levels of cache, either immediately or after a delay
+	RequestFlush
+
+	// RequestStats returns statistics about the server, optionally for a specific group of stats
+	RequestStats
+
+	// RequestSASLListMechs lists the SASL mechanisms a client can use to authenticate
+	RequestSASLListMechs
+
+	// RequestSASLAuth starts a SASL authentication exchange with the given mechanism
+	RequestSASLAuth
+
+	// RequestSASLStep continues a SASL authentication exchange that was started with RequestSASLAuth
+	RequestSASLStep
 )
 
 type Request interface {
@@ -139,13 +162,14 @@ type Request interface {
 }
 
 // SetRequest corresponds to common.RequestSet. It contains all the information required to fulfill
-// a set request.
+// a set request. A nonzero Cas makes the request conditional on the item's current CAS value.
 type SetRequest struct {
 	Key     []byte
 	Data    []byte
 	Flags   uint32
 	Exptime uint32
 	Opaque  uint32
+	Cas     uint64
 	Quiet   bool
 }
 
@@ -159,19 +183,29 @@ func (r SetRequest) IsQuiet() bool {
 
 // GetRequest corresponds to common.RequestGet. It contains all the information required to fulfill
 // a get requestGets are batch by default, so single gets and batch gets are both represented by the
-// same type.
+// same type. ReturnCas is set when the client explicitly asked for CAS values (e.g. the text
+// protocol's gets command), which tells orchestrators to return values that are authoritative.
+// ReturnKey is set when the client wants each response to carry its key (the binary protocol's
+// GetK and GetKQ commands).
 type GetRequest struct {
 	Keys       [][]byte
 	Opaques    []uint32
 	Quiet      []bool
 	NoopOpaque uint32
 	NoopEnd    bool
+	ReturnCas  bool
+	ReturnKey  bool
 }
 
 func (r GetRequest) GetOpaque() uint32 {
-	// TODO: better implementation?
-	// It's nonsensical but the best way to react in this case since it's a bad situation already.
-	// Typically if this method was needed we're already in a fatal error sitation.
+	// The request that ends the batch is the one that expects a response. Errors for a whole
+	// batch, like an authentication failure, go back with this opaque.
+	if r.NoopEnd {
+		return r.NoopOpaque
+	}
+	if len(r.Opaques) > 0 {
+		return r.Opaques[len(r.Opaques)-1]
+	}
 	return 0
 }
 
@@ -213,22 +247,119 @@ func (r TouchRequest) IsQuiet() bool {
 }
 
 // GATRequest corresponds to common.RequestGat. It contains all the information required to fulfill
-// a get-and-touch request.
+// a get-and-touch request. Like GetRequest, it is batch shaped so single and batch GATs are both
+// represented by the same type. Each key has its own new TTL in Exptimes since pipelined GATQ
+// requests in the binary protocol don't need to agree on one.
 type GATRequest struct {
-	Key     []byte
-	Exptime uint32
-	Opaque  uint32
-	Quiet   bool
+	Keys       [][]byte
+	Exptimes   []uint32
+	Opaques    []uint32
+	Quiet      []bool
+	NoopOpaque uint32
+	NoopEnd    bool
+	ReturnCas  bool
+	ReturnKey  bool
 }
 
 func (r GATRequest) GetOpaque() uint32 {
-	return r.Opaque
+	// The request that ends the batch is the one that expects a response
+	if r.NoopEnd {
+		return r.NoopOpaque
+	}
+	if len(r.Opaques) > 0 {
+		return r.Opaques[len(r.Opaques)-1]
+	}
+	return 0
 }
 
 func (r GATRequest) IsQuiet() bool {
+	return false
+}
+
+// IncrDecrRequest corresponds to common.RequestIncrement and common.RequestDecrement. It contains
+// all the information required to fulfill an increment or decrement request. If the item does not
+// exist it is created with the Initial value and Exptime unless NoCreate is set, in which case the
+// request fails with ErrKeyNotFound.
+type IncrDecrRequest struct {
+	Key      []byte
+	Delta    uint64
+	Initial  uint64
+	Exptime  uint32
+	Opaque   uint32
+	NoCreate bool
+	Quiet    bool
+}
+
+func (r IncrDecrRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r IncrDecrRequest) IsQuiet() bool {
 	return r.Quiet
 }
 
+// FlushRequest corresponds to common.RequestFlush. It contains all the information required to
+// fulfill a flush request. A nonzero Delay is the number of seconds to wait before the flush
+// takes effect.
+type FlushRequest struct {
+	Delay  uint32
+	Opaque uint32
+	Quiet  bool
+}
+
+func (r FlushRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r FlushRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// StatsRequest corresponds to common.RequestStats. It contains all the information required to
+// fulfill a stats request. Group is empty for the general stats or names a specific group such
+// as "settings" or "conns".
+type StatsRequest struct {
+	Group  string
+	Opaque uint32
+}
+
+func (r StatsRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r StatsRequest) IsQuiet() bool {
+	return false
+}
+
+// SASLListMechsRequest corresponds to common.RequestSASLListMechs.
+type SASLListMechsRequest struct {
+	Opaque uint32
+}
+
+func (r SASLListMechsRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r SASLListMechsRequest) IsQuiet() bool {
+	return false
+}
+
+// SASLAuthRequest corresponds to both common.RequestSASLAuth and common.RequestSASLStep. It contains
+// the mechanism being used and the data for the current step of the exchange.
+type SASLAuthRequest struct {
+	Mechanism string
+	Data      []byte
+	Opaque    uint32
+}
+
+func (r SASLAuthRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r SASLAuthRequest) IsQuiet() bool {
+	return false
+}
+
 // QuitRequest corresponds to common.RequestQuit. It contains all the information required to
 // fulfill a quit request.
 type QuitRequest struct {
@@ -274,14 +405,19 @@ func (r VersionRequest) IsQuiet() bool {
 
 // GetResponse is used in both RequestGet and RequestGat handling. Both respond in the same manner
 // but with different opcodes. It is binary-protocol specific, but is still a part of the interface
-// of responder to make the handling code more protocol-agnostic.
+// of responder to make the handling code more protocol-agnostic. ReturnCas mirrors the flag on the
+// originating GetRequest so protocols that only sometimes show the CAS value know when to do so.
+// ReturnKey does the same for the key.
 type GetResponse struct {
-	Key    []byte
-	Data   []byte
-	Opaque uint32
-	Flags  uint32
-	Miss   bool
-	Quiet  bool
+	Key       []byte
+	Data      []byte
+	Opaque    uint32
+	Flags     uint32
+	Cas       uint64
+	Miss      bool
+	Quiet     bool
+	ReturnCas bool
+	ReturnKey bool
 }
 
 // GetEResponse is used in the GetE protocol extension
@@ -291,6 +427,7 @@ type GetEResponse struct {
 	Opaque  uint32
 	Flags   uint32
 	Exptime uint32
+	Cas     uint64
 	Miss    bool
 	Quiet   bool
 }
@@ -0,0 +1,117 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry maps names to factories for one kind of component, like handlers or orcas. It is the
+// shared part of the typed registries in those packages, which wrap it so callers get their own
+// types back. Components are usually registered from an init() function so importing a package is
+// enough to make them available by name.
+type Registry struct {
+	kind    string
+	lock    *sync.RWMutex
+	entries map[string]registryEntry
+}
+
+type registryEntry struct {
+	options func() interface{}
+	build   func(opts interface{}) (interface{}, error)
+}
+
+// NewRegistry returns an empty registry. The kind is used in error messages.
+func NewRegistry(kind string) *Registry {
+	return &Registry{
+		kind:    kind,
+		lock:    new(sync.RWMutex),
+		entries: make(map[string]registryEntry),
+	}
+}
+
+// Register adds a factory under the given name. The options function returns a pointer to a new
+// options value, with any defaults already set, that the options given to Build are decoded into.
+// It is nil for components that take no options. Registering the same name twice panics, since it
+// is always a programming error.
+func (r *Registry) Register(name string, options func() interface{}, build func(opts interface{}) (interface{}, error)) {
+	if name == "" || build == nil {
+		panic(fmt.Sprintf("Registering %s with an empty name or nil factory", r.kind))
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.entries[name]; ok {
+		panic(fmt.Sprintf("Registering %s %q twice", r.kind, name))
+	}
+
+	r.entries[name] = registryEntry{
+		options: options,
+		build:   build,
+	}
+}
+
+// Build decodes the JSON options into the options type of the named factory and calls it. Unknown
+// option fields are an error so typos don't go unnoticed. Empty options leave the defaults alone.
+func (r *Registry) Build(name string, options []byte) (interface{}, error) {
+	r.lock.RLock()
+	e, ok := r.entries[name]
+	r.lock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown %s type %q, must be one of: %s", r.kind, name, strings.Join(r.Names(), ", "))
+	}
+
+	var opts interface{}
+	empty := len(bytes.TrimSpace(options)) == 0 || string(bytes.TrimSpace(options)) == "null"
+
+	if e.options == nil {
+		if !empty {
+			return nil, fmt.Errorf("%s %q takes no options", r.kind, name)
+		}
+	} else {
+		opts = e.options()
+
+		if !empty {
+			dec := json.NewDecoder(bytes.NewReader(options))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(opts); err != nil {
+				return nil, fmt.Errorf("invalid options for %s %q: %v", r.kind, name, err)
+			}
+		}
+	}
+
+	return e.build(opts)
+}
+
+// Names returns the registered names in sorted order
+func (r *Registry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
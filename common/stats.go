@@ -0,0 +1,59 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import "sync"
+
+// Stat is a single name / value pair as returned by the memcached stats command.
+type Stat struct {
+	Name  string
+	Value string
+}
+
+// StatsCallback produces the current set of stats for a stats group.
+type StatsCallback func() []Stat
+
+var (
+	statsLock   = new(sync.RWMutex)
+	statsGroups = make(map[string][]StatsCallback)
+)
+
+// RegisterStats adds a callback to the given stats group. The general group, returned for a plain
+// "stats" command, is the empty string. Groups can have many callbacks registered, in which case
+// the results are concatenated in registration order.
+func RegisterStats(group string, cb StatsCallback) {
+	statsLock.Lock()
+	statsGroups[group] = append(statsGroups[group], cb)
+	statsLock.Unlock()
+}
+
+// GetStats returns all of the stats for the given group. If nothing is registered for the group,
+// ErrNotSupported is returned.
+func GetStats(group string) ([]Stat, error) {
+	statsLock.RLock()
+	cbs, ok := statsGroups[group]
+	statsLock.RUnlock()
+
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	var ret []Stat
+	for _, cb := range cbs {
+		ret = append(ret, cb()...)
+	}
+
+	return ret, nil
+}
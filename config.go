@@ -0,0 +1,987 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/server"
+
+	// The built in handlers and protocols register themselves by name
+	_ "github.com/netflix/rend/handlers/inmem"
+	_ "github.com/netflix/rend/handlers/memcached"
+	_ "github.com/netflix/rend/protocol/binprot"
+	_ "github.com/netflix/rend/protocol/textprot"
+)
+
+// config is the full description of what memproxy runs. It is read from the JSON file given with
+// --config, or built from the flags if there isn't one. Flags that are set on the command line
+// override the matching settings in the file for the listeners named main, tls, and batch, which
+// are the names of the listeners the flags create on their own.
+//
+//	{
+//	    "drain_timeout": "30s",
+//	    "listeners": [
+//	        {
+//	            "name": "main",
+//	            "port": 11211,
+//	            "protocols": ["binary", "text"],
+//	            "orca": {"type": "l1l2", "locked": true, "lock_set": "shared"},
+//	            "l1": {"type": "batched", "options": {"sock": "/tmp/memcached.sock", "batch_size": 20}},
+//	            "l2": {"type": "memcached", "options": {"sock": "/tmp/l2.sock", "pool": {"size": 64}}}
+//	        },
+//	        {
+//	            "name": "batch",
+//	            "port": 11212,
+//	            "orca": {"type": "l1l2batch", "locked": true, "lock_set": "shared"},
+//	            "l1": {"type": "batched", "options": {"sock": "/tmp/memcached.sock"}},
+//	            "l2": {"type": "memcached", "options": {"sock": "/tmp/l2.sock"}}
+//	        }
+//	    ]
+//	}
+type config struct {
+	DrainTimeout     duration `json:"drain_timeout"`
+	HandoffTimeout   duration `json:"handoff_timeout"`
+	MetricsFlushFile string   `json:"metrics_flush_file"`
+
+	// Connection limits across all listeners. Zero means no limit.
+	MaxConns      int     `json:"max_conns"`
+	MaxConnsPerIP int     `json:"max_conns_per_ip"`
+	AcceptRate    float64 `json:"accept_rate"`
+	AcceptBurst   int     `json:"accept_burst"`
+
+	// Client connection and request timeouts across all listeners. Zero means no timeout.
+	IdleTimeout    duration `json:"idle_timeout"`
+	ReadTimeout    duration `json:"read_timeout"`
+	WriteTimeout   duration `json:"write_timeout"`
+	RequestTimeout duration `json:"request_timeout"`
+
+	Listeners []listenerConfig `json:"listeners"`
+}
+
+type listenerConfig struct {
+	Name string `json:"name"`
+
+	// Exactly one of Port and SockPath is set. TLS is only valid with Port.
+	Port          int        `json:"port"`
+	SockPath      string     `json:"sock_path"`
+	TLS           *tlsConfig `json:"tls"`
+	ProxyProtocol bool       `json:"proxy_protocol"`
+
+	// Protocols are tried in order when a connection is established. Defaults to binary, text.
+	Protocols []string `json:"protocols"`
+
+	AuthFile     string `json:"auth_file"`
+	ACLFile      string `json:"acl_file"`
+	DisableFlush bool   `json:"disable_flush"`
+
+	Orca orcaConfig     `json:"orca"`
+	L1   handlerConfig  `json:"l1"`
+	L2   *handlerConfig `json:"l2"`
+
+	// The connection limits and client timeouts are shared by every listener in the process, so
+	// they can only be set at the top level. They are decoded here only so that setting them on a
+	// listener is reported clearly instead of as an unknown field.
+	MaxConns       json.RawMessage `json:"max_conns"`
+	MaxConnsPerIP  json.RawMessage `json:"max_conns_per_ip"`
+	AcceptRate     json.RawMessage `json:"accept_rate"`
+	AcceptBurst    json.RawMessage `json:"accept_burst"`
+	IdleTimeout    json.RawMessage `json:"idle_timeout"`
+	ReadTimeout    json.RawMessage `json:"read_timeout"`
+	WriteTimeout   json.RawMessage `json:"write_timeout"`
+	RequestTimeout json.RawMessage `json:"request_timeout"`
+}
+
+type tlsConfig struct {
+	CertFile          string `json:"cert_file"`
+	KeyFile           string `json:"key_file"`
+	CAFile            string `json:"ca_file"`
+	RequireClientCert bool   `json:"require_client_cert"`
+}
+
+// orcaConfig and handlerConfig name a component registered with orcas.Register or
+// handlers.Register, along with the options for it. The options are decoded into the component's
+// own options type.
+type orcaConfig struct {
+	Type    string          `json:"type"`
+	Options json.RawMessage `json:"options"`
+
+	Locked      bool  `json:"locked"`
+	Concurrency int   `json:"concurrency"`
+	MultiReader *bool `json:"multi_reader"`
+
+	// Listeners with the same lock set share their locks, e.g. to keep the batch orca from
+	// interfering with the main one. They must have the same concurrency and multi_reader settings.
+	LockSet string `json:"lock_set"`
+}
+
+type handlerConfig struct {
+	Type    string          `json:"type"`
+	Options json.RawMessage `json:"options"`
+}
+
+// batchFlags holds the batched handler flags. They are turned into options for the batched
+// handler, whose option parsing rejects negative values.
+type batchFlags struct {
+	Sock                  string  `json:"sock"`
+	BatchSize             int     `json:"batch_size"`
+	BatchDelayMicros      int     `json:"batch_delay_micros"`
+	ReadBufSize           int     `json:"read_buf_size"`
+	WriteBufSize          int     `json:"write_buf_size"`
+	EvaluationIntervalSec int     `json:"evaluation_interval_sec"`
+	LoadFactorExpandRatio float64 `json:"load_factor_expand_ratio"`
+	OverloadedConnRatio   float64 `json:"overloaded_conn_ratio"`
+}
+
+// duration is a time.Duration written as a string like "30s" in JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"30s\": %v", err)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+const (
+	listenerMain  = "main"
+	listenerTLS   = "tls"
+	listenerBatch = "batch"
+
+	defaultConcurrency = 8
+)
+
+// loadConfig reads the config file if one is given and applies the flags set on the command line
+// on top of it. Without a file the config comes from the flags alone.
+func loadConfig(path string) (*config, error) {
+	fromFlags := configFromFlags()
+
+	if path == "" {
+		return fromFlags, fromFlags.validate()
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config file %s: %v", path, err)
+	}
+
+	c := &config{
+		DrainTimeout:   duration(30 * time.Second),
+		HandoffTimeout: duration(30 * time.Second),
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %s: %v", path, err)
+	}
+
+	// The flags that pick a handler type go first, so the options set by the other flags are
+	// merged into the handler that is actually used
+	var set []string
+	flag.Visit(func(f *flag.Flag) {
+		set = append(set, f.Name)
+	})
+	sort.SliceStable(set, func(i, j int) bool {
+		return handlerTypeFlags[set[i]] && !handlerTypeFlags[set[j]]
+	})
+
+	for _, name := range set {
+		c.override(name, fromFlags)
+	}
+
+	return c, c.validate()
+}
+
+// configFromFlags builds the config that the flags describe on their own: a main listener on a
+// port or unix socket, plus a TLS listener serving the same way if --tls-port is set, plus the
+// batch listener if L2 is enabled.
+func configFromFlags() *config {
+	l1 := handlerConfig{
+		Type:    "memcached",
+		Options: poolOptions(l1sock, l1poolSize),
+	}
+
+	if l1inmem {
+		l1 = handlerConfig{Type: "inmem"}
+	} else if chunked {
+		l1.Type = "chunked"
+	} else if l1batched {
+		opts := flagBatch
+		opts.Sock = l1sock
+		l1 = handlerConfig{Type: "batched", Options: jsonOptions(opts)}
+	}
+
+	var l2 *handlerConfig
+	if l2enabled {
+		l2 = &handlerConfig{Type: "memcached", Options: poolOptions(l2sock, l2poolSize)}
+	}
+
+	multi := multiReader
+	orca := orcaConfig{
+		Type:        "l1only",
+		Locked:      locked,
+		Concurrency: concurrency,
+		MultiReader: &multi,
+		LockSet:     listenerMain,
+	}
+
+	if l2enabled {
+		orca.Type = "l1l2"
+	}
+
+	main := listenerConfig{
+		Name:          listenerMain,
+		Port:          port,
+		ProxyProtocol: proxyProtocol,
+		AuthFile:      authFile,
+		ACLFile:       aclFile,
+		DisableFlush:  disableFlush,
+		Orca:          orca,
+		L1:            l1,
+		L2:            l2,
+	}
+
+	if useDomainSocket {
+		main.Port = 0
+		main.SockPath = sockPath
+	}
+
+	c := &config{
+		DrainTimeout:     duration(drainTimeout),
+		HandoffTimeout:   duration(handoffTimeout),
+		MetricsFlushFile: metricsFlushFile,
+		MaxConns:         maxConns,
+		MaxConnsPerIP:    maxConnsPerIP,
+		AcceptRate:       acceptRate,
+		AcceptBurst:      acceptBurst,
+		IdleTimeout:      duration(idleTimeout),
+		ReadTimeout:      duration(readTimeout),
+		WriteTimeout:     duration(writeTimeout),
+		RequestTimeout:   duration(requestTimeout),
+		Listeners:        []listenerConfig{main},
+	}
+
+	if tlsPort != 0 {
+		tls := main
+		tls.Name = listenerTLS
+		tls.Port = tlsPort
+		tls.SockPath = ""
+		tls.TLS = &tlsFlags
+		c.Listeners = append(c.Listeners, tls)
+	}
+
+	if l2enabled {
+		batch := main
+		batch.Name = listenerBatch
+		batch.Port = batchPort
+		batch.SockPath = ""
+		batch.ProxyProtocol = batchProxyProtocol
+		batch.AuthFile = batchAuthFile
+		batch.ACLFile = batchACLFile
+		batch.DisableFlush = batchDisableFlush
+		batch.Orca.Type = "l1l2batch"
+		c.Listeners = append(c.Listeners, batch)
+	}
+
+	return c
+}
+
+func sockOptions(sock string) json.RawMessage {
+	return jsonOptions(struct {
+		Sock string `json:"sock"`
+	}{sock})
+}
+
+// poolOptions are the options for the memcached and chunked handlers, with a pool of the given
+// size if it is positive
+func poolOptions(sock string, size int) json.RawMessage {
+	if size <= 0 {
+		return sockOptions(sock)
+	}
+
+	type pool struct {
+		Size int `json:"size"`
+	}
+
+	return jsonOptions(struct {
+		Sock string `json:"sock"`
+		Pool pool   `json:"pool"`
+	}{sock, pool{size}})
+}
+
+func jsonOptions(opts interface{}) json.RawMessage {
+	// Marshalling plain structs can't fail
+	data, _ := json.Marshal(opts)
+	return data
+}
+
+// flagScopes says which listeners each listener-specific flag applies to when it overrides a
+// config file. Flags that are not listed here apply to the config as a whole.
+var flagScopes = map[string][]string{
+	"p":                 {listenerMain},
+	"use-domain-socket": {listenerMain},
+	"sock-path":         {listenerMain},
+	"bp":                {listenerBatch},
+
+	"tls-port":                {listenerTLS},
+	"tls-cert":                {listenerTLS},
+	"tls-key":                 {listenerTLS},
+	"tls-ca":                  {listenerTLS},
+	"tls-require-client-cert": {listenerTLS},
+
+	"proxy-protocol": {listenerMain, listenerTLS},
+	"auth-file":      {listenerMain, listenerTLS},
+	"acl-file":       {listenerMain, listenerTLS},
+	"disable-flush":  {listenerMain, listenerTLS},
+
+	"batch-proxy-protocol": {listenerBatch},
+	"batch-auth-file":      {listenerBatch},
+	"batch-acl-file":       {listenerBatch},
+	"batch-disable-flush":  {listenerBatch},
+
+	"chunked":                        {listenerMain, listenerTLS, listenerBatch},
+	"l1-inmem":                       {listenerMain, listenerTLS, listenerBatch},
+	"l1-sock":                        {listenerMain, listenerTLS, listenerBatch},
+	"l1-pool-size":                   {listenerMain, listenerTLS, listenerBatch},
+	"l1-batched":                     {listenerMain, listenerTLS, listenerBatch},
+	"batch-size":                     {listenerMain, listenerTLS, listenerBatch},
+	"batch-delay":                    {listenerMain, listenerTLS, listenerBatch},
+	"batch-read-buf-size":            {listenerMain, listenerTLS, listenerBatch},
+	"batch-write-buf-size":           {listenerMain, listenerTLS, listenerBatch},
+	"batch-eval-interval":            {listenerMain, listenerTLS, listenerBatch},
+	"batch-expand-load-factor-ratio": {listenerMain, listenerTLS, listenerBatch},
+	"batch-expand-overloaded-ratio":  {listenerMain, listenerTLS, listenerBatch},
+	"l2-enabled":                     {listenerMain, listenerTLS, listenerBatch},
+	"l2-sock":                        {listenerMain, listenerTLS, listenerBatch},
+	"l2-pool-size":                   {listenerMain, listenerTLS, listenerBatch},
+	"locked":                         {listenerMain, listenerTLS, listenerBatch},
+	"concurrency":                    {listenerMain, listenerTLS, listenerBatch},
+	"multi-reader":                   {listenerMain, listenerTLS, listenerBatch},
+}
+
+// override applies a flag set on the command line to the config read from a file. src is the
+// config built from the flags, which already has the flag's value in the right place.
+func (c *config) override(name string, src *config) {
+	switch name {
+	case "config", "check-config":
+		return
+	case "drain-timeout":
+		c.DrainTimeout = src.DrainTimeout
+		return
+	case "handoff-timeout":
+		c.HandoffTimeout = src.HandoffTimeout
+		return
+	case "metrics-flush-file":
+		c.MetricsFlushFile = src.MetricsFlushFile
+		return
+	case "max-conns":
+		c.MaxConns = src.MaxConns
+		return
+	case "max-conns-per-ip":
+		c.MaxConnsPerIP = src.MaxConnsPerIP
+		return
+	case "accept-rate":
+		c.AcceptRate = src.AcceptRate
+		return
+	case "accept-burst":
+		c.AcceptBurst = src.AcceptBurst
+		return
+	case "idle-timeout":
+		c.IdleTimeout = src.IdleTimeout
+		return
+	case "read-timeout":
+		c.ReadTimeout = src.ReadTimeout
+		return
+	case "write-timeout":
+		c.WriteTimeout = src.WriteTimeout
+		return
+	case "request-timeout":
+		c.RequestTimeout = src.RequestTimeout
+		return
+	}
+
+	applied := false
+
+	for _, lname := range flagScopes[name] {
+		dst := c.listener(lname)
+		if dst == nil {
+			continue
+		}
+
+		// The flags only create the tls and batch listeners when they are enabled, but the
+		// settings they share with main are the same
+		s := src.listener(lname)
+		if s == nil {
+			s = src.listener(listenerMain)
+		}
+
+		applied = true
+
+		switch name {
+		case "p":
+			if dst.SockPath == "" {
+				dst.Port = s.Port
+			}
+		case "sock-path":
+			if dst.SockPath != "" {
+				dst.SockPath = sockPath
+			}
+		case "use-domain-socket":
+			if useDomainSocket {
+				dst.Port, dst.SockPath = 0, sockPath
+			} else if dst.SockPath != "" {
+				dst.Port, dst.SockPath = port, ""
+			}
+		case "bp", "tls-port":
+			dst.Port, dst.SockPath = s.Port, ""
+		case "tls-cert", "tls-key", "tls-ca", "tls-require-client-cert":
+			dst.mergeTLS(name)
+		case "proxy-protocol", "batch-proxy-protocol":
+			dst.ProxyProtocol = s.ProxyProtocol
+		case "auth-file", "batch-auth-file":
+			dst.AuthFile = s.AuthFile
+		case "acl-file", "batch-acl-file":
+			dst.ACLFile = s.ACLFile
+		case "disable-flush", "batch-disable-flush":
+			dst.DisableFlush = s.DisableFlush
+		case "chunked", "l1-inmem", "l1-batched", "l1-sock", "l1-pool-size", "batch-size", "batch-delay",
+			"batch-read-buf-size", "batch-write-buf-size", "batch-eval-interval",
+			"batch-expand-load-factor-ratio", "batch-expand-overloaded-ratio":
+			dst.mergeL1(name)
+		case "l2-enabled", "l2-sock", "l2-pool-size":
+			dst.mergeL2(name, s)
+		case "locked":
+			dst.Orca.Locked = s.Orca.Locked
+		case "concurrency":
+			dst.Orca.Concurrency = s.Orca.Concurrency
+		case "multi-reader":
+			dst.Orca.MultiReader = s.Orca.MultiReader
+		}
+	}
+
+	if !applied {
+		log.Printf("Flag --%s does not match any listener in the config file and is ignored", name)
+	}
+}
+
+// handlerTypeFlags are the flags that change which handler is used for L1 or whether there is an L2
+var handlerTypeFlags = map[string]bool{
+	"chunked":    true,
+	"l1-inmem":   true,
+	"l1-batched": true,
+	"l2-enabled": true,
+}
+
+// batchOptionFlags maps the batched handler flags to the options they set
+var batchOptionFlags = map[string]string{
+	"batch-size":                     "batch_size",
+	"batch-delay":                    "batch_delay_micros",
+	"batch-read-buf-size":            "read_buf_size",
+	"batch-write-buf-size":           "write_buf_size",
+	"batch-eval-interval":            "evaluation_interval_sec",
+	"batch-expand-load-factor-ratio": "load_factor_expand_ratio",
+	"batch-expand-overloaded-ratio":  "overloaded_conn_ratio",
+}
+
+// mergeTLS applies one of the TLS flags to the listener's TLS settings, keeping the rest of them
+func (l *listenerConfig) mergeTLS(name string) {
+	var t tlsConfig
+	if l.TLS != nil {
+		t = *l.TLS
+	}
+
+	switch name {
+	case "tls-cert":
+		t.CertFile = tlsFlags.CertFile
+	case "tls-key":
+		t.KeyFile = tlsFlags.KeyFile
+	case "tls-ca":
+		t.CAFile = tlsFlags.CAFile
+	case "tls-require-client-cert":
+		t.RequireClientCert = tlsFlags.RequireClientCert
+	}
+
+	l.TLS = &t
+}
+
+// mergeL1 applies one of the L1 flags to the listener's L1 handler. The type flags change the
+// type with the same precedence as without a config file, keeping only the backend address from
+// the file. The other flags set their option on the handler in the file and are ignored
+// for handler types that don't take them.
+func (l *listenerConfig) mergeL1(name string) {
+	h := &l.L1
+
+	switch name {
+	case "l1-inmem":
+		if l1inmem {
+			h.setType("inmem", "")
+		} else if h.Type == "inmem" {
+			typ := "memcached"
+			if chunked {
+				typ = "chunked"
+			} else if l1batched {
+				typ = "batched"
+			}
+			h.setType(typ, l1sock)
+		}
+		return
+	case "chunked":
+		if chunked && !l1inmem {
+			h.setType("chunked", l1sock)
+		} else if !chunked && h.Type == "chunked" {
+			h.setType("memcached", l1sock)
+		}
+		return
+	case "l1-batched":
+		if l1batched && !l1inmem && !chunked {
+			h.setType("batched", l1sock)
+		} else if !l1batched && h.Type == "batched" {
+			h.setType("memcached", l1sock)
+		}
+		return
+	}
+
+	switch {
+	case name == "l1-sock" && h.Type != "inmem":
+		h.setAddr(l1sock)
+	case name == "l1-pool-size" && (h.Type == "memcached" || h.Type == "chunked"):
+		h.setPoolSize(l1poolSize)
+	case batchOptionFlags[name] != "" && h.Type == "batched":
+		var opts map[string]json.RawMessage
+		// Marshalling plain structs can't fail
+		json.Unmarshal(jsonOptions(flagBatch), &opts)
+		key := batchOptionFlags[name]
+		h.Options = setOption(h.Options, key, opts[key])
+	default:
+		log.Printf("Flag --%s does not apply to the %s handler and is ignored", name, h.Type)
+	}
+}
+
+// mergeL2 applies one of the L2 flags to the listener. Enabling L2 only adds the L2 the flags
+// describe if the listener doesn't have one already. The other flags change the L2 in the file
+// and are ignored if there is no L2.
+func (l *listenerConfig) mergeL2(name string, s *listenerConfig) {
+	switch name {
+	case "l2-enabled":
+		if l2enabled && l.L2 == nil {
+			l.L2 = s.L2
+			if l.Orca.Type == "l1only" {
+				l.Orca.Type = "l1l2"
+			}
+		} else if !l2enabled && l.L2 != nil {
+			l.L2 = nil
+			if l.Orca.Type == "l1l2" {
+				l.Orca.Type = "l1only"
+			}
+		}
+		return
+	}
+
+	if l.L2 == nil {
+		log.Printf("Flag --%s is ignored because listener %s has no L2", name, l.Name)
+		return
+	}
+
+	switch name {
+	case "l2-sock":
+		l.L2.setAddr(l2sock)
+	case "l2-pool-size":
+		l.L2.setPoolSize(l2poolSize)
+	}
+}
+
+// setType changes the handler type. Only the backend address is kept from the old options, since
+// the rest are specific to the old type. If there isn't one, addr is used.
+func (h *handlerConfig) setType(typ, addr string) {
+	if h.Type == typ {
+		return
+	}
+
+	var old map[string]json.RawMessage
+	json.Unmarshal(h.Options, &old)
+
+	h.Type = typ
+	h.Options = nil
+
+	if typ == "inmem" {
+		return
+	}
+
+	if old["addr"] == nil && old["sock"] == nil {
+		h.Options = sockOptions(addr)
+		return
+	}
+	for _, key := range []string{"addr", "sock"} {
+		if old[key] != nil {
+			h.Options = setOption(h.Options, key, old[key])
+		}
+	}
+}
+
+// setAddr replaces the backend address in the handler options
+func (h *handlerConfig) setAddr(addr string) {
+	h.Options = setOption(h.Options, "addr", nil)
+	h.Options = setOption(h.Options, "sock", addr)
+}
+
+// setPoolSize sets the pool size in the handler options, keeping the other pool options. A size
+// of 0 or less removes the pool.
+func (h *handlerConfig) setPoolSize(size int) {
+	if size <= 0 {
+		h.Options = setOption(h.Options, "pool", nil)
+		return
+	}
+
+	var opts map[string]json.RawMessage
+	json.Unmarshal(h.Options, &opts)
+	h.Options = setOption(h.Options, "pool", setOption(opts["pool"], "size", size))
+}
+
+// setOption sets one key in a JSON object of options, or removes it if value is nil. Options that
+// aren't an object are replaced, since the handler would reject them anyway.
+func setOption(opts json.RawMessage, key string, value interface{}) json.RawMessage {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(opts, &m); err != nil || m == nil {
+		m = make(map[string]json.RawMessage)
+	}
+
+	if value == nil {
+		delete(m, key)
+	} else if raw, ok := value.(json.RawMessage); ok {
+		m[key] = raw
+	} else {
+		m[key] = jsonOptions(value)
+	}
+
+	return jsonOptions(m)
+}
+
+func (c *config) listener(name string) *listenerConfig {
+	for i := range c.Listeners {
+		if c.Listeners[i].Name == name {
+			return &c.Listeners[i]
+		}
+	}
+	return nil
+}
+
+// validate checks everything that can be checked without opening any files
+func (c *config) validate() error {
+	if c.DrainTimeout < 0 {
+		return fmt.Errorf("drain_timeout must be >= 0")
+	}
+	if c.HandoffTimeout < 0 {
+		return fmt.Errorf("handoff_timeout must be >= 0")
+	}
+	if c.MaxConns < 0 || c.MaxConnsPerIP < 0 || c.AcceptRate < 0 || c.AcceptBurst < 0 {
+		return fmt.Errorf("connection limits must be >= 0")
+	}
+	if c.IdleTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.RequestTimeout < 0 {
+		return fmt.Errorf("client timeouts must be >= 0")
+	}
+	if len(c.Listeners) == 0 {
+		return fmt.Errorf("at least one listener is required")
+	}
+
+	names := make(map[string]bool)
+	lockSets := make(map[string]orcaConfig)
+
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+
+		if l.Name == "" {
+			l.Name = fmt.Sprintf("listener%d", i)
+		}
+		if names[l.Name] {
+			return fmt.Errorf("listener name %s is used more than once", l.Name)
+		}
+		names[l.Name] = true
+
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("listener %s: %v", l.Name, err)
+		}
+
+		if l.Orca.Locked && l.Orca.LockSet != "" {
+			if prev, ok := lockSets[l.Orca.LockSet]; ok {
+				if prev.Concurrency != l.Orca.Concurrency || *prev.MultiReader != *l.Orca.MultiReader {
+					return fmt.Errorf("listener %s: lock set %s is shared with different concurrency or multi_reader settings", l.Name, l.Orca.LockSet)
+				}
+			} else {
+				lockSets[l.Orca.LockSet] = l.Orca
+			}
+		}
+	}
+
+	return nil
+}
+
+func (l *listenerConfig) validate() error {
+	global := []struct {
+		name string
+		v    json.RawMessage
+	}{
+		{"max_conns", l.MaxConns},
+		{"max_conns_per_ip", l.MaxConnsPerIP},
+		{"accept_rate", l.AcceptRate},
+		{"accept_burst", l.AcceptBurst},
+		{"idle_timeout", l.IdleTimeout},
+		{"read_timeout", l.ReadTimeout},
+		{"write_timeout", l.WriteTimeout},
+		{"request_timeout", l.RequestTimeout},
+	}
+	for _, g := range global {
+		if g.v != nil {
+			return fmt.Errorf("%s applies to every listener and can only be set at the top level", g.name)
+		}
+	}
+
+	if (l.Port == 0) == (l.SockPath == "") {
+		return fmt.Errorf("exactly one of port and sock_path is required")
+	}
+	if l.Port < 0 || l.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535")
+	}
+
+	if l.TLS != nil {
+		if l.SockPath != "" {
+			return fmt.Errorf("tls can only be used with a port")
+		}
+		if l.TLS.CertFile == "" || l.TLS.KeyFile == "" {
+			return fmt.Errorf("tls requires cert_file and key_file")
+		}
+		if l.TLS.RequireClientCert && l.TLS.CAFile == "" {
+			return fmt.Errorf("tls require_client_cert requires ca_file")
+		}
+	}
+
+	if len(l.Protocols) == 0 {
+		l.Protocols = []string{"binary", "text"}
+	}
+
+	if l.ACLFile != "" && l.AuthFile == "" {
+		return fmt.Errorf("acl_file requires auth_file")
+	}
+
+	// Whether the type exists and its options are valid is checked by the registry when the
+	// listener is built. Only the built in orcas are known to need an L2 here.
+	switch l.Orca.Type {
+	case "":
+		return fmt.Errorf("orca type is required")
+	case "l1l2", "l1l2batch":
+		if l.L2 == nil {
+			return fmt.Errorf("orca %s requires an l2", l.Orca.Type)
+		}
+	}
+
+	if l.Orca.Concurrency == 0 {
+		l.Orca.Concurrency = defaultConcurrency
+	}
+	if l.Orca.Concurrency < 0 || l.Orca.Concurrency >= 64 {
+		return fmt.Errorf("orca concurrency must be between 1 and 63")
+	}
+	if l.Orca.MultiReader == nil {
+		multi := true
+		l.Orca.MultiReader = &multi
+	}
+
+	if err := l.L1.validate(); err != nil {
+		return fmt.Errorf("l1: %v", err)
+	}
+	if l.L2 != nil {
+		if err := l.L2.validate(); err != nil {
+			return fmt.Errorf("l2: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (h *handlerConfig) validate() error {
+	if h.Type == "" {
+		return fmt.Errorf("handler type is required")
+	}
+	return nil
+}
+
+// listenerSetup is everything needed to call server.ListenAndServe for one listener
+type listenerSetup struct {
+	name      string
+	l         server.ListenConst
+	protocols []protocol.Components
+	s         server.ServerConst
+	o         orcas.OrcaConst
+	h1, h2    handlers.HandlerConst
+}
+
+// limits returns the connection limits for the server package
+func (c *config) limits() server.Limits {
+	return server.Limits{
+		MaxConns:      c.MaxConns,
+		MaxConnsPerIP: c.MaxConnsPerIP,
+		AcceptRate:    c.AcceptRate,
+		AcceptBurst:   c.AcceptBurst,
+	}
+}
+
+// timeouts returns the client timeouts for the server package
+func (c *config) timeouts() server.Timeouts {
+	return server.Timeouts{
+		Idle:    time.Duration(c.IdleTimeout),
+		Read:    time.Duration(c.ReadTimeout),
+		Write:   time.Duration(c.WriteTimeout),
+		Request: time.Duration(c.RequestTimeout),
+	}
+}
+
+// build turns a validated config into listener setups. This is where the credentials, ACL
+// policies, and certificates are loaded, so errors here are problems with those files.
+func (c *config) build() ([]listenerSetup, error) {
+	var setups []listenerSetup
+	lockSets := make(map[string]uint32)
+
+	for _, lc := range c.Listeners {
+		s, err := lc.build(lockSets)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", lc.Name, err)
+		}
+		setups = append(setups, s)
+	}
+
+	return setups, nil
+}
+
+func (lc listenerConfig) build(lockSets map[string]uint32) (listenerSetup, error) {
+	setup := listenerSetup{name: lc.Name}
+
+	// Listener
+	if lc.SockPath != "" {
+		setup.l = server.UnixListener(lc.SockPath)
+	} else if lc.TLS != nil {
+		certs, err := server.LoadTLSCerts(server.TLSConfig{
+			CertFile:          lc.TLS.CertFile,
+			KeyFile:           lc.TLS.KeyFile,
+			CAFile:            lc.TLS.CAFile,
+			RequireClientCert: lc.TLS.RequireClientCert,
+		})
+		if err != nil {
+			return setup, err
+		}
+
+		reloadOnHUP("TLS certificates from "+lc.TLS.CertFile, certs.Reload)
+		setup.l = server.TLSListener(lc.Port, certs)
+	} else {
+		setup.l = server.TCPListener(lc.Port)
+	}
+
+	if lc.ProxyProtocol {
+		setup.l = server.ProxyProtocol(setup.l)
+	}
+
+	for _, p := range lc.Protocols {
+		comps, err := protocol.New(p, nil)
+		if err != nil {
+			return setup, err
+		}
+		setup.protocols = append(setup.protocols, comps)
+	}
+
+	// Server
+	setup.s = server.Default
+	if lc.AuthFile != "" {
+		creds, err := server.FileCredentials(lc.AuthFile)
+		if err != nil {
+			return setup, err
+		}
+		setup.s = server.Authenticated(creds)
+	}
+
+	// Handlers
+	var err error
+
+	setup.h1, err = handlers.New(lc.L1.Type, lc.L1.Options)
+	if err != nil {
+		return setup, fmt.Errorf("l1: %v", err)
+	}
+
+	setup.h2 = handlers.NilHandler
+	if lc.L2 != nil {
+		setup.h2, err = handlers.New(lc.L2.Type, lc.L2.Options)
+		if err != nil {
+			return setup, fmt.Errorf("l2: %v", err)
+		}
+	}
+
+	// Orca stack, from the inside out
+	setup.o, err = orcas.New(lc.Orca.Type, lc.Orca.Options)
+	if err != nil {
+		return setup, err
+	}
+
+	// The locking wrapper can either allow mutltiple readers or not, with the same difference in
+	// semantics between a sync.Mutex and a sync.RWMutex. If chunking is enabled, we want to ensure
+	// that stricter locking is enabled, since concurrent sets into L1 with chunking can collide and
+	// cause data corruption.
+	if lc.Orca.Locked {
+		if id, ok := lockSets[lc.Orca.LockSet]; ok && lc.Orca.LockSet != "" {
+			setup.o = orcas.LockedWithExisting(setup.o, id)
+		} else {
+			multi := *lc.Orca.MultiReader && lc.L1.Type != "chunked"
+
+			var id uint32
+			setup.o, id = orcas.Locked(setup.o, multi, uint8(lc.Orca.Concurrency))
+			lockSets[lc.Orca.LockSet] = id
+		}
+	}
+
+	if lc.DisableFlush {
+		setup.o = orcas.FlushDisabled(setup.o)
+	}
+
+	// The ACL has to be the outermost wrapper so the server can tell it who the user is
+	if lc.ACLFile != "" {
+		policy, err := orcas.LoadACLPolicy(lc.ACLFile)
+		if err != nil {
+			return setup, err
+		}
+
+		reloadOnHUP("ACL policy from "+lc.ACLFile, policy.Reload)
+		setup.o = orcas.ACL(setup.o, policy)
+	}
+
+	return setup, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDialTimeout is how long a connection to a backend can take to open when the address
+// doesn't say otherwise
+const DefaultDialTimeout = 1 * time.Second
+
+// Addr is a parsed backend address. Addresses are either the path to a unix socket, which is how
+// backends have always been given, or a URL in one of these forms:
+//
+//	unix:///path/to/memcached.sock
+//	tcp://host:port
+//
+// URLs can have options in the query string:
+//
+//	dial_timeout  how long opening a connection can take, e.g. 500ms. Defaults to 1s, and 0
+//	              means no limit.
+//	keepalive     the TCP keepalive period, e.g. 30s. TCP only. Defaults to the OS settings.
+//	nodelay       false to turn Nagle's algorithm back on. TCP only. Defaults to true.
+//
+// For example, tcp://10.0.0.1:11211?dial_timeout=250ms&keepalive=30s
+type Addr struct {
+	Network     string
+	Address     string
+	DialTimeout time.Duration
+	KeepAlive   time.Duration
+	NoDelay     bool
+}
+
+// ParseAddr parses a backend address
+func ParseAddr(addr string) (Addr, error) {
+	a := Addr{
+		Network:     "unix",
+		Address:     addr,
+		DialTimeout: DefaultDialTimeout,
+		NoDelay:     true,
+	}
+
+	if addr == "" {
+		return Addr{}, fmt.Errorf("empty backend address")
+	}
+	if !strings.Contains(addr, "://") {
+		return a, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return Addr{}, fmt.Errorf("bad backend address %q: %v", addr, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		// unix://relative.sock puts the path in the host
+		a.Address = u.Host + u.Path
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return Addr{}, fmt.Errorf("bad backend address %q: %v", addr, err)
+		}
+		a.Network = "tcp"
+		a.Address = u.Host
+	default:
+		return Addr{}, fmt.Errorf("bad backend address %q: the scheme must be unix or tcp", addr)
+	}
+
+	if a.Address == "" {
+		return Addr{}, fmt.Errorf("bad backend address %q: no socket path", addr)
+	}
+
+	for name, vals := range u.Query() {
+		val := vals[len(vals)-1]
+
+		switch name {
+		case "dial_timeout":
+			a.DialTimeout, err = time.ParseDuration(val)
+			if err == nil && a.DialTimeout < 0 {
+				err = fmt.Errorf("must be >= 0")
+			}
+		case "keepalive":
+			a.KeepAlive, err = time.ParseDuration(val)
+			if err == nil && a.KeepAlive <= 0 {
+				err = fmt.Errorf("must be > 0")
+			}
+		case "nodelay":
+			a.NoDelay, err = strconv.ParseBool(val)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+
+		if err == nil && a.Network != "tcp" && (name == "keepalive" || name == "nodelay") {
+			err = fmt.Errorf("only applies to tcp")
+		}
+		if err != nil {
+			return Addr{}, fmt.Errorf("bad backend address %q: %s: %v", addr, name, err)
+		}
+	}
+
+	return a, nil
+}
+
+// Dial opens a connection to the backend with the address's options
+func (a Addr) Dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(a.Network, a.Address, a.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetNoDelay(a.NoDelay)
+		if a.KeepAlive > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(a.KeepAlive)
+		}
+	}
+
+	return conn, nil
+}
+
+// NewDialer returns a Dialer for a backend address
+func NewDialer(addr string) (Dialer, error) {
+	a, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return a.Dial, nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// ContextHandler is the context-aware version of Handler. Each call is given the context of the
+// request it is part of, which carries the request's deadline and is canceled if the client hangs
+// up. Implementations should give up on work that is no longer needed once the context is done.
+type ContextHandler interface {
+	Set(ctx context.Context, cmd common.SetRequest) error
+	Add(ctx context.Context, cmd common.SetRequest) error
+	Replace(ctx context.Context, cmd common.SetRequest) error
+	Append(ctx context.Context, cmd common.SetRequest) error
+	Prepend(ctx context.Context, cmd common.SetRequest) error
+	Get(ctx context.Context, cmd common.GetRequest) (<-chan common.GetResponse, <-chan error)
+	GetE(ctx context.Context, cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error)
+	GAT(ctx context.Context, cmd common.GATRequest) (<-chan common.GetResponse, <-chan error)
+	Delete(ctx context.Context, cmd common.DeleteRequest) error
+	Touch(ctx context.Context, cmd common.TouchRequest) error
+	Increment(ctx context.Context, cmd common.IncrDecrRequest) (uint64, error)
+	Decrement(ctx context.Context, cmd common.IncrDecrRequest) (uint64, error)
+	Flush(ctx context.Context, cmd common.FlushRequest) error
+	Close() error
+}
+
+// WithContext returns a ContextHandler for a Handler. If the Handler came from WithoutContext, the
+// original ContextHandler is returned. Otherwise the Handler is adapted: a call whose context is
+// already done returns the error from common.ContextErr without reaching the Handler, and Handlers
+// that implement DeadlineAware are given the context's deadline before each call.
+func WithContext(h Handler) ContextHandler {
+	if h == nil {
+		return nil
+	}
+	if nc, ok := h.(noContextHandler); ok {
+		return nc.ch
+	}
+	return contextHandler{h: h}
+}
+
+// WithoutContext returns a Handler for a ContextHandler, which is needed to return it from a
+// HandlerConst. Every call is made with context.Background(). Orchestrators that are context-aware
+// get the ContextHandler back with WithContext.
+func WithoutContext(ch ContextHandler) Handler {
+	if ch == nil {
+		return nil
+	}
+	if c, ok := ch.(contextHandler); ok {
+		return c.h
+	}
+	return noContextHandler{ch: ch}
+}
+
+type contextHandler struct {
+	h Handler
+}
+
+// begin is called before each call to the Handler. The context is checked again after the
+// deadline is set so a cancellation that happens in between isn't missed.
+func (c contextHandler) begin(ctx context.Context) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+
+	if da, ok := c.h.(DeadlineAware); ok {
+		d, _ := ctx.Deadline()
+		da.SetDeadline(d)
+		return common.ContextErr(ctx)
+	}
+
+	return nil
+}
+
+func (c contextHandler) Set(ctx context.Context, cmd common.SetRequest) error {
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
+	return c.h.Set(cmd)
+}
+
+func (c contextHandler) Add(ctx context.Context, cmd common.SetRequest) error {
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
+	return c.h.Add(cmd)
+}
+
+func (c contextHandler) Replace(ctx context.Context, cmd common.SetRequest) error {
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
+	return c.h.Replace(cmd)
+}
+
+func (c contextHandler) Append(ctx context.Context, cmd common.SetRequest) error {
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
+	return c.h.Append(cmd)
+}
+
+func (c contextHandler) Prepend(ctx context.Context, cmd common.SetRequest) error {
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
+	return c.h.Prepend(cmd)
+}
+
+func (c contextHandler) Get(ctx context.Context, cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if err := c.begin(ctx); err != nil {
+		return FailedGet(err)
+	}
+	return c.h.Get(cmd)
+}
+
+func (c contextHandler) GetE(ctx context.Context, cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	if err := c.begin(ctx); err != nil {
+		return FailedGetE(err)
+	}
+	return c.h.GetE(cmd)
+}
+
+func (c contextHandler) GAT(ctx context.Context, cmd common.GATRequest) (<-chan common.GetResponse, <-chan error) {
+	if err := c.begin(ctx); err != nil {
+		return FailedGet(err)
+	}
+	return c.h.GAT(cmd)
+}
+
+func (c contextHandler) Delete(ctx context.Context, cmd common.DeleteRequest) error {
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
+	return c.h.Delete(cmd)
+}
+
+func (c contextHandler) Touch(ctx context.Context, cmd common.TouchRequest) error {
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
+	return c.h.Touch(cmd)
+}
+
+func (c contextHandler) Increment(ctx context.Context, cmd common.IncrDecrRequest) (uint64, error) {
+	if err := c.begin(ctx); err != nil {
+		return 0, err
+	}
+	return c.h.Increment(cmd)
+}
+
+func (c contextHandler) Decrement(ctx context.Context, cmd common.IncrDecrRequest) (uint64, error) {
+	if err := c.begin(ctx); err != nil {
+		return 0, err
+	}
+	return c.h.Decrement(cmd)
+}
+
+func (c contextHandler) Flush(ctx context.Context, cmd common.FlushRequest) error {
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
+	return c.h.Flush(cmd)
+}
+
+func (c contextHandler) Close() error {
+	return c.h.Close()
+}
+
+// LastCas implements CasAware if the Handler does
+func (c contextHandler) LastCas() uint64 {
+	return LastCas(c.h)
+}
+
+type noContextHandler struct {
+	ch ContextHandler
+}
+
+// SetDeadline implements DeadlineAware if the ContextHandler does
+func (n noContextHandler) SetDeadline(t time.Time) {
+	if da, ok := n.ch.(DeadlineAware); ok {
+		da.SetDeadline(t)
+	}
+}
+
+// LastCas implements CasAware if the ContextHandler does
+func (n noContextHandler) LastCas() uint64 {
+	return LastCas(n.ch)
+}
+
+func (n noContextHandler) Set(cmd common.SetRequest) error {
+	return n.ch.Set(context.Background(), cmd)
+}
+
+func (n noContextHandler) Add(cmd common.SetRequest) error {
+	return n.ch.Add(context.Background(), cmd)
+}
+
+func (n noContextHandler) Replace(cmd common.SetRequest) error {
+	return n.ch.Replace(context.Background(), cmd)
+}
+
+func (n noContextHandler) Append(cmd common.SetRequest) error {
+	return n.ch.Append(context.Background(), cmd)
+}
+
+func (n noContextHandler) Prepend(cmd common.SetRequest) error {
+	return n.ch.Prepend(context.Background(), cmd)
+}
+
+func (n noContextHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return n.ch.Get(context.Background(), cmd)
+}
+
+func (n noContextHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return n.ch.GetE(context.Background(), cmd)
+}
+
+func (n noContextHandler) GAT(cmd common.GATRequest) (<-chan common.GetResponse, <-chan error) {
+	return n.ch.GAT(context.Background(), cmd)
+}
+
+func (n noContextHandler) Delete(cmd common.DeleteRequest) error {
+	return n.ch.Delete(context.Background(), cmd)
+}
+
+func (n noContextHandler) Touch(cmd common.TouchRequest) error {
+	return n.ch.Touch(context.Background(), cmd)
+}
+
+func (n noContextHandler) Increment(cmd common.IncrDecrRequest) (uint64, error) {
+	return n.ch.Increment(context.Background(), cmd)
+}
+
+func (n noContextHandler) Decrement(cmd common.IncrDecrRequest) (uint64, error) {
+	return n.ch.Decrement(context.Background(), cmd)
+}
+
+func (n noContextHandler) Flush(cmd common.FlushRequest) error {
+	return n.ch.Flush(context.Background(), cmd)
+}
+
+func (n noContextHandler) Close() error {
+	return n.ch.Close()
+}
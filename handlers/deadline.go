@@ -0,0 +1,159 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricBackendTimeouts = metrics.AddCounter("backend_timeouts", nil)
+
+// DeadlineAware is implemented by handlers that can limit how long a request to their backend
+// takes. The server calls SetDeadline before each request it passes to the orchestrator when it
+// is configured with a request timeout. A request that runs past the deadline returns
+// common.ErrTempFailure.
+type DeadlineAware interface {
+	SetDeadline(t time.Time)
+}
+
+// DeadlineConn is a backend connection for handlers that implement DeadlineAware by setting the
+// deadline on the connection itself. A read or write that times out returns
+// common.ErrTempFailure instead of the timeout error. The rest of the response may still be on
+// the way at that point, so the connection can't be trusted any more. It is closed, and every
+// read or write after that returns common.ErrTempFailure as well, until the connection is
+// replaced by Reconnect.
+type DeadlineConn struct {
+	failed int32
+
+	// dial is used by Reconnect to replace the connection. It is nil if the connection can't
+	// be replaced. See NewReconnectingConn.
+	dial     Dialer
+	attempts int
+	next     time.Time
+
+	// lock protects the connection while it is replaced, since requests can still be reading
+	// or writing, deadlines can be set, and the connection closed from other goroutines. Each
+	// call loads the connection once so it sees either the old one or the new one.
+	lock     sync.Mutex
+	conn     net.Conn
+	deadline time.Time
+	closed   bool
+}
+
+// NewDeadlineConn wraps a connection to a backend
+func NewDeadlineConn(conn net.Conn) *DeadlineConn {
+	return &DeadlineConn{conn: conn}
+}
+
+func (c *DeadlineConn) current() net.Conn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn
+}
+
+// Failed returns true if a read or write has timed out and the connection has been closed
+func (c *DeadlineConn) Failed() bool {
+	return atomic.LoadInt32(&c.failed) == 1
+}
+
+func (c *DeadlineConn) Read(b []byte) (int, error) {
+	if c.Failed() {
+		return 0, common.ErrTempFailure
+	}
+	conn := c.current()
+	n, err := conn.Read(b)
+	return n, c.check(conn, err)
+}
+
+func (c *DeadlineConn) Write(b []byte) (int, error) {
+	if c.Failed() {
+		return 0, common.ErrTempFailure
+	}
+	conn := c.current()
+	n, err := conn.Write(b)
+	return n, c.check(conn, err)
+}
+
+func (c *DeadlineConn) LocalAddr() net.Addr {
+	return c.current().LocalAddr()
+}
+
+func (c *DeadlineConn) RemoteAddr() net.Addr {
+	return c.current().RemoteAddr()
+}
+
+func (c *DeadlineConn) SetReadDeadline(t time.Time) error {
+	return c.current().SetReadDeadline(t)
+}
+
+func (c *DeadlineConn) SetWriteDeadline(t time.Time) error {
+	return c.current().SetWriteDeadline(t)
+}
+
+// SetDeadline sets the deadline on the connection and remembers it for any connection that
+// replaces it
+func (c *DeadlineConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	return c.conn.SetDeadline(t)
+}
+
+// Close closes the connection. It won't be replaced after this.
+func (c *DeadlineConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
+
+// check turns timeouts into common.ErrTempFailure and marks the connection as failed. If the
+// connection can be replaced, every other I/O error is treated the same way. conn is the
+// connection the error came from; an error from one that has already been replaced doesn't
+// affect its replacement.
+func (c *DeadlineConn) check(conn net.Conn, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	ne, ok := err.(net.Error)
+	timeout := ok && ne.Timeout()
+	if !timeout && c.dial == nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if conn != c.conn {
+		return common.ErrTempFailure
+	}
+
+	if atomic.CompareAndSwapInt32(&c.failed, 0, 1) {
+		if timeout {
+			metrics.IncCounter(MetricBackendTimeouts)
+		} else {
+			metrics.IncCounter(MetricBackendConnFailures)
+		}
+		conn.Close()
+	}
+	return common.ErrTempFailure
+}
@@ -15,6 +15,7 @@
 package inmem
 
 import (
+	"strconv"
 	"sync"
 	"time"
 
@@ -25,6 +26,7 @@ import (
 type entry struct {
 	exptime uint32
 	flags   uint32
+	cas     uint64
 	data    []byte
 }
 
@@ -35,6 +37,16 @@ func (e entry) isExpired() bool {
 type Handler struct {
 	data  map[string]entry
 	mutex *sync.RWMutex
+	// last CAS value handed out, protected by mutex
+	cas uint64
+	// pending delayed flush, protected by mutex
+	flushTimer *time.Timer
+}
+
+// nextCas returns a new unique CAS value. The caller must hold the write lock.
+func (h *Handler) nextCas() uint64 {
+	h.cas++
+	return h.cas
 }
 
 var singleton = &Handler{
@@ -42,6 +54,12 @@ var singleton = &Handler{
 	mutex: new(sync.RWMutex),
 }
 
+func init() {
+	handlers.Register("inmem", handlers.Factory{
+		New: func(interface{}) (handlers.HandlerConst, error) { return New, nil },
+	})
+}
+
 func New() (handlers.Handler, error) {
 	// return the same singleton map each time so all connections see the same data
 	return singleton, nil
@@ -50,6 +68,21 @@ func New() (handlers.Handler, error) {
 func (h *Handler) Set(cmd common.SetRequest) error {
 	h.mutex.Lock()
 
+	if cmd.Cas != 0 {
+		e, ok := h.data[string(cmd.Key)]
+
+		if !ok || e.isExpired() {
+			delete(h.data, string(cmd.Key))
+			h.mutex.Unlock()
+			return common.ErrKeyNotFound
+		}
+
+		if e.cas != cmd.Cas {
+			h.mutex.Unlock()
+			return common.ErrKeyExists
+		}
+	}
+
 	var exptime uint32
 	if cmd.Exptime > 0 {
 		exptime = uint32(time.Now().Unix()) + cmd.Exptime
@@ -59,6 +92,7 @@ func (h *Handler) Set(cmd common.SetRequest) error {
 		data:    cmd.Data,
 		exptime: exptime,
 		flags:   cmd.Flags,
+		cas:     h.nextCas(),
 	}
 
 	h.mutex.Unlock()
@@ -85,6 +119,7 @@ func (h *Handler) Add(cmd common.SetRequest) error {
 		data:    cmd.Data,
 		exptime: exptime,
 		flags:   cmd.Flags,
+		cas:     h.nextCas(),
 	}
 
 	h.mutex.Unlock()
@@ -102,6 +137,11 @@ func (h *Handler) Replace(cmd common.SetRequest) error {
 		return common.ErrKeyNotFound
 	}
 
+	if cmd.Cas != 0 && e.cas != cmd.Cas {
+		h.mutex.Unlock()
+		return common.ErrKeyExists
+	}
+
 	var exptime uint32
 	if cmd.Exptime > 0 {
 		exptime = uint32(time.Now().Unix()) + cmd.Exptime
@@ -111,6 +151,7 @@ func (h *Handler) Replace(cmd common.SetRequest) error {
 		data:    cmd.Data,
 		exptime: exptime,
 		flags:   cmd.Flags,
+		cas:     h.nextCas(),
 	}
 
 	h.mutex.Unlock()
@@ -128,10 +169,16 @@ func (h *Handler) Append(cmd common.SetRequest) error {
 		return common.ErrKeyNotFound
 	}
 
+	if cmd.Cas != 0 && e.cas != cmd.Cas {
+		h.mutex.Unlock()
+		return common.ErrKeyExists
+	}
+
 	h.data[string(cmd.Key)] = entry{
 		data:    append(e.data, cmd.Data...),
 		exptime: e.exptime,
 		flags:   e.flags,
+		cas:     h.nextCas(),
 	}
 
 	h.mutex.Unlock()
@@ -149,10 +196,16 @@ func (h *Handler) Prepend(cmd common.SetRequest) error {
 		return common.ErrKeyNotFound
 	}
 
+	if cmd.Cas != 0 && e.cas != cmd.Cas {
+		h.mutex.Unlock()
+		return common.ErrKeyExists
+	}
+
 	h.data[string(cmd.Key)] = entry{
 		data:    append(cmd.Data, e.data...),
 		exptime: e.exptime,
 		flags:   e.flags,
+		cas:     h.nextCas(),
 	}
 
 	h.mutex.Unlock()
@@ -184,6 +237,7 @@ func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan
 			Quiet:  cmd.Quiet[idx],
 			Opaque: cmd.Opaques[idx],
 			Flags:  e.flags,
+			Cas:    e.cas,
 			Key:    bk,
 			Data:   e.data,
 		}
@@ -222,6 +276,7 @@ func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-cha
 			Opaque:  cmd.Opaques[idx],
 			Exptime: e.exptime,
 			Flags:   e.flags,
+			Cas:     e.cas,
 			Key:     bk,
 			Data:    e.data,
 		}
@@ -234,7 +289,60 @@ func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-cha
 	return dataOut, errorOut
 }
 
-func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+func (h *Handler) GAT(cmd common.GATRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error)
+
+	h.mutex.Lock()
+
+	for idx, bk := range cmd.Keys {
+		e, ok := h.data[string(bk)]
+
+		if !ok || e.isExpired() {
+			delete(h.data, string(bk))
+			dataOut <- common.GetResponse{
+				Miss:   true,
+				Quiet:  cmd.Quiet[idx],
+				Opaque: cmd.Opaques[idx],
+				Key:    bk,
+			}
+			continue
+		}
+
+		if cmd.Exptimes[idx] > 0 {
+			e.exptime = uint32(time.Now().Unix()) + cmd.Exptimes[idx]
+		} else {
+			e.exptime = 0
+		}
+
+		h.data[string(bk)] = e
+
+		dataOut <- common.GetResponse{
+			Miss:   false,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Flags:  e.flags,
+			Cas:    e.cas,
+			Key:    bk,
+			Data:   e.data,
+		}
+	}
+
+	h.mutex.Unlock()
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	h.mutex.Lock()
+	delete(h.data, string(cmd.Key))
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
 	h.mutex.Lock()
 
 	e, ok := h.data[string(cmd.Key)]
@@ -242,11 +350,7 @@ func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 	if !ok || e.isExpired() {
 		delete(h.data, string(cmd.Key))
 		h.mutex.Unlock()
-		return common.GetResponse{
-			Miss:   true,
-			Opaque: cmd.Opaque,
-			Key:    cmd.Key,
-		}, nil
+		return common.ErrKeyNotFound
 	}
 
 	if cmd.Exptime > 0 {
@@ -259,43 +363,97 @@ func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 
 	h.mutex.Unlock()
 
-	return common.GetResponse{
-		Miss:   false,
-		Opaque: cmd.Opaque,
-		Flags:  e.flags,
-		Key:    cmd.Key,
-		Data:   e.data,
-	}, nil
+	return nil
 }
 
-func (h *Handler) Delete(cmd common.DeleteRequest) error {
-	h.mutex.Lock()
-	delete(h.data, string(cmd.Key))
-	h.mutex.Unlock()
-	return nil
+func (h *Handler) Increment(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecr(cmd, true)
 }
 
-func (h *Handler) Touch(cmd common.TouchRequest) error {
+func (h *Handler) Decrement(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecr(cmd, false)
+}
+
+func (h *Handler) incrDecr(cmd common.IncrDecrRequest, incr bool) (uint64, error) {
 	h.mutex.Lock()
 
 	e, ok := h.data[string(cmd.Key)]
 
 	if !ok || e.isExpired() {
 		delete(h.data, string(cmd.Key))
+
+		if cmd.NoCreate {
+			h.mutex.Unlock()
+			return 0, common.ErrKeyNotFound
+		}
+
+		var exptime uint32
+		if cmd.Exptime > 0 {
+			exptime = uint32(time.Now().Unix()) + cmd.Exptime
+		}
+
+		h.data[string(cmd.Key)] = entry{
+			data:    []byte(strconv.FormatUint(cmd.Initial, 10)),
+			exptime: exptime,
+			cas:     h.nextCas(),
+		}
+
 		h.mutex.Unlock()
-		return common.ErrKeyNotFound
+		return cmd.Initial, nil
 	}
 
-	if cmd.Exptime > 0 {
-		e.exptime = uint32(time.Now().Unix()) + cmd.Exptime
+	val, err := strconv.ParseUint(string(e.data), 10, 64)
+	if err != nil {
+		h.mutex.Unlock()
+		return 0, common.ErrBadIncDecValue
+	}
+
+	// Increments wrap around at 64 bits while decrements stop at 0, same as memcached
+	if incr {
+		val += cmd.Delta
+	} else if cmd.Delta > val {
+		val = 0
 	} else {
-		e.exptime = 0
+		val -= cmd.Delta
 	}
 
+	e.data = []byte(strconv.FormatUint(val, 10))
+	e.cas = h.nextCas()
 	h.data[string(cmd.Key)] = e
 
 	h.mutex.Unlock()
+	return val, nil
+}
+
+// Flush removes all items. With a delay, the removal happens once the delay has passed and will
+// also remove any items set in the meantime. A new flush replaces any pending delayed flush.
+func (h *Handler) Flush(cmd common.FlushRequest) error {
+	h.mutex.Lock()
 
+	if h.flushTimer != nil {
+		h.flushTimer.Stop()
+		h.flushTimer = nil
+	}
+
+	if cmd.Delay == 0 {
+		h.data = make(map[string]entry)
+		h.mutex.Unlock()
+		return nil
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(time.Duration(cmd.Delay)*time.Second, func() {
+		h.mutex.Lock()
+		// A later flush may have replaced this one after the timer fired
+		if h.flushTimer == t {
+			h.data = make(map[string]entry)
+			h.flushTimer = nil
+		}
+		h.mutex.Unlock()
+	})
+	h.flushTimer = t
+
+	h.mutex.Unlock()
 	return nil
 }
 
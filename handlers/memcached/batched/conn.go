@@ -27,6 +27,7 @@ import (
 	"time"
 
 	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/protocol/binprot"
 )
@@ -42,6 +43,7 @@ var (
 type conn struct {
 	id           uint32
 	sock         string
+	dial         handlers.Dialer
 	readerSize   uint32
 	writerSize   uint32
 	conn         net.Conn
@@ -64,9 +66,17 @@ type batch struct {
 }
 
 func newConn(sock string, id uint32, batchDelay time.Duration, batchSize, readerSize, writerSize uint32, expand chan struct{}) *conn {
+	dial, err := handlers.NewDialer(sock)
+	if err != nil {
+		// The address is checked before it gets here, but if it's bad it fails like a socket
+		// that isn't there
+		dial = func() (net.Conn, error) { return nil, err }
+	}
+
 	c := &conn{
 		id:           id,
 		sock:         sock,
+		dial:         dial,
 		readerSize:   readerSize,
 		writerSize:   writerSize,
 		rand:         rand.New(rand.NewSource(randSeed())),
@@ -155,7 +165,7 @@ func (c *conn) reconnect(initialDelay bool) {
 			metrics.IncCounter(metricBatchConnectAttemptHigh)
 		}
 
-		nc, err = net.Dial("unix", c.sock)
+		nc, err = c.dial()
 		if err != nil {
 			metrics.IncCounter(MetricBatchConnectionFailure)
 
@@ -363,7 +373,7 @@ func (c *conn) batchIntoBuffer(reqs []request) (*bytes.Buffer, map[uint32]reshan
 		switch req.reqtype {
 		case common.RequestSet:
 			cmd := req.req.(common.SetRequest)
-			binprot.WriteSetCmd(buf, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque)
+			binprot.WriteSetCmd(buf, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque, cmd.Cas)
 			buf.Write(cmd.Data)
 			responses[opaque] = reshandle{
 				key:     cmd.Key,
@@ -376,7 +386,7 @@ func (c *conn) batchIntoBuffer(reqs []request) (*bytes.Buffer, map[uint32]reshan
 
 		case common.RequestAdd:
 			cmd := req.req.(common.SetRequest)
-			binprot.WriteAddCmd(buf, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque)
+			binprot.WriteAddCmd(buf, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque, cmd.Cas)
 			buf.Write(cmd.Data)
 			responses[opaque] = reshandle{
 				key:     cmd.Key,
@@ -389,7 +399,7 @@ func (c *conn) batchIntoBuffer(reqs []request) (*bytes.Buffer, map[uint32]reshan
 
 		case common.RequestReplace:
 			cmd := req.req.(common.SetRequest)
-			binprot.WriteReplaceCmd(buf, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque)
+			binprot.WriteReplaceCmd(buf, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque, cmd.Cas)
 			buf.Write(cmd.Data)
 			responses[opaque] = reshandle{
 				key:     cmd.Key,
@@ -402,7 +412,7 @@ func (c *conn) batchIntoBuffer(reqs []request) (*bytes.Buffer, map[uint32]reshan
 
 		case common.RequestAppend:
 			cmd := req.req.(common.SetRequest)
-			binprot.WriteAppendCmd(buf, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque)
+			binprot.WriteAppendCmd(buf, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque, cmd.Cas)
 			buf.Write(cmd.Data)
 			responses[opaque] = reshandle{
 				key:     cmd.Key,
@@ -415,7 +425,7 @@ func (c *conn) batchIntoBuffer(reqs []request) (*bytes.Buffer, map[uint32]reshan
 
 		case common.RequestPrepend:
 			cmd := req.req.(common.SetRequest)
-			binprot.WritePrependCmd(buf, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque)
+			binprot.WritePrependCmd(buf, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque, cmd.Cas)
 			buf.Write(cmd.Data)
 			responses[opaque] = reshandle{
 				key:     cmd.Key,
@@ -450,9 +460,21 @@ func (c *conn) batchIntoBuffer(reqs []request) (*bytes.Buffer, map[uint32]reshan
 
 			numExpected = 1
 
-		case common.RequestGat:
-			cmd := req.req.(common.GATRequest)
-			binprot.WriteGATCmd(buf, cmd.Key, cmd.Exptime, opaque)
+		case common.RequestIncrement:
+			cmd := req.req.(common.IncrDecrRequest)
+			binprot.WriteIncrementCmd(buf, cmd.Key, cmd.Delta, cmd.Initial, cmd.Exptime, opaque, cmd.NoCreate)
+			responses[opaque] = reshandle{
+				key:     cmd.Key,
+				opaque:  cmd.Opaque,
+				quiet:   cmd.Quiet,
+				reschan: req.reschan,
+			}
+
+			numExpected = 1
+
+		case common.RequestDecrement:
+			cmd := req.req.(common.IncrDecrRequest)
+			binprot.WriteDecrementCmd(buf, cmd.Key, cmd.Delta, cmd.Initial, cmd.Exptime, opaque, cmd.NoCreate)
 			responses[opaque] = reshandle{
 				key:     cmd.Key,
 				opaque:  cmd.Opaque,
@@ -462,6 +484,33 @@ func (c *conn) batchIntoBuffer(reqs []request) (*bytes.Buffer, map[uint32]reshan
 
 			numExpected = 1
 
+		case common.RequestFlush:
+			cmd := req.req.(common.FlushRequest)
+			binprot.WriteFlushCmd(buf, cmd.Delay, opaque)
+			responses[opaque] = reshandle{
+				opaque:  cmd.Opaque,
+				quiet:   cmd.Quiet,
+				reschan: req.reschan,
+			}
+
+			numExpected = 1
+
+		case common.RequestGat:
+			cmd := req.req.(common.GATRequest)
+
+			for idx := range cmd.Keys {
+				binprot.WriteGATCmd(buf, cmd.Keys[idx], cmd.Exptimes[idx], opaque)
+				responses[opaque] = reshandle{
+					key:     cmd.Keys[idx],
+					opaque:  cmd.Opaques[idx],
+					quiet:   cmd.Quiet[idx],
+					reschan: req.reschan,
+				}
+				opaque++
+			}
+
+			numExpected = len(cmd.Keys)
+
 		case common.RequestGet:
 			cmd := req.req.(common.GetRequest)
 
@@ -502,6 +551,21 @@ func (c *conn) batchIntoBuffer(reqs []request) (*bytes.Buffer, map[uint32]reshan
 	return buf, responses, channels
 }
 
+func isGetOpcode(opcode uint8) bool {
+	return opcode == binprot.OpcodeGet ||
+		opcode == binprot.OpcodeGetQ ||
+		opcode == binprot.OpcodeGat ||
+		opcode == binprot.OpcodeGetE ||
+		opcode == binprot.OpcodeGetEQ
+}
+
+func isIncrDecrOpcode(opcode uint8) bool {
+	return opcode == binprot.OpcodeIncrement ||
+		opcode == binprot.OpcodeIncrementQ ||
+		opcode == binprot.OpcodeDecrement ||
+		opcode == binprot.OpcodeDecrementQ
+}
+
 func (c *conn) reader() {
 	recovery := false
 	var batch batch
@@ -545,6 +609,12 @@ readerOuter:
 						rh.reschan <- response{
 							err: err,
 						}
+					} else if !isGetOpcode(resHeader.Opcode) {
+						// Storage commands need to see the real reason they failed, e.g. a
+						// CAS mismatch, so the application error is passed back as-is.
+						rh.reschan <- response{
+							err: err,
+						}
 					} else {
 						// this is an application-level error and should be treated as such
 						rh.reschan <- response{
@@ -571,11 +641,7 @@ readerOuter:
 
 			// if reading information (and not just a response header) from the remote
 			// process, do some extra parsing
-			if resHeader.Opcode == binprot.OpcodeGet ||
-				resHeader.Opcode == binprot.OpcodeGetQ ||
-				resHeader.Opcode == binprot.OpcodeGat ||
-				resHeader.Opcode == binprot.OpcodeGetE ||
-				resHeader.Opcode == binprot.OpcodeGetEQ {
+			if isGetOpcode(resHeader.Opcode) {
 
 				b := make([]byte, 4)
 				n, err := io.ReadAtLeast(c.rw, b, 4)
@@ -621,6 +687,7 @@ readerOuter:
 							Data:    buf,
 							Flags:   serverFlags,
 							Exptime: serverExp,
+							Cas:     resHeader.CASToken,
 							Opaque:  rh.opaque,
 							Quiet:   rh.quiet,
 						},
@@ -636,6 +703,29 @@ readerOuter:
 					panic("FATAL ERROR: Batch out of sync")
 				}
 
+			} else if isIncrDecrOpcode(resHeader.Opcode) {
+				// The body of an increment or decrement response is the new value
+				b := make([]byte, 8)
+				n, err := io.ReadAtLeast(c.rw, b, 8)
+				metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+				if err != nil {
+					// jump to error handling / reconnect / reset
+					recovery = true
+					continue readerOuter
+				}
+
+				if rh, ok := batch.responses[resHeader.OpaqueToken]; ok {
+					rh.reschan <- response{
+						val: binary.BigEndian.Uint64(b),
+					}
+
+					batch.channels[rh.reschan]--
+					delete(batch.responses, resHeader.OpaqueToken)
+
+				} else {
+					panic("FATAL ERROR: Batch out of sync")
+				}
+
 			} else {
 				// Non-get repsonses
 				// Discard the message for non-get responses
@@ -34,13 +34,13 @@ type Handler struct {
 
 // Opts is the set of tuning options for the batched handler.
 type Opts struct {
-	BatchSize             uint32
-	BatchDelayMicros      uint32
-	ReadBufSize           uint32
-	WriteBufSize          uint32
-	EvaluationIntervalSec uint32
-	LoadFactorExpandRatio float64
-	OverloadedConnRatio   float64
+	BatchSize             uint32  `json:"batch_size"`
+	BatchDelayMicros      uint32  `json:"batch_delay_micros"`
+	ReadBufSize           uint32  `json:"read_buf_size"`
+	WriteBufSize          uint32  `json:"write_buf_size"`
+	EvaluationIntervalSec uint32  `json:"evaluation_interval_sec"`
+	LoadFactorExpandRatio float64 `json:"load_factor_expand_ratio"`
+	OverloadedConnRatio   float64 `json:"overloaded_conn_ratio"`
 }
 
 var defaultOpts = Opts{
@@ -67,10 +67,11 @@ func float64ValueOrDefault(val float64, def float64) float64 {
 	return val
 }
 
-// NewHandler creates a new handler with the given unix socket as the connected backend. The first
-// time this method is called it creates a background monitor that will add connections as needed
-// for the given domain socket. The Opts parameter can exclude any settings in order to take the
-// defaults. Any setting that is at the 0 value or negative will take the default.
+// NewHandler creates a new handler with the given address as the connected backend. The address is
+// either a unix socket path or a URL as described in handlers.Addr. The first time this method is
+// called it creates a background monitor that will add connections as needed for the given
+// address. The Opts parameter can exclude any settings in order to take the defaults. Any setting
+// that is at the 0 value or negative will take the default.
 //
 // Default values are:
 //
@@ -126,7 +127,7 @@ func init() {
 	}
 }
 
-func (h Handler) doRequest(cmd common.Request, reqType common.RequestType) (common.GetEResponse, error) {
+func (h Handler) doRequest(cmd common.Request, reqType common.RequestType) (response, error) {
 	var res response
 
 	// If we don't try more times than the number of connections, one request may
@@ -157,7 +158,7 @@ func (h Handler) doRequest(cmd common.Request, reqType common.RequestType) (comm
 
 		// wait for the response from the pool over the response channel
 		// and return whatever it gives as the error
-		res := <-reschan
+		res = <-reschan
 
 		// If the connection signals that the connection failed, we should retry
 		// a few times as connections get recreated
@@ -167,10 +168,10 @@ func (h Handler) doRequest(cmd common.Request, reqType common.RequestType) (comm
 	}
 
 	if res.err == errRetryRequestBecauseOfConnectionFailure {
-		return common.GetEResponse{}, common.ErrInternal
+		return response{}, common.ErrInternal
 	}
 
-	return res.gr, res.err
+	return res, res.err
 }
 
 // Set performs a set operation on the backend. It unconditionally sets a key to a value.
@@ -215,24 +216,36 @@ func (h Handler) Touch(cmd common.TouchRequest) error {
 	return err
 }
 
+// Increment performs an increment operation on the backend. It returns the new value after the increment.
+func (h Handler) Increment(cmd common.IncrDecrRequest) (uint64, error) {
+	res, err := h.doRequest(cmd, common.RequestIncrement)
+	return res.val, err
+}
+
+// Decrement performs a decrement operation on the backend. It returns the new value after the decrement.
+func (h Handler) Decrement(cmd common.IncrDecrRequest) (uint64, error) {
+	res, err := h.doRequest(cmd, common.RequestDecrement)
+	return res.val, err
+}
+
+// Flush performs a flush operation on the backend. It invalidates all of the data after the given delay.
+func (h Handler) Flush(cmd common.FlushRequest) error {
+	_, err := h.doRequest(cmd, common.RequestFlush)
+	return err
+}
+
 func getEResponseToGetResponse(res common.GetEResponse) common.GetResponse {
 	return common.GetResponse{
 		Key:    res.Key,
 		Data:   res.Data,
 		Flags:  res.Flags,
+		Cas:    res.Cas,
 		Opaque: res.Opaque,
 		Quiet:  res.Quiet,
 		Miss:   res.Miss,
 	}
 }
 
-// GAT performs a get-and-touch on the backend for the given key. It will retrieve the value while updating the TTL to
-// the one supplied.
-func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
-	gr, err := h.doRequest(cmd, common.RequestGat)
-	return getEResponseToGetResponse(gr), err
-}
-
 type keyAttrs struct {
 	key    string
 	opaque uint32
@@ -462,3 +475,131 @@ func realHandleGetE(h Handler, cmd common.GetRequest, dataOut chan common.GetERe
 		}
 	}
 }
+
+// gatExptimes maps each key in a GAT to the TTL it should be touched with. Keys that show up more than once with
+// the same opaque and quiet flag but different TTLs are not distinguishable in the responses, so the last one wins.
+func gatExptimes(cmd common.GATRequest) map[keyAttrs]uint32 {
+	exptimes := make(map[keyAttrs]uint32)
+
+	for i := range cmd.Keys {
+		key := keyAttrs{
+			key:    string(cmd.Keys[i]),
+			opaque: cmd.Opaques[i],
+			quiet:  cmd.Quiet[i],
+		}
+		exptimes[key] = cmd.Exptimes[i]
+	}
+
+	return exptimes
+}
+
+func trackerMapToGATRequest(tm trackermap, exptimes map[keyAttrs]uint32) common.GATRequest {
+	get := trackerMapToGetRequest(tm)
+
+	ret := common.GATRequest{
+		Keys:    get.Keys,
+		Opaques: get.Opaques,
+		Quiet:   get.Quiet,
+	}
+
+	for i := range ret.Keys {
+		key := keyAttrs{
+			key:    string(ret.Keys[i]),
+			opaque: ret.Opaques[i],
+			quiet:  ret.Quiet[i],
+		}
+		ret.Exptimes = append(ret.Exptimes, exptimes[key])
+	}
+
+	return ret
+}
+
+// GAT performs a get-and-touch on the backend. It retrieves the whole batch of keys given as a group while updating
+// their TTLs and returns them one at a time over the request channel.
+func (h Handler) GAT(cmd common.GATRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+	go realHandleGAT(h, cmd, dataOut, errorOut)
+	return dataOut, errorOut
+}
+
+func realHandleGAT(h Handler, cmd common.GATRequest, dataOut chan common.GetResponse, errorOut chan error) {
+	defer close(errorOut)
+	defer close(dataOut)
+
+	tm := getRequestToTrackerMap(common.GetRequest{
+		Keys:    cmd.Keys,
+		Opaques: cmd.Opaques,
+		Quiet:   cmd.Quiet,
+	})
+	exptimes := gatExptimes(cmd)
+	conns := h.relay.conns.Load().([]*conn)
+	maxTries := len(conns) * 2
+
+	for i := 0; i < maxTries; i++ {
+		if i < maxRetryMetrics {
+			metrics.IncCounter(requestRetryMetrics[i])
+		} else {
+			metrics.IncCounter(metricRequestRetryHigh)
+		}
+
+		reschan := make(chan response)
+
+		if i > 0 {
+			// on a retry we need to generate the subset of keys that were not server the first time around
+			// to be resubmitted
+			cmd = trackerMapToGATRequest(tm, exptimes)
+		}
+
+		h.relay.submit(h.rand, request{
+			req:     cmd,
+			reqtype: common.RequestGat,
+			reschan: reschan,
+		})
+
+		errored := false
+
+		for res := range reschan {
+			// after an error, drop all the rest of the responses. The contract of the handler interface
+			// says that an error will be the last thing to come through; this is just for safety so the
+			// connection is guaranteed to not get blocked.
+			if errored {
+				continue
+			}
+
+			if res.err != nil {
+				// On the last go-round we can return the error back to the caller
+				// because we will no longer be trying to succeed
+				if i == maxTries-1 {
+					if res.err == errRetryRequestBecauseOfConnectionFailure {
+						errorOut <- common.ErrInternal
+					} else {
+						errorOut <- res.err
+					}
+				}
+				errored = true
+				continue
+			}
+
+			key := keyAttrs{
+				key:    string(res.gr.Key),
+				opaque: res.gr.Opaque,
+				quiet:  res.gr.Quiet,
+			}
+
+			if count, ok := tm[key]; ok {
+				if count == 1 {
+					delete(tm, key)
+				} else {
+					tm[key] = count - 1
+				}
+			}
+
+			dataOut <- getEResponseToGetResponse(res.gr)
+		}
+
+		if len(tm) == 0 {
+			break
+		}
+	}
+}
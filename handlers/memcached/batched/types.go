@@ -36,6 +36,8 @@ type response struct {
 	err error
 	// a GetEResponse is a superset of all other responses
 	gr common.GetEResponse
+	// the new value after an increment or decrement
+	val uint64
 }
 
 func randSeed() int64 {
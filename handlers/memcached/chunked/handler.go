@@ -19,9 +19,11 @@ import (
 	"bytes"
 	"io"
 	"math"
+	"net"
 	"time"
 
 	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/protocol/binprot"
 )
@@ -115,12 +117,19 @@ func readResponseHeader(r *bufio.Reader) (*binprot.ResponseHeader, error) {
 type Handler struct {
 	rw   *bufio.ReadWriter
 	conn io.ReadWriteCloser
+
+	// dc is the backend connection if it supports deadlines, otherwise nil
+	dc *handlers.DeadlineConn
 }
 
 // NewHandler returns an implementation of handlers.Handler that implements a special interaction
 // with the memcached server to pack data into fixed-size chunks in order to store either very
 // large objects or to avoid memory fragmentation overhead when data sizes rapidly change.
 func NewHandler(conn io.ReadWriteCloser) Handler {
+	if nc, ok := conn.(net.Conn); ok {
+		return newHandler(handlers.NewDeadlineConn(nc))
+	}
+
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	return Handler{
 		rw:   rw,
@@ -128,11 +137,72 @@ func NewHandler(conn io.ReadWriteCloser) Handler {
 	}
 }
 
+// NewReconnectingHandler returns a Handler like NewHandler that opens its own connection to the
+// backend with dial. If the connection fails, the request that was using it returns
+// common.ErrTempFailure and the connection is replaced before a later request. A request that
+// fails part way through may leave some of the chunks for a key written and others not, which is
+// the same as any other failed set: the metadata and chunks won't match and the next get misses.
+func NewReconnectingHandler(dial handlers.Dialer) (Handler, error) {
+	dc, err := handlers.NewReconnectingConn(dial)
+	if err != nil {
+		return Handler{}, err
+	}
+	return newHandler(dc), nil
+}
+
+func newHandler(dc *handlers.DeadlineConn) Handler {
+	rw := bufio.NewReadWriter(bufio.NewReader(dc), bufio.NewWriter(dc))
+	return Handler{
+		rw:   rw,
+		conn: dc,
+		dc:   dc,
+	}
+}
+
+// begin replaces the connection to the backend before a request if it has failed. Whatever is
+// left in the buffers from the old connection is thrown away.
+func (h Handler) begin() error {
+	if h.dc == nil {
+		return nil
+	}
+
+	reconnected, err := h.dc.Reconnect()
+	if reconnected {
+		h.rw.Reader.Reset(h.dc)
+		h.rw.Writer.Reset(h.dc)
+	}
+	return err
+}
+
+// SetDeadline implements handlers.DeadlineAware. A request that runs past the deadline returns
+// common.ErrTempFailure and the connection to the backend is closed. It does nothing if the
+// handler wasn't given a net.Conn.
+func (h Handler) SetDeadline(t time.Time) {
+	if h.dc != nil {
+		h.dc.SetDeadline(t)
+	}
+}
+
 func (h Handler) reset() {
 	h.rw.Reader.Reset(bufio.NewReader(h.conn))
 	h.rw.Writer.Reset(bufio.NewWriter(h.conn))
 }
 
+// Ping implements handlers.Pinger by sending a noop to the backend and waiting for the response
+func (h Handler) Ping() error {
+	if err := h.begin(); err != nil {
+		return err
+	}
+	if err := binprot.WriteNoopCmd(h.rw.Writer, 0); err != nil {
+		return err
+	}
+	if err := h.rw.Flush(); err != nil {
+		return err
+	}
+	_, err := readResponseHeader(h.rw.Reader)
+	return err
+}
+
 // Close closes the Handler's underlying io.ReadWriteCloser.
 // Any calls to the handler after Close is called are invalid.
 func (h Handler) Close() error {
@@ -212,6 +282,10 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 		return nil
 	}
 
+	if err := h.begin(); err != nil {
+		return err
+	}
+
 	// Specialized chunk reader to make the code here much simpler
 	dataSize, fullSize := chunkSize(len(cmd.Key))
 	limChunkReader := newChunkLimitedReader(bytes.NewBuffer(cmd.Data), int64(dataSize), int64(len(cmd.Data)))
@@ -229,19 +303,20 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 		Exptime:   exp,
 	}
 
-	// Write metadata key
+	// Write metadata key. Any CAS value applies only to the metadata; the chunks are not written
+	// unless the metadata write succeeds, so a CAS mismatch leaves the old data intact.
 	// TODO: should there be a unique flags value for chunked data?
 	switch reqType {
 	case common.RequestSet:
-		if err := binprot.WriteSetCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metadataSize, 0); err != nil {
+		if err := binprot.WriteSetCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metadataSize, 0, cmd.Cas); err != nil {
 			return err
 		}
 	case common.RequestAdd:
-		if err := binprot.WriteAddCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metadataSize, 0); err != nil {
+		if err := binprot.WriteAddCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metadataSize, 0, cmd.Cas); err != nil {
 			return err
 		}
 	case common.RequestReplace:
-		if err := binprot.WriteReplaceCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metadataSize, 0); err != nil {
+		if err := binprot.WriteReplaceCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metadataSize, 0, cmd.Cas); err != nil {
 			return err
 		}
 	default:
@@ -259,6 +334,11 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 	// Read server's response
 	resHeader, err := readResponseHeader(h.rw.Reader)
 	if err != nil {
+		// There's no header at all after an I/O error or a timeout
+		if resHeader == nil {
+			return err
+		}
+
 		// Discard response body
 		n, ioerr := h.rw.Discard(int(resHeader.TotalBodyLength))
 		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
@@ -283,7 +363,7 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 		key := chunkKey(cmd.Key, chunkNum)
 
 		// Write the key
-		if err := binprot.WriteSetCmd(h.rw.Writer, key, cmd.Flags, cmd.Exptime, fullSize, 0); err != nil {
+		if err := binprot.WriteSetCmd(h.rw.Writer, key, cmd.Flags, cmd.Exptime, fullSize, 0, 0); err != nil {
 			return err
 		}
 		// Write token
@@ -345,6 +425,10 @@ func (h Handler) Prepend(cmd common.SetRequest) error {
 }
 
 func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common.RequestType) error {
+	if err := h.begin(); err != nil {
+		return err
+	}
+
 	// read data, (ap|pre)pend, write out
 
 	switch reqType {
@@ -354,7 +438,7 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 		panic("Bad request type in appendPrependCommon!")
 	}
 
-	_, metaData, err := getMetadata(h.rw, cmd.Key)
+	_, metaData, metaCas, err := getMetadata(h.rw, cmd.Key)
 	if err != nil {
 		if err == common.ErrKeyNotFound {
 			switch reqType {
@@ -370,6 +454,10 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 		return err
 	}
 
+	if cmd.Cas != 0 && cmd.Cas != metaCas {
+		return common.ErrKeyExists
+	}
+
 	// Write all the get commands before reading
 	cmdSize := int(metaData.NumChunks)*(len(cmd.Key)+4 /* key suffix */ +binprot.ReqHeaderLen) + binprot.ReqHeaderLen /* for the noop */
 	cmdbuf := bytes.NewBuffer(make([]byte, 0, cmdSize))
@@ -458,6 +546,7 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 		Data:    dataBuf,
 		Flags:   metaData.OrigFlags,
 		Exptime: metaData.Exptime,
+		Cas:     cmd.Cas,
 	}
 	return h.handleSetCommon(setcmd, common.RequestSet)
 }
@@ -466,14 +555,18 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 // are expected to be read from until either a single error is received or the
 // response channel is exhausted.
 func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if err := h.begin(); err != nil {
+		return handlers.FailedGet(err)
+	}
+
 	// No buffering here so there's not multiple gets in memory
 	dataOut := make(chan common.GetResponse)
 	errorOut := make(chan error)
-	go realHandleGet(cmd, dataOut, errorOut, h.rw)
+	go realHandleGet(cmd, dataOut, errorOut, h.rw, h.dc)
 	return dataOut, errorOut
 }
 
-func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error, rw *bufio.ReadWriter) {
+func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error, rw *bufio.ReadWriter, dc *handlers.DeadlineConn) {
 	// read index
 	// make buf
 	// for numChunks do
@@ -494,7 +587,7 @@ outer:
 			Data:   nil,
 		}
 
-		_, metaData, err := getMetadata(rw, key)
+		_, metaData, metaCas, err := getMetadata(rw, key)
 		if err != nil {
 			if err == common.ErrKeyNotFound {
 				metrics.IncCounter(MetricCmdGetMissesMeta)
@@ -559,6 +652,11 @@ outer:
 					continue
 				} else {
 					lastErr = err
+
+					// The rest of the chunks can't be read after an I/O error or a timeout
+					if !common.IsAppError(err) || (dc != nil && dc.Failed()) {
+						break
+					}
 				}
 			}
 
@@ -594,6 +692,7 @@ outer:
 			Quiet:  cmd.Quiet[idx],
 			Opaque: cmd.Opaques[idx],
 			Flags:  metaData.OrigFlags,
+			Cas:    metaCas,
 			Key:    key,
 			Data:   dataBuf,
 		}
@@ -617,18 +716,47 @@ func (h Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan
 	panic("GetE not supported in Rend chunked mode")
 }
 
-// GAT performs a get-and-touch request on the remote backend
-func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+// GAT performs a batched get-and-touch request on the remote backend. The chunks for each key are
+// pipelined, one key at a time. The channels returned are expected to be read from until either a
+// single error is received or the response channel is exhausted.
+func (h Handler) GAT(cmd common.GATRequest) (<-chan common.GetResponse, <-chan error) {
+	if err := h.begin(); err != nil {
+		return handlers.FailedGet(err)
+	}
+
+	// No buffering here so there's not multiple GATs in memory
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+	go realHandleGAT(cmd, dataOut, errorOut, h.rw, h.dc)
+	return dataOut, errorOut
+}
+
+func realHandleGAT(cmd common.GATRequest, dataOut chan common.GetResponse, errorOut chan error, rw *bufio.ReadWriter, dc *handlers.DeadlineConn) {
+	defer close(errorOut)
+	defer close(dataOut)
+
+	for idx, key := range cmd.Keys {
+		res, err := gatOne(rw, dc, key, cmd.Exptimes[idx], cmd.Opaques[idx], cmd.Quiet[idx])
+		if err != nil {
+			errorOut <- err
+			return
+		}
+
+		dataOut <- res
+	}
+}
+
+func gatOne(rw *bufio.ReadWriter, dc *handlers.DeadlineConn, key []byte, exptime, opaque uint32, quiet bool) (common.GetResponse, error) {
 	missResponse := common.GetResponse{
 		Miss:   true,
-		Quiet:  false,
-		Opaque: cmd.Opaque,
+		Quiet:  quiet,
+		Opaque: opaque,
 		Flags:  0,
-		Key:    cmd.Key,
+		Key:    key,
 		Data:   nil,
 	}
 
-	_, metaData, err := getAndTouchMetadata(h.rw, cmd.Key, cmd.Exptime)
+	_, metaData, metaCas, err := getAndTouchMetadata(rw, key, exptime)
 	if err != nil {
 		if err == common.ErrKeyNotFound {
 			metrics.IncCounter(MetricCmdGatMissesMeta)
@@ -642,8 +770,8 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 
 	// Write all the GAT commands before reading
 	for i := 0; i < int(metaData.NumChunks); i++ {
-		chunkKey := chunkKey(cmd.Key, i)
-		if err := binprot.WriteGATQCmd(h.rw.Writer, chunkKey, cmd.Exptime, 0); err != nil {
+		chunkKey := chunkKey(key, i)
+		if err := binprot.WriteGATQCmd(rw.Writer, chunkKey, exptime, 0); err != nil {
 			return common.GetResponse{}, err
 		}
 	}
@@ -651,12 +779,12 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 	// The final command must be GAT or Noop to guarantee a response
 	// We use Noop to make coding easier, but it's (very) slightly less efficient
 	// since we send 24 extra bytes in each direction
-	if err := binprot.WriteNoopCmd(h.rw.Writer, 0); err != nil {
+	if err := binprot.WriteNoopCmd(rw.Writer, 0); err != nil {
 		return common.GetResponse{}, err
 	}
 
 	// Flush to make sure all the GAT commands are sent to the server.
-	if err := h.rw.Flush(); err != nil {
+	if err := rw.Flush(); err != nil {
 		return common.GetResponse{}, err
 	}
 
@@ -673,7 +801,7 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 	var lastErr error
 
 	for {
-		opcodeNoop, err := getLocalIntoBuf(h.rw.Reader, metaData, tokenBuf, dataBuf, chunk, int(metaData.ChunkSize))
+		opcodeNoop, err := getLocalIntoBuf(rw.Reader, metaData, tokenBuf, dataBuf, chunk, int(metaData.ChunkSize))
 		if err != nil {
 			if err == common.ErrKeyNotFound {
 				if !miss {
@@ -683,6 +811,11 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 				continue
 			} else {
 				lastErr = err
+
+				// The rest of the chunks can't be read after an I/O error or a timeout
+				if !common.IsAppError(err) || (dc != nil && dc.Failed()) {
+					break
+				}
 			}
 		}
 
@@ -713,22 +846,27 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 
 	return common.GetResponse{
 		Miss:   false,
-		Quiet:  false,
-		Opaque: cmd.Opaque,
+		Quiet:  quiet,
+		Opaque: opaque,
 		Flags:  metaData.OrigFlags,
-		Key:    cmd.Key,
+		Cas:    metaCas,
+		Key:    key,
 		Data:   dataBuf,
 	}, nil
 }
 
 // Delete performs a delete request on the remote backend
 func (h Handler) Delete(cmd common.DeleteRequest) error {
+	if err := h.begin(); err != nil {
+		return err
+	}
+
 	// read metadata
 	// delete metadata
 	// for 0 to metadata.numChunks
 	//  delete item
 
-	metaKey, metaData, err := getMetadata(h.rw, cmd.Key)
+	metaKey, metaData, _, err := getMetadata(h.rw, cmd.Key)
 
 	if err != nil {
 		if err == common.ErrKeyNotFound {
@@ -779,6 +917,10 @@ func (h Handler) Delete(cmd common.DeleteRequest) error {
 
 // Touch performs a touch request on the remote backend
 func (h Handler) Touch(cmd common.TouchRequest) error {
+	if err := h.begin(); err != nil {
+		return err
+	}
+
 	// read metadata
 	// for 0 to metadata.numChunks
 	//  touch item
@@ -788,7 +930,7 @@ func (h Handler) Touch(cmd common.TouchRequest) error {
 	// In this case if a chunk expires during the operation, we fail the touch instead of
 	// leaving a key in an inconsistent state where the metadata lives on and the data is
 	// incomplete. The metadata is touched last to make sure the data exists first.
-	metaKey, metaData, err := getMetadata(h.rw, cmd.Key)
+	metaKey, metaData, _, err := getMetadata(h.rw, cmd.Key)
 
 	if err != nil {
 		if err == common.ErrKeyNotFound {
@@ -827,7 +969,7 @@ func (h Handler) Touch(cmd common.TouchRequest) error {
 	// Overwrite the metadata with the new expiration time
 	metrics.IncCounter(MetricCmdTouchMetaSet)
 	metaData.Exptime, _ = exptime(cmd.Exptime)
-	if err := binprot.WriteSetCmd(h.rw.Writer, metaKey, metaData.OrigFlags, cmd.Exptime, metadataSize, 0); err != nil {
+	if err := binprot.WriteSetCmd(h.rw.Writer, metaKey, metaData.OrigFlags, cmd.Exptime, metadataSize, 0, 0); err != nil {
 		return err
 	}
 
@@ -841,6 +983,11 @@ func (h Handler) Touch(cmd common.TouchRequest) error {
 	resHeader, err := readResponseHeader(h.rw.Reader)
 	if err != nil {
 		metrics.IncCounter(MetricCmdTouchMetaSetErrors)
+		// There's no header at all after an I/O error or a timeout
+		if resHeader == nil {
+			return err
+		}
+
 		// Discard response body
 		n, ioerr := h.rw.Discard(int(resHeader.TotalBodyLength))
 		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
@@ -853,3 +1000,29 @@ func (h Handler) Touch(cmd common.TouchRequest) error {
 
 	return nil
 }
+
+// Increment is not supported by the chunked handler. Values are split across a metadata item and
+// one or more chunks that are padded out to a fixed size, so memcached has no numeric value it
+// could operate on atomically. Returning an application error here means the client gets a clean
+// "not supported" response instead of a broken connection.
+func (h Handler) Increment(cmd common.IncrDecrRequest) (uint64, error) {
+	return 0, common.ErrNotSupported
+}
+
+// Decrement is not supported by the chunked handler for the same reasons as Increment.
+func (h Handler) Decrement(cmd common.IncrDecrRequest) (uint64, error) {
+	return 0, common.ErrNotSupported
+}
+
+// Flush performs a flush request on the remote backend. The metadata items and chunks are all
+// regular items in memcached, so they are all invalidated together.
+func (h Handler) Flush(cmd common.FlushRequest) error {
+	if err := h.begin(); err != nil {
+		return err
+	}
+
+	if err := binprot.WriteFlushCmd(h.rw.Writer, cmd.Delay, 0); err != nil {
+		return err
+	}
+	return simpleCmdLocal(h.rw, true)
+}
@@ -26,32 +26,34 @@ import (
 // TODO: replace sending new empty metadata on miss with emptyMeta
 var emptyMeta = metadata{}
 
-func getAndTouchMetadata(rw *bufio.ReadWriter, key []byte, exptime uint32) ([]byte, metadata, error) {
+// The CAS value of the metadata key is used as the CAS value of the whole item, since the metadata
+// is always written before any of the chunks.
+func getAndTouchMetadata(rw *bufio.ReadWriter, key []byte, exptime uint32) ([]byte, metadata, uint64, error) {
 	metaKey := metaKey(key)
 	if err := binprot.WriteGATCmd(rw, metaKey, exptime, 0); err != nil {
-		return nil, emptyMeta, err
+		return nil, emptyMeta, 0, err
 	}
-	metaData, err := getMetadataCommon(rw)
-	return metaKey, metaData, err
+	metaData, cas, err := getMetadataCommon(rw)
+	return metaKey, metaData, cas, err
 }
 
-func getMetadata(rw *bufio.ReadWriter, key []byte) ([]byte, metadata, error) {
+func getMetadata(rw *bufio.ReadWriter, key []byte) ([]byte, metadata, uint64, error) {
 	metaKey := metaKey(key)
 	if err := binprot.WriteGetCmd(rw, metaKey, 0); err != nil {
-		return nil, emptyMeta, err
+		return nil, emptyMeta, 0, err
 	}
-	metaData, err := getMetadataCommon(rw)
-	return metaKey, metaData, err
+	metaData, cas, err := getMetadataCommon(rw)
+	return metaKey, metaData, cas, err
 }
 
-func getMetadataCommon(rw *bufio.ReadWriter) (metadata, error) {
+func getMetadataCommon(rw *bufio.ReadWriter) (metadata, uint64, error) {
 	if err := rw.Flush(); err != nil {
-		return emptyMeta, err
+		return emptyMeta, 0, err
 	}
 
 	resHeader, err := binprot.ReadResponseHeader(rw)
 	if err != nil {
-		return emptyMeta, err
+		return emptyMeta, 0, err
 	}
 	defer binprot.PutResponseHeader(resHeader)
 
@@ -61,9 +63,9 @@ func getMetadataCommon(rw *bufio.ReadWriter) (metadata, error) {
 		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
 		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 		if ioerr != nil {
-			return emptyMeta, ioerr
+			return emptyMeta, 0, ioerr
 		}
-		return emptyMeta, err
+		return emptyMeta, 0, err
 	}
 
 	// we currently do nothing with the flags
@@ -81,10 +83,10 @@ func getMetadataCommon(rw *bufio.ReadWriter) (metadata, error) {
 
 	metaData, err := readMetadata(rw)
 	if err != nil {
-		return emptyMeta, err
+		return emptyMeta, 0, err
 	}
 
-	return metaData, nil
+	return metaData, resHeader.CASToken, nil
 }
 
 func simpleCmdLocal(rw *bufio.ReadWriter, flush bool) error {
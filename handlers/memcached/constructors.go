@@ -15,53 +15,159 @@
 package memcached
 
 import (
+	"errors"
 	"log"
-	"net"
 
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/handlers/memcached/batched"
 	"github.com/netflix/rend/handlers/memcached/chunked"
+	"github.com/netflix/rend/handlers/memcached/pooled"
 	"github.com/netflix/rend/handlers/memcached/std"
 )
 
+// Options are the options for the memcached and chunked handlers in a config file
+type Options struct {
+	// Addr is the address of the memcached backend. See handlers.Addr for the forms it can take.
+	Addr string `json:"addr"`
+
+	// Sock is the older name for Addr, from when backends could only be on unix sockets
+	Sock string `json:"sock"`
+
+	// Pool makes the client connections share a pool of connections to the backend if it is set
+	Pool *pooled.Opts `json:"pool,omitempty"`
+}
+
+// BatchedOptions are the options for the batched handler in a config file. Unset tuning options
+// use the batched package defaults.
+type BatchedOptions struct {
+	Addr string `json:"addr"`
+	Sock string `json:"sock"`
+	batched.Opts
+}
+
+var errNoAddr = errors.New("the addr option is required")
+
+// backendAddr returns whichever of the addr and sock options is set, after checking it parses
+func backendAddr(addr, sock string) (string, error) {
+	if addr == "" {
+		addr = sock
+	}
+	if addr == "" {
+		return "", errNoAddr
+	}
+	if _, err := handlers.ParseAddr(addr); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+func init() {
+	handlers.Register("memcached", handlers.Factory{
+		Options: func() interface{} { return new(Options) },
+		New: func(opts interface{}) (handlers.HandlerConst, error) {
+			o := opts.(*Options)
+			addr, err := backendAddr(o.Addr, o.Sock)
+			if err != nil {
+				return nil, err
+			}
+			if o.Pool != nil {
+				return RegularPooled(addr, *o.Pool), nil
+			}
+			return Regular(addr), nil
+		},
+	})
+	handlers.Register("chunked", handlers.Factory{
+		Options: func() interface{} { return new(Options) },
+		New: func(opts interface{}) (handlers.HandlerConst, error) {
+			o := opts.(*Options)
+			addr, err := backendAddr(o.Addr, o.Sock)
+			if err != nil {
+				return nil, err
+			}
+			if o.Pool != nil {
+				return ChunkedPooled(addr, *o.Pool), nil
+			}
+			return Chunked(addr), nil
+		},
+	})
+	handlers.Register("batched", handlers.Factory{
+		Options: func() interface{} { return new(BatchedOptions) },
+		New: func(opts interface{}) (handlers.HandlerConst, error) {
+			o := opts.(*BatchedOptions)
+			addr, err := backendAddr(o.Addr, o.Sock)
+			if err != nil {
+				return nil, err
+			}
+			return Batched(addr, o.Opts), nil
+		},
+	})
+}
+
 // Regular returns an implementation of the Handler interface that does standard,
-// direct interactions with the external memcached backend which is listening on
-// the specified unix domain socket.
-func Regular(sock string) handlers.HandlerConst {
+// direct interactions with the external memcached backend at the given address,
+// which is either a unix socket path or a URL as described in handlers.Addr. The
+// connection is reopened if it fails, e.g. when memcached restarts, so the client
+// connection can stay open.
+func Regular(addr string) handlers.HandlerConst {
 	return func() (handlers.Handler, error) {
-		conn, err := net.Dial("unix", sock)
+		dial, err := handlers.NewDialer(addr)
 		if err != nil {
-			if conn != nil {
-				conn.Close()
-			}
 			return nil, err
 		}
-		return std.NewHandler(conn), nil
+		h, err := std.NewReconnectingHandler(dial)
+		if err != nil {
+			return nil, err
+		}
+		return h, nil
 	}
 }
 
 // Chunked returns an implementation of the Handler interface that implements an
-// interaction model which splits data to set size chunks before inserting. the
-// external memcached backend is expected to be listening on the specified unix
-// domain socket.
-func Chunked(sock string) handlers.HandlerConst {
+// interaction model which splits data to set size chunks before inserting. The
+// external memcached backend is expected to be at the given address, in the same
+// forms as for Regular. Like Regular, the connection is reopened if it fails.
+func Chunked(addr string) handlers.HandlerConst {
 	return func() (handlers.Handler, error) {
-		conn, err := net.Dial("unix", sock)
+		dial, err := handlers.NewDialer(addr)
+		if err != nil {
+			return nil, err
+		}
+		h, err := chunked.NewReconnectingHandler(dial)
 		if err != nil {
 			log.Println("Error opening connection:", err.Error())
-			if conn != nil {
-				conn.Close()
-			}
 			return nil, err
 		}
-		return chunked.NewHandler(conn), nil
+		return h, nil
+	}
+}
+
+// RegularPooled returns a HandlerConst for handlers like the ones from Regular, except that the
+// connections to memcached are kept in a pool shared by every handler from the same HandlerConst.
+// Each request uses a connection from the pool, so the number of connections to memcached is
+// bounded by the pool size instead of growing with the number of client connections.
+func RegularPooled(addr string, opts pooled.Opts) handlers.HandlerConst {
+	p := pooled.NewPool(Regular(addr), opts)
+	return func() (handlers.Handler, error) {
+		return pooled.NewHandler(p), nil
+	}
+}
+
+// ChunkedPooled is the same as RegularPooled for the chunked handler.
+func ChunkedPooled(addr string, opts pooled.Opts) handlers.HandlerConst {
+	p := pooled.NewPool(Chunked(addr), opts)
+	return func() (handlers.Handler, error) {
+		return pooled.NewHandler(p), nil
 	}
 }
 
 // Batched returns an implementation of the Handler interface that multiplexes
 // requests on to a connection pool in order to reduce the overhead per request.
-func Batched(sock string, opts batched.Opts) handlers.HandlerConst {
+// The address takes the same forms as for Regular.
+func Batched(addr string, opts batched.Opts) handlers.HandlerConst {
 	return func() (handlers.Handler, error) {
-		return batched.NewHandler(sock, opts), nil
+		if _, err := handlers.ParseAddr(addr); err != nil {
+			return nil, err
+		}
+		return batched.NewHandler(addr, opts), nil
 	}
 }
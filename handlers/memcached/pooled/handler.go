@@ -0,0 +1,280 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pooled
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// Handler implements the handlers.Handler interface for one client connection by checking out a
+// handler from a Pool for each request. The number of connections to the backend depends on how
+// many requests are in progress at once rather than on how many clients are connected.
+type Handler struct {
+	pool *Pool
+
+	// The deadline given by the server is kept so it can be passed to the handler checked out
+	// for the request. Deadlines may be set from another goroutine while a request is running.
+	lock     *sync.Mutex
+	deadline *time.Time
+	current  *handlers.Handler
+
+	// cas is copied from the pooled handler before it is checked back in
+	cas *uint64
+}
+
+// NewHandler returns a Handler that uses the given pool. Handlers are cheap, so the usual way to
+// use a pool is to make one for each client connection from a HandlerConst.
+func NewHandler(p *Pool) Handler {
+	return Handler{
+		pool:     p,
+		lock:     new(sync.Mutex),
+		deadline: new(time.Time),
+		current:  new(handlers.Handler),
+		cas:      new(uint64),
+	}
+}
+
+// SetDeadline implements handlers.DeadlineAware. The deadline applies to the handler checked out
+// for the current request, if any, and to the handlers checked out for later requests until it
+// is changed.
+func (h Handler) SetDeadline(t time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	*h.deadline = t
+	if da, ok := (*h.current).(handlers.DeadlineAware); ok {
+		da.SetDeadline(t)
+	}
+}
+
+// Close does nothing for this Handler as the connections are pooled behind it and are not
+// explicitly controlled.
+func (h Handler) Close() error {
+	return nil
+}
+
+// Shared implements handlers.SharedCloser with the pool, which is closed separately from the
+// Handlers that use it
+func (h Handler) Shared() io.Closer {
+	return h.pool
+}
+
+// LastCas implements handlers.CasAware with the CAS from the handler used for the last request
+func (h Handler) LastCas() uint64 {
+	return *h.cas
+}
+
+func (h Handler) checkout() (handlers.Handler, error) {
+	b, err := h.pool.checkout()
+	if err != nil {
+		return nil, err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	*h.current = b
+	if da, ok := b.(handlers.DeadlineAware); ok {
+		da.SetDeadline(*h.deadline)
+	}
+
+	return b, nil
+}
+
+// checkin clears the deadline so it doesn't follow the handler to another client
+func (h Handler) checkin(b handlers.Handler, err error) {
+	h.lock.Lock()
+	*h.current = nil
+	if da, ok := b.(handlers.DeadlineAware); ok {
+		da.SetDeadline(time.Time{})
+	}
+	h.lock.Unlock()
+
+	h.pool.checkin(b, err)
+}
+
+// tempFailure returns the error for the client. The pool has already dealt with a broken handler,
+// so the client only needs to know this request failed.
+func tempFailure(err error) error {
+	if err != nil && !common.IsAppError(err) {
+		return common.ErrTempFailure
+	}
+	return err
+}
+
+func (h Handler) do(f func(b handlers.Handler) error) error {
+	b, err := h.checkout()
+	if err != nil {
+		return err
+	}
+
+	err = f(b)
+	*h.cas = handlers.LastCas(b)
+	h.checkin(b, err)
+
+	return tempFailure(err)
+}
+
+// Set performs a set request on a pooled handler
+func (h Handler) Set(cmd common.SetRequest) error {
+	return h.do(func(b handlers.Handler) error { return b.Set(cmd) })
+}
+
+// Add performs an add request on a pooled handler
+func (h Handler) Add(cmd common.SetRequest) error {
+	return h.do(func(b handlers.Handler) error { return b.Add(cmd) })
+}
+
+// Replace performs a replace request on a pooled handler
+func (h Handler) Replace(cmd common.SetRequest) error {
+	return h.do(func(b handlers.Handler) error { return b.Replace(cmd) })
+}
+
+// Append performs an append request on a pooled handler
+func (h Handler) Append(cmd common.SetRequest) error {
+	return h.do(func(b handlers.Handler) error { return b.Append(cmd) })
+}
+
+// Prepend performs a prepend request on a pooled handler
+func (h Handler) Prepend(cmd common.SetRequest) error {
+	return h.do(func(b handlers.Handler) error { return b.Prepend(cmd) })
+}
+
+// Delete performs a delete request on a pooled handler
+func (h Handler) Delete(cmd common.DeleteRequest) error {
+	return h.do(func(b handlers.Handler) error { return b.Delete(cmd) })
+}
+
+// Touch performs a touch request on a pooled handler
+func (h Handler) Touch(cmd common.TouchRequest) error {
+	return h.do(func(b handlers.Handler) error { return b.Touch(cmd) })
+}
+
+// Flush performs a flush request on a pooled handler
+func (h Handler) Flush(cmd common.FlushRequest) error {
+	return h.do(func(b handlers.Handler) error { return b.Flush(cmd) })
+}
+
+// Increment performs an increment request on a pooled handler
+func (h Handler) Increment(cmd common.IncrDecrRequest) (uint64, error) {
+	var val uint64
+	err := h.do(func(b handlers.Handler) (err error) {
+		val, err = b.Increment(cmd)
+		return
+	})
+	return val, err
+}
+
+// Decrement performs a decrement request on a pooled handler
+func (h Handler) Decrement(cmd common.IncrDecrRequest) (uint64, error) {
+	var val uint64
+	err := h.do(func(b handlers.Handler) (err error) {
+		val, err = b.Decrement(cmd)
+		return
+	})
+	return val, err
+}
+
+// Get performs a get request on a pooled handler. The handler is returned to the pool once it has
+// sent all of its responses.
+func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	b, err := h.checkout()
+	if err != nil {
+		return handlers.FailedGet(err)
+	}
+
+	resIn, errIn := b.Get(cmd)
+	return h.forwardGet(b, resIn, errIn)
+}
+
+// GAT performs a get-and-touch request on a pooled handler. The handler is returned to the pool
+// once it has sent all of its responses.
+func (h Handler) GAT(cmd common.GATRequest) (<-chan common.GetResponse, <-chan error) {
+	b, err := h.checkout()
+	if err != nil {
+		return handlers.FailedGet(err)
+	}
+
+	resIn, errIn := b.GAT(cmd)
+	return h.forwardGet(b, resIn, errIn)
+}
+
+// GetE performs a gete request on a pooled handler. The handler is returned to the pool once it
+// has sent all of its responses.
+func (h Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	b, err := h.checkout()
+	if err != nil {
+		return handlers.FailedGetE(err)
+	}
+
+	resIn, errIn := b.GetE(cmd)
+	return h.forwardGetE(b, resIn, errIn)
+}
+
+// forward passes the errors from a checked out handler's get, gete, or gat on to the caller, and
+// returns the handler to the pool once the handler has closed both of its channels. relay copies
+// the responses and closes the caller's response channel. It runs alongside the errors because a
+// handler may block sending an error before it closes its response channel.
+func (h Handler) forward(b handlers.Handler, errIn <-chan error, relay func()) <-chan error {
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+
+		relayed := make(chan struct{})
+		go func() {
+			defer close(relayed)
+			relay()
+		}()
+
+		var lastErr error
+		for err := range errIn {
+			lastErr = err
+			errorOut <- tempFailure(err)
+		}
+
+		<-relayed
+		h.checkin(b, lastErr)
+	}()
+
+	return errorOut
+}
+
+func (h Handler) forwardGet(b handlers.Handler, resIn <-chan common.GetResponse, errIn <-chan error) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := h.forward(b, errIn, func() {
+		defer close(dataOut)
+		for res := range resIn {
+			dataOut <- res
+		}
+	})
+	return dataOut, errorOut
+}
+
+func (h Handler) forwardGetE(b handlers.Handler, resIn <-chan common.GetEResponse, errIn <-chan error) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := h.forward(b, errIn, func() {
+		defer close(dataOut)
+		for res := range resIn {
+			dataOut <- res
+		}
+	})
+	return dataOut, errorOut
+}
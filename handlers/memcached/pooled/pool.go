@@ -0,0 +1,258 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pooled
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricPoolConnsOpened      = metrics.AddCounter("pool_conns_opened", nil)
+	MetricPoolConnsClosed      = metrics.AddCounter("pool_conns_closed", nil)
+	MetricPoolOpenErrors       = metrics.AddCounter("pool_open_errors", nil)
+	MetricPoolCheckoutTimeouts = metrics.AddCounter("pool_checkout_timeouts", nil)
+	MetricPoolHealthChecks     = metrics.AddCounter("pool_health_checks", nil)
+	MetricPoolHealthFailures   = metrics.AddCounter("pool_health_failures", nil)
+)
+
+// Opts is the set of tuning options for a pool.
+type Opts struct {
+	// Size is the most connections the pool will have open to the backend at once
+	Size uint32 `json:"size"`
+
+	// WaitMillis is how long a request waits for a connection when they are all in use. A
+	// request that doesn't get one in time fails with common.ErrTempFailure.
+	WaitMillis uint32 `json:"wait_millis"`
+
+	// HealthCheckIntervalSec is the time between checks of the idle connections. Connections
+	// whose handlers implement handlers.Pinger and fail the check are closed.
+	HealthCheckIntervalSec uint32 `json:"health_check_interval_sec"`
+}
+
+var defaultOpts = Opts{
+	Size:                   32,
+	WaitMillis:             100,
+	HealthCheckIntervalSec: 5,
+}
+
+func uint32ValueOrDefault(val uint32, def uint32) uint32 {
+	if val <= 0 {
+		return def
+	}
+	return val
+}
+
+// Pool is a bounded set of handlers for one backend that are shared between client connections.
+// Each request checks out a handler, uses it, and returns it. Handlers are only opened when a
+// request needs one and none are idle, so a pool that is never busy stays small.
+type Pool struct {
+	open     handlers.HandlerConst
+	wait     time.Duration
+	interval time.Duration
+
+	// idle holds the handlers that are not in use. slots has an entry for every handler that is
+	// open, so its capacity bounds the size of the pool.
+	idle  chan handlers.Handler
+	slots chan struct{}
+
+	// The health check starts with the first request, and stop is closed by Close
+	startOnce *sync.Once
+	stopOnce  *sync.Once
+	stop      chan struct{}
+}
+
+// NewPool creates a pool of handlers made by open. The Opts parameter can exclude any settings in
+// order to take the defaults. Any setting that is at the 0 value takes the default. A background
+// health check runs from the first request until the pool is closed.
+//
+// Default values are:
+//
+// Size:                   32,
+// WaitMillis:             100,
+// HealthCheckIntervalSec: 5,
+func NewPool(open handlers.HandlerConst, opts Opts) *Pool {
+	size := uint32ValueOrDefault(opts.Size, defaultOpts.Size)
+	wait := uint32ValueOrDefault(opts.WaitMillis, defaultOpts.WaitMillis)
+	interval := uint32ValueOrDefault(opts.HealthCheckIntervalSec, defaultOpts.HealthCheckIntervalSec)
+
+	return &Pool{
+		open:      open,
+		wait:      time.Duration(wait) * time.Millisecond,
+		interval:  time.Duration(interval) * time.Second,
+		idle:      make(chan handlers.Handler, size),
+		slots:     make(chan struct{}, size),
+		startOnce: new(sync.Once),
+		stopOnce:  new(sync.Once),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Close stops the health check and closes the idle handlers. Handlers that are in use are closed
+// when they are returned, and requests made after Close fail with common.ErrTempFailure. It is
+// safe to call Close more than once.
+func (p *Pool) Close() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.discardIdle()
+	return nil
+}
+
+func (p *Pool) closed() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Pool) discardIdle() {
+	for {
+		select {
+		case h := <-p.idle:
+			p.discard(h)
+		default:
+			return
+		}
+	}
+}
+
+// checkout returns an idle handler, or opens a new one if there is room. Otherwise it waits for a
+// handler to be returned.
+func (p *Pool) checkout() (handlers.Handler, error) {
+	if p.closed() {
+		return nil, common.ErrTempFailure
+	}
+
+	p.startOnce.Do(func() { go p.healthCheck() })
+
+	select {
+	case h := <-p.idle:
+		return h, nil
+	default:
+	}
+
+	timer := time.NewTimer(p.wait)
+	defer timer.Stop()
+
+	select {
+	case h := <-p.idle:
+		return h, nil
+
+	case p.slots <- struct{}{}:
+		h, err := p.open()
+		if err != nil {
+			metrics.IncCounter(MetricPoolOpenErrors)
+			<-p.slots
+			return nil, common.ErrTempFailure
+		}
+		metrics.IncCounter(MetricPoolConnsOpened)
+		return h, nil
+
+	case <-timer.C:
+		metrics.IncCounter(MetricPoolCheckoutTimeouts)
+		return nil, common.ErrTempFailure
+	}
+}
+
+// checkin returns a handler to the pool after a request. A request that failed with anything
+// other than an application error may have left the connection in an unknown state, and a
+// temporary failure usually means the connection timed out or broke, so the handler is closed
+// instead. The pool opens a new one the next time it needs it.
+func (p *Pool) checkin(h handlers.Handler, err error) {
+	if err == common.ErrTempFailure || (err != nil && !common.IsAppError(err)) {
+		p.discard(h)
+		return
+	}
+
+	// There is always room since every handler has a slot
+	p.idle <- h
+
+	// Close may have emptied the pool in the meantime
+	if p.closed() {
+		p.discardIdle()
+	}
+}
+
+func (p *Pool) discard(h handlers.Handler) {
+	metrics.IncCounter(MetricPoolConnsClosed)
+	h.Close()
+	<-p.slots
+}
+
+// healthCheck pings each of the idle handlers every interval until the pool is closed
+func (p *Pool) healthCheck() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.checkIdle()
+		}
+	}
+}
+
+// checkIdle pings each of the idle handlers once. Handlers that are checked out in the meantime
+// are skipped until the next time around.
+func (p *Pool) checkIdle() {
+	for n := len(p.idle); n > 0; n-- {
+		var h handlers.Handler
+
+		select {
+		case h = <-p.idle:
+		default:
+		}
+
+		if h == nil {
+			break
+		}
+
+		pinger, ok := h.(handlers.Pinger)
+		if !ok {
+			p.checkin(h, nil)
+			continue
+		}
+
+		// A backend that doesn't answer is as bad as one that's gone
+		da, _ := h.(handlers.DeadlineAware)
+		if da != nil {
+			da.SetDeadline(time.Now().Add(p.interval))
+		}
+
+		metrics.IncCounter(MetricPoolHealthChecks)
+		err := pinger.Ping()
+
+		if da != nil {
+			da.SetDeadline(time.Time{})
+		}
+
+		if err != nil {
+			metrics.IncCounter(MetricPoolHealthFailures)
+			log.Println("Closing pooled backend connection after failed health check:", err.Error())
+			p.discard(h)
+			continue
+		}
+
+		p.checkin(h, nil)
+	}
+}
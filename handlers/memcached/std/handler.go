@@ -17,8 +17,11 @@ package std
 import (
 	"bufio"
 	"io"
+	"net"
+	"time"
 
 	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/protocol/binprot"
 )
@@ -42,16 +45,88 @@ func readResponseHeader(r *bufio.Reader) (*binprot.ResponseHeader, error) {
 type Handler struct {
 	rw   *bufio.ReadWriter
 	conn io.Closer
+
+	// dc is the backend connection if it supports deadlines, otherwise nil
+	dc *handlers.DeadlineConn
+
+	// cas is the CAS value memcached gave the item changed by the last store or arithmetic command
+	cas *uint64
 }
 
 // NewHandler returns an implementation of handlers.Handler that implements a straightforward
 // request-response like normal memcached usage.
 func NewHandler(conn io.ReadWriteCloser) Handler {
+	if nc, ok := conn.(net.Conn); ok {
+		return newHandler(handlers.NewDeadlineConn(nc))
+	}
+
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	return Handler{
 		rw:   rw,
 		conn: conn,
+		cas:  new(uint64),
+	}
+}
+
+// NewReconnectingHandler returns a Handler like NewHandler that opens its own connection to the
+// backend with dial. If the connection fails, the request that was using it returns
+// common.ErrTempFailure and the connection is replaced before a later request, so the client's
+// connection to Rend doesn't have to be closed. See handlers.DeadlineConn.Reconnect.
+func NewReconnectingHandler(dial handlers.Dialer) (Handler, error) {
+	dc, err := handlers.NewReconnectingConn(dial)
+	if err != nil {
+		return Handler{}, err
 	}
+	return newHandler(dc), nil
+}
+
+func newHandler(dc *handlers.DeadlineConn) Handler {
+	rw := bufio.NewReadWriter(bufio.NewReader(dc), bufio.NewWriter(dc))
+	return Handler{
+		rw:   rw,
+		conn: dc,
+		dc:   dc,
+		cas:  new(uint64),
+	}
+}
+
+// begin replaces the connection to the backend before a request if it has failed. Whatever is
+// left in the buffers from the old connection is thrown away.
+func (h Handler) begin() error {
+	if h.dc == nil {
+		return nil
+	}
+
+	reconnected, err := h.dc.Reconnect()
+	if reconnected {
+		h.rw.Reader.Reset(h.dc)
+		h.rw.Writer.Reset(h.dc)
+	}
+	return err
+}
+
+// SetDeadline implements handlers.DeadlineAware. A request that runs past the deadline returns
+// common.ErrTempFailure and the connection to the backend is closed. It does nothing if the
+// handler wasn't given a net.Conn.
+func (h Handler) SetDeadline(t time.Time) {
+	if h.dc != nil {
+		h.dc.SetDeadline(t)
+	}
+}
+
+// Ping implements handlers.Pinger by sending a noop to the backend and waiting for the response
+func (h Handler) Ping() error {
+	if err := h.begin(); err != nil {
+		return err
+	}
+	if err := binprot.WriteNoopCmd(h.rw.Writer, 0); err != nil {
+		return err
+	}
+	if err := h.rw.Flush(); err != nil {
+		return err
+	}
+	_, err := readResponseHeader(h.rw.Reader)
+	return err
 }
 
 // Close closes the Handler's underlying io.ReadWriteCloser.
@@ -62,7 +137,10 @@ func (h Handler) Close() error {
 
 // Set performs a set request on the remote backend
 func (h Handler) Set(cmd common.SetRequest) error {
-	if err := binprot.WriteSetCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0); err != nil {
+	if err := h.begin(); err != nil {
+		return err
+	}
+	if err := binprot.WriteSetCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0, cmd.Cas); err != nil {
 		return err
 	}
 	return h.handleSetCommon(cmd)
@@ -70,7 +148,10 @@ func (h Handler) Set(cmd common.SetRequest) error {
 
 // Add performs an add request on the remote backend
 func (h Handler) Add(cmd common.SetRequest) error {
-	if err := binprot.WriteAddCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0); err != nil {
+	if err := h.begin(); err != nil {
+		return err
+	}
+	if err := binprot.WriteAddCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0, cmd.Cas); err != nil {
 		return err
 	}
 	return h.handleSetCommon(cmd)
@@ -78,7 +159,10 @@ func (h Handler) Add(cmd common.SetRequest) error {
 
 // Replace performs a replace request on the remote backend
 func (h Handler) Replace(cmd common.SetRequest) error {
-	if err := binprot.WriteReplaceCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0); err != nil {
+	if err := h.begin(); err != nil {
+		return err
+	}
+	if err := binprot.WriteReplaceCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0, cmd.Cas); err != nil {
 		return err
 	}
 	return h.handleSetCommon(cmd)
@@ -86,7 +170,10 @@ func (h Handler) Replace(cmd common.SetRequest) error {
 
 // Append performs an append request on the remote backend
 func (h Handler) Append(cmd common.SetRequest) error {
-	if err := binprot.WriteAppendCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0); err != nil {
+	if err := h.begin(); err != nil {
+		return err
+	}
+	if err := binprot.WriteAppendCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0, cmd.Cas); err != nil {
 		return err
 	}
 	return h.handleSetCommon(cmd)
@@ -94,7 +181,10 @@ func (h Handler) Append(cmd common.SetRequest) error {
 
 // Prepend performs a prepend request on the remote backend
 func (h Handler) Prepend(cmd common.SetRequest) error {
-	if err := binprot.WritePrependCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0); err != nil {
+	if err := h.begin(); err != nil {
+		return err
+	}
+	if err := binprot.WritePrependCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0, cmd.Cas); err != nil {
 		return err
 	}
 	return h.handleSetCommon(cmd)
@@ -102,6 +192,7 @@ func (h Handler) Prepend(cmd common.SetRequest) error {
 
 func (h Handler) handleSetCommon(cmd common.SetRequest) error {
 	// TODO: should there be a unique flags value for regular data?
+	*h.cas = 0
 
 	// Write value
 	h.rw.Write(cmd.Data)
@@ -112,8 +203,14 @@ func (h Handler) handleSetCommon(cmd common.SetRequest) error {
 	}
 
 	// Read server's response
-	resHeader, err := readResponseHeader(h.rw.Reader)
+	resHeader, err := binprot.ReadResponseHeader(h.rw.Reader)
 	if err != nil {
+		// There's no header at all after an I/O error or a timeout
+		return err
+	}
+	defer binprot.PutResponseHeader(resHeader)
+
+	if err := binprot.DecodeError(resHeader); err != nil {
 		// Discard response body
 		n, ioerr := h.rw.Discard(int(resHeader.TotalBodyLength))
 		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
@@ -128,6 +225,7 @@ func (h Handler) handleSetCommon(cmd common.SetRequest) error {
 		return err
 	}
 
+	*h.cas = resHeader.CASToken
 	return nil
 }
 
@@ -135,6 +233,9 @@ func (h Handler) handleSetCommon(cmd common.SetRequest) error {
 // are expected to be read from until either a single error is received or the
 // response channel is exhausted.
 func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if err := h.begin(); err != nil {
+		return handlers.FailedGet(err)
+	}
 	dataOut := make(chan common.GetResponse)
 	errorOut := make(chan error)
 	go realHandleGet(cmd, dataOut, errorOut, h.rw)
@@ -151,7 +252,7 @@ func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, error
 			return
 		}
 
-		data, flags, _, err := getLocal(rw, false)
+		data, flags, _, cas, err := getLocal(rw, false)
 		if err != nil {
 			if err == common.ErrKeyNotFound {
 				dataOut <- common.GetResponse{
@@ -175,6 +276,7 @@ func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, error
 			Quiet:  cmd.Quiet[idx],
 			Opaque: cmd.Opaques[idx],
 			Flags:  flags,
+			Cas:    cas,
 			Key:    key,
 			Data:   data,
 		}
@@ -185,6 +287,9 @@ func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, error
 // are expected to be read from until either a single error is received or the
 // response channel is exhausted.
 func (h Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	if err := h.begin(); err != nil {
+		return handlers.FailedGetE(err)
+	}
 	dataOut := make(chan common.GetEResponse)
 	errorOut := make(chan error)
 	go realHandleGetE(cmd, dataOut, errorOut, h.rw)
@@ -201,7 +306,7 @@ func realHandleGetE(cmd common.GetRequest, dataOut chan common.GetEResponse, err
 			return
 		}
 
-		data, flags, exp, err := getLocal(rw, true)
+		data, flags, exp, cas, err := getLocal(rw, true)
 		if err != nil {
 			if err == common.ErrKeyNotFound {
 				dataOut <- common.GetEResponse{
@@ -227,46 +332,123 @@ func realHandleGetE(cmd common.GetRequest, dataOut chan common.GetEResponse, err
 			Opaque:  cmd.Opaques[idx],
 			Flags:   flags,
 			Exptime: exp,
+			Cas:     cas,
 			Key:     key,
 			Data:    data,
 		}
 	}
 }
 
-// GAT performs a get-and-touch request on the remote backend
-func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
-	if err := binprot.WriteGATCmd(h.rw.Writer, cmd.Key, cmd.Exptime, 0); err != nil {
-		return common.GetResponse{}, err
+// GAT performs a batched get-and-touch request on the remote backend. All of the keys are sent
+// as quiet GATs followed by a noop so the whole batch takes a single round trip. The channels
+// returned are expected to be read from until either a single error is received or the response
+// channel is exhausted.
+func (h Handler) GAT(cmd common.GATRequest) (<-chan common.GetResponse, <-chan error) {
+	if err := h.begin(); err != nil {
+		return handlers.FailedGet(err)
 	}
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+	go realHandleGAT(cmd, dataOut, errorOut, h.rw, h.dc)
+	return dataOut, errorOut
+}
 
-	data, flags, _, err := getLocal(h.rw, false)
-	if err != nil {
-		if err == common.ErrKeyNotFound {
-			return common.GetResponse{
-				Miss:   true,
-				Quiet:  false,
-				Opaque: cmd.Opaque,
-				Flags:  flags,
-				Key:    cmd.Key,
-				Data:   nil,
-			}, nil
+func realHandleGAT(cmd common.GATRequest, dataOut chan common.GetResponse, errorOut chan error, rw *bufio.ReadWriter, dc *handlers.DeadlineConn) {
+	defer close(errorOut)
+	defer close(dataOut)
+
+	// The opaque for each GATQ is the index of its key so the hits can be matched back up
+	for idx, key := range cmd.Keys {
+		if err := binprot.WriteGATQCmd(rw.Writer, key, cmd.Exptimes[idx], uint32(idx)); err != nil {
+			errorOut <- err
+			return
 		}
+	}
+
+	if err := binprot.WriteNoopCmd(rw.Writer, 0); err != nil {
+		errorOut <- err
+		return
+	}
+
+	if err := rw.Flush(); err != nil {
+		errorOut <- err
+		return
+	}
+
+	missResponse := func(idx int) common.GetResponse {
+		return common.GetResponse{
+			Miss:   true,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Key:    cmd.Keys[idx],
+			Data:   nil,
+		}
+	}
+
+	// Responses come back in order and only for hits, so every key before a hit is a miss. All of
+	// the responses up to the noop are read even after an error to keep the connection usable.
+	next := 0
+	var lastErr error
+
+	for {
+		idx, data, flags, cas, noop, err := getQuietLocal(rw)
+		if err != nil {
+			// A connection that timed out keeps failing with an app error, so it has to be
+			// checked for separately or this would never finish
+			if !common.IsAppError(err) || (dc != nil && dc.Failed()) {
+				errorOut <- err
+				return
+			}
+			lastErr = err
+			continue
+		}
+
+		if noop {
+			break
+		}
+
+		if lastErr != nil {
+			continue
+		}
+
+		// An opaque that doesn't match up means the responses can't be trusted, but the rest of
+		// them still have to be read so the next request doesn't see them
+		if int(idx) < next || int(idx) >= len(cmd.Keys) {
+			lastErr = common.ErrInternal
+			continue
+		}
+
+		for ; next < int(idx); next++ {
+			dataOut <- missResponse(next)
+		}
+
+		dataOut <- common.GetResponse{
+			Miss:   false,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Flags:  flags,
+			Cas:    cas,
+			Key:    cmd.Keys[idx],
+			Data:   data,
+		}
+		next++
+	}
 
-		return common.GetResponse{}, err
+	if lastErr != nil {
+		errorOut <- lastErr
+		return
 	}
 
-	return common.GetResponse{
-		Miss:   false,
-		Quiet:  false,
-		Opaque: cmd.Opaque,
-		Flags:  flags,
-		Key:    cmd.Key,
-		Data:   data,
-	}, nil
+	for ; next < len(cmd.Keys); next++ {
+		dataOut <- missResponse(next)
+	}
 }
 
 // Delete performs a delete request on the remote backend
 func (h Handler) Delete(cmd common.DeleteRequest) error {
+	if err := h.begin(); err != nil {
+		return err
+	}
 	if err := binprot.WriteDeleteCmd(h.rw.Writer, cmd.Key, 0); err != nil {
 		return err
 	}
@@ -275,8 +457,55 @@ func (h Handler) Delete(cmd common.DeleteRequest) error {
 
 // Touch performs a touch request on the remote backend
 func (h Handler) Touch(cmd common.TouchRequest) error {
+	if err := h.begin(); err != nil {
+		return err
+	}
 	if err := binprot.WriteTouchCmd(h.rw.Writer, cmd.Key, cmd.Exptime, 0); err != nil {
 		return err
 	}
 	return simpleCmdLocal(h.rw)
 }
+
+// Increment performs an increment request on the remote backend
+func (h Handler) Increment(cmd common.IncrDecrRequest) (uint64, error) {
+	if err := h.begin(); err != nil {
+		return 0, err
+	}
+	if err := binprot.WriteIncrementCmd(h.rw.Writer, cmd.Key, cmd.Delta, cmd.Initial, cmd.Exptime, 0, cmd.NoCreate); err != nil {
+		return 0, err
+	}
+	return h.incrDecr()
+}
+
+// Decrement performs a decrement request on the remote backend
+func (h Handler) Decrement(cmd common.IncrDecrRequest) (uint64, error) {
+	if err := h.begin(); err != nil {
+		return 0, err
+	}
+	if err := binprot.WriteDecrementCmd(h.rw.Writer, cmd.Key, cmd.Delta, cmd.Initial, cmd.Exptime, 0, cmd.NoCreate); err != nil {
+		return 0, err
+	}
+	return h.incrDecr()
+}
+
+func (h Handler) incrDecr() (uint64, error) {
+	value, cas, err := incrDecrLocal(h.rw)
+	*h.cas = cas
+	return value, err
+}
+
+// LastCas implements handlers.CasAware
+func (h Handler) LastCas() uint64 {
+	return *h.cas
+}
+
+// Flush performs a flush request on the remote backend
+func (h Handler) Flush(cmd common.FlushRequest) error {
+	if err := h.begin(); err != nil {
+		return err
+	}
+	if err := binprot.WriteFlushCmd(h.rw.Writer, cmd.Delay, 0); err != nil {
+		return err
+	}
+	return simpleCmdLocal(h.rw)
+}
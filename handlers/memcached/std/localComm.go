@@ -52,14 +52,14 @@ func simpleCmdLocal(rw *bufio.ReadWriter) error {
 	return err
 }
 
-func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint32, err error) {
+func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint32, cas uint64, err error) {
 	if err := rw.Flush(); err != nil {
-		return nil, 0, 0, err
+		return nil, 0, 0, 0, err
 	}
 
 	resHeader, err := binprot.ReadResponseHeader(rw)
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, 0, 0, 0, err
 	}
 	defer binprot.PutResponseHeader(resHeader)
 
@@ -68,9 +68,9 @@ func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint3
 		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
 		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 		if ioerr != nil {
-			return nil, 0, 0, ioerr
+			return nil, 0, 0, 0, ioerr
 		}
-		return nil, 0, 0, err
+		return nil, 0, 0, 0, err
 	}
 
 	var serverFlags uint32
@@ -91,8 +91,81 @@ func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint3
 	n, err := io.ReadAtLeast(rw, buf, int(dataLen))
 	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, 0, 0, 0, err
 	}
 
-	return buf, serverFlags, serverExp, nil
+	return buf, serverFlags, serverExp, resHeader.CASToken, nil
+}
+
+// getQuietLocal reads one response to a pipeline of quiet get-style commands. The caller is expected
+// to have flushed the requests already. The opaque identifies which request a hit belongs to and
+// noop is true once the response to the terminating noop is read.
+func getQuietLocal(rw *bufio.ReadWriter) (opaque uint32, data []byte, flags uint32, cas uint64, noop bool, err error) {
+	resHeader, err := binprot.ReadResponseHeader(rw)
+	if err != nil {
+		return 0, nil, 0, 0, false, err
+	}
+	defer binprot.PutResponseHeader(resHeader)
+
+	if resHeader.Opcode == binprot.OpcodeNoop {
+		return resHeader.OpaqueToken, nil, 0, 0, true, nil
+	}
+
+	err = binprot.DecodeError(resHeader)
+	if err != nil {
+		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if ioerr != nil {
+			return 0, nil, 0, 0, false, ioerr
+		}
+		return resHeader.OpaqueToken, nil, 0, 0, false, err
+	}
+
+	var serverFlags uint32
+	binary.Read(rw, binary.BigEndian, &serverFlags)
+	metrics.IncCounterBy(common.MetricBytesReadLocal, 4)
+
+	// total body - key - extra
+	dataLen := resHeader.TotalBodyLength - uint32(resHeader.KeyLength) - uint32(resHeader.ExtraLength)
+	buf := make([]byte, dataLen)
+
+	// Read in value
+	n, err := io.ReadAtLeast(rw, buf, int(dataLen))
+	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+	if err != nil {
+		return 0, nil, 0, 0, false, err
+	}
+
+	return resHeader.OpaqueToken, buf, serverFlags, resHeader.CASToken, false, nil
+}
+
+func incrDecrLocal(rw *bufio.ReadWriter) (uint64, uint64, error) {
+	if err := rw.Flush(); err != nil {
+		return 0, 0, err
+	}
+
+	resHeader, err := binprot.ReadResponseHeader(rw)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer binprot.PutResponseHeader(resHeader)
+
+	err = binprot.DecodeError(resHeader)
+	if err != nil {
+		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if ioerr != nil {
+			return 0, 0, ioerr
+		}
+		return 0, 0, err
+	}
+
+	// The body is the new value as a 64 bit unsigned integer
+	var value uint64
+	if err := binary.Read(rw, binary.BigEndian, &value); err != nil {
+		return 0, 0, err
+	}
+	metrics.IncCounterBy(common.MetricBytesReadLocal, 8)
+
+	return value, resHeader.CASToken, nil
 }
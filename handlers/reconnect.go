@@ -0,0 +1,112 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricBackendConnFailures      = metrics.AddCounter("backend_conn_failures", nil)
+	MetricBackendReconnects        = metrics.AddCounter("backend_reconnects", nil)
+	MetricBackendReconnectFailures = metrics.AddCounter("backend_reconnect_failures", nil)
+)
+
+// Dialer opens a new connection to a backend
+type Dialer func() (net.Conn, error)
+
+const (
+	reconnectDelayBase = 1 * time.Millisecond
+	reconnectDelayMax  = 1 * time.Second
+)
+
+// NewReconnectingConn dials a backend and returns a DeadlineConn that can be replaced by
+// Reconnect. Unlike a plain DeadlineConn, any I/O error marks the connection as failed, not just
+// timeouts, so the request that sees it gets common.ErrTempFailure instead of an error that would
+// close the client's connection.
+func NewReconnectingConn(dial Dialer) (*DeadlineConn, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadlineConn{
+		conn: conn,
+		dial: dial,
+	}, nil
+}
+
+// Reconnect replaces the connection if it has failed. Handlers call it before each request. It
+// returns true if the connection was replaced, in which case anything buffered for the old one
+// has to be thrown away.
+//
+// A failed connection that can't be replaced returns common.ErrTempFailure. After a failed
+// attempt, the next one waits for the cube of the number of attempts in milliseconds plus some
+// jitter, up to a second, the same as the batched handler. Requests in the meantime fail right
+// away instead of waiting.
+func (c *DeadlineConn) Reconnect() (bool, error) {
+	if !c.Failed() {
+		return false, nil
+	}
+	if c.dial == nil || time.Now().Before(c.next) {
+		return false, common.ErrTempFailure
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		metrics.IncCounter(MetricBackendReconnectFailures)
+		c.attempts++
+		c.next = time.Now().Add(reconnectDelay(c.attempts))
+		return false, common.ErrTempFailure
+	}
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		conn.Close()
+		return false, common.ErrTempFailure
+	}
+	c.conn = conn
+	conn.SetDeadline(c.deadline)
+	atomic.StoreInt32(&c.failed, 0)
+	c.lock.Unlock()
+
+	metrics.IncCounter(MetricBackendReconnects)
+	c.attempts = 0
+	c.next = time.Time{}
+
+	return true, nil
+}
+
+// reconnectDelay is the time to wait after the given number of failed attempts
+func reconnectDelay(attempts int) time.Duration {
+	td := time.Duration(attempts)
+	total := reconnectDelayBase * (td * td * td)
+	if total >= reconnectDelayMax {
+		return reconnectDelayMax
+	}
+
+	total += time.Duration(rand.Int63n(int64(total)/2 + 1))
+	if total > reconnectDelayMax {
+		total = reconnectDelayMax
+	}
+	return total
+}
@@ -0,0 +1,60 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import "github.com/netflix/rend/common"
+
+// Factory creates a HandlerConst from a named handler's options. Handler packages register one
+// from init() so a server can be assembled from names in a config file:
+//
+//	func init() {
+//		handlers.Register("mine", handlers.Factory{
+//			Options: func() interface{} { return &Options{Size: 10} },
+//			New: func(opts interface{}) (handlers.HandlerConst, error) {
+//				return New(*opts.(*Options)), nil
+//			},
+//		})
+//	}
+type Factory struct {
+	// Options returns a pointer to a new options value with the defaults set. The options from
+	// the config are decoded into it before it is passed to New. Nil if there are no options.
+	Options func() interface{}
+
+	// New returns the HandlerConst for the given options, or an error if they are invalid
+	New func(opts interface{}) (HandlerConst, error)
+}
+
+var registry = common.NewRegistry("handler")
+
+// Register makes a handler available by name. It panics if the name is already registered.
+func Register(name string, f Factory) {
+	registry.Register(name, f.Options, func(opts interface{}) (interface{}, error) {
+		return f.New(opts)
+	})
+}
+
+// New returns the HandlerConst for the named handler with the given JSON options
+func New(name string, options []byte) (HandlerConst, error) {
+	h, err := registry.Build(name, options)
+	if err != nil {
+		return nil, err
+	}
+	return h.(HandlerConst), nil
+}
+
+// Registered returns the names of all registered handlers
+func Registered() []string {
+	return registry.Names()
+}
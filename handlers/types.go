@@ -14,7 +14,11 @@
 
 package handlers
 
-import "github.com/netflix/rend/common"
+import (
+	"io"
+
+	"github.com/netflix/rend/common"
+)
 
 type HandlerConst func() (Handler, error)
 
@@ -31,8 +35,60 @@ type Handler interface {
 	Prepend(cmd common.SetRequest) error
 	Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error)
 	GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error)
-	GAT(cmd common.GATRequest) (common.GetResponse, error)
+	GAT(cmd common.GATRequest) (<-chan common.GetResponse, <-chan error)
 	Delete(cmd common.DeleteRequest) error
 	Touch(cmd common.TouchRequest) error
+	Increment(cmd common.IncrDecrRequest) (uint64, error)
+	Decrement(cmd common.IncrDecrRequest) (uint64, error)
+	Flush(cmd common.FlushRequest) error
 	Close() error
 }
+
+// Pinger is implemented by handlers that can check that their backend is still there without
+// changing anything. Pools of handlers use it to find broken connections while they are idle.
+type Pinger interface {
+	Ping() error
+}
+
+// SharedCloser is implemented by handlers that share something with the other handlers from the
+// same HandlerConst, like a pool of connections to the backend. Closing a handler leaves the shared
+// part open, so it is closed by whoever stops using the HandlerConst, e.g. when an Instance stops.
+type SharedCloser interface {
+	Shared() io.Closer
+}
+
+// CasAware is implemented by handlers that can report the CAS value the backend gave an item when
+// it changed it. LastCas returns the CAS from the last successful set, add, replace, append,
+// prepend, increment, or decrement, or 0 if the backend didn't give one.
+type CasAware interface {
+	LastCas() uint64
+}
+
+// LastCas returns the CAS value from the last change made through h if it is CasAware, or 0
+func LastCas(h interface{}) uint64 {
+	if ca, ok := h.(CasAware); ok {
+		return ca.LastCas()
+	}
+	return 0
+}
+
+// FailedGet returns the channels for a get or gat that fails before it starts. The error is the
+// only thing sent.
+func FailedGet(err error) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error, 1)
+	errorOut <- err
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+// FailedGetE is the same as FailedGet for a gete
+func FailedGetE(err error) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error, 1)
+	errorOut <- err
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
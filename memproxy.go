@@ -15,24 +15,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime/debug"
-	"sync"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/netflix/rend/handlers"
-	"github.com/netflix/rend/handlers/inmem"
-	"github.com/netflix/rend/handlers/memcached"
-	"github.com/netflix/rend/handlers/memcached/batched"
+	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
-	"github.com/netflix/rend/orcas"
-	"github.com/netflix/rend/protocol"
-	"github.com/netflix/rend/protocol/binprot"
-	"github.com/netflix/rend/protocol/textprot"
 	"github.com/netflix/rend/server"
 )
 
@@ -42,33 +39,38 @@ func init() {
 		debug.SetGCPercent(100)
 	}
 
-	// Setting up signal handlers
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, os.Interrupt)
-
-	go func() {
-		<-sigs
-		panic("Keyboard Interrupt")
-	}()
-
 	// http debug and metrics endpoint
-	go http.ListenAndServe("localhost:11299", nil)
+	go serveDebug("localhost:11299")
 
 	// metrics output prefix
 	metrics.SetPrefix("rend_")
 }
 
+// serveDebug serves the http debug and metrics endpoint. During a handoff the previous process
+// still holds the port, so keep trying until it lets go.
+func serveDebug(addr string) {
+	for {
+		http.ListenAndServe(addr, nil)
+		time.Sleep(time.Second)
+	}
+}
+
 // Flags
 var (
-	chunked bool
-	l1sock  string
-	l1inmem bool
+	configFile  string
+	checkConfig bool
+
+	chunked    bool
+	l1sock     string
+	l1inmem    bool
+	l1poolSize int
 
 	l1batched bool
-	batchOpts batched.Opts
+	flagBatch batchFlags
 
-	l2enabled bool
-	l2sock    string
+	l2enabled  bool
+	l2sock     string
+	l2poolSize int
 
 	locked      bool
 	concurrency int
@@ -78,33 +80,58 @@ var (
 	batchPort       int
 	useDomainSocket bool
 	sockPath        string
+
+	disableFlush      bool
+	batchDisableFlush bool
+
+	authFile      string
+	batchAuthFile string
+
+	aclFile      string
+	batchACLFile string
+
+	tlsPort  int
+	tlsFlags tlsConfig
+
+	proxyProtocol      bool
+	batchProxyProtocol bool
+
+	maxConns      int
+	maxConnsPerIP int
+	acceptRate    float64
+	acceptBurst   int
+
+	idleTimeout    time.Duration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	requestTimeout time.Duration
+
+	drainTimeout     time.Duration
+	metricsFlushFile string
+	handoffTimeout   time.Duration
 )
 
 func init() {
+	flag.StringVar(&configFile, "config", "", "JSON file describing the listeners to run. Flags given on the command line override the matching settings in the file.")
+	flag.BoolVar(&checkConfig, "check-config", false, "Validate the configuration, including the files it refers to, and exit")
+
 	flag.BoolVar(&chunked, "chunked", false, "If --chunked is specified, the chunked handler is used for L1")
 	flag.BoolVar(&l1inmem, "l1-inmem", false, "Use the debug in-memory in-process L1 cache")
-	flag.StringVar(&l1sock, "l1-sock", "invalid.sock", "Specifies the unix socket to connect to L1")
-
-	var tempBatchSize,
-		tempBatchDelay,
-		tempBatchReadBufSize,
-		tempBatchWriteBufSize,
-		tempBatchEvalIntervalSec int
-
-	var tempBatchLoadFactorRatio,
-		tempBatchOverloadedRatio float64
+	flag.StringVar(&l1sock, "l1-sock", "invalid.sock", "Specifies the address of L1: a unix socket path, unix:///path, or tcp://host:port")
+	flag.IntVar(&l1poolSize, "l1-pool-size", 0, "Share a pool of at most this many connections to L1 between all client connections, instead of one connection per client. Only used with the memcached and chunked handlers. 0 means no pool.")
 
 	flag.BoolVar(&l1batched, "l1-batched", false, "Uses the batching handler for L1")
-	flag.IntVar(&tempBatchSize, "batch-size", 0, "The size of each batch sent to the remote server in the batched handler. Positive values only. 0 assumes default.")
-	flag.IntVar(&tempBatchDelay, "batch-delay", 0, "The max time a batch will wait to fill up (microseconds). Positive values only. 0 assumes default.")
-	flag.IntVar(&tempBatchReadBufSize, "batch-read-buf-size", 0, "The read buffer size per pooled connection (bytes). Positive values only. 0 assumes default.")
-	flag.IntVar(&tempBatchWriteBufSize, "batch-write-buf-size", 0, "The write buffer size per pooled connection (bytes). Positive values only. 0 assumes default.")
-	flag.IntVar(&tempBatchEvalIntervalSec, "batch-eval-interval", 0, "The interval between evalations of the pool size (seconds). Positive values only. 0 assumes default.")
-	flag.Float64Var(&tempBatchLoadFactorRatio, "batch-expand-load-factor-ratio", 0, "The ratio of average batch size above which the pool will expand (float). Positive values only between 0 and 1. 0 assumes default.")
-	flag.Float64Var(&tempBatchOverloadedRatio, "batch-expand-overloaded-ratio", 0, "The ratio of connections whose average size is greater than the max batch size - 1 above which the pool will expand (float). Positive values only between 0 and 1. 0 assumes default.")
+	flag.IntVar(&flagBatch.BatchSize, "batch-size", 0, "The size of each batch sent to the remote server in the batched handler. Positive values only. 0 assumes default.")
+	flag.IntVar(&flagBatch.BatchDelayMicros, "batch-delay", 0, "The max time a batch will wait to fill up (microseconds). Positive values only. 0 assumes default.")
+	flag.IntVar(&flagBatch.ReadBufSize, "batch-read-buf-size", 0, "The read buffer size per pooled connection (bytes). Positive values only. 0 assumes default.")
+	flag.IntVar(&flagBatch.WriteBufSize, "batch-write-buf-size", 0, "The write buffer size per pooled connection (bytes). Positive values only. 0 assumes default.")
+	flag.IntVar(&flagBatch.EvaluationIntervalSec, "batch-eval-interval", 0, "The interval between evalations of the pool size (seconds). Positive values only. 0 assumes default.")
+	flag.Float64Var(&flagBatch.LoadFactorExpandRatio, "batch-expand-load-factor-ratio", 0, "The ratio of average batch size above which the pool will expand (float). Positive values only between 0 and 1. 0 assumes default.")
+	flag.Float64Var(&flagBatch.OverloadedConnRatio, "batch-expand-overloaded-ratio", 0, "The ratio of connections whose average size is greater than the max batch size - 1 above which the pool will expand (float). Positive values only between 0 and 1. 0 assumes default.")
 
 	flag.BoolVar(&l2enabled, "l2-enabled", false, "Specifies if l2 is enabled")
-	flag.StringVar(&l2sock, "l2-sock", "invalid.sock", "Specifies the unix socket to connect to L2. Only used if --l2-enabled is true.")
+	flag.StringVar(&l2sock, "l2-sock", "invalid.sock", "Specifies the address of L2: a unix socket path, unix:///path, or tcp://host:port. Only used if --l2-enabled is true.")
+	flag.IntVar(&l2poolSize, "l2-pool-size", 0, "Share a pool of at most this many connections to L2 between all client connections, instead of one connection per client. 0 means no pool.")
 
 	flag.BoolVar(&locked, "locked", false, "Add locking to overall operations (above L1/L2 layers)")
 	flag.IntVar(&concurrency, "concurrency", 8, "Concurrency level. 2^(concurrency) parallel operations permitted, assuming no collisions. Large values (>16) are likely useless and will eat up RAM. Default of 8 means 256 operations (on different keys) can happen in parallel.")
@@ -115,118 +142,161 @@ func init() {
 	flag.BoolVar(&useDomainSocket, "use-domain-socket", false, "Listen on a domain socket instead of a TCP port. --port will be ignored.")
 	flag.StringVar(&sockPath, "sock-path", "/tmp/invalid.sock", "The socket path to listen on. Only valid in conjunction with --use-domain-socket.")
 
+	flag.BoolVar(&disableFlush, "disable-flush", false, "Reject flush_all on the main listener (port or domain socket)")
+	flag.BoolVar(&batchDisableFlush, "batch-disable-flush", false, "Reject flush_all on the batch port listener. Only used if --l2-enabled is true.")
+
+	flag.StringVar(&authFile, "auth-file", "", "Require SASL PLAIN authentication on the main listener using the user:password pairs in this file")
+	flag.StringVar(&batchAuthFile, "batch-auth-file", "", "Require SASL PLAIN authentication on the batch port listener using the user:password pairs in this file. Only used if --l2-enabled is true.")
+
+	flag.StringVar(&aclFile, "acl-file", "", "Restrict authenticated users on the main listener to the commands and key prefixes in this policy file. Requires --auth-file. Reloaded on SIGHUP.")
+	flag.StringVar(&batchACLFile, "batch-acl-file", "", "Restrict authenticated users on the batch port listener to the commands and key prefixes in this policy file. Requires --batch-auth-file. Reloaded on SIGHUP.")
+
+	flag.IntVar(&tlsPort, "tls-port", 0, "External port to listen on for TLS connections, served the same way as the main listener. 0 disables TLS.")
+	flag.StringVar(&tlsFlags.CertFile, "tls-cert", "", "The PEM encoded certificate for the TLS listener. Reloaded on SIGHUP.")
+	flag.StringVar(&tlsFlags.KeyFile, "tls-key", "", "The PEM encoded private key for the TLS listener. Reloaded on SIGHUP.")
+	flag.StringVar(&tlsFlags.CAFile, "tls-ca", "", "The PEM encoded CA bundle used to verify client certificates on the TLS listener. The common name of a verified client certificate is given to the orchestrator with each request; it does not replace SASL auth. Reloaded on SIGHUP.")
+	flag.BoolVar(&tlsFlags.RequireClientCert, "tls-require-client-cert", false, "Reject TLS connections without a client certificate signed by --tls-ca")
+
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", false, "Require a PROXY protocol v1 or v2 header on every connection to the main and TLS listeners and use the client address from it")
+	flag.BoolVar(&batchProxyProtocol, "batch-proxy-protocol", false, "Require a PROXY protocol v1 or v2 header on every connection to the batch port listener. Only used if --l2-enabled is true.")
+
+	flag.IntVar(&maxConns, "max-conns", 0, "The most client connections served at once across all listeners. Connections over the limit get a busy error and are closed. 0 means no limit.")
+	flag.IntVar(&maxConnsPerIP, "max-conns-per-ip", 0, "The most client connections served at once from a single IP address across all listeners. 0 means no limit.")
+	flag.Float64Var(&acceptRate, "accept-rate", 0, "The most new client connections accepted per second on average. Connections over the rate get a busy error and are closed. 0 means no limit.")
+	flag.IntVar(&acceptBurst, "accept-burst", 0, "The most new client connections accepted at once above --accept-rate. Defaults to the rate.")
+
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "How long a client connection can go without sending a request before it is closed. 0 means no timeout.")
+	flag.DurationVar(&readTimeout, "read-timeout", 0, "How long a client has to send the rest of a request once it has started sending it. 0 means no timeout.")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "How long each write of a response to a client can take before the connection is closed. 0 means no timeout.")
+	flag.DurationVar(&requestTimeout, "request-timeout", 0, "How long the memcached and chunked handlers wait for their backend on each request. Requests that take longer get a temporary failure. 0 means no timeout.")
+
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "On SIGTERM or SIGINT, how long to wait for in-flight requests to finish before closing all connections")
+	flag.StringVar(&metricsFlushFile, "metrics-flush-file", "", "File to write a final snapshot of all metrics to on shutdown. Defaults to stderr.")
+
+	flag.DurationVar(&handoffTimeout, "handoff-timeout", 30*time.Second, "On SIGUSR2, how long to wait for the new process to take over the listening sockets before giving up and continuing to serve")
+
 	flag.Parse()
 
-	// Validation
-	if tempBatchSize < 0 {
-		fmt.Println("ERROR: argument --batch-size must be >= 0")
-		os.Exit(-1)
-	}
-	if tempBatchDelay < 0 {
-		fmt.Println("ERROR: argument --batch-delay must be >= 0")
-		os.Exit(-1)
-	}
-	if tempBatchReadBufSize < 0 {
-		fmt.Println("ERROR: argument --batch-read-buf-size must be >= 0")
-		os.Exit(-1)
-	}
-	if tempBatchWriteBufSize < 0 {
-		fmt.Println("ERROR: argument --batch-write-buf-size must be >= 0")
-		os.Exit(-1)
-	}
-	if tempBatchEvalIntervalSec < 0 {
-		fmt.Println("ERROR: argument --batch-eval-interval must be >= 0")
-		os.Exit(-1)
-	}
-	if tempBatchLoadFactorRatio < 0 {
-		fmt.Println("ERROR: argument --batch-expand-load-factor-ratio must be >= 0")
-		os.Exit(-1)
-	}
-	if tempBatchOverloadedRatio < 0 {
-		fmt.Println("ERROR: argument --batch-expand-overloaded-ratio must be >= 0")
-		os.Exit(-1)
-	}
+	common.RegisterStats("settings", settingsStats)
+}
 
-	if concurrency >= 64 {
-		fmt.Println("ERROR: Concurrency cannot be more than 2^64")
-		os.Exit(-1)
-	}
+// settingsStats exposes the command line settings through "stats settings". Flag names are
+// converted to the underscore style used by memcached.
+func settingsStats() []common.Stat {
+	var ret []common.Stat
+	flag.VisitAll(func(f *flag.Flag) {
+		ret = append(ret, common.Stat{
+			Name:  strings.Replace(f.Name, "-", "_", -1),
+			Value: f.Value.String(),
+		})
+	})
+	return ret
+}
 
-	batchOpts = batched.Opts{
-		BatchSize:             uint32(tempBatchSize),
-		BatchDelayMicros:      uint32(tempBatchDelay),
-		ReadBufSize:           uint32(tempBatchReadBufSize),
-		WriteBufSize:          uint32(tempBatchWriteBufSize),
-		EvaluationIntervalSec: uint32(tempBatchEvalIntervalSec),
-		LoadFactorExpandRatio: tempBatchLoadFactorRatio,
-		OverloadedConnRatio:   tempBatchOverloadedRatio,
-	}
+// reloadOnHUP calls reload every time the process gets a SIGHUP. A failed reload is logged and
+// whatever was loaded before stays in use.
+func reloadOnHUP(what string, reload func() error) {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+
+	go func() {
+		for range hups {
+			if err := reload(); err != nil {
+				log.Printf("Error reloading %s, keeping the old one: %v", what, err)
+			} else {
+				log.Println("Reloaded", what)
+			}
+		}
+	}()
 }
 
 // And away we go
 func main() {
-	var l server.ListenConst
+	conf, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Println("ERROR:", err.Error())
+		os.Exit(-1)
+	}
 
-	if useDomainSocket {
-		l = server.UnixListener(sockPath)
-	} else {
-		l = server.TCPListener(port)
+	setups, err := conf.build()
+	if err != nil {
+		fmt.Println("ERROR:", err.Error())
+		os.Exit(-1)
 	}
 
-	protocols := []protocol.Components{binprot.Components, textprot.Components}
+	if checkConfig {
+		fmt.Printf("OK: %d listeners\n", len(setups))
+		os.Exit(0)
+	}
 
-	var o orcas.OrcaConst
-	var h2 handlers.HandlerConst
-	var h1 handlers.HandlerConst
+	server.SetLimits(conf.limits())
+	server.SetTimeouts(conf.timeouts())
 
-	// Choose the proper L1 handler
-	if l1inmem {
-		h1 = inmem.New
-	} else if chunked {
-		h1 = memcached.Chunked(l1sock)
-	} else if l1batched {
-		h1 = memcached.Batched(l1sock, batchOpts)
-	} else {
-		h1 = memcached.Regular(l1sock)
+	for _, s := range setups {
+		inst := server.NewInstance(s.l, s.protocols, s.s, s.o, s.h1, s.h2)
+		if err := inst.Start(context.Background()); err != nil {
+			fmt.Printf("ERROR: listener %s: %v\n", s.name, err)
+			os.Exit(-1)
+		}
 	}
 
-	if l2enabled {
-		o = orcas.L1L2
-		h2 = memcached.Regular(l2sock)
-	} else {
-		o = orcas.L1Only
-		h2 = handlers.NilHandler
+	drainTimeout := time.Duration(conf.DrainTimeout)
+	handoffTimeout := time.Duration(conf.HandoffTimeout)
+
+	// If this process was started by a handoff from an older one, let it know it can start draining
+	if err := server.NotifyReady(handoffTimeout); err != nil {
+		log.Println("Error taking over from the previous process:", err.Error())
+		os.Exit(-1)
 	}
 
-	// Add the locking wrapper if requested. The locking wrapper can either allow mutltiple readers
-	// or not, with the same difference in semantics between a sync.Mutex and a sync.RWMutex. If
-	// chunking is enabled, we want to ensure that stricter locking is enabled, since concurrent
-	// sets into L1 with chunking can collide and cause data corruption.
-	var lockset uint32
-	if locked {
-		if chunked || !multiReader {
-			o, lockset = orcas.Locked(o, false, uint8(concurrency))
-		} else {
-			o, lockset = orcas.Locked(o, true, uint8(concurrency))
+	// Run until told to stop, then drain connections and exit cleanly. SIGUSR2 hands the listening
+	// sockets to a new copy of this process first, so the ports never stop accepting.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt, syscall.SIGUSR2)
+
+	var sig os.Signal
+	for sig = range sigs {
+		if sig != syscall.SIGUSR2 {
+			break
 		}
+
+		log.Println("Got SIGUSR2, handing off listeners to a new process")
+		proc, err := server.Handoff(handoffTimeout)
+		if err != nil {
+			log.Println("Error handing off listeners, continuing to serve:", err.Error())
+			continue
+		}
+
+		log.Println("New process", proc.Pid, "is ready")
+		break
 	}
 
-	go server.ListenAndServe(l, protocols, server.Default, o, h1, h2)
+	log.Printf("Got %v, draining connections for up to %v", sig, drainTimeout)
+
+	if server.Shutdown(drainTimeout) {
+		log.Println("All connections drained")
+	} else {
+		log.Println("Drain timeout reached, closed remaining connections")
+	}
 
-	if l2enabled {
-		// If L2 is enabled, start the batch L1 / L2 orchestrator
-		l = server.TCPListener(batchPort)
-		o := orcas.L1L2Batch
+	flushMetrics(conf.MetricsFlushFile)
+	os.Exit(0)
+}
 
-		if locked {
-			o = orcas.LockedWithExisting(o, lockset)
-		}
+// flushMetrics writes out the final values of all metrics since they can't be scraped once the
+// process exits
+func flushMetrics(path string) {
+	if path == "" {
+		metrics.WriteMetrics(os.Stderr)
+		return
+	}
 
-		go server.ListenAndServe(l, protocols, server.Default, o, h1, h2)
+	f, err := os.Create(path)
+	if err != nil {
+		log.Println("Error creating metrics flush file:", err.Error())
+		return
 	}
+	defer f.Close()
 
-	// Block forever
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	wg.Wait()
+	metrics.WriteMetrics(f)
 }
@@ -75,13 +75,18 @@ func init() {
 }
 
 func printMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	WriteMetrics(w)
+}
+
+// WriteMetrics writes all metrics to w in the same format as the /metrics endpoint. It is meant
+// for a final flush on shutdown, after which the endpoint can't be scraped anymore.
+func WriteMetrics(w io.Writer) {
 	// prevent concurrent access to metrics. This is an assumption helpd by much of
 	// the code that retrieves the metrics for printing.
 	metricsReadLock.Lock()
 	defer metricsReadLock.Unlock()
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-
 	//////////////////////////
 	// Runtime memory stats
 	//////////////////////////
@@ -179,6 +184,30 @@ func printMetrics(w http.ResponseWriter, r *http.Request) {
 	printFloatMetrics(w, fm)
 }
 
+// Snapshot returns the current values of all counters and gauges, including callback gauges. It
+// is meant for consumers that want the application's own metrics without the runtime memory
+// statistics or histograms, e.g. the memcached stats command.
+func Snapshot() ([]IntMetric, []FloatMetric) {
+	metricsReadLock.Lock()
+	defer metricsReadLock.Unlock()
+
+	im := getAllCounters()
+
+	intg, floatg := getAllGauges()
+	im = append(im, intg...)
+	fm := floatg
+
+	intg, floatg = getAllCallbackGauges()
+	im = append(im, intg...)
+	fm = append(fm, floatg...)
+
+	intcb, floatcb := getAllBulkCallbackGauges()
+	im = append(im, intcb...)
+	fm = append(fm, floatcb...)
+
+	return im, fm
+}
+
 func makeTags(typ, dataType, statistic string) Tags {
 	ret := Tags{
 		TagMetricType: typ,
@@ -0,0 +1,320 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+// ACLClass is a class of commands a user is allowed to run. Each class includes everything in the
+// classes below it.
+type ACLClass int
+
+const (
+	// ACLReadOnly allows get and gete
+	ACLReadOnly ACLClass = iota
+	// ACLReadWrite adds all of the commands that change data or expiry, including touch and gat,
+	// since a gat with a short TTL can expire a key as surely as a delete
+	ACLReadWrite
+	// ACLAdmin adds the commands that affect the whole server, flush and stats
+	ACLAdmin
+)
+
+type aclRule struct {
+	class ACLClass
+	// a nil prefixes slice means all keys
+	prefixes [][]byte
+}
+
+func (r aclRule) allowsKey(key []byte) bool {
+	if r.prefixes == nil {
+		return true
+	}
+	for _, p := range r.prefixes {
+		if bytes.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACLPolicy holds the per-user rules for an ACL orchestrator. It is shared by all connections on
+// the listeners it is used for, and can be reloaded while they are running.
+type ACLPolicy struct {
+	path  string
+	rules atomic.Value // map[string]aclRule
+}
+
+// LoadACLPolicy reads an ACL policy file. Each line is a user name, a class (read-only,
+// read-write, or admin), and then any number of key prefixes the user is limited to. A prefix of
+// * or no prefixes at all means every key. Blank lines and lines starting with # are ignored.
+//
+//	# user   class       prefixes
+//	alice    read-write  user: session:
+//	reporter read-only   user:
+//	ops      admin       *
+func LoadACLPolicy(path string) (*ACLPolicy, error) {
+	p := &ACLPolicy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload re-reads the policy file. If the file is invalid the current rules are left in place and
+// the error is returned. Connections pick up the new rules on their next request.
+func (p *ACLPolicy) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return fmt.Errorf("Error opening ACL policy file %s: %v", p.path, err)
+	}
+	defer f.Close()
+
+	rules := make(map[string]aclRule)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("Error parsing ACL policy file %s: line %d needs a user and a class", p.path, lineNum)
+		}
+
+		var rule aclRule
+
+		switch fields[1] {
+		case "read-only":
+			rule.class = ACLReadOnly
+		case "read-write":
+			rule.class = ACLReadWrite
+		case "admin":
+			rule.class = ACLAdmin
+		default:
+			return fmt.Errorf("Error parsing ACL policy file %s: line %d has unknown class %q", p.path, lineNum, fields[1])
+		}
+
+		for _, prefix := range fields[2:] {
+			if prefix == "*" {
+				rule.prefixes = nil
+				break
+			}
+			rule.prefixes = append(rule.prefixes, []byte(prefix))
+		}
+
+		rules[fields[0]] = rule
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Error reading ACL policy file %s: %v", p.path, err)
+	}
+
+	p.rules.Store(rules)
+	metrics.IncCounter(MetricACLReloads)
+
+	return nil
+}
+
+func (p *ACLPolicy) rule(user string) (aclRule, bool) {
+	rule, ok := p.rules.Load().(map[string]aclRule)[user]
+	return rule, ok
+}
+
+// ACLOrca wraps another Orca and checks each request against the rules for the user the
+// connection authenticated as. Denied requests get common.ErrAuth and never reach the wrapped
+// Orca. A connection that has not authenticated, or whose user has no rule, is denied everything
+// except the commands that don't touch data.
+type ACLOrca struct {
+	wrapped ContextOrca
+	policy  *ACLPolicy
+	user    string
+	authed  bool
+}
+
+// ACL wraps an orcas.OrcaConst so the orchestrators it creates enforce the given policy. The user
+// is given to each orchestrator by the server through the UserAware interface, so this must be
+// the outermost wrapper for the server to find it.
+func ACL(oc OrcaConst, policy *ACLPolicy) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return WithoutContext(&ACLOrca{
+			wrapped: WithContext(oc(l1, l2, res)),
+			policy:  policy,
+		})
+	}
+}
+
+// SetUser implements UserAware
+func (a *ACLOrca) SetUser(user string) {
+	a.user = user
+	a.authed = user != ""
+}
+
+func (a *ACLOrca) allowed(class ACLClass, keys ...[]byte) bool {
+	if !a.authed {
+		metrics.IncCounter(MetricACLDenied)
+		return false
+	}
+
+	rule, ok := a.policy.rule(a.user)
+	if !ok || rule.class < class {
+		metrics.IncCounter(MetricACLDenied)
+		return false
+	}
+
+	for _, key := range keys {
+		if !rule.allowsKey(key) {
+			metrics.IncCounter(MetricACLDenied)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (a *ACLOrca) Set(ctx context.Context, req common.SetRequest) error {
+	if !a.allowed(ACLReadWrite, req.Key) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Set(ctx, req)
+}
+
+func (a *ACLOrca) Add(ctx context.Context, req common.SetRequest) error {
+	if !a.allowed(ACLReadWrite, req.Key) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Add(ctx, req)
+}
+
+func (a *ACLOrca) Replace(ctx context.Context, req common.SetRequest) error {
+	if !a.allowed(ACLReadWrite, req.Key) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Replace(ctx, req)
+}
+
+func (a *ACLOrca) Append(ctx context.Context, req common.SetRequest) error {
+	if !a.allowed(ACLReadWrite, req.Key) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Append(ctx, req)
+}
+
+func (a *ACLOrca) Prepend(ctx context.Context, req common.SetRequest) error {
+	if !a.allowed(ACLReadWrite, req.Key) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Prepend(ctx, req)
+}
+
+func (a *ACLOrca) Delete(ctx context.Context, req common.DeleteRequest) error {
+	if !a.allowed(ACLReadWrite, req.Key) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Delete(ctx, req)
+}
+
+func (a *ACLOrca) Touch(ctx context.Context, req common.TouchRequest) error {
+	if !a.allowed(ACLReadWrite, req.Key) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Touch(ctx, req)
+}
+
+func (a *ACLOrca) Increment(ctx context.Context, req common.IncrDecrRequest) error {
+	if !a.allowed(ACLReadWrite, req.Key) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Increment(ctx, req)
+}
+
+func (a *ACLOrca) Decrement(ctx context.Context, req common.IncrDecrRequest) error {
+	if !a.allowed(ACLReadWrite, req.Key) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Decrement(ctx, req)
+}
+
+func (a *ACLOrca) Flush(ctx context.Context, req common.FlushRequest) error {
+	if !a.allowed(ACLAdmin) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Flush(ctx, req)
+}
+
+func (a *ACLOrca) Stats(ctx context.Context, req common.StatsRequest) error {
+	if !a.allowed(ACLAdmin) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Stats(ctx, req)
+}
+
+// A batch get is denied as a whole if any one of its keys is denied
+func (a *ACLOrca) Get(ctx context.Context, req common.GetRequest) error {
+	if !a.allowed(ACLReadOnly, req.Keys...) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Get(ctx, req)
+}
+
+func (a *ACLOrca) GetE(ctx context.Context, req common.GetRequest) error {
+	if !a.allowed(ACLReadOnly, req.Keys...) {
+		return common.ErrAuth
+	}
+	return a.wrapped.GetE(ctx, req)
+}
+
+func (a *ACLOrca) Gat(ctx context.Context, req common.GATRequest) error {
+	if !a.allowed(ACLReadWrite, req.Keys...) {
+		return common.ErrAuth
+	}
+	return a.wrapped.Gat(ctx, req)
+}
+
+func (a *ACLOrca) Noop(ctx context.Context, req common.NoopRequest) error {
+	return a.wrapped.Noop(ctx, req)
+}
+
+func (a *ACLOrca) Quit(ctx context.Context, req common.QuitRequest) error {
+	return a.wrapped.Quit(ctx, req)
+}
+
+func (a *ACLOrca) Version(ctx context.Context, req common.VersionRequest) error {
+	return a.wrapped.Version(ctx, req)
+}
+
+func (a *ACLOrca) Unknown(ctx context.Context, req common.Request) error {
+	return a.wrapped.Unknown(ctx, req)
+}
+
+func (a *ACLOrca) Error(ctx context.Context, req common.Request, reqType common.RequestType, err error) {
+	a.wrapped.Error(ctx, req, reqType, err)
+}
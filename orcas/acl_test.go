@@ -0,0 +1,193 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+// testCountingOrca counts the requests that make it through to it. Anything not overridden here
+// panics through the nil embedded Orca.
+type testCountingOrca struct {
+	orcas.Orca
+	calls int
+}
+
+func (t *testCountingOrca) Set(req common.SetRequest) error     { t.calls++; return nil }
+func (t *testCountingOrca) Get(req common.GetRequest) error     { t.calls++; return nil }
+func (t *testCountingOrca) Gat(req common.GATRequest) error     { t.calls++; return nil }
+func (t *testCountingOrca) Flush(req common.FlushRequest) error { t.calls++; return nil }
+func (t *testCountingOrca) Version(req common.VersionRequest) error {
+	t.calls++
+	return nil
+}
+
+func writeTestPolicy(t *testing.T, f *os.File, policy string) {
+	if err := f.Truncate(0); err != nil {
+		t.Fatalf("Error truncating policy file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte(policy), 0); err != nil {
+		t.Fatalf("Error writing policy file: %v", err)
+	}
+}
+
+func newTestACL(t *testing.T, policy string) (*os.File, *orcas.ACLPolicy) {
+	f, err := ioutil.TempFile("", "rend-acl")
+	if err != nil {
+		t.Fatalf("Error creating policy file: %v", err)
+	}
+
+	writeTestPolicy(t, f, policy)
+
+	p, err := orcas.LoadACLPolicy(f.Name())
+	if err != nil {
+		t.Fatalf("Error loading policy: %v", err)
+	}
+
+	return f, p
+}
+
+func newTestACLOrca(p *orcas.ACLPolicy, user string) (orcas.Orca, *testCountingOrca) {
+	inner := &testCountingOrca{}
+	oc := orcas.ACL(func(l1, l2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		return inner
+	}, p)
+
+	o := oc(nil, nil, nil)
+	o.(orcas.UserAware).SetUser(user)
+
+	return o, inner
+}
+
+func TestACL(t *testing.T) {
+	f, p := newTestACL(t, `
+# user   class       prefixes
+writer   read-write  foo: bar:
+reader   read-only   foo:
+ops      admin       *
+`)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	set := func(key string) common.SetRequest { return common.SetRequest{Key: []byte(key)} }
+	get := func(keys ...string) common.GetRequest {
+		req := common.GetRequest{}
+		for _, k := range keys {
+			req.Keys = append(req.Keys, []byte(k))
+		}
+		return req
+	}
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		o, inner := newTestACLOrca(p, "")
+
+		if err := o.Get(get("foo:1")); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth, got %v", err)
+		}
+		if err := o.Version(common.VersionRequest{}); err != nil {
+			t.Fatalf("Expected version to be allowed, got %v", err)
+		}
+		if inner.calls != 1 {
+			t.Fatalf("Expected 1 call to reach the wrapped orca, got %d", inner.calls)
+		}
+	})
+	t.Run("UnknownUser", func(t *testing.T) {
+		o, inner := newTestACLOrca(p, "mallory")
+
+		if err := o.Get(get("foo:1")); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth, got %v", err)
+		}
+		if inner.calls != 0 {
+			t.Fatalf("Expected no calls to reach the wrapped orca, got %d", inner.calls)
+		}
+	})
+	t.Run("ReadOnlyCannotWrite", func(t *testing.T) {
+		o, inner := newTestACLOrca(p, "reader")
+
+		if err := o.Get(get("foo:1")); err != nil {
+			t.Fatalf("Expected get to be allowed, got %v", err)
+		}
+		if err := o.Set(set("foo:1")); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth, got %v", err)
+		}
+		// gat changes the expiry, so it's a write
+		gat := common.GATRequest{Keys: [][]byte{[]byte("foo:1")}}
+		if err := o.Gat(gat); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth for gat, got %v", err)
+		}
+		if inner.calls != 1 {
+			t.Fatalf("Expected 1 call to reach the wrapped orca, got %d", inner.calls)
+		}
+	})
+	t.Run("PrefixMismatch", func(t *testing.T) {
+		o, inner := newTestACLOrca(p, "writer")
+
+		if err := o.Set(set("bar:1")); err != nil {
+			t.Fatalf("Expected set to be allowed, got %v", err)
+		}
+		if err := o.Gat(common.GATRequest{Keys: [][]byte{[]byte("bar:1")}}); err != nil {
+			t.Fatalf("Expected gat to be allowed, got %v", err)
+		}
+		if err := o.Set(set("baz:1")); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth, got %v", err)
+		}
+		if err := o.Get(get("foo:1", "baz:1")); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth for a batch with one denied key, got %v", err)
+		}
+		if inner.calls != 2 {
+			t.Fatalf("Expected 2 calls to reach the wrapped orca, got %d", inner.calls)
+		}
+	})
+	t.Run("AdminOnlyFlush", func(t *testing.T) {
+		o, _ := newTestACLOrca(p, "writer")
+		if err := o.Flush(common.FlushRequest{}); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth, got %v", err)
+		}
+
+		o, inner := newTestACLOrca(p, "ops")
+		if err := o.Flush(common.FlushRequest{}); err != nil {
+			t.Fatalf("Expected flush to be allowed, got %v", err)
+		}
+		if inner.calls != 1 {
+			t.Fatalf("Expected 1 call to reach the wrapped orca, got %d", inner.calls)
+		}
+	})
+	t.Run("Reload", func(t *testing.T) {
+		o, _ := newTestACLOrca(p, "reader")
+
+		writeTestPolicy(t, f, "reader read-write foo:\n")
+		if err := p.Reload(); err != nil {
+			t.Fatalf("Error reloading policy: %v", err)
+		}
+		if err := o.Set(set("foo:1")); err != nil {
+			t.Fatalf("Expected set to be allowed after reload, got %v", err)
+		}
+
+		writeTestPolicy(t, f, "reader bogus-class foo:\n")
+		if err := p.Reload(); err == nil {
+			t.Fatalf("Expected an error reloading an invalid policy")
+		}
+		if err := o.Set(set("foo:1")); err != nil {
+			t.Fatalf("Expected the old policy to be kept after a failed reload, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,302 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// ContextOrca is the context-aware version of Orca. Each call is given the context of the request,
+// which carries the request's deadline, the user and address of the client, and is canceled if the
+// client hangs up. The orchestrators in this package are all ContextOrcas underneath and pass the
+// context on to their handlers.
+type ContextOrca interface {
+	Set(ctx context.Context, req common.SetRequest) error
+	Add(ctx context.Context, req common.SetRequest) error
+	Replace(ctx context.Context, req common.SetRequest) error
+	Append(ctx context.Context, req common.SetRequest) error
+	Prepend(ctx context.Context, req common.SetRequest) error
+	Delete(ctx context.Context, req common.DeleteRequest) error
+	Touch(ctx context.Context, req common.TouchRequest) error
+	Increment(ctx context.Context, req common.IncrDecrRequest) error
+	Decrement(ctx context.Context, req common.IncrDecrRequest) error
+	Flush(ctx context.Context, req common.FlushRequest) error
+	Stats(ctx context.Context, req common.StatsRequest) error
+	Get(ctx context.Context, req common.GetRequest) error
+	GetE(ctx context.Context, req common.GetRequest) error
+	Gat(ctx context.Context, req common.GATRequest) error
+	Noop(ctx context.Context, req common.NoopRequest) error
+	Quit(ctx context.Context, req common.QuitRequest) error
+	Version(ctx context.Context, req common.VersionRequest) error
+	Unknown(ctx context.Context, req common.Request) error
+	Error(ctx context.Context, req common.Request, reqType common.RequestType, err error)
+}
+
+// WithContext returns a ContextOrca for an Orca. If the Orca came from WithoutContext, which is
+// the case for every OrcaConst in this package, the original ContextOrca is returned. Otherwise
+// the Orca is adapted so a request whose context is already done returns the error from
+// common.ContextErr without reaching the Orca. UserAware and RemoteAddrAware are passed through.
+func WithContext(o Orca) ContextOrca {
+	if nc, ok := o.(noContextOrca); ok {
+		return nc.co
+	}
+	return contextOrca{o: o}
+}
+
+// WithoutContext returns an Orca for a ContextOrca, which is needed to return it from an
+// OrcaConst. Every call is made with context.Background(). UserAware and RemoteAddrAware are
+// passed through.
+func WithoutContext(co ContextOrca) Orca {
+	if c, ok := co.(contextOrca); ok {
+		return c.o
+	}
+	return noContextOrca{co: co}
+}
+
+// reconcileTimeout bounds the L1 half of a write that L2 has already accepted
+const reconcileTimeout = time.Second
+
+// reconcileContext returns the context used to bring L1 in line with a change that L2 has already
+// accepted. It is detached from the request context on purpose: once L2 has the change, a client
+// hanging up or the request deadline passing must not stop L1 from being updated or invalidated,
+// or L1 would keep serving the old value.
+func reconcileContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), reconcileTimeout)
+}
+
+// setUser and setRemoteAddr pass the optional interfaces through the adapters
+func setUser(o interface{}, user string) {
+	if ua, ok := o.(UserAware); ok {
+		ua.SetUser(user)
+	}
+}
+
+func setRemoteAddr(o interface{}, addr net.Addr) {
+	if ra, ok := o.(RemoteAddrAware); ok {
+		ra.SetRemoteAddr(addr)
+	}
+}
+
+type contextOrca struct {
+	o Orca
+}
+
+func (c contextOrca) SetUser(user string)         { setUser(c.o, user) }
+func (c contextOrca) SetRemoteAddr(addr net.Addr) { setRemoteAddr(c.o, addr) }
+
+func (c contextOrca) Set(ctx context.Context, req common.SetRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Set(req)
+}
+
+func (c contextOrca) Add(ctx context.Context, req common.SetRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Add(req)
+}
+
+func (c contextOrca) Replace(ctx context.Context, req common.SetRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Replace(req)
+}
+
+func (c contextOrca) Append(ctx context.Context, req common.SetRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Append(req)
+}
+
+func (c contextOrca) Prepend(ctx context.Context, req common.SetRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Prepend(req)
+}
+
+func (c contextOrca) Delete(ctx context.Context, req common.DeleteRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Delete(req)
+}
+
+func (c contextOrca) Touch(ctx context.Context, req common.TouchRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Touch(req)
+}
+
+func (c contextOrca) Increment(ctx context.Context, req common.IncrDecrRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Increment(req)
+}
+
+func (c contextOrca) Decrement(ctx context.Context, req common.IncrDecrRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Decrement(req)
+}
+
+func (c contextOrca) Flush(ctx context.Context, req common.FlushRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Flush(req)
+}
+
+func (c contextOrca) Stats(ctx context.Context, req common.StatsRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Stats(req)
+}
+
+func (c contextOrca) Get(ctx context.Context, req common.GetRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Get(req)
+}
+
+func (c contextOrca) GetE(ctx context.Context, req common.GetRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.GetE(req)
+}
+
+func (c contextOrca) Gat(ctx context.Context, req common.GATRequest) error {
+	if err := common.ContextErr(ctx); err != nil {
+		return err
+	}
+	return c.o.Gat(req)
+}
+
+func (c contextOrca) Noop(ctx context.Context, req common.NoopRequest) error {
+	return c.o.Noop(req)
+}
+
+func (c contextOrca) Quit(ctx context.Context, req common.QuitRequest) error {
+	return c.o.Quit(req)
+}
+
+func (c contextOrca) Version(ctx context.Context, req common.VersionRequest) error {
+	return c.o.Version(req)
+}
+
+func (c contextOrca) Unknown(ctx context.Context, req common.Request) error {
+	return c.o.Unknown(req)
+}
+
+func (c contextOrca) Error(ctx context.Context, req common.Request, reqType common.RequestType, err error) {
+	c.o.Error(req, reqType, err)
+}
+
+type noContextOrca struct {
+	co ContextOrca
+}
+
+func (n noContextOrca) SetUser(user string)         { setUser(n.co, user) }
+func (n noContextOrca) SetRemoteAddr(addr net.Addr) { setRemoteAddr(n.co, addr) }
+
+func (n noContextOrca) Set(req common.SetRequest) error {
+	return n.co.Set(context.Background(), req)
+}
+
+func (n noContextOrca) Add(req common.SetRequest) error {
+	return n.co.Add(context.Background(), req)
+}
+
+func (n noContextOrca) Replace(req common.SetRequest) error {
+	return n.co.Replace(context.Background(), req)
+}
+
+func (n noContextOrca) Append(req common.SetRequest) error {
+	return n.co.Append(context.Background(), req)
+}
+
+func (n noContextOrca) Prepend(req common.SetRequest) error {
+	return n.co.Prepend(context.Background(), req)
+}
+
+func (n noContextOrca) Delete(req common.DeleteRequest) error {
+	return n.co.Delete(context.Background(), req)
+}
+
+func (n noContextOrca) Touch(req common.TouchRequest) error {
+	return n.co.Touch(context.Background(), req)
+}
+
+func (n noContextOrca) Increment(req common.IncrDecrRequest) error {
+	return n.co.Increment(context.Background(), req)
+}
+
+func (n noContextOrca) Decrement(req common.IncrDecrRequest) error {
+	return n.co.Decrement(context.Background(), req)
+}
+
+func (n noContextOrca) Flush(req common.FlushRequest) error {
+	return n.co.Flush(context.Background(), req)
+}
+
+func (n noContextOrca) Stats(req common.StatsRequest) error {
+	return n.co.Stats(context.Background(), req)
+}
+
+func (n noContextOrca) Get(req common.GetRequest) error {
+	return n.co.Get(context.Background(), req)
+}
+
+func (n noContextOrca) GetE(req common.GetRequest) error {
+	return n.co.GetE(context.Background(), req)
+}
+
+func (n noContextOrca) Gat(req common.GATRequest) error {
+	return n.co.Gat(context.Background(), req)
+}
+
+func (n noContextOrca) Noop(req common.NoopRequest) error {
+	return n.co.Noop(context.Background(), req)
+}
+
+func (n noContextOrca) Quit(req common.QuitRequest) error {
+	return n.co.Quit(context.Background(), req)
+}
+
+func (n noContextOrca) Version(req common.VersionRequest) error {
+	return n.co.Version(context.Background(), req)
+}
+
+func (n noContextOrca) Unknown(req common.Request) error {
+	return n.co.Unknown(context.Background(), req)
+}
+
+func (n noContextOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	n.co.Error(context.Background(), req, reqType, err)
+}
@@ -0,0 +1,48 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+// FlushDisabledOrca wraps another Orca and rejects all flush requests with
+// common.ErrNotSupported before they reach any backend. All other requests are
+// passed through unchanged.
+type FlushDisabledOrca struct {
+	ContextOrca
+}
+
+// FlushDisabled wraps an orcas.OrcaConst so the orchestrators it creates will
+// refuse flush requests. Since each listener is given its own OrcaConst, this
+// allows flushing to be turned off per listener, e.g. on a port that is exposed
+// to clients while keeping it available on an administrative one.
+func FlushDisabled(oc OrcaConst) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return WithoutContext(FlushDisabledOrca{
+			ContextOrca: WithContext(oc(l1, l2, res)),
+		})
+	}
+}
+
+func (f FlushDisabledOrca) Flush(ctx context.Context, req common.FlushRequest) error {
+	metrics.IncCounter(MetricCmdFlushRejected)
+	return common.ErrNotSupported
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+	"log"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
+)
+
+// incrDecrMetrics are the metrics for one of increment or decrement
+type incrDecrMetrics struct {
+	l2, hitsL2, missesL2, errorsL2                         uint32
+	hits, misses, errors                                   uint32
+	deleteL1, deleteHitsL1, deleteMissesL1, deleteErrorsL1 uint32
+	histL2                                                 uint32
+}
+
+var (
+	incrMetrics = incrDecrMetrics{
+		l2:             MetricCmdIncrL2,
+		hitsL2:         MetricCmdIncrHitsL2,
+		missesL2:       MetricCmdIncrMissesL2,
+		errorsL2:       MetricCmdIncrErrorsL2,
+		hits:           MetricCmdIncrHits,
+		misses:         MetricCmdIncrMisses,
+		errors:         MetricCmdIncrErrors,
+		deleteL1:       MetricCmdIncrDeleteL1,
+		deleteHitsL1:   MetricCmdIncrDeleteHitsL1,
+		deleteMissesL1: MetricCmdIncrDeleteMissesL1,
+		deleteErrorsL1: MetricCmdIncrDeleteErrorsL1,
+		histL2:         HistIncrL2,
+	}
+	decrMetrics = incrDecrMetrics{
+		l2:             MetricCmdDecrL2,
+		hitsL2:         MetricCmdDecrHitsL2,
+		missesL2:       MetricCmdDecrMissesL2,
+		errorsL2:       MetricCmdDecrErrorsL2,
+		hits:           MetricCmdDecrHits,
+		misses:         MetricCmdDecrMisses,
+		errors:         MetricCmdDecrErrors,
+		deleteL1:       MetricCmdDecrDeleteL1,
+		deleteHitsL1:   MetricCmdDecrDeleteHitsL1,
+		deleteMissesL1: MetricCmdDecrDeleteMissesL1,
+		deleteErrorsL1: MetricCmdDecrDeleteErrorsL1,
+		histL2:         HistDecrL2,
+	}
+)
+
+// incrDecrL1L2 performs an increment or decrement for the orchestrators that have both an L1 and
+// an L2.
+//
+// L2 holds the authoritative value for counters, so the increment (or the creation of the initial
+// value) is done there first. Rather than trying to keep two counters in sync, L1 is invalidated
+// afterward and will be repopulated from L2 on the next read. There is a small window where a
+// concurrent get can read the old value from L1; the locking wrapper closes it if that matters for
+// the deployment.
+//
+// Once L2 has applied the delta the request has succeeded. Failing it because L1 couldn't be
+// invalidated would make a client that retries apply the delta twice, so that failure is only
+// logged and counted, the same as a failed L1 set after a set.
+func incrDecrL1L2(ctx context.Context, l1, l2 handlers.ContextHandler, res protocol.Responder, reqType common.RequestType, req common.IncrDecrRequest) error {
+	m := incrMetrics
+	apply := l2.Increment
+	if reqType == common.RequestDecrement {
+		m = decrMetrics
+		apply = l2.Decrement
+	}
+
+	metrics.IncCounter(m.l2)
+	start := timer.Now()
+
+	val, err := apply(ctx, req)
+
+	metrics.ObserveHist(m.histL2, timer.Since(start))
+
+	if err != nil {
+		// A miss in L2 means the item does not exist (and was not created) so
+		// there's nothing to do in L1.
+		if err == common.ErrKeyNotFound {
+			metrics.IncCounter(m.missesL2)
+			metrics.IncCounter(m.misses)
+			return err
+		}
+
+		metrics.IncCounter(m.errorsL2)
+		metrics.IncCounter(m.errors)
+		return err
+	}
+	metrics.IncCounter(m.hitsL2)
+
+	// Invalidate L1 so the next read pulls the new value from L2.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
+	metrics.IncCounter(m.deleteL1)
+	start = timer.Now()
+
+	err = l1.Delete(l1ctx, common.DeleteRequest{
+		Key:    req.Key,
+		Opaque: req.Opaque,
+	})
+
+	metrics.ObserveHist(HistDeleteL1, timer.Since(start))
+
+	switch err {
+	case nil:
+		metrics.IncCounter(m.deleteHitsL1)
+	case common.ErrKeyNotFound:
+		// The item not being in L1 is the expected case for most counters
+		metrics.IncCounter(m.deleteMissesL1)
+	default:
+		// L1 may hold a stale value until it expires or is overwritten
+		metrics.IncCounter(m.deleteErrorsL1)
+		log.Printf("[WARN] Could not invalidate %q in L1 after changing it in L2: %v\n", req.Key, err)
+	}
+
+	metrics.IncCounter(m.hits)
+	return respondIncrDecr(res, l2, reqType, req, val)
+}
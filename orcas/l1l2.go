@@ -15,6 +15,7 @@
 package orcas
 
 import (
+	"context"
 	"log"
 
 	"github.com/netflix/rend/common"
@@ -25,27 +26,27 @@ import (
 )
 
 type L1L2Orca struct {
-	l1  handlers.Handler
-	l2  handlers.Handler
+	l1  handlers.ContextHandler
+	l2  handlers.ContextHandler
 	res protocol.Responder
 }
 
 func L1L2(l1, l2 handlers.Handler, res protocol.Responder) Orca {
-	return &L1L2Orca{
-		l1:  l1,
-		l2:  l2,
+	return WithoutContext(&L1L2Orca{
+		l1:  handlers.WithContext(l1),
+		l2:  handlers.WithContext(l2),
 		res: res,
-	}
+	})
 }
 
-func (l *L1L2Orca) Set(req common.SetRequest) error {
+func (l *L1L2Orca) Set(ctx context.Context, req common.SetRequest) error {
 	//log.Println("set", string(req.Key))
 
 	// Try L2 first
 	metrics.IncCounter(MetricCmdSetL2)
 	start := timer.Now()
 
-	err := l.l2.Set(req)
+	err := l.l2.Set(ctx, req)
 
 	metrics.ObserveHist(HistSetL2, timer.Since(start))
 
@@ -71,10 +72,15 @@ func (l *L1L2Orca) Set(req common.SetRequest) error {
 	// and that the client will reconnect to try again. The one exception is when
 	// the server is so busy that it cannot clear enough memory for the data to
 	// be stored, in which case the delete may work just fine.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdSetL1)
 	start = timer.Now()
 
-	err = l.l1.Set(req)
+	// CAS values come from L2 and are never valid in L1
+	req.Cas = 0
+	err = l.l1.Set(l1ctx, req)
 
 	metrics.ObserveHist(HistSetL1, timer.Since(start))
 
@@ -94,7 +100,7 @@ func (l *L1L2Orca) Set(req common.SetRequest) error {
 		}
 
 		start = timer.Now()
-		err = l.l1.Delete(dcmd)
+		err = l.l1.Delete(l1ctx, dcmd)
 		metrics.ObserveHist(HistDeleteL1, timer.Since(start))
 
 		if err == common.ErrKeyNotFound {
@@ -109,17 +115,17 @@ func (l *L1L2Orca) Set(req common.SetRequest) error {
 	metrics.IncCounter(MetricCmdSetSuccessL1)
 	metrics.IncCounter(MetricCmdSetSuccess)
 
-	return l.res.Set(req.Opaque, req.Quiet)
+	return respondStored(l.res, l.l2, common.RequestSet, req)
 }
 
-func (l *L1L2Orca) Add(req common.SetRequest) error {
+func (l *L1L2Orca) Add(ctx context.Context, req common.SetRequest) error {
 	//log.Println("add", string(req.Key))
 
 	// Add in L2 first, since it has the larger state
 	metrics.IncCounter(MetricCmdAddL2)
 	start := timer.Now()
 
-	err := l.l2.Add(req)
+	err := l.l2.Add(ctx, req)
 
 	metrics.ObserveHist(HistAddL2, timer.Since(start))
 
@@ -150,10 +156,14 @@ func (l *L1L2Orca) Add(req common.SetRequest) error {
 	// inconsistent state. A concurrent delete could hit in L2 and miss in
 	// L1 between the two add operations, causing the L2 to be deleted and
 	// the L1 to have the data.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdAddL1)
 	start = timer.Now()
 
-	err = l.l1.Add(req)
+	req.Cas = 0
+	err = l.l1.Add(l1ctx, req)
 
 	metrics.ObserveHist(HistAddL1, timer.Since(start))
 
@@ -182,17 +192,17 @@ func (l *L1L2Orca) Add(req common.SetRequest) error {
 	metrics.IncCounter(MetricCmdAddStoredL1)
 	metrics.IncCounter(MetricCmdAddStored)
 
-	return l.res.Add(req.Opaque, req.Quiet)
+	return respondStored(l.res, l.l2, common.RequestAdd, req)
 }
 
-func (l *L1L2Orca) Replace(req common.SetRequest) error {
+func (l *L1L2Orca) Replace(ctx context.Context, req common.SetRequest) error {
 	//log.Println("replace", string(req.Key))
 
 	// Replace in L2 first, since it has the larger state
 	metrics.IncCounter(MetricCmdReplaceL2)
 	start := timer.Now()
 
-	err := l.l2.Replace(req)
+	err := l.l2.Replace(ctx, req)
 
 	metrics.ObserveHist(HistReplaceL2, timer.Since(start))
 
@@ -231,10 +241,14 @@ func (l *L1L2Orca) Replace(req common.SetRequest) error {
 	//
 	// The other risk here is a concurrent replace for the same key, which will
 	// possibly interleave to produce inconsistency in L2 and L1.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdReplaceL1)
 	start = timer.Now()
 
-	err = l.l1.Replace(req)
+	req.Cas = 0
+	err = l.l1.Replace(l1ctx, req)
 
 	metrics.ObserveHist(HistReplaceL1, timer.Since(start))
 
@@ -246,7 +260,7 @@ func (l *L1L2Orca) Replace(req common.SetRequest) error {
 		if err == common.ErrKeyNotFound {
 			metrics.IncCounter(MetricCmdReplaceNotStoredL1)
 			metrics.IncCounter(MetricCmdReplaceNotStored)
-			return l.res.Replace(req.Opaque, req.Quiet)
+			return respondStored(l.res, l.l2, common.RequestReplace, req)
 		}
 
 		// otherwise we have a real error on our hands
@@ -258,10 +272,10 @@ func (l *L1L2Orca) Replace(req common.SetRequest) error {
 	metrics.IncCounter(MetricCmdReplaceStoredL1)
 	metrics.IncCounter(MetricCmdReplaceStored)
 
-	return l.res.Replace(req.Opaque, req.Quiet)
+	return respondStored(l.res, l.l2, common.RequestReplace, req)
 }
 
-func (l *L1L2Orca) Append(req common.SetRequest) error {
+func (l *L1L2Orca) Append(ctx context.Context, req common.SetRequest) error {
 	//log.Println("append", string(req.Key))
 
 	// Ordering of append and prepend operations won't matter much unless
@@ -278,7 +292,7 @@ func (l *L1L2Orca) Append(req common.SetRequest) error {
 	metrics.IncCounter(MetricCmdAppendL2)
 	start := timer.Now()
 
-	err := l.l2.Append(req)
+	err := l.l2.Append(ctx, req)
 
 	metrics.ObserveHist(HistAppendL2, timer.Since(start))
 
@@ -301,10 +315,14 @@ func (l *L1L2Orca) Append(req common.SetRequest) error {
 	// there's an error, we need to fail because we're not in an unknown state
 	// where L1 possibly doesn't have the append when L2 does. We don't recover
 	// from this but instead fail the request and let the client retry.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdAppendL1)
 	start = timer.Now()
 
-	err = l.l1.Append(req)
+	req.Cas = 0
+	err = l.l1.Append(l1ctx, req)
 
 	metrics.ObserveHist(HistAppendL1, timer.Since(start))
 
@@ -316,7 +334,7 @@ func (l *L1L2Orca) Append(req common.SetRequest) error {
 		if err == common.ErrItemNotStored || err == common.ErrKeyNotFound {
 			metrics.IncCounter(MetricCmdAppendNotStoredL1)
 			metrics.IncCounter(MetricCmdAppendStored)
-			return l.res.Append(req.Opaque, req.Quiet)
+			return respondStored(l.res, l.l2, common.RequestAppend, req)
 		}
 
 		metrics.IncCounter(MetricCmdAppendErrorsL1)
@@ -326,16 +344,16 @@ func (l *L1L2Orca) Append(req common.SetRequest) error {
 
 	metrics.IncCounter(MetricCmdAppendStoredL1)
 	metrics.IncCounter(MetricCmdAppendStored)
-	return l.res.Append(req.Opaque, req.Quiet)
+	return respondStored(l.res, l.l2, common.RequestAppend, req)
 }
 
-func (l *L1L2Orca) Prepend(req common.SetRequest) error {
+func (l *L1L2Orca) Prepend(ctx context.Context, req common.SetRequest) error {
 	//log.Println("prepend", string(req.Key))
 
 	metrics.IncCounter(MetricCmdPrependL2)
 	start := timer.Now()
 
-	err := l.l2.Prepend(req)
+	err := l.l2.Prepend(ctx, req)
 
 	metrics.ObserveHist(HistPrependL2, timer.Since(start))
 
@@ -358,10 +376,14 @@ func (l *L1L2Orca) Prepend(req common.SetRequest) error {
 	// there's an error, we need to fail because we're not in an unknown state
 	// where L1 possibly doesn't have the Prepend when L2 does. We don't recover
 	// from this but instead fail the request and let the client retry.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdPrependL1)
 	start = timer.Now()
 
-	err = l.l1.Prepend(req)
+	req.Cas = 0
+	err = l.l1.Prepend(l1ctx, req)
 
 	metrics.ObserveHist(HistPrependL1, timer.Since(start))
 
@@ -373,7 +395,7 @@ func (l *L1L2Orca) Prepend(req common.SetRequest) error {
 		if err == common.ErrItemNotStored || err == common.ErrKeyNotFound {
 			metrics.IncCounter(MetricCmdPrependNotStoredL1)
 			metrics.IncCounter(MetricCmdPrependStored)
-			return l.res.Prepend(req.Opaque, req.Quiet)
+			return respondStored(l.res, l.l2, common.RequestPrepend, req)
 		}
 
 		metrics.IncCounter(MetricCmdPrependErrorsL1)
@@ -383,17 +405,17 @@ func (l *L1L2Orca) Prepend(req common.SetRequest) error {
 
 	metrics.IncCounter(MetricCmdPrependStoredL1)
 	metrics.IncCounter(MetricCmdPrependStored)
-	return l.res.Prepend(req.Opaque, req.Quiet)
+	return respondStored(l.res, l.l2, common.RequestPrepend, req)
 }
 
-func (l *L1L2Orca) Delete(req common.DeleteRequest) error {
+func (l *L1L2Orca) Delete(ctx context.Context, req common.DeleteRequest) error {
 	//log.Println("delete", string(req.Key))
 
 	// Try L2 first
 	metrics.IncCounter(MetricCmdDeleteL2)
 	start := timer.Now()
 
-	err := l.l2.Delete(req)
+	err := l.l2.Delete(ctx, req)
 
 	metrics.ObserveHist(HistDeleteL2, timer.Since(start))
 
@@ -424,10 +446,13 @@ func (l *L1L2Orca) Delete(req common.DeleteRequest) error {
 	// eliminated the interleaving where the data is deleted from L1, read from
 	// L2, set in L1, then deleted in L2. By deleting from L2 first, if L1 goes
 	// missing then no other request can undo part of this request.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdDeleteL1)
 	start = timer.Now()
 
-	err = l.l1.Delete(req)
+	err = l.l1.Delete(l1ctx, req)
 
 	metrics.ObserveHist(HistDeleteL1, timer.Since(start))
 
@@ -440,7 +465,7 @@ func (l *L1L2Orca) Delete(req common.DeleteRequest) error {
 			metrics.IncCounter(MetricCmdDeleteMissesL1)
 			metrics.IncCounter(MetricCmdDeleteHits)
 			// disregard the miss, don't return the error
-			return l.res.Delete(req.Opaque)
+			return l.res.Delete(req.Opaque, req.Quiet)
 		}
 		metrics.IncCounter(MetricCmdDeleteErrorsL1)
 		metrics.IncCounter(MetricCmdDeleteErrors)
@@ -450,17 +475,17 @@ func (l *L1L2Orca) Delete(req common.DeleteRequest) error {
 	metrics.IncCounter(MetricCmdDeleteHitsL1)
 	metrics.IncCounter(MetricCmdDeleteHits)
 
-	return l.res.Delete(req.Opaque)
+	return l.res.Delete(req.Opaque, req.Quiet)
 }
 
-func (l *L1L2Orca) Touch(req common.TouchRequest) error {
+func (l *L1L2Orca) Touch(ctx context.Context, req common.TouchRequest) error {
 	//log.Println("touch", string(req.Key))
 
 	// Try L2 first
 	metrics.IncCounter(MetricCmdTouchL2)
 	start := timer.Now()
 
-	err := l.l2.Touch(req)
+	err := l.l2.Touch(ctx, req)
 
 	metrics.ObserveHist(HistTouchL2, timer.Since(start))
 
@@ -491,10 +516,13 @@ func (l *L1L2Orca) Touch(req common.TouchRequest) error {
 	// state. The L2 could be touched long, then L2 and L1 touched short on
 	// another request, then L1 touched long. In this case the data in L1 would
 	// outlive L2. This situation is uncommon and is therefore discounted.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdTouchL1)
 	start = timer.Now()
 
-	err = l.l1.Touch(req)
+	err = l.l1.Touch(l1ctx, req)
 
 	metrics.ObserveHist(HistTouchL1, timer.Since(start))
 
@@ -507,7 +535,7 @@ func (l *L1L2Orca) Touch(req common.TouchRequest) error {
 			// Note that we increment the overall hits here (not misses) on
 			// purpose because L2 hit.
 			metrics.IncCounter(MetricCmdTouchHits)
-			return l.res.Touch(req.Opaque)
+			return l.res.Touch(req.Opaque, req.Quiet)
 		}
 
 		metrics.IncCounter(MetricCmdTouchErrorsL1)
@@ -518,10 +546,58 @@ func (l *L1L2Orca) Touch(req common.TouchRequest) error {
 	metrics.IncCounter(MetricCmdTouchHitsL1)
 	metrics.IncCounter(MetricCmdTouchHits)
 
-	return l.res.Touch(req.Opaque)
+	return l.res.Touch(req.Opaque, req.Quiet)
+}
+
+func (l *L1L2Orca) Increment(ctx context.Context, req common.IncrDecrRequest) error {
+	return incrDecrL1L2(ctx, l.l1, l.l2, l.res, common.RequestIncrement, req)
+}
+
+func (l *L1L2Orca) Decrement(ctx context.Context, req common.IncrDecrRequest) error {
+	return incrDecrL1L2(ctx, l.l1, l.l2, l.res, common.RequestDecrement, req)
+}
+
+func (l *L1L2Orca) Flush(ctx context.Context, req common.FlushRequest) error {
+	//log.Println("flush", req.Delay)
+
+	// Flush L2 first. If L1 were flushed first, a concurrent get could miss in
+	// L1, read the old data from L2 and put it right back into L1. Both tiers
+	// get the same delay so they become empty at the same time.
+	metrics.IncCounter(MetricCmdFlushL2)
+	start := timer.Now()
+
+	err := l.l2.Flush(ctx, req)
+
+	metrics.ObserveHist(HistFlushL2, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(MetricCmdFlushErrorsL2)
+		metrics.IncCounter(MetricCmdFlushErrors)
+		return err
+	}
+
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
+	metrics.IncCounter(MetricCmdFlushL1)
+	start = timer.Now()
+
+	err = l.l1.Flush(l1ctx, req)
+
+	metrics.ObserveHist(HistFlushL1, timer.Since(start))
+
+	if err != nil {
+		// L2 is already flushed, so any data left in L1 is invalid. Fail the
+		// request so the client knows to retry.
+		metrics.IncCounter(MetricCmdFlushErrorsL1)
+		metrics.IncCounter(MetricCmdFlushErrors)
+		return err
+	}
+
+	return l.res.Flush(req.Opaque, req.Quiet)
 }
 
-func (l *L1L2Orca) Get(req common.GetRequest) error {
+func (l *L1L2Orca) Get(ctx context.Context, req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetKeys, uint64(len(req.Keys)))
 	//debugString := "get"
 	//for _, k := range req.Keys {
@@ -530,59 +606,72 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 	//}
 	//println(debugString)
 
-	metrics.IncCounter(MetricCmdGetL1)
-	metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
-	start := timer.Now()
-
-	resChan, errChan := l.l1.Get(req)
-
 	var err error
 	//var lastres common.GetResponse
 	var l2keys [][]byte
 	var l2opaques []uint32
 	var l2quiets []bool
+	var start uint64
+
+	if req.ReturnCas {
+		// CAS values are only meaningful relative to L2, which is the source of
+		// truth. A client explicitly asking for them skips L1 entirely so the
+		// values it gets back can be used for a later conditional set.
+		l2keys = req.Keys
+		l2opaques = req.Opaques
+		l2quiets = req.Quiet
+	} else {
+		metrics.IncCounter(MetricCmdGetL1)
+		metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
+		start = timer.Now()
 
-	// Read all the responses back from L1.
-	// The contract is that the resChan will have GetResponse's for get hits and misses,
-	// and the errChan will have any other errors, such as an out of memory error from
-	// memcached. If any receive happens from errChan, there will be no more responses
-	// from resChan.
-	for {
-		select {
-		case res, ok := <-resChan:
-			if !ok {
-				resChan = nil
-			} else {
-				if res.Miss {
-					metrics.IncCounter(MetricCmdGetMissesL1)
-					l2keys = append(l2keys, res.Key)
-					l2opaques = append(l2opaques, res.Opaque)
-					l2quiets = append(l2quiets, res.Quiet)
+		resChan, errChan := l.l1.Get(ctx, req)
+
+		// Read all the responses back from L1.
+		// The contract is that the resChan will have GetResponse's for get hits and misses,
+		// and the errChan will have any other errors, such as an out of memory error from
+		// memcached. If any receive happens from errChan, there will be no more responses
+		// from resChan.
+		for {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
 				} else {
-					metrics.IncCounter(MetricCmdGetHits)
-					metrics.IncCounter(MetricCmdGetHitsL1)
-					l.res.Get(res)
+					if res.Miss {
+						metrics.IncCounter(MetricCmdGetMissesL1)
+						l2keys = append(l2keys, res.Key)
+						l2opaques = append(l2opaques, res.Opaque)
+						l2quiets = append(l2quiets, res.Quiet)
+					} else {
+						metrics.IncCounter(MetricCmdGetHits)
+						metrics.IncCounter(MetricCmdGetHitsL1)
+						// L1 CAS values are meaningless to a client, L2 is authoritative
+						res.Cas = 0
+						res.ReturnKey = req.ReturnKey
+						l.res.Get(res)
+					}
+				}
+
+			case getErr, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					metrics.IncCounter(MetricCmdGetErrors)
+					metrics.IncCounter(MetricCmdGetErrorsL1)
+					err = getErr
 				}
 			}
 
-		case getErr, ok := <-errChan:
-			if !ok {
-				errChan = nil
-			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
-				metrics.IncCounter(MetricCmdGetErrorsL1)
-				err = getErr
+			if resChan == nil && errChan == nil {
+				break
 			}
 		}
 
-		if resChan == nil && errChan == nil {
-			break
-		}
+		// finish up metrics for overall L1 (batch) get operation
+		metrics.ObserveHist(HistGetL1, timer.Since(start))
 	}
 
-	// finish up metrics for overall L1 (batch) get operation
-	metrics.ObserveHist(HistGetL1, timer.Since(start))
-
 	// leave early on all hits
 	if len(l2keys) == 0 {
 		if err != nil {
@@ -591,6 +680,13 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
 	}
 
+	// Skip the trip to L2 if the client has gone away or the request ran out of time while L1
+	// was being checked
+	if ctxErr := common.ContextErr(ctx); ctxErr != nil {
+		metrics.IncCounter(MetricCmdGetCanceled)
+		return ctxErr
+	}
+
 	// Time for the same dance with L2
 	req = common.GetRequest{
 		Keys:       l2keys,
@@ -598,13 +694,15 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 		NoopOpaque: req.NoopOpaque,
 		Opaques:    l2opaques,
 		Quiet:      l2quiets,
+		ReturnCas:  req.ReturnCas,
+		ReturnKey:  req.ReturnKey,
 	}
 
 	metrics.IncCounter(MetricCmdGetEL2)
 	metrics.IncCounterBy(MetricCmdGetEKeysL2, uint64(len(l2keys)))
 	start = timer.Now()
 
-	resChanE, errChan := l.l2.GetE(req)
+	resChanE, errChan := l.l2.GetE(ctx, req)
 
 	for {
 		select {
@@ -630,7 +728,7 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 					metrics.IncCounter(MetricCmdGetSetL1)
 					start2 := timer.Now()
 
-					err = l.l1.Set(setreq)
+					err = l.l1.Set(ctx, setreq)
 
 					metrics.ObserveHist(HistSetL1, timer.Since(start2))
 
@@ -651,7 +749,7 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 						}
 
 						start = timer.Now()
-						err = l.l1.Delete(dcmd)
+						err = l.l1.Delete(ctx, dcmd)
 						metrics.ObserveHist(HistDeleteL1, timer.Since(start))
 
 						if err == common.ErrKeyNotFound {
@@ -672,12 +770,15 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 				}
 
 				getres := common.GetResponse{
-					Key:    res.Key,
-					Flags:  res.Flags,
-					Data:   res.Data,
-					Miss:   res.Miss,
-					Opaque: res.Opaque,
-					Quiet:  res.Quiet,
+					Key:       res.Key,
+					Flags:     res.Flags,
+					Data:      res.Data,
+					Cas:       res.Cas,
+					Miss:      res.Miss,
+					Opaque:    res.Opaque,
+					Quiet:     res.Quiet,
+					ReturnCas: req.ReturnCas,
+					ReturnKey: req.ReturnKey,
 				}
 
 				l.res.Get(getres)
@@ -708,192 +809,389 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 	return err
 }
 
-func (l *L1L2Orca) GetE(req common.GetRequest) error {
+func (l *L1L2Orca) GetE(ctx context.Context, req common.GetRequest) error {
 	// The L1/L2 does not support getE, only L1Only does.
 	log.Println("[WARN] Use of GetE in L1L2 Batch orchestrator")
 	return common.ErrUnknownCmd
 }
 
-func (l *L1L2Orca) Gat(req common.GATRequest) error {
-	//log.Println("gat", string(req.Key))
+// gatKey identifies a key within a batch GAT so the TTL it was requested with can
+// be found again when its response comes back.
+type gatKey struct {
+	key    string
+	opaque uint32
+}
 
-	// Try L1 first
-	metrics.IncCounter(MetricCmdGatL1)
-	start := timer.Now()
+func gatExptimes(req common.GATRequest) map[gatKey]uint32 {
+	ret := make(map[gatKey]uint32, len(req.Keys))
+	for i := range req.Keys {
+		ret[gatKey{string(req.Keys[i]), req.Opaques[i]}] = req.Exptimes[i]
+	}
+	return ret
+}
 
-	res, err := l.l1.GAT(req)
+func (l *L1L2Orca) Gat(ctx context.Context, req common.GATRequest) error {
+	//log.Println("gat", string(req.Key))
 
-	metrics.ObserveHist(HistGatL1, timer.Since(start))
+	var err error
+	var l2keys [][]byte
+	var l2exptimes []uint32
+	var l2opaques []uint32
+	var l2quiets []bool
+	var hitKeys [][]byte
+	var hitExptimes []uint32
+	var hitOpaques []uint32
+	var hitQuiets []bool
+	var start uint64
+
+	exptimes := gatExptimes(req)
+
+	if req.ReturnCas {
+		// Same as Get, L2 is the only source of meaningful CAS values so L1 is
+		// skipped on the way in and only touched on the way out.
+		l2keys = req.Keys
+		l2exptimes = req.Exptimes
+		l2opaques = req.Opaques
+		l2quiets = req.Quiet
+	} else {
+		// Try L1 first
+		metrics.IncCounter(MetricCmdGatL1)
+		start = timer.Now()
 
-	// Errors here are genrally fatal to the connection, as something has gone
-	// seriously wrong. Bail out early.
-	// I should note that this is different than the other commands, where there
-	// are some benevolent "errors" that include KeyNotFound or KeyExists. In
-	// both Get and GAT the mini-internal-protocol is different because the Get
-	// command uses a channel to send results back and an error channel to signal
-	// some kind of fatal problem. The result signals non-fatal "errors"; in this
-	// case it's ErrKeyNotFound --> res.Miss is true.
-	if err != nil {
-		metrics.IncCounter(MetricCmdGatErrorsL1)
-		metrics.IncCounter(MetricCmdGatErrors)
-		return err
-	}
+		resChan, errChan := l.l1.GAT(ctx, req)
+
+		// Errors here are generally fatal to the connection, as something has gone
+		// seriously wrong. As with Get, the channel contract means non-fatal "errors"
+		// like ErrKeyNotFound come through as res.Miss and any error through errChan
+		// is the last thing sent. After an error the rest of the responses are
+		// drained but not sent on to the client.
+		for {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+				} else if err == nil {
+					exptime := exptimes[gatKey{string(res.Key), res.Opaque}]
+
+					if res.Miss {
+						// If we miss here, we have to GAT L2 to get the data, then put it back
+						// into L1 with the new TTL. All of the L1 misses go to L2 together.
+						metrics.IncCounter(MetricCmdGatMissesL1)
+						l2keys = append(l2keys, res.Key)
+						l2exptimes = append(l2exptimes, exptime)
+						l2opaques = append(l2opaques, res.Opaque)
+						l2quiets = append(l2quiets, res.Quiet)
+						continue
+					}
 
-	if res.Miss {
-		// If we miss here, we have to GAT L2 to get the data, then put it back
-		// into L1 with the new TTL.
-		metrics.IncCounter(MetricCmdGatMissesL1)
+					// The hit is only answered once L2 has taken the new TTL as well. All of
+					// the L1 hits go to L2 together after the L1 GAT is done.
+					metrics.IncCounter(MetricCmdGatHitsL1)
+					hitKeys = append(hitKeys, res.Key)
+					hitExptimes = append(hitExptimes, exptime)
+					hitOpaques = append(hitOpaques, res.Opaque)
+					hitQuiets = append(hitQuiets, res.Quiet)
+				}
 
-		metrics.IncCounter(MetricCmdGatL2)
-		start = timer.Now()
+			case gatErr, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					metrics.IncCounter(MetricCmdGatErrorsL1)
+					metrics.IncCounter(MetricCmdGatErrors)
+					err = gatErr
+				}
+			}
 
-		res, err = l.l2.GAT(req)
+			if resChan == nil && errChan == nil {
+				break
+			}
+		}
 
-		metrics.ObserveHist(HistGatL2, timer.Since(start))
+		metrics.ObserveHist(HistGatL1, timer.Since(start))
 
-		// fatal error
 		if err != nil {
-			metrics.IncCounter(MetricCmdGatErrorsL2)
-			metrics.IncCounter(MetricCmdGatErrors)
 			return err
 		}
 
-		// A miss on L2 after L1 is a true miss
-		if res.Miss {
-			metrics.IncCounter(MetricCmdGatMissesL2)
-			metrics.IncCounter(MetricCmdGatMisses)
-			return l.res.GAT(res)
-		}
+		if len(hitKeys) > 0 {
+			hitreq := common.GATRequest{
+				Keys:      hitKeys,
+				Exptimes:  hitExptimes,
+				Opaques:   hitOpaques,
+				Quiet:     hitQuiets,
+				ReturnKey: req.ReturnKey,
+			}
 
-		// Take the data from the L2 GAT and set into L1 with the new TTL.
-		// There's several problems that could arise from interleaving of other
-		// operations. Another GAT isn't a problem.
-		//
-		// Intermediate sets might get clobbered in L1 but remain in L2 if we
-		// used Set, but since we use Add we should not overwrite a Set that
-		// happens between the L2 GAT hit and subsequent L1 reconciliation.
-		//
-		// Deletes would be a possible problem since a delete hit in L2 and miss
-		// in L1 would interleave to have data in L1 not in L2. This is a risk
-		// that is understood and accepted. The typical use cases at Netflix
-		// will not use deletes concurrently with GATs.
-		setreq := common.SetRequest{
-			Key:     req.Key,
-			Exptime: req.Exptime,
-			Flags:   res.Flags,
-			Data:    res.Data,
+			if err := l.gatTouchL2(ctx, hitreq); err != nil {
+				return err
+			}
 		}
+	}
 
-		metrics.IncCounter(MetricCmdGatAddL1)
-		start2 := timer.Now()
+	// leave early on all hits
+	if len(l2keys) == 0 {
+		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+	}
 
-		err = l.l1.Add(setreq)
+	// One round trip to L2 for everything L1 didn't have
+	l2req := common.GATRequest{
+		Keys:       l2keys,
+		Exptimes:   l2exptimes,
+		Opaques:    l2opaques,
+		Quiet:      l2quiets,
+		NoopOpaque: req.NoopOpaque,
+		NoopEnd:    req.NoopEnd,
+		ReturnCas:  req.ReturnCas,
+		ReturnKey:  req.ReturnKey,
+	}
 
-		metrics.ObserveHist(HistAddL1, timer.Since(start2))
+	metrics.IncCounter(MetricCmdGatL2)
+	start = timer.Now()
 
-		if err != nil {
-			// we were trampled in the middle of performing the GAT operation
-			// In this case, it's fine; no error for the overall op. We still
-			// want to track this with a metric, though, and return success.
-			if err == common.ErrKeyExists {
-				metrics.IncCounter(MetricCmdGatAddNotStoredL1)
+	resChan, errChan := l.l2.GAT(ctx, l2req)
+
+	// The hits have had their expiry changed in L2, so L1 has to follow
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if err == nil {
+				// A miss on L2 after L1 is a true miss
+				if res.Miss {
+					metrics.IncCounter(MetricCmdGatMissesL2)
+					metrics.IncCounter(MetricCmdGatMisses)
+					res.ReturnKey = req.ReturnKey
+					l.res.GAT(res)
+					continue
+				}
+
+				metrics.IncCounter(MetricCmdGatHitsL2)
+				exptime := exptimes[gatKey{string(res.Key), res.Opaque}]
+
+				if req.ReturnCas {
+					err = l.gatTouchL1(l1ctx, res.Key, exptime)
+				} else {
+					err = l.gatAddL1(l1ctx, res, exptime)
+				}
+
+				if err != nil {
+					// Gat errors here and not Add. The metrics for L1/L2 correspond to
+					// direct interaction with the two. THe overall metrics correspond
+					// to the more abstract orchestrator operation.
+					metrics.IncCounter(MetricCmdGatErrors)
+					continue
+				}
+
+				// the overall operation succeeded
+				metrics.IncCounter(MetricCmdGatHits)
+
+				res.ReturnCas = req.ReturnCas
+				res.ReturnKey = req.ReturnKey
+				l.res.GAT(res)
+			}
+
+		case gatErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
 			} else {
-				metrics.IncCounter(MetricCmdGatAddErrorsL1)
-				// Gat errors here and not Add. The metrics for L1/L2 correspond to
-				// direct interaction with the two. THe overall metrics correspond
-				// to the more abstract orchestrator operation.
+				metrics.IncCounter(MetricCmdGatErrorsL2)
 				metrics.IncCounter(MetricCmdGatErrors)
-				return err
+				err = gatErr
 			}
-		} else {
-			metrics.IncCounter(MetricCmdGatAddStoredL1)
 		}
 
-		// the overall operation succeeded
-		metrics.IncCounter(MetricCmdGatHits)
+		if resChan == nil && errChan == nil {
+			break
+		}
+	}
+
+	metrics.ObserveHist(HistGatL2, timer.Since(start))
 
-	} else {
-		metrics.IncCounter(MetricCmdGatHitsL1)
+	if err != nil {
+		return err
+	}
 
-		// Touch in L2. This used to be a set operation, but touch allows the L2
-		// to have more control over the operation than a set does. This helps
-		// migrations internally at Netflix because we can choose to discount
-		// touch commands in L2 but not sets.
-		//
-		// The first possibility is a Set. A set into L2 would possibly cause a
-		// concurrent delete to not take, meaning the delete could say it was
-		// successful and then a subsequent get call would show the old data
-		// that was just deleted.
-		//
-		// Another option is to just send a touch, which allows us to send less
-		// data but gives the possibility of a touch miss on L2, which will be a
-		// problematic situation. If we get a touch miss, then we know we are
-		// inconsistent but we don't affect concurrent deletes.
-		//
-		// A third option is to use Replace, which could be helpful to avoid
-		// overriding concurrent deletes. This also might cause problems with
-		// othr sets at the same time, as it might overwrite a set that just
-		// finished.
-		//
-		// Many heavy users of EVCache at Netflix use GAT commands to lengthen
-		// TTLs of their data in use and to shorten the TTL of data they will
-		// not be using which is then async TTL'd out. I am explicitly
-		// discounting the concurrent delete situation here and accepting that
-		// they might not be exactly correct.
-		touchreq := common.TouchRequest{
-			Key:     req.Key,
-			Exptime: req.Exptime,
-		}
+	return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+// gatTouchL2 carries the new TTLs of the L1 GAT hits over to L2 in a single round trip.
+//
+// This used to be a touch per key, and before that a set. A set into L2 would possibly cause a
+// concurrent delete to not take, meaning the delete could say it was successful and then a
+// subsequent get call would show the old data that was just deleted. A touch or GAT sends less
+// data and gives L2 more control over the operation than a set does. This helps migrations
+// internally at Netflix because we can choose to discount touch commands in L2 but not sets.
+// GAT is used here because it can be batched.
+//
+// The downside is the possibility of a miss on L2, which will be a problematic situation. If
+// we get a miss, then we know we are inconsistent but we don't affect concurrent deletes.
+//
+// A third option is to use Replace, which could be helpful to avoid overriding concurrent
+// deletes. This also might cause problems with othr sets at the same time, as it might
+// overwrite a set that just finished.
+//
+// Many heavy users of EVCache at Netflix use GAT commands to lengthen TTLs of their data in use
+// and to shorten the TTL of data they will not be using which is then async TTL'd out. I am
+// explicitly discounting the concurrent delete situation here and accepting that they might not
+// be exactly correct.
+func (l *L1L2Orca) gatTouchL2(ctx context.Context, req common.GATRequest) error {
+	metrics.IncCounterBy(MetricCmdGatTouchL2, uint64(len(req.Keys)))
+	start := timer.Now()
 
-		metrics.IncCounter(MetricCmdGatTouchL2)
-		start2 := timer.Now()
+	resChan, errChan := l.l2.GAT(ctx, req)
 
-		err := l.l2.Touch(touchreq)
+	var err error
 
-		metrics.ObserveHist(HistTouchL2, timer.Since(start2))
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if err == nil {
+				if res.Miss {
+					// this is a problem. L1 had the item but L2 doesn't. To avoid an
+					// inconsistent view, respond with a miss for this key.
+					metrics.IncCounter(MetricInconsistencyDetected)
+					metrics.IncCounter(MetricCmdGatTouchMissesL2)
+					metrics.IncCounter(MetricCmdGatMisses)
+				} else {
+					metrics.IncCounter(MetricCmdGatTouchHitsL2)
 
-		if err != nil {
-			if err == common.ErrKeyNotFound {
-				// this is a problem. L1 had the item but L2 doesn't. To avoid an
-				// inconsistent view, return the same ErrNotFound and fail the op.
-				metrics.IncCounter(MetricInconsistencyDetected)
-				metrics.IncCounter(MetricCmdGatTouchMissesL2)
-				metrics.IncCounter(MetricCmdGatMisses)
+					// overall operation succeeded
+					metrics.IncCounter(MetricCmdGatHits)
+				}
+
+				// L2 has the same data as L1 here, and is the source of truth if it doesn't
+				res.ReturnCas = false
+				res.ReturnKey = req.ReturnKey
+				l.res.GAT(res)
+			}
+
+		case gatErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
 			} else {
-				// If there's a true error, return it as our error. The GAT
-				// succeeded in L1 but if L2 didn't take, then likely something
-				// is seriously wrong.
+				// If there's a true error, return it as our error. The GAT succeeded in
+				// L1 but if L2 didn't take, then likely something is seriously wrong.
 				metrics.IncCounter(MetricCmdGatTouchErrorsL2)
 				metrics.IncCounter(MetricCmdGatErrors)
+				err = gatErr
 			}
-			return err
 		}
-		metrics.IncCounter(MetricCmdGatTouchHitsL2)
 
-		// overall operation succeeded
-		metrics.IncCounter(MetricCmdGatHits)
+		if resChan == nil && errChan == nil {
+			break
+		}
+	}
+
+	metrics.ObserveHist(HistTouchL2, timer.Since(start))
+
+	return err
+}
+
+// gatAddL1 takes the data from an L2 GAT hit and sets it into L1 with the new TTL.
+// There's several problems that could arise from interleaving of other operations.
+// Another GAT isn't a problem.
+//
+// Intermediate sets might get clobbered in L1 but remain in L2 if we used Set, but
+// since we use Add we should not overwrite a Set that happens between the L2 GAT hit
+// and subsequent L1 reconciliation.
+//
+// Deletes would be a possible problem since a delete hit in L2 and miss in L1 would
+// interleave to have data in L1 not in L2. This is a risk that is understood and
+// accepted. The typical use cases at Netflix will not use deletes concurrently with
+// GATs.
+func (l *L1L2Orca) gatAddL1(ctx context.Context, res common.GetResponse, exptime uint32) error {
+	setreq := common.SetRequest{
+		Key:     res.Key,
+		Exptime: exptime,
+		Flags:   res.Flags,
+		Data:    res.Data,
+	}
+
+	metrics.IncCounter(MetricCmdGatAddL1)
+	start := timer.Now()
+
+	err := l.l1.Add(ctx, setreq)
+
+	metrics.ObserveHist(HistAddL1, timer.Since(start))
+
+	if err != nil {
+		// we were trampled in the middle of performing the GAT operation
+		// In this case, it's fine; no error for the overall op. We still
+		// want to track this with a metric, though, and return success.
+		if err == common.ErrKeyExists {
+			metrics.IncCounter(MetricCmdGatAddNotStoredL1)
+			return nil
+		}
+
+		metrics.IncCounter(MetricCmdGatAddErrorsL1)
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdGatAddStoredL1)
+	return nil
+}
+
+// gatTouchL1 carries the new TTL from an L2 GAT over to L1 when L1 was skipped on
+// the way in. A miss is fine; the next plain get will fill L1 from L2.
+func (l *L1L2Orca) gatTouchL1(ctx context.Context, key []byte, exptime uint32) error {
+	touchreq := common.TouchRequest{
+		Key:     key,
+		Exptime: exptime,
+	}
+
+	metrics.IncCounter(MetricCmdGatTouchL1)
+	start := timer.Now()
+
+	err := l.l1.Touch(ctx, touchreq)
+
+	metrics.ObserveHist(HistTouchL1, timer.Since(start))
+
+	if err != nil {
+		if err == common.ErrKeyNotFound {
+			metrics.IncCounter(MetricCmdGatTouchMissesL1)
+			return nil
+		}
+
+		metrics.IncCounter(MetricCmdGatTouchErrorsL1)
+		return err
 	}
 
-	return l.res.GAT(res)
+	metrics.IncCounter(MetricCmdGatTouchHitsL1)
+	return nil
+}
+
+func (l *L1L2Orca) Stats(ctx context.Context, req common.StatsRequest) error {
+	stats, err := common.GetStats(req.Group)
+	if err != nil {
+		return err
+	}
+	return l.res.Stats(req.Opaque, stats)
 }
 
-func (l *L1L2Orca) Noop(req common.NoopRequest) error {
+func (l *L1L2Orca) Noop(ctx context.Context, req common.NoopRequest) error {
 	return l.res.Noop(req.Opaque)
 }
 
-func (l *L1L2Orca) Quit(req common.QuitRequest) error {
+func (l *L1L2Orca) Quit(ctx context.Context, req common.QuitRequest) error {
 	return l.res.Quit(req.Opaque, req.Quiet)
 }
 
-func (l *L1L2Orca) Version(req common.VersionRequest) error {
+func (l *L1L2Orca) Version(ctx context.Context, req common.VersionRequest) error {
 	return l.res.Version(req.Opaque)
 }
 
-func (l *L1L2Orca) Unknown(req common.Request) error {
+func (l *L1L2Orca) Unknown(ctx context.Context, req common.Request) error {
 	return common.ErrUnknownCmd
 }
 
-func (l *L1L2Orca) Error(req common.Request, reqType common.RequestType, err error) {
+func (l *L1L2Orca) Error(ctx context.Context, req common.Request, reqType common.RequestType, err error) {
 	var opaque uint32
 	var quiet bool
 
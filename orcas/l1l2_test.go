@@ -17,6 +17,7 @@ package orcas_test
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"io"
 	"testing"
 
@@ -112,6 +113,29 @@ func TestL1L2Orca(t *testing.T) {
 				})
 			})
 		})
+		t.Run("CanceledAfterL2", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// The client hangs up once L2 has the data. L1 still has to be set.
+			h1 := &testHandler{
+				errors: []error{nil},
+			}
+			h2 := &testHandler{
+				errors: []error{nil},
+			}
+			output := &bytes.Buffer{}
+
+			l1l2 := orcas.WithContext(orcas.L1L2(h1, cancelingHandler{h2, cancel}, textprot.NewTextResponder(bufio.NewWriter(output))))
+
+			err := l1l2.Set(ctx, common.SetRequest{})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
 	})
 	t.Run("Get", func(t *testing.T) {
 		t.Run("L1Miss", func(t *testing.T) {
@@ -239,5 +263,267 @@ func TestL1L2Orca(t *testing.T) {
 				})
 			})
 		})
+		t.Run("ReturnCas", func(t *testing.T) {
+			// L1 is never consulted, so it has no responses queued. The only
+			// call it sees is the set that warms it up after the L2 hit.
+			h1 := &testHandler{
+				errors: []error{nil},
+			}
+			h2 := &testHandler{
+				eresponses: []common.GetEResponse{
+					{
+						Key:  []byte("key"),
+						Data: []byte("foo"),
+						Cas:  5,
+					},
+				},
+			}
+			output := &bytes.Buffer{}
+
+			l1l2 := orcas.L1L2(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1l2.Get(common.GetRequest{
+				Keys:      [][]byte{[]byte("key")},
+				Opaques:   []uint32{0},
+				Quiet:     []bool{false},
+				ReturnCas: true,
+			})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+
+			out := string(output.Bytes())
+
+			gold := "VALUE key 0 3 5\r\nfoo\r\nEND\r\n"
+
+			if out != gold {
+				t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+		t.Run("CanceledBeforeL2", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			h1 := &testHandler{
+				responses: []common.GetResponse{
+					{
+						Miss: true,
+					},
+				},
+			}
+			// L2 has nothing queued, so any call to it fails the test
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			l1l2 := orcas.WithContext(orcas.L1L2(cancelingHandler{h1, cancel}, h2, textprot.NewTextResponder(bufio.NewWriter(output))))
+
+			err := l1l2.Get(ctx, common.GetRequest{
+				Keys:    [][]byte{[]byte("key")},
+				Opaques: []uint32{0},
+				Quiet:   []bool{false},
+			})
+			if err != context.Canceled {
+				t.Fatalf("Expected context.Canceled, got %v", err)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+	})
+	t.Run("Gat", func(t *testing.T) {
+		t.Run("L1HitsTouchL2Once", func(t *testing.T) {
+			// The L2 side of every L1 hit goes out as one batch instead of a touch per key
+			h1 := &gatHandler{testHandler: &testHandler{}}
+			h2 := &gatHandler{testHandler: &testHandler{}}
+			output := &bytes.Buffer{}
+
+			l1l2 := orcas.L1L2(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1l2.Gat(common.GATRequest{
+				Keys:     [][]byte{[]byte("foo"), []byte("bar")},
+				Exptimes: []uint32{10, 10},
+				Opaques:  []uint32{0, 0},
+				Quiet:    []bool{false, false},
+			})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+
+			if h1.gats != 1 || h2.gats != 1 {
+				t.Fatalf("Expected one GAT on each of L1 and L2, got %d and %d", h1.gats, h2.gats)
+			}
+
+			out := string(output.Bytes())
+
+			gold := "VALUE foo 0 3\r\nfoo\r\nVALUE bar 0 3\r\nfoo\r\nEND\r\n"
+
+			if out != gold {
+				t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+	})
+	t.Run("Increment", func(t *testing.T) {
+		t.Run("L2Hit", func(t *testing.T) {
+			t.Run("L1DeleteHit", func(t *testing.T) {
+				h1 := &testHandler{
+					errors: []error{nil},
+				}
+				h2 := &testHandler{
+					values: []uint64{5},
+				}
+				output := &bytes.Buffer{}
+
+				l1l2 := orcas.L1L2(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+				err := l1l2.Increment(common.IncrDecrRequest{})
+				if err != nil {
+					t.Fatalf("Error should be nil, got %v", err)
+				}
+
+				out := string(output.Bytes())
+
+				if out != "5\r\n" {
+					t.Fatalf("Expected response '5\\r\\n' but got '%v'", out)
+				}
+
+				h1.verifyEmpty(t)
+				h2.verifyEmpty(t)
+			})
+			t.Run("L1DeleteMiss", func(t *testing.T) {
+				h1 := &testHandler{
+					errors: []error{common.ErrKeyNotFound},
+				}
+				h2 := &testHandler{
+					values: []uint64{5},
+				}
+				output := &bytes.Buffer{}
+
+				l1l2 := orcas.L1L2(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+				err := l1l2.Increment(common.IncrDecrRequest{})
+				if err != nil {
+					t.Fatalf("Error should be nil, got %v", err)
+				}
+
+				out := string(output.Bytes())
+
+				if out != "5\r\n" {
+					t.Fatalf("Expected response '5\\r\\n' but got '%v'", out)
+				}
+
+				h1.verifyEmpty(t)
+				h2.verifyEmpty(t)
+			})
+			t.Run("L1DeleteError", func(t *testing.T) {
+				h1 := &testHandler{
+					errors: []error{common.ErrNoMem},
+				}
+				h2 := &testHandler{
+					values: []uint64{5},
+				}
+				output := &bytes.Buffer{}
+
+				l1l2 := orcas.L1L2(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+				// L2 has already applied the increment, so it must not be reported as failed
+				err := l1l2.Increment(common.IncrDecrRequest{})
+				if err != nil {
+					t.Fatalf("Error should be nil, got %v", err)
+				}
+
+				out := string(output.Bytes())
+				if out != "5\r\n" {
+					t.Fatalf("Expected response '5\\r\\n' but got '%v'", out)
+				}
+
+				h1.verifyEmpty(t)
+				h2.verifyEmpty(t)
+			})
+		})
+		t.Run("L2Miss", func(t *testing.T) {
+			// L1 must not be touched when L2 does not have the item
+			h1 := &testHandler{}
+			h2 := &testHandler{
+				errors: []error{common.ErrKeyNotFound},
+			}
+			output := &bytes.Buffer{}
+
+			l1l2 := orcas.L1L2(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1l2.Decrement(common.IncrDecrRequest{})
+			if err != common.ErrKeyNotFound {
+				t.Fatalf("Error should be ErrKeyNotFound, got %v", err)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+	})
+	t.Run("Flush", func(t *testing.T) {
+		t.Run("Success", func(t *testing.T) {
+			h1 := &testHandler{
+				errors: []error{nil},
+			}
+			h2 := &testHandler{
+				errors: []error{nil},
+			}
+			output := &bytes.Buffer{}
+
+			l1l2 := orcas.L1L2(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1l2.Flush(common.FlushRequest{Delay: 10})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+
+			out := string(output.Bytes())
+
+			if out != "OK\r\n" {
+				t.Fatalf("Expected response 'OK\\r\\n' but got '%v'", out)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+		t.Run("L2Error", func(t *testing.T) {
+			// L1 must be left alone if L2 could not be flushed
+			h1 := &testHandler{}
+			h2 := &testHandler{
+				errors: []error{common.ErrNoMem},
+			}
+			output := &bytes.Buffer{}
+
+			l1l2 := orcas.L1L2(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1l2.Flush(common.FlushRequest{})
+			if err != common.ErrNoMem {
+				t.Fatalf("Error should be ErrNoMem, got %v", err)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
+		t.Run("Disabled", func(t *testing.T) {
+			h1 := &testHandler{}
+			h2 := &testHandler{}
+			output := &bytes.Buffer{}
+
+			oc := orcas.FlushDisabled(orcas.L1L2)
+			l1l2 := oc(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1l2.Flush(common.FlushRequest{})
+			if err != common.ErrNotSupported {
+				t.Fatalf("Error should be ErrNotSupported, got %v", err)
+			}
+
+			h1.verifyEmpty(t)
+			h2.verifyEmpty(t)
+		})
 	})
 }
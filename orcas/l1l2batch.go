@@ -15,6 +15,7 @@
 package orcas
 
 import (
+	"context"
 	"log"
 
 	"github.com/netflix/rend/common"
@@ -25,27 +26,27 @@ import (
 )
 
 type L1L2BatchOrca struct {
-	l1  handlers.Handler
-	l2  handlers.Handler
+	l1  handlers.ContextHandler
+	l2  handlers.ContextHandler
 	res protocol.Responder
 }
 
 func L1L2Batch(l1, l2 handlers.Handler, res protocol.Responder) Orca {
-	return &L1L2BatchOrca{
-		l1:  l1,
-		l2:  l2,
+	return WithoutContext(&L1L2BatchOrca{
+		l1:  handlers.WithContext(l1),
+		l2:  handlers.WithContext(l2),
 		res: res,
-	}
+	})
 }
 
-func (l *L1L2BatchOrca) Set(req common.SetRequest) error {
+func (l *L1L2BatchOrca) Set(ctx context.Context, req common.SetRequest) error {
 	//log.Println("set", string(req.Key))
 
 	// Try L2 first
 	metrics.IncCounter(MetricCmdSetL2)
 	start := timer.Now()
 
-	err := l.l2.Set(req)
+	err := l.l2.Set(ctx, req)
 
 	metrics.ObserveHist(HistSetL2, timer.Since(start))
 
@@ -58,10 +59,15 @@ func (l *L1L2BatchOrca) Set(req common.SetRequest) error {
 	metrics.IncCounter(MetricCmdSetSuccessL2)
 
 	// Replace the entry in L1.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdSetReplaceL1)
 	start = timer.Now()
 
-	err = l.l1.Replace(req)
+	// CAS values come from L2 and are never valid in L1
+	req.Cas = 0
+	err = l.l1.Replace(l1ctx, req)
 
 	metrics.ObserveHist(HistReplaceL1, timer.Since(start))
 
@@ -86,7 +92,7 @@ func (l *L1L2BatchOrca) Set(req common.SetRequest) error {
 			}
 
 			start = timer.Now()
-			err = l.l1.Delete(dcmd)
+			err = l.l1.Delete(l1ctx, dcmd)
 			metrics.ObserveHist(HistDeleteL1, timer.Since(start))
 
 			if err == common.ErrKeyNotFound {
@@ -103,17 +109,17 @@ func (l *L1L2BatchOrca) Set(req common.SetRequest) error {
 
 	metrics.IncCounter(MetricCmdSetSuccess)
 
-	return l.res.Set(req.Opaque, req.Quiet)
+	return respondStored(l.res, l.l2, common.RequestSet, req)
 }
 
-func (l *L1L2BatchOrca) Add(req common.SetRequest) error {
+func (l *L1L2BatchOrca) Add(ctx context.Context, req common.SetRequest) error {
 	//log.Println("add", string(req.Key))
 
 	// Add in L2 first, since it has the larger state
 	metrics.IncCounter(MetricCmdAddL2)
 	start := timer.Now()
 
-	err := l.l2.Add(req)
+	err := l.l2.Add(ctx, req)
 
 	metrics.ObserveHist(HistAddL2, timer.Since(start))
 
@@ -136,10 +142,14 @@ func (l *L1L2BatchOrca) Add(req common.SetRequest) error {
 	metrics.IncCounter(MetricCmdAddStoredL2)
 
 	// Replace the entry in L1.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdAddReplaceL1)
 	start = timer.Now()
 
-	err = l.l1.Replace(req)
+	req.Cas = 0
+	err = l.l1.Replace(l1ctx, req)
 
 	metrics.ObserveHist(HistReplaceL1, timer.Since(start))
 
@@ -159,17 +169,17 @@ func (l *L1L2BatchOrca) Add(req common.SetRequest) error {
 
 	metrics.IncCounter(MetricCmdAddStored)
 
-	return l.res.Add(req.Opaque, req.Quiet)
+	return respondStored(l.res, l.l2, common.RequestAdd, req)
 }
 
-func (l *L1L2BatchOrca) Replace(req common.SetRequest) error {
+func (l *L1L2BatchOrca) Replace(ctx context.Context, req common.SetRequest) error {
 	//log.Println("replace", string(req.Key))
 
 	// Add in L2 first, since it has the larger state
 	metrics.IncCounter(MetricCmdReplaceL2)
 	start := timer.Now()
 
-	err := l.l2.Replace(req)
+	err := l.l2.Replace(ctx, req)
 
 	metrics.ObserveHist(HistReplaceL2, timer.Since(start))
 
@@ -192,10 +202,14 @@ func (l *L1L2BatchOrca) Replace(req common.SetRequest) error {
 	metrics.IncCounter(MetricCmdReplaceStoredL2)
 
 	// Replace the entry in L1.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdReplaceReplaceL1)
 	start = timer.Now()
 
-	err = l.l1.Replace(req)
+	req.Cas = 0
+	err = l.l1.Replace(l1ctx, req)
 
 	metrics.ObserveHist(HistReplaceL1, timer.Since(start))
 
@@ -215,10 +229,10 @@ func (l *L1L2BatchOrca) Replace(req common.SetRequest) error {
 
 	metrics.IncCounter(MetricCmdReplaceStored)
 
-	return l.res.Replace(req.Opaque, req.Quiet)
+	return respondStored(l.res, l.l2, common.RequestReplace, req)
 }
 
-func (l *L1L2BatchOrca) Append(req common.SetRequest) error {
+func (l *L1L2BatchOrca) Append(ctx context.Context, req common.SetRequest) error {
 	//log.Println("append", string(req.Key))
 
 	// Ordering of append and prepend operations won't matter much unless
@@ -234,7 +248,7 @@ func (l *L1L2BatchOrca) Append(req common.SetRequest) error {
 	metrics.IncCounter(MetricCmdAppendL2)
 	start := timer.Now()
 
-	err := l.l2.Append(req)
+	err := l.l2.Append(ctx, req)
 
 	metrics.ObserveHist(HistAppendL2, timer.Since(start))
 
@@ -257,10 +271,14 @@ func (l *L1L2BatchOrca) Append(req common.SetRequest) error {
 	// there's an error, we need to fail because we're not in an unknown state
 	// where L1 possibly doesn't have the append when L2 does. We don't recover
 	// from this but instead fail the request and let the client retry.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdAppendL1)
 	start = timer.Now()
 
-	err = l.l1.Append(req)
+	req.Cas = 0
+	err = l.l1.Append(l1ctx, req)
 
 	metrics.ObserveHist(HistAppendL1, timer.Since(start))
 
@@ -272,7 +290,7 @@ func (l *L1L2BatchOrca) Append(req common.SetRequest) error {
 		if err == common.ErrItemNotStored || err == common.ErrKeyNotFound {
 			metrics.IncCounter(MetricCmdAppendNotStoredL1)
 			metrics.IncCounter(MetricCmdAppendStored)
-			return l.res.Append(req.Opaque, req.Quiet)
+			return respondStored(l.res, l.l2, common.RequestAppend, req)
 		}
 
 		metrics.IncCounter(MetricCmdAppendErrorsL1)
@@ -282,16 +300,16 @@ func (l *L1L2BatchOrca) Append(req common.SetRequest) error {
 
 	metrics.IncCounter(MetricCmdAppendStoredL1)
 	metrics.IncCounter(MetricCmdAppendStored)
-	return l.res.Append(req.Opaque, req.Quiet)
+	return respondStored(l.res, l.l2, common.RequestAppend, req)
 }
 
-func (l *L1L2BatchOrca) Prepend(req common.SetRequest) error {
+func (l *L1L2BatchOrca) Prepend(ctx context.Context, req common.SetRequest) error {
 	//log.Println("prepend", string(req.Key))
 
 	metrics.IncCounter(MetricCmdPrependL2)
 	start := timer.Now()
 
-	err := l.l2.Prepend(req)
+	err := l.l2.Prepend(ctx, req)
 
 	metrics.ObserveHist(HistPrependL2, timer.Since(start))
 
@@ -314,10 +332,14 @@ func (l *L1L2BatchOrca) Prepend(req common.SetRequest) error {
 	// there's an error, we need to fail because we're not in an unknown state
 	// where L1 possibly doesn't have the Prepend when L2 does. We don't recover
 	// from this but instead fail the request and let the client retry.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdPrependL1)
 	start = timer.Now()
 
-	err = l.l1.Prepend(req)
+	req.Cas = 0
+	err = l.l1.Prepend(l1ctx, req)
 
 	metrics.ObserveHist(HistPrependL1, timer.Since(start))
 
@@ -329,7 +351,7 @@ func (l *L1L2BatchOrca) Prepend(req common.SetRequest) error {
 		if err == common.ErrItemNotStored || err == common.ErrKeyNotFound {
 			metrics.IncCounter(MetricCmdPrependNotStoredL1)
 			metrics.IncCounter(MetricCmdPrependStored)
-			return l.res.Prepend(req.Opaque, req.Quiet)
+			return respondStored(l.res, l.l2, common.RequestPrepend, req)
 		}
 
 		metrics.IncCounter(MetricCmdPrependErrorsL1)
@@ -339,17 +361,17 @@ func (l *L1L2BatchOrca) Prepend(req common.SetRequest) error {
 
 	metrics.IncCounter(MetricCmdPrependStoredL1)
 	metrics.IncCounter(MetricCmdPrependStored)
-	return l.res.Prepend(req.Opaque, req.Quiet)
+	return respondStored(l.res, l.l2, common.RequestPrepend, req)
 }
 
-func (l *L1L2BatchOrca) Delete(req common.DeleteRequest) error {
+func (l *L1L2BatchOrca) Delete(ctx context.Context, req common.DeleteRequest) error {
 	//log.Println("delete", string(req.Key))
 
 	// Try L2 first
 	metrics.IncCounter(MetricCmdDeleteL2)
 	start := timer.Now()
 
-	err := l.l2.Delete(req)
+	err := l.l2.Delete(ctx, req)
 
 	metrics.ObserveHist(HistDeleteL2, timer.Since(start))
 
@@ -380,10 +402,13 @@ func (l *L1L2BatchOrca) Delete(req common.DeleteRequest) error {
 	// eliminated the interleaving where the data is deleted from L1, read from
 	// L2, set in L1, then deleted in L2. By deleting from L2 first, if L1 goes
 	// missing then no other request can undo part of this request.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdDeleteL1)
 	start = timer.Now()
 
-	err = l.l1.Delete(req)
+	err = l.l1.Delete(l1ctx, req)
 
 	metrics.ObserveHist(HistDeleteL1, timer.Since(start))
 
@@ -396,7 +421,7 @@ func (l *L1L2BatchOrca) Delete(req common.DeleteRequest) error {
 			metrics.IncCounter(MetricCmdDeleteMissesL1)
 			metrics.IncCounter(MetricCmdDeleteHits)
 			// disregard the miss, don't return the error
-			return l.res.Delete(req.Opaque)
+			return l.res.Delete(req.Opaque, req.Quiet)
 		}
 		metrics.IncCounter(MetricCmdDeleteErrorsL1)
 		metrics.IncCounter(MetricCmdDeleteErrors)
@@ -406,17 +431,17 @@ func (l *L1L2BatchOrca) Delete(req common.DeleteRequest) error {
 	metrics.IncCounter(MetricCmdDeleteHitsL1)
 	metrics.IncCounter(MetricCmdDeleteHits)
 
-	return l.res.Delete(req.Opaque)
+	return l.res.Delete(req.Opaque, req.Quiet)
 }
 
-func (l *L1L2BatchOrca) Touch(req common.TouchRequest) error {
+func (l *L1L2BatchOrca) Touch(ctx context.Context, req common.TouchRequest) error {
 	//log.Println("touch", string(req.Key))
 
 	// Try L2 first
 	metrics.IncCounter(MetricCmdTouchL2)
 	start := timer.Now()
 
-	err := l.l2.Touch(req)
+	err := l.l2.Touch(ctx, req)
 
 	metrics.ObserveHist(HistTouchL2, timer.Since(start))
 
@@ -447,10 +472,13 @@ func (l *L1L2BatchOrca) Touch(req common.TouchRequest) error {
 	// up to let it naturally expire. If I don't touch or delete in L1 then data
 	// in L1 might live longer. Touching keeps hot data hot, while delete is
 	// more disruptive.
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
 	metrics.IncCounter(MetricCmdTouchTouchL1)
 	start = timer.Now()
 
-	err = l.l1.Touch(req)
+	err = l.l1.Touch(l1ctx, req)
 
 	metrics.ObserveHist(HistTouchL1, timer.Since(start))
 
@@ -469,10 +497,58 @@ func (l *L1L2BatchOrca) Touch(req common.TouchRequest) error {
 
 	metrics.IncCounter(MetricCmdTouchHits)
 
-	return l.res.Touch(req.Opaque)
+	return l.res.Touch(req.Opaque, req.Quiet)
+}
+
+func (l *L1L2BatchOrca) Increment(ctx context.Context, req common.IncrDecrRequest) error {
+	return incrDecrL1L2(ctx, l.l1, l.l2, l.res, common.RequestIncrement, req)
+}
+
+func (l *L1L2BatchOrca) Decrement(ctx context.Context, req common.IncrDecrRequest) error {
+	return incrDecrL1L2(ctx, l.l1, l.l2, l.res, common.RequestDecrement, req)
+}
+
+func (l *L1L2BatchOrca) Flush(ctx context.Context, req common.FlushRequest) error {
+	//log.Println("flush", req.Delay)
+
+	// Flush L2 first. If L1 were flushed first, a concurrent get could miss in
+	// L1, read the old data from L2 and put it right back into L1. Both tiers
+	// get the same delay so they become empty at the same time.
+	metrics.IncCounter(MetricCmdFlushL2)
+	start := timer.Now()
+
+	err := l.l2.Flush(ctx, req)
+
+	metrics.ObserveHist(HistFlushL2, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(MetricCmdFlushErrorsL2)
+		metrics.IncCounter(MetricCmdFlushErrors)
+		return err
+	}
+
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
+
+	metrics.IncCounter(MetricCmdFlushL1)
+	start = timer.Now()
+
+	err = l.l1.Flush(l1ctx, req)
+
+	metrics.ObserveHist(HistFlushL1, timer.Since(start))
+
+	if err != nil {
+		// L2 is already flushed, so any data left in L1 is invalid. Fail the
+		// request so the client knows to retry.
+		metrics.IncCounter(MetricCmdFlushErrorsL1)
+		metrics.IncCounter(MetricCmdFlushErrors)
+		return err
+	}
+
+	return l.res.Flush(req.Opaque, req.Quiet)
 }
 
-func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
+func (l *L1L2BatchOrca) Get(ctx context.Context, req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetKeys, uint64(len(req.Keys)))
 	//debugString := "get"
 	//for _, k := range req.Keys {
@@ -481,59 +557,72 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 	//}
 	//println(debugString)
 
-	metrics.IncCounter(MetricCmdGetL1)
-	metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
-	start := timer.Now()
-
-	resChan, errChan := l.l1.Get(req)
-
 	var err error
 	//var lastres common.GetResponse
 	var l2keys [][]byte
 	var l2opaques []uint32
 	var l2quiets []bool
+	var start uint64
+
+	if req.ReturnCas {
+		// CAS values are only meaningful relative to L2, which is the source of
+		// truth. A client explicitly asking for them skips L1 entirely so the
+		// values it gets back can be used for a later conditional set.
+		l2keys = req.Keys
+		l2opaques = req.Opaques
+		l2quiets = req.Quiet
+	} else {
+		metrics.IncCounter(MetricCmdGetL1)
+		metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
+		start = timer.Now()
 
-	// Read all the responses back from L1.
-	// The contract is that the resChan will have GetResponse's for get hits and misses,
-	// and the errChan will have any other errors, such as an out of memory error from
-	// memcached. If any receive happens from errChan, there will be no more responses
-	// from resChan.
-	for {
-		select {
-		case res, ok := <-resChan:
-			if !ok {
-				resChan = nil
-			} else {
-				if res.Miss {
-					metrics.IncCounter(MetricCmdGetMissesL1)
-					l2keys = append(l2keys, res.Key)
-					l2opaques = append(l2opaques, res.Opaque)
-					l2quiets = append(l2quiets, res.Quiet)
+		resChan, errChan := l.l1.Get(ctx, req)
+
+		// Read all the responses back from L1.
+		// The contract is that the resChan will have GetResponse's for get hits and misses,
+		// and the errChan will have any other errors, such as an out of memory error from
+		// memcached. If any receive happens from errChan, there will be no more responses
+		// from resChan.
+		for {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
 				} else {
-					metrics.IncCounter(MetricCmdGetHits)
-					metrics.IncCounter(MetricCmdGetHitsL1)
-					l.res.Get(res)
+					if res.Miss {
+						metrics.IncCounter(MetricCmdGetMissesL1)
+						l2keys = append(l2keys, res.Key)
+						l2opaques = append(l2opaques, res.Opaque)
+						l2quiets = append(l2quiets, res.Quiet)
+					} else {
+						metrics.IncCounter(MetricCmdGetHits)
+						metrics.IncCounter(MetricCmdGetHitsL1)
+						// L1 CAS values are meaningless to a client, L2 is authoritative
+						res.Cas = 0
+						res.ReturnKey = req.ReturnKey
+						l.res.Get(res)
+					}
+				}
+
+			case getErr, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					metrics.IncCounter(MetricCmdGetErrors)
+					metrics.IncCounter(MetricCmdGetErrorsL1)
+					err = getErr
 				}
 			}
 
-		case getErr, ok := <-errChan:
-			if !ok {
-				errChan = nil
-			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
-				metrics.IncCounter(MetricCmdGetErrorsL1)
-				err = getErr
+			if resChan == nil && errChan == nil {
+				break
 			}
 		}
 
-		if resChan == nil && errChan == nil {
-			break
-		}
+		// record metrics before going to L2
+		metrics.ObserveHist(HistGetL1, timer.Since(start))
 	}
 
-	// record metrics before going to L2
-	metrics.ObserveHist(HistGetL1, timer.Since(start))
-
 	// leave early on all hits
 	if len(l2keys) == 0 {
 		if err != nil {
@@ -549,13 +638,15 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 		NoopOpaque: req.NoopOpaque,
 		Opaques:    l2opaques,
 		Quiet:      l2quiets,
+		ReturnCas:  req.ReturnCas,
+		ReturnKey:  req.ReturnKey,
 	}
 
 	metrics.IncCounter(MetricCmdGetL2)
 	metrics.IncCounterBy(MetricCmdGetKeysL2, uint64(len(l2keys)))
 	start = timer.Now()
 
-	resChan, errChan = l.l2.Get(req)
+	resChan, errChan := l.l2.Get(ctx, req)
 
 	for {
 		select {
@@ -580,12 +671,15 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 				}
 
 				getres := common.GetResponse{
-					Key:    res.Key,
-					Flags:  res.Flags,
-					Data:   res.Data,
-					Miss:   res.Miss,
-					Opaque: res.Opaque,
-					Quiet:  res.Quiet,
+					Key:       res.Key,
+					Flags:     res.Flags,
+					Data:      res.Data,
+					Cas:       res.Cas,
+					Miss:      res.Miss,
+					Opaque:    res.Opaque,
+					Quiet:     res.Quiet,
+					ReturnCas: req.ReturnCas,
+					ReturnKey: req.ReturnKey,
 				}
 
 				l.res.Get(getres)
@@ -615,98 +709,135 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 	return err
 }
 
-func (l *L1L2BatchOrca) GetE(req common.GetRequest) error {
+func (l *L1L2BatchOrca) GetE(ctx context.Context, req common.GetRequest) error {
 	// The L1/L2 batch does not support getE, only L1Only does.
 	log.Println("[WARN] Use of GetE in L1L2 Batch orchestrator")
 	return common.ErrUnknownCmd
 }
 
-func (l *L1L2BatchOrca) Gat(req common.GATRequest) error {
+func (l *L1L2BatchOrca) Gat(ctx context.Context, req common.GATRequest) error {
 	//log.Println("gat", string(req.Key))
 
+	exptimes := gatExptimes(req)
+
 	// Perform L2 for correctness, invalidate in L1 later
 	metrics.IncCounter(MetricCmdGatL2)
 	start := timer.Now()
 
-	res, err := l.l2.GAT(req)
+	resChan, errChan := l.l2.GAT(ctx, req)
 
-	metrics.ObserveHist(HistGatL2, timer.Since(start))
+	l1ctx, cancel := reconcileContext()
+	defer cancel()
 
-	// Errors here are genrally fatal to the connection, as something has gone
-	// seriously wrong. Bail out early.
-	// I should note that this is different than the other commands, where there
-	// are some benevolent "errors" that include KeyNotFound or KeyExists. In
-	// both Get and GAT the mini-internal-protocol is different because the Get
-	// command uses a channel to send results back and an error channel to signal
-	// some kind of fatal problem. The result signals non-fatal "errors"; in this
-	// case it's ErrKeyNotFound --> res.Miss is true.
-	if err != nil {
-		metrics.IncCounter(MetricCmdGatErrorsL2)
-		metrics.IncCounter(MetricCmdGatErrors)
-		return err
-	}
+	var err error
 
-	if res.Miss {
-		// We got a true miss here. L1 is assumed to be missing the data if L2
-		// does not have it.
-		metrics.IncCounter(MetricCmdGatMissesL2)
-		metrics.IncCounter(MetricCmdGatMisses)
+	// Errors here are generally fatal to the connection, as something has gone
+	// seriously wrong. The channel contract is the same as for Get: misses come
+	// back as res.Miss and any error through errChan is the last thing sent.
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if err == nil {
+				if res.Miss {
+					// We got a true miss here. L1 is assumed to be missing the data if L2
+					// does not have it.
+					metrics.IncCounter(MetricCmdGatMissesL2)
+					metrics.IncCounter(MetricCmdGatMisses)
+					res.ReturnKey = req.ReturnKey
+					l.res.GAT(res)
+					continue
+				}
 
-	} else {
-		metrics.IncCounter(MetricCmdGatHitsL2)
+				metrics.IncCounter(MetricCmdGatHitsL2)
 
-		// Success finding and touching the data in L2, but still need to touch
-		// in L1
-		touchreq := common.TouchRequest{
-			Key:    req.Key,
-			Opaque: req.Opaque,
-		}
+				// Success finding and touching the data in L2, but still need to touch
+				// in L1
+				touchreq := common.TouchRequest{
+					Key:     res.Key,
+					Exptime: exptimes[gatKey{string(res.Key), res.Opaque}],
+				}
 
-		// Try touching in L1 to touch hot data. See touch impl for reasoning.
-		metrics.IncCounter(MetricCmdGatTouchL1)
-		start = timer.Now()
+				// Try touching in L1 to touch hot data. See touch impl for reasoning.
+				metrics.IncCounter(MetricCmdGatTouchL1)
+				start2 := timer.Now()
 
-		err = l.l1.Touch(touchreq)
+				terr := l.l1.Touch(l1ctx, touchreq)
 
-		metrics.ObserveHist(HistTouchL1, timer.Since(start))
+				metrics.ObserveHist(HistTouchL1, timer.Since(start2))
 
-		if err != nil {
-			if err == common.ErrKeyNotFound {
-				// For a touch miss in L1, there's no problem.
-				metrics.IncCounter(MetricCmdGatTouchMissesL1)
+				if terr != nil {
+					if terr == common.ErrKeyNotFound {
+						// For a touch miss in L1, there's no problem.
+						metrics.IncCounter(MetricCmdGatTouchMissesL1)
+					} else {
+						metrics.IncCounter(MetricCmdGatTouchErrorsL1)
+						metrics.IncCounter(MetricCmdGatErrors)
+						err = terr
+						continue
+					}
+				} else {
+					metrics.IncCounter(MetricCmdGatTouchHitsL1)
+				}
+
+				// overall operation succeeded
+				metrics.IncCounter(MetricCmdGatHits)
+
+				res.ReturnCas = req.ReturnCas
+				res.ReturnKey = req.ReturnKey
+				l.res.GAT(res)
+			}
+
+		case gatErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
 			} else {
-				metrics.IncCounter(MetricCmdGatTouchErrorsL1)
+				metrics.IncCounter(MetricCmdGatErrorsL2)
 				metrics.IncCounter(MetricCmdGatErrors)
-				return err
+				err = gatErr
 			}
-		} else {
-			metrics.IncCounter(MetricCmdGatTouchHitsL1)
 		}
 
-		// overall operation succeeded
-		metrics.IncCounter(MetricCmdGatHits)
+		if resChan == nil && errChan == nil {
+			break
+		}
+	}
+
+	metrics.ObserveHist(HistGatL2, timer.Since(start))
+
+	if err != nil {
+		return err
 	}
 
-	return l.res.GAT(res)
+	return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+func (l *L1L2BatchOrca) Stats(ctx context.Context, req common.StatsRequest) error {
+	stats, err := common.GetStats(req.Group)
+	if err != nil {
+		return err
+	}
+	return l.res.Stats(req.Opaque, stats)
 }
 
-func (l *L1L2BatchOrca) Noop(req common.NoopRequest) error {
+func (l *L1L2BatchOrca) Noop(ctx context.Context, req common.NoopRequest) error {
 	return l.res.Noop(req.Opaque)
 }
 
-func (l *L1L2BatchOrca) Quit(req common.QuitRequest) error {
+func (l *L1L2BatchOrca) Quit(ctx context.Context, req common.QuitRequest) error {
 	return l.res.Quit(req.Opaque, req.Quiet)
 }
 
-func (l *L1L2BatchOrca) Version(req common.VersionRequest) error {
+func (l *L1L2BatchOrca) Version(ctx context.Context, req common.VersionRequest) error {
 	return l.res.Version(req.Opaque)
 }
 
-func (l *L1L2BatchOrca) Unknown(req common.Request) error {
+func (l *L1L2BatchOrca) Unknown(ctx context.Context, req common.Request) error {
 	return common.ErrUnknownCmd
 }
 
-func (l *L1L2BatchOrca) Error(req common.Request, reqType common.RequestType, err error) {
+func (l *L1L2BatchOrca) Error(ctx context.Context, req common.Request, reqType common.RequestType, err error) {
 	var opaque uint32
 	var quiet bool
 
@@ -15,6 +15,8 @@
 package orcas
 
 import (
+	"context"
+
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
@@ -23,24 +25,24 @@ import (
 )
 
 type L1OnlyOrca struct {
-	l1  handlers.Handler
+	l1  handlers.ContextHandler
 	res protocol.Responder
 }
 
 func L1Only(l1, l2 handlers.Handler, res protocol.Responder) Orca {
-	return &L1OnlyOrca{
-		l1:  l1,
+	return WithoutContext(&L1OnlyOrca{
+		l1:  handlers.WithContext(l1),
 		res: res,
-	}
+	})
 }
 
-func (l *L1OnlyOrca) Set(req common.SetRequest) error {
+func (l *L1OnlyOrca) Set(ctx context.Context, req common.SetRequest) error {
 	//log.Println("set", string(req.Key))
 
 	metrics.IncCounter(MetricCmdSetL1)
 	start := timer.Now()
 
-	err := l.l1.Set(req)
+	err := l.l1.Set(ctx, req)
 
 	metrics.ObserveHist(HistSetL1, timer.Since(start))
 
@@ -48,7 +50,7 @@ func (l *L1OnlyOrca) Set(req common.SetRequest) error {
 		metrics.IncCounter(MetricCmdSetSuccessL1)
 		metrics.IncCounter(MetricCmdSetSuccess)
 
-		err = l.res.Set(req.Opaque, req.Quiet)
+		err = respondStored(l.res, l.l1, common.RequestSet, req)
 
 	} else {
 		metrics.IncCounter(MetricCmdSetErrorsL1)
@@ -58,13 +60,13 @@ func (l *L1OnlyOrca) Set(req common.SetRequest) error {
 	return err
 }
 
-func (l *L1OnlyOrca) Add(req common.SetRequest) error {
+func (l *L1OnlyOrca) Add(ctx context.Context, req common.SetRequest) error {
 	//log.Println("add", string(req.Key))
 
 	metrics.IncCounter(MetricCmdAddL1)
 	start := timer.Now()
 
-	err := l.l1.Add(req)
+	err := l.l1.Add(ctx, req)
 
 	metrics.ObserveHist(HistAddL1, timer.Since(start))
 
@@ -72,7 +74,7 @@ func (l *L1OnlyOrca) Add(req common.SetRequest) error {
 		metrics.IncCounter(MetricCmdAddStoredL1)
 		metrics.IncCounter(MetricCmdAddStored)
 
-		err = l.res.Add(req.Opaque, req.Quiet)
+		err = respondStored(l.res, l.l1, common.RequestAdd, req)
 
 	} else if err == common.ErrKeyExists {
 		metrics.IncCounter(MetricCmdAddNotStoredL1)
@@ -85,13 +87,13 @@ func (l *L1OnlyOrca) Add(req common.SetRequest) error {
 	return err
 }
 
-func (l *L1OnlyOrca) Replace(req common.SetRequest) error {
+func (l *L1OnlyOrca) Replace(ctx context.Context, req common.SetRequest) error {
 	//log.Println("replace", string(req.Key))
 
 	metrics.IncCounter(MetricCmdReplaceL1)
 	start := timer.Now()
 
-	err := l.l1.Replace(req)
+	err := l.l1.Replace(ctx, req)
 
 	metrics.ObserveHist(HistReplaceL1, timer.Since(start))
 
@@ -99,7 +101,7 @@ func (l *L1OnlyOrca) Replace(req common.SetRequest) error {
 		metrics.IncCounter(MetricCmdReplaceStoredL1)
 		metrics.IncCounter(MetricCmdReplaceStored)
 
-		err = l.res.Replace(req.Opaque, req.Quiet)
+		err = respondStored(l.res, l.l1, common.RequestReplace, req)
 
 	} else if err == common.ErrKeyNotFound {
 		metrics.IncCounter(MetricCmdReplaceNotStoredL1)
@@ -112,13 +114,13 @@ func (l *L1OnlyOrca) Replace(req common.SetRequest) error {
 	return err
 }
 
-func (l *L1OnlyOrca) Append(req common.SetRequest) error {
+func (l *L1OnlyOrca) Append(ctx context.Context, req common.SetRequest) error {
 	//log.Println("append", string(req.Key))
 
 	metrics.IncCounter(MetricCmdAppendL1)
 	start := timer.Now()
 
-	err := l.l1.Append(req)
+	err := l.l1.Append(ctx, req)
 
 	metrics.ObserveHist(HistAppendL1, timer.Since(start))
 
@@ -126,7 +128,7 @@ func (l *L1OnlyOrca) Append(req common.SetRequest) error {
 		metrics.IncCounter(MetricCmdAppendStoredL1)
 		metrics.IncCounter(MetricCmdAppendStored)
 
-		err = l.res.Append(req.Opaque, req.Quiet)
+		err = respondStored(l.res, l.l1, common.RequestAppend, req)
 
 	} else if err == common.ErrKeyNotFound {
 		metrics.IncCounter(MetricCmdAppendNotStoredL1)
@@ -139,13 +141,13 @@ func (l *L1OnlyOrca) Append(req common.SetRequest) error {
 	return err
 }
 
-func (l *L1OnlyOrca) Prepend(req common.SetRequest) error {
+func (l *L1OnlyOrca) Prepend(ctx context.Context, req common.SetRequest) error {
 	//log.Println("prepend", string(req.Key))
 
 	metrics.IncCounter(MetricCmdPrependL1)
 	start := timer.Now()
 
-	err := l.l1.Prepend(req)
+	err := l.l1.Prepend(ctx, req)
 
 	metrics.ObserveHist(HistPrependL1, timer.Since(start))
 
@@ -153,7 +155,7 @@ func (l *L1OnlyOrca) Prepend(req common.SetRequest) error {
 		metrics.IncCounter(MetricCmdPrependStoredL1)
 		metrics.IncCounter(MetricCmdPrependStored)
 
-		err = l.res.Prepend(req.Opaque, req.Quiet)
+		err = respondStored(l.res, l.l1, common.RequestPrepend, req)
 
 	} else if err == common.ErrKeyNotFound {
 		metrics.IncCounter(MetricCmdPrependNotStoredL1)
@@ -166,13 +168,13 @@ func (l *L1OnlyOrca) Prepend(req common.SetRequest) error {
 	return err
 }
 
-func (l *L1OnlyOrca) Delete(req common.DeleteRequest) error {
+func (l *L1OnlyOrca) Delete(ctx context.Context, req common.DeleteRequest) error {
 	//log.Println("delete", string(req.Key))
 
 	metrics.IncCounter(MetricCmdDeleteL1)
 	start := timer.Now()
 
-	err := l.l1.Delete(req)
+	err := l.l1.Delete(ctx, req)
 
 	metrics.ObserveHist(HistDeleteL1, timer.Since(start))
 
@@ -180,7 +182,7 @@ func (l *L1OnlyOrca) Delete(req common.DeleteRequest) error {
 		metrics.IncCounter(MetricCmdDeleteHits)
 		metrics.IncCounter(MetricCmdDeleteHitsL1)
 
-		l.res.Delete(req.Opaque)
+		l.res.Delete(req.Opaque, req.Quiet)
 
 	} else if err == common.ErrKeyNotFound {
 		metrics.IncCounter(MetricCmdDeleteMissesL1)
@@ -193,13 +195,13 @@ func (l *L1OnlyOrca) Delete(req common.DeleteRequest) error {
 	return err
 }
 
-func (l *L1OnlyOrca) Touch(req common.TouchRequest) error {
+func (l *L1OnlyOrca) Touch(ctx context.Context, req common.TouchRequest) error {
 	//log.Println("touch", string(req.Key))
 
 	metrics.IncCounter(MetricCmdTouchL1)
 	start := timer.Now()
 
-	err := l.l1.Touch(req)
+	err := l.l1.Touch(ctx, req)
 
 	metrics.ObserveHist(HistTouchL1, timer.Since(start))
 
@@ -207,7 +209,7 @@ func (l *L1OnlyOrca) Touch(req common.TouchRequest) error {
 		metrics.IncCounter(MetricCmdTouchHitsL1)
 		metrics.IncCounter(MetricCmdTouchHits)
 
-		l.res.Touch(req.Opaque)
+		l.res.Touch(req.Opaque, req.Quiet)
 
 	} else if err == common.ErrKeyNotFound {
 		metrics.IncCounter(MetricCmdTouchMissesL1)
@@ -220,7 +222,80 @@ func (l *L1OnlyOrca) Touch(req common.TouchRequest) error {
 	return err
 }
 
-func (l *L1OnlyOrca) Get(req common.GetRequest) error {
+func (l *L1OnlyOrca) Increment(ctx context.Context, req common.IncrDecrRequest) error {
+	//log.Println("incr", string(req.Key))
+
+	metrics.IncCounter(MetricCmdIncrL1)
+	start := timer.Now()
+
+	val, err := l.l1.Increment(ctx, req)
+
+	metrics.ObserveHist(HistIncrL1, timer.Since(start))
+
+	if err == nil {
+		metrics.IncCounter(MetricCmdIncrHitsL1)
+		metrics.IncCounter(MetricCmdIncrHits)
+
+		err = respondIncrDecr(l.res, l.l1, common.RequestIncrement, req, val)
+
+	} else if err == common.ErrKeyNotFound {
+		metrics.IncCounter(MetricCmdIncrMissesL1)
+		metrics.IncCounter(MetricCmdIncrMisses)
+	} else {
+		metrics.IncCounter(MetricCmdIncrErrorsL1)
+		metrics.IncCounter(MetricCmdIncrErrors)
+	}
+
+	return err
+}
+
+func (l *L1OnlyOrca) Decrement(ctx context.Context, req common.IncrDecrRequest) error {
+	//log.Println("decr", string(req.Key))
+
+	metrics.IncCounter(MetricCmdDecrL1)
+	start := timer.Now()
+
+	val, err := l.l1.Decrement(ctx, req)
+
+	metrics.ObserveHist(HistDecrL1, timer.Since(start))
+
+	if err == nil {
+		metrics.IncCounter(MetricCmdDecrHitsL1)
+		metrics.IncCounter(MetricCmdDecrHits)
+
+		err = respondIncrDecr(l.res, l.l1, common.RequestDecrement, req, val)
+
+	} else if err == common.ErrKeyNotFound {
+		metrics.IncCounter(MetricCmdDecrMissesL1)
+		metrics.IncCounter(MetricCmdDecrMisses)
+	} else {
+		metrics.IncCounter(MetricCmdDecrErrorsL1)
+		metrics.IncCounter(MetricCmdDecrErrors)
+	}
+
+	return err
+}
+
+func (l *L1OnlyOrca) Flush(ctx context.Context, req common.FlushRequest) error {
+	//log.Println("flush", req.Delay)
+
+	metrics.IncCounter(MetricCmdFlushL1)
+	start := timer.Now()
+
+	err := l.l1.Flush(ctx, req)
+
+	metrics.ObserveHist(HistFlushL1, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(MetricCmdFlushErrorsL1)
+		metrics.IncCounter(MetricCmdFlushErrors)
+		return err
+	}
+
+	return l.res.Flush(req.Opaque, req.Quiet)
+}
+
+func (l *L1OnlyOrca) Get(ctx context.Context, req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetKeys, uint64(len(req.Keys)))
 	//debugString := "get"
 	//for _, k := range req.Keys {
@@ -233,7 +308,7 @@ func (l *L1OnlyOrca) Get(req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
 	start := timer.Now()
 
-	resChan, errChan := l.l1.Get(req)
+	resChan, errChan := l.l1.Get(ctx, req)
 
 	var err error
 
@@ -255,6 +330,8 @@ func (l *L1OnlyOrca) Get(req common.GetRequest) error {
 					metrics.IncCounter(MetricCmdGetHits)
 					metrics.IncCounter(MetricCmdGetHitsL1)
 				}
+				res.ReturnCas = req.ReturnCas
+				res.ReturnKey = req.ReturnKey
 				l.res.Get(res)
 			}
 
@@ -282,7 +359,7 @@ func (l *L1OnlyOrca) Get(req common.GetRequest) error {
 	return err
 }
 
-func (l *L1OnlyOrca) GetE(req common.GetRequest) error {
+func (l *L1OnlyOrca) GetE(ctx context.Context, req common.GetRequest) error {
 	// For an L1 only orchestrator, this will fail if the backend is memcached.
 	// It should be talking to another rend-based server, such as the L2 for the
 	// EVCache server project.
@@ -298,7 +375,7 @@ func (l *L1OnlyOrca) GetE(req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetEKeysL1, uint64(len(req.Keys)))
 	start := timer.Now()
 
-	resChan, errChan := l.l1.GetE(req)
+	resChan, errChan := l.l1.GetE(ctx, req)
 
 	var err error
 
@@ -347,55 +424,85 @@ func (l *L1OnlyOrca) GetE(req common.GetRequest) error {
 	return err
 }
 
-func (l *L1OnlyOrca) Gat(req common.GATRequest) error {
+func (l *L1OnlyOrca) Gat(ctx context.Context, req common.GATRequest) error {
 	//log.Println("gat", string(req.Key))
 
 	metrics.IncCounter(MetricCmdGatL1)
 	start := timer.Now()
 
-	res, err := l.l1.GAT(req)
+	resChan, errChan := l.l1.GAT(ctx, req)
+
+	var err error
+
+	// Same contract as Get: hits and misses come through resChan and any error comes
+	// through errChan as the last thing sent.
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				if res.Miss {
+					metrics.IncCounter(MetricCmdGatMissesL1)
+					metrics.IncCounter(MetricCmdGatMisses)
+				} else {
+					metrics.IncCounter(MetricCmdGatHits)
+					metrics.IncCounter(MetricCmdGatHitsL1)
+				}
+				res.ReturnCas = req.ReturnCas
+				res.ReturnKey = req.ReturnKey
+				l.res.GAT(res)
+			}
+
+		case gatErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				metrics.IncCounter(MetricCmdGatErrors)
+				metrics.IncCounter(MetricCmdGatErrorsL1)
+				err = gatErr
+			}
+		}
+
+		if resChan == nil && errChan == nil {
+			break
+		}
+	}
 
 	metrics.ObserveHist(HistGatL1, timer.Since(start))
 
 	if err == nil {
-		if res.Miss {
-			metrics.IncCounter(MetricCmdGatMissesL1)
-			// TODO: Account for L2
-			metrics.IncCounter(MetricCmdGatMisses)
-		} else {
-			metrics.IncCounter(MetricCmdGatHits)
-			metrics.IncCounter(MetricCmdGatHitsL1)
-		}
-		l.res.GAT(res)
-		// There is no GetEnd call required here since this is only ever
-		// done in the binary protocol, where there's no END marker.
-		// Calling l.res.GetEnd was a no-op here and is just useless.
-		//l.res.GetEnd(0, false)
-	} else {
-		metrics.IncCounter(MetricCmdGatErrors)
-		metrics.IncCounter(MetricCmdGatErrorsL1)
+		l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
 	}
 
 	return err
 }
 
-func (l *L1OnlyOrca) Noop(req common.NoopRequest) error {
+func (l *L1OnlyOrca) Stats(ctx context.Context, req common.StatsRequest) error {
+	stats, err := common.GetStats(req.Group)
+	if err != nil {
+		return err
+	}
+	return l.res.Stats(req.Opaque, stats)
+}
+
+func (l *L1OnlyOrca) Noop(ctx context.Context, req common.NoopRequest) error {
 	return l.res.Noop(req.Opaque)
 }
 
-func (l *L1OnlyOrca) Quit(req common.QuitRequest) error {
+func (l *L1OnlyOrca) Quit(ctx context.Context, req common.QuitRequest) error {
 	return l.res.Quit(req.Opaque, req.Quiet)
 }
 
-func (l *L1OnlyOrca) Version(req common.VersionRequest) error {
+func (l *L1OnlyOrca) Version(ctx context.Context, req common.VersionRequest) error {
 	return l.res.Version(req.Opaque)
 }
 
-func (l *L1OnlyOrca) Unknown(req common.Request) error {
+func (l *L1OnlyOrca) Unknown(ctx context.Context, req common.Request) error {
 	return common.ErrUnknownCmd
 }
 
-func (l *L1OnlyOrca) Error(req common.Request, reqType common.RequestType, err error) {
+func (l *L1OnlyOrca) Error(ctx context.Context, req common.Request, reqType common.RequestType, err error) {
 	var opaque uint32
 	var quiet bool
 
@@ -15,6 +15,7 @@
 package orcas
 
 import (
+	"context"
 	"hash"
 	"hash/fnv"
 	"sync"
@@ -61,7 +62,7 @@ func getNewLocks(multipleReaders bool, concurrency uint8) (slot uint32) {
 }
 
 type LockedOrca struct {
-	wrapped Orca
+	wrapped ContextOrca
 	locks   []sync.Locker
 	rlocks  []sync.Locker
 	hpool   *sync.Pool
@@ -90,13 +91,13 @@ func Locked(oc OrcaConst, multipleReaders bool, concurrency uint8) (OrcaConst, u
 	}
 
 	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
-		return &LockedOrca{
-			wrapped: oc(l1, l2, res),
+		return WithoutContext(&LockedOrca{
+			wrapped: WithContext(oc(l1, l2, res)),
 			locks:   locks[slot],
 			rlocks:  rlocks[slot],
 			hpool:   hashpool,
 			//counts:  counts,
-		}
+		})
 	}, slot
 }
 
@@ -112,12 +113,12 @@ func LockedWithExisting(oc OrcaConst, locksetID uint32) OrcaConst {
 	}
 
 	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
-		return &LockedOrca{
-			wrapped: oc(l1, l2, res),
+		return WithoutContext(&LockedOrca{
+			wrapped: WithContext(oc(l1, l2, res)),
 			locks:   locks[locksetID],
 			rlocks:  rlocks[locksetID],
 			hpool:   hashpool,
-		}
+		})
 	}
 }
 
@@ -148,63 +149,90 @@ func (l *LockedOrca) getlock(key []byte, read bool) sync.Locker {
 	return l.locks[bucket]
 }
 
-func (l *LockedOrca) Set(req common.SetRequest) error {
+func (l *LockedOrca) Set(ctx context.Context, req common.SetRequest) error {
+	lock := l.getlock(req.Key, false)
+	lock.Lock()
+	defer lock.Unlock()
+	ret := l.wrapped.Set(ctx, req)
+	return ret
+}
+
+func (l *LockedOrca) Add(ctx context.Context, req common.SetRequest) error {
 	lock := l.getlock(req.Key, false)
 	lock.Lock()
 	defer lock.Unlock()
-	ret := l.wrapped.Set(req)
+	ret := l.wrapped.Add(ctx, req)
 	return ret
 }
 
-func (l *LockedOrca) Add(req common.SetRequest) error {
+func (l *LockedOrca) Replace(ctx context.Context, req common.SetRequest) error {
 	lock := l.getlock(req.Key, false)
 	lock.Lock()
 	defer lock.Unlock()
-	ret := l.wrapped.Add(req)
+	ret := l.wrapped.Replace(ctx, req)
 	return ret
 }
 
-func (l *LockedOrca) Replace(req common.SetRequest) error {
+func (l *LockedOrca) Append(ctx context.Context, req common.SetRequest) error {
 	lock := l.getlock(req.Key, false)
 	lock.Lock()
 	defer lock.Unlock()
-	ret := l.wrapped.Replace(req)
+	ret := l.wrapped.Append(ctx, req)
 	return ret
 }
 
-func (l *LockedOrca) Append(req common.SetRequest) error {
+func (l *LockedOrca) Prepend(ctx context.Context, req common.SetRequest) error {
 	lock := l.getlock(req.Key, false)
 	lock.Lock()
 	defer lock.Unlock()
-	ret := l.wrapped.Append(req)
+	ret := l.wrapped.Prepend(ctx, req)
 	return ret
 }
 
-func (l *LockedOrca) Prepend(req common.SetRequest) error {
+func (l *LockedOrca) Delete(ctx context.Context, req common.DeleteRequest) error {
 	lock := l.getlock(req.Key, false)
 	lock.Lock()
 	defer lock.Unlock()
-	ret := l.wrapped.Prepend(req)
+	ret := l.wrapped.Delete(ctx, req)
 	return ret
 }
 
-func (l *LockedOrca) Delete(req common.DeleteRequest) error {
+func (l *LockedOrca) Touch(ctx context.Context, req common.TouchRequest) error {
 	lock := l.getlock(req.Key, false)
 	lock.Lock()
 	defer lock.Unlock()
-	ret := l.wrapped.Delete(req)
+	ret := l.wrapped.Touch(ctx, req)
 	return ret
 }
 
-func (l *LockedOrca) Touch(req common.TouchRequest) error {
+func (l *LockedOrca) Increment(ctx context.Context, req common.IncrDecrRequest) error {
 	lock := l.getlock(req.Key, false)
 	lock.Lock()
 	defer lock.Unlock()
-	ret := l.wrapped.Touch(req)
+	ret := l.wrapped.Increment(ctx, req)
 	return ret
 }
 
-func (l *LockedOrca) Get(req common.GetRequest) error {
+func (l *LockedOrca) Decrement(ctx context.Context, req common.IncrDecrRequest) error {
+	lock := l.getlock(req.Key, false)
+	lock.Lock()
+	defer lock.Unlock()
+	ret := l.wrapped.Decrement(ctx, req)
+	return ret
+}
+
+func (l *LockedOrca) Flush(ctx context.Context, req common.FlushRequest) error {
+	// There is no single key to lock here. A flush racing with a set may
+	// leave that one item in place, which is the same as the set arriving
+	// right after the flush.
+	return l.wrapped.Flush(ctx, req)
+}
+
+func (l *LockedOrca) Stats(ctx context.Context, req common.StatsRequest) error {
+	return l.wrapped.Stats(ctx, req)
+}
+
+func (l *LockedOrca) Get(ctx context.Context, req common.GetRequest) error {
 	// Lock for each read key, complete the read, and then move on.
 	// The last key sent through should have a noop at the end to complete the
 	// whole interaction between the client and this server.
@@ -239,10 +267,12 @@ func (l *LockedOrca) Get(req common.GetRequest) error {
 			Quiet:      []bool{req.Quiet[idx]},
 			NoopOpaque: noopOpaque,
 			NoopEnd:    noopEnd,
+			ReturnCas:  req.ReturnCas,
+			ReturnKey:  req.ReturnKey,
 		}
 
 		// Make the actual request
-		ret = l.wrapped.Get(subreq)
+		ret = l.wrapped.Get(ctx, subreq)
 
 		// release read lock
 		lock.Unlock()
@@ -258,7 +288,7 @@ func (l *LockedOrca) Get(req common.GetRequest) error {
 	return ret
 }
 
-func (l *LockedOrca) GetE(req common.GetRequest) error {
+func (l *LockedOrca) GetE(ctx context.Context, req common.GetRequest) error {
 	// Lock for each read key, complete the read, and then move on.
 	// The last key sent through should have a noop at the end to complete the
 	// whole interaction between the client and this server.
@@ -298,7 +328,7 @@ func (l *LockedOrca) GetE(req common.GetRequest) error {
 		}
 
 		// Make the actual request
-		ret = l.wrapped.GetE(subreq)
+		ret = l.wrapped.GetE(ctx, subreq)
 
 		// release read lock
 		lock.Unlock()
@@ -314,30 +344,73 @@ func (l *LockedOrca) GetE(req common.GetRequest) error {
 	return ret
 }
 
-func (l *LockedOrca) Gat(req common.GATRequest) error {
-	lock := l.getlock(req.Key, false)
-	lock.Lock()
-	defer lock.Unlock()
-	ret := l.wrapped.Gat(req)
+func (l *LockedOrca) Gat(ctx context.Context, req common.GATRequest) error {
+	// Same as Get, but each key is written to so it takes the write lock.
+	var ret error
+	var lock sync.Locker
+
+	// guarantee that an operation that failed with a panic will unlock its lock
+	defer func() {
+		if r := recover(); r != nil {
+			if lock != nil {
+				lock.Unlock()
+			}
+		}
+	}()
+
+	for idx, key := range req.Keys {
+		// Acquire write lock (false == write)
+		lock = l.getlock(key, false)
+		lock.Lock()
+
+		// The last request will have these set to complete the interaction
+		noopOpaque := uint32(0)
+		noopEnd := false
+		if idx == len(req.Keys)-1 {
+			noopOpaque = req.NoopOpaque
+			noopEnd = req.NoopEnd
+		}
+
+		subreq := common.GATRequest{
+			Keys:       [][]byte{key},
+			Exptimes:   []uint32{req.Exptimes[idx]},
+			Opaques:    []uint32{req.Opaques[idx]},
+			Quiet:      []bool{req.Quiet[idx]},
+			NoopOpaque: noopOpaque,
+			NoopEnd:    noopEnd,
+			ReturnCas:  req.ReturnCas,
+			ReturnKey:  req.ReturnKey,
+		}
+
+		ret = l.wrapped.Gat(ctx, subreq)
+
+		// release write lock
+		lock.Unlock()
+
+		if ret != nil {
+			break
+		}
+	}
+
 	return ret
 }
 
-func (l *LockedOrca) Noop(req common.NoopRequest) error {
-	return l.wrapped.Noop(req)
+func (l *LockedOrca) Noop(ctx context.Context, req common.NoopRequest) error {
+	return l.wrapped.Noop(ctx, req)
 }
 
-func (l *LockedOrca) Quit(req common.QuitRequest) error {
-	return l.wrapped.Quit(req)
+func (l *LockedOrca) Quit(ctx context.Context, req common.QuitRequest) error {
+	return l.wrapped.Quit(ctx, req)
 }
 
-func (l *LockedOrca) Version(req common.VersionRequest) error {
-	return l.wrapped.Version(req)
+func (l *LockedOrca) Version(ctx context.Context, req common.VersionRequest) error {
+	return l.wrapped.Version(ctx, req)
 }
 
-func (l *LockedOrca) Unknown(req common.Request) error {
-	return l.wrapped.Unknown(req)
+func (l *LockedOrca) Unknown(ctx context.Context, req common.Request) error {
+	return l.wrapped.Unknown(ctx, req)
 }
 
-func (l *LockedOrca) Error(req common.Request, reqType common.RequestType, err error) {
-	l.wrapped.Error(req, reqType, err)
+func (l *LockedOrca) Error(ctx context.Context, req common.Request, reqType common.RequestType, err error) {
+	l.wrapped.Error(ctx, req, reqType, err)
 }
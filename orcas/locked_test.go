@@ -29,20 +29,24 @@ func testPanicOrcaConst(l1, l2 handlers.Handler, res protocol.Responder) orcas.O
 	return testPanicOrca{}
 }
 
-func (t testPanicOrca) Set(req common.SetRequest) error         { panic("test") }
-func (t testPanicOrca) Add(req common.SetRequest) error         { panic("test") }
-func (t testPanicOrca) Replace(req common.SetRequest) error     { panic("test") }
-func (t testPanicOrca) Append(req common.SetRequest) error      { panic("test") }
-func (t testPanicOrca) Prepend(req common.SetRequest) error     { panic("test") }
-func (t testPanicOrca) Delete(req common.DeleteRequest) error   { panic("test") }
-func (t testPanicOrca) Touch(req common.TouchRequest) error     { panic("test") }
-func (t testPanicOrca) Get(req common.GetRequest) error         { panic("test") }
-func (t testPanicOrca) GetE(req common.GetRequest) error        { panic("test") }
-func (t testPanicOrca) Gat(req common.GATRequest) error         { panic("test") }
-func (t testPanicOrca) Noop(req common.NoopRequest) error       { panic("test") }
-func (t testPanicOrca) Quit(req common.QuitRequest) error       { panic("test") }
-func (t testPanicOrca) Version(req common.VersionRequest) error { panic("test") }
-func (t testPanicOrca) Unknown(req common.Request) error        { panic("test") }
+func (t testPanicOrca) Set(req common.SetRequest) error            { panic("test") }
+func (t testPanicOrca) Add(req common.SetRequest) error            { panic("test") }
+func (t testPanicOrca) Replace(req common.SetRequest) error        { panic("test") }
+func (t testPanicOrca) Append(req common.SetRequest) error         { panic("test") }
+func (t testPanicOrca) Prepend(req common.SetRequest) error        { panic("test") }
+func (t testPanicOrca) Delete(req common.DeleteRequest) error      { panic("test") }
+func (t testPanicOrca) Touch(req common.TouchRequest) error        { panic("test") }
+func (t testPanicOrca) Increment(req common.IncrDecrRequest) error { panic("test") }
+func (t testPanicOrca) Decrement(req common.IncrDecrRequest) error { panic("test") }
+func (t testPanicOrca) Flush(req common.FlushRequest) error        { panic("test") }
+func (t testPanicOrca) Stats(req common.StatsRequest) error        { panic("test") }
+func (t testPanicOrca) Get(req common.GetRequest) error            { panic("test") }
+func (t testPanicOrca) GetE(req common.GetRequest) error           { panic("test") }
+func (t testPanicOrca) Gat(req common.GATRequest) error            { panic("test") }
+func (t testPanicOrca) Noop(req common.NoopRequest) error          { panic("test") }
+func (t testPanicOrca) Quit(req common.QuitRequest) error          { panic("test") }
+func (t testPanicOrca) Version(req common.VersionRequest) error    { panic("test") }
+func (t testPanicOrca) Unknown(req common.Request) error           { panic("test") }
 
 func (t testPanicOrca) Error(req common.Request, reqType common.RequestType, err error) {}
 
@@ -146,6 +150,34 @@ func TestPanicUnlocksOrca(t *testing.T) {
 			// if this times out, the test fails
 			f()
 		})
+		t.Run("Increment", func(t *testing.T) {
+			loc, _ := orcas.Locked(testPanicOrcaConst, true, 0)
+			lo := loc(nil, nil, nil)
+
+			// make a separate function to be able to recover twice
+			f := func() {
+				defer func() { recover() }()
+				lo.Increment(common.IncrDecrRequest{})
+			}
+
+			f()
+			// if this times out, the test fails
+			f()
+		})
+		t.Run("Decrement", func(t *testing.T) {
+			loc, _ := orcas.Locked(testPanicOrcaConst, true, 0)
+			lo := loc(nil, nil, nil)
+
+			// make a separate function to be able to recover twice
+			f := func() {
+				defer func() { recover() }()
+				lo.Decrement(common.IncrDecrRequest{})
+			}
+
+			f()
+			// if this times out, the test fails
+			f()
+		})
 		t.Run("Get", func(t *testing.T) {
 			loc, _ := orcas.Locked(testPanicOrcaConst, true, 0)
 			lo := loc(nil, nil, nil)
@@ -344,6 +376,34 @@ func TestPanicUnlocksOrca(t *testing.T) {
 			// if this times out, the test fails
 			f()
 		})
+		t.Run("Increment", func(t *testing.T) {
+			loc, _ := orcas.Locked(testPanicOrcaConst, false, 0)
+			lo := loc(nil, nil, nil)
+
+			// make a separate function to be able to recover twice
+			f := func() {
+				defer func() { recover() }()
+				lo.Increment(common.IncrDecrRequest{})
+			}
+
+			f()
+			// if this times out, the test fails
+			f()
+		})
+		t.Run("Decrement", func(t *testing.T) {
+			loc, _ := orcas.Locked(testPanicOrcaConst, false, 0)
+			lo := loc(nil, nil, nil)
+
+			// make a separate function to be able to recover twice
+			f := func() {
+				defer func() { recover() }()
+				lo.Decrement(common.IncrDecrRequest{})
+			}
+
+			f()
+			// if this times out, the test fails
+			f()
+		})
 		t.Run("Get", func(t *testing.T) {
 			loc, _ := orcas.Locked(testPanicOrcaConst, false, 0)
 			lo := loc(nil, nil, nil)
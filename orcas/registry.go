@@ -0,0 +1,58 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import "github.com/netflix/rend/common"
+
+// Factory creates an OrcaConst by name. It works the same way as handlers.Factory. The wrappers
+// like Locked and ACL are not registered here since they need state shared between listeners or
+// loaded from files, so they are applied by whatever assembles the server.
+type Factory struct {
+	// Options returns a pointer to a new options value with the defaults set, or is nil if the
+	// orca has no options
+	Options func() interface{}
+
+	// New returns the OrcaConst for the decoded options
+	New func(opts interface{}) (OrcaConst, error)
+}
+
+var registry = common.NewRegistry("orca")
+
+func init() {
+	Register("l1only", Factory{New: func(interface{}) (OrcaConst, error) { return L1Only, nil }})
+	Register("l1l2", Factory{New: func(interface{}) (OrcaConst, error) { return L1L2, nil }})
+	Register("l1l2batch", Factory{New: func(interface{}) (OrcaConst, error) { return L1L2Batch, nil }})
+}
+
+// Register makes an orca available by name. It panics if the name is already registered.
+func Register(name string, f Factory) {
+	registry.Register(name, f.Options, func(opts interface{}) (interface{}, error) {
+		return f.New(opts)
+	})
+}
+
+// New returns the OrcaConst for the named orca with the given JSON options
+func New(name string, options []byte) (OrcaConst, error) {
+	o, err := registry.Build(name, options)
+	if err != nil {
+		return nil, err
+	}
+	return o.(OrcaConst), nil
+}
+
+// Registered returns the names of all registered orcas
+func Registered() []string {
+	return registry.Names()
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/netflix/rend/orcas"
+)
+
+type testRegistryOpts struct {
+	Fail  bool `json:"fail"`
+	Count int  `json:"count"`
+}
+
+func init() {
+	orcas.Register("test-registry", orcas.Factory{
+		Options: func() interface{} { return &testRegistryOpts{Count: 3} },
+		New: func(opts interface{}) (orcas.OrcaConst, error) {
+			o := opts.(*testRegistryOpts)
+			if o.Fail {
+				return nil, errors.New("told to fail")
+			}
+			if o.Count != 3 {
+				return testPanicOrcaConst, nil
+			}
+			return orcas.L1Only, nil
+		},
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	t.Run("BuiltIn", func(t *testing.T) {
+		for _, name := range []string{"l1only", "l1l2", "l1l2batch"} {
+			o, err := orcas.New(name, nil)
+			if err != nil || o == nil {
+				t.Fatalf("Expected built in orca %s to be registered, got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		if _, err := orcas.New("nope", nil); err == nil {
+			t.Fatal("Expected an error for an unknown orca")
+		}
+	})
+
+	t.Run("NoOptionsAllowed", func(t *testing.T) {
+		if _, err := orcas.New("l1only", []byte(`{"x": 1}`)); err == nil {
+			t.Fatal("Expected an error for options given to an orca without any")
+		}
+		if _, err := orcas.New("l1only", []byte(`null`)); err != nil {
+			t.Fatalf("Expected null options to be the same as none, got %v", err)
+		}
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		o, err := orcas.New("test-registry", nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// The count default was kept, so the real orca was returned
+		if o(nil, nil, nil) == (testPanicOrca{}) {
+			t.Fatal("Expected the default options to be used")
+		}
+	})
+
+	t.Run("Options", func(t *testing.T) {
+		o, err := orcas.New("test-registry", []byte(`{"count": 4}`))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if o(nil, nil, nil) != (testPanicOrca{}) {
+			t.Fatal("Expected the options to be decoded")
+		}
+	})
+
+	t.Run("FactoryError", func(t *testing.T) {
+		if _, err := orcas.New("test-registry", []byte(`{"fail": true}`)); err == nil {
+			t.Fatal("Expected the factory's error to be returned")
+		}
+	})
+
+	t.Run("UnknownOption", func(t *testing.T) {
+		if _, err := orcas.New("test-registry", []byte(`{"cuont": 4}`)); err == nil {
+			t.Fatal("Expected an error for a misspelled option")
+		}
+	})
+
+	t.Run("WrongType", func(t *testing.T) {
+		if _, err := orcas.New("test-registry", []byte(`{"count": "4"}`)); err == nil {
+			t.Fatal("Expected an error for an option of the wrong type")
+		}
+	})
+
+	t.Run("Duplicate", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Expected registering a name twice to panic")
+			}
+		}()
+		orcas.Register("l1only", orcas.Factory{
+			New: func(interface{}) (orcas.OrcaConst, error) { return orcas.L1Only, nil },
+		})
+	})
+}
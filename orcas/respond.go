@@ -0,0 +1,56 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/protocol"
+)
+
+// respondStored answers a store that succeeded. If the protocol can send the client the new CAS
+// value of the item, it gets the one reported by h, which is the handler that holds the
+// authoritative copy of the data.
+func respondStored(res protocol.Responder, h interface{}, reqType common.RequestType, req common.SetRequest) error {
+	if cr, ok := res.(protocol.CasResponder); ok {
+		return cr.Stored(reqType, req.Opaque, handlers.LastCas(h), req.Quiet)
+	}
+
+	switch reqType {
+	case common.RequestAdd:
+		return res.Add(req.Opaque, req.Quiet)
+	case common.RequestReplace:
+		return res.Replace(req.Opaque, req.Quiet)
+	case common.RequestAppend:
+		return res.Append(req.Opaque, req.Quiet)
+	case common.RequestPrepend:
+		return res.Prepend(req.Opaque, req.Quiet)
+	default:
+		return res.Set(req.Opaque, req.Quiet)
+	}
+}
+
+// respondIncrDecr answers an increment or decrement that succeeded the same way respondStored
+// answers a store
+func respondIncrDecr(res protocol.Responder, h interface{}, reqType common.RequestType, req common.IncrDecrRequest, value uint64) error {
+	if cr, ok := res.(protocol.CasResponder); ok {
+		return cr.IncrDecr(reqType, req.Opaque, value, handlers.LastCas(h), req.Quiet)
+	}
+
+	if reqType == common.RequestDecrement {
+		return res.Decrement(req.Opaque, value, req.Quiet)
+	}
+	return res.Increment(req.Opaque, value, req.Quiet)
+}
@@ -15,6 +15,8 @@
 package orcas
 
 import (
+	"net"
+
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
@@ -31,6 +33,10 @@ type Orca interface {
 	Prepend(req common.SetRequest) error
 	Delete(req common.DeleteRequest) error
 	Touch(req common.TouchRequest) error
+	Increment(req common.IncrDecrRequest) error
+	Decrement(req common.IncrDecrRequest) error
+	Flush(req common.FlushRequest) error
+	Stats(req common.StatsRequest) error
 	Get(req common.GetRequest) error
 	GetE(req common.GetRequest) error
 	Gat(req common.GATRequest) error
@@ -41,6 +47,19 @@ type Orca interface {
 	Error(req common.Request, reqType common.RequestType, err error)
 }
 
+// UserAware is implemented by orchestrators that make decisions based on the user a connection
+// has authenticated as. The server calls SetUser whenever that changes. An empty user means the
+// connection is not authenticated.
+type UserAware interface {
+	SetUser(user string)
+}
+
+// RemoteAddrAware is implemented by orchestrators that want to know the address of the client.
+// The server calls SetRemoteAddr once before the first request.
+type RemoteAddrAware interface {
+	SetRemoteAddr(addr net.Addr)
+}
+
 var (
 	MetricCmdGetL1       = metrics.AddCounter("cmd_get_l1", nil)
 	MetricCmdGetL2       = metrics.AddCounter("cmd_get_l2", nil)
@@ -56,6 +75,7 @@ var (
 	MetricCmdGetKeys     = metrics.AddCounter("cmd_get_keys", nil)
 	MetricCmdGetKeysL1   = metrics.AddCounter("cmd_get_keys_l1", nil)
 	MetricCmdGetKeysL2   = metrics.AddCounter("cmd_get_keys_l2", nil)
+	MetricCmdGetCanceled = metrics.AddCounter("cmd_get_canceled", nil)
 
 	MetricCmdGetSetL1       = metrics.AddCounter("cmd_get_set_l1", nil)
 	MetricCmdGetSetErrorsL1 = metrics.AddCounter("cmd_get_set_errors_l1", nil)
@@ -198,6 +218,51 @@ var (
 	MetricCmdTouchTouchErrorsL1 = metrics.AddCounter("cmd_touch_touch_errors_l1", nil)
 	MetricCmdTouchTouchHitsL1   = metrics.AddCounter("cmd_touch_touch_hits_l1", nil)
 
+	MetricCmdIncrL1       = metrics.AddCounter("cmd_incr_l1", nil)
+	MetricCmdIncrL2       = metrics.AddCounter("cmd_incr_l2", nil)
+	MetricCmdIncrHits     = metrics.AddCounter("cmd_incr_hits", nil)
+	MetricCmdIncrHitsL1   = metrics.AddCounter("cmd_incr_hits_l1", nil)
+	MetricCmdIncrHitsL2   = metrics.AddCounter("cmd_incr_hits_l2", nil)
+	MetricCmdIncrMisses   = metrics.AddCounter("cmd_incr_misses", nil)
+	MetricCmdIncrMissesL1 = metrics.AddCounter("cmd_incr_misses_l1", nil)
+	MetricCmdIncrMissesL2 = metrics.AddCounter("cmd_incr_misses_l2", nil)
+	MetricCmdIncrErrors   = metrics.AddCounter("cmd_incr_errors", nil)
+	MetricCmdIncrErrorsL1 = metrics.AddCounter("cmd_incr_errors_l1", nil)
+	MetricCmdIncrErrorsL2 = metrics.AddCounter("cmd_incr_errors_l2", nil)
+
+	MetricCmdDecrL1       = metrics.AddCounter("cmd_decr_l1", nil)
+	MetricCmdDecrL2       = metrics.AddCounter("cmd_decr_l2", nil)
+	MetricCmdDecrHits     = metrics.AddCounter("cmd_decr_hits", nil)
+	MetricCmdDecrHitsL1   = metrics.AddCounter("cmd_decr_hits_l1", nil)
+	MetricCmdDecrHitsL2   = metrics.AddCounter("cmd_decr_hits_l2", nil)
+	MetricCmdDecrMisses   = metrics.AddCounter("cmd_decr_misses", nil)
+	MetricCmdDecrMissesL1 = metrics.AddCounter("cmd_decr_misses_l1", nil)
+	MetricCmdDecrMissesL2 = metrics.AddCounter("cmd_decr_misses_l2", nil)
+	MetricCmdDecrErrors   = metrics.AddCounter("cmd_decr_errors", nil)
+	MetricCmdDecrErrorsL1 = metrics.AddCounter("cmd_decr_errors_l1", nil)
+	MetricCmdDecrErrorsL2 = metrics.AddCounter("cmd_decr_errors_l2", nil)
+
+	// Secondary metrics under incr and decr for invalidating the key in L1
+	// after the authoritative change was made in L2
+	MetricCmdIncrDeleteL1       = metrics.AddCounter("cmd_incr_delete_l1", nil)
+	MetricCmdIncrDeleteHitsL1   = metrics.AddCounter("cmd_incr_delete_hits_l1", nil)
+	MetricCmdIncrDeleteMissesL1 = metrics.AddCounter("cmd_incr_delete_misses_l1", nil)
+	MetricCmdIncrDeleteErrorsL1 = metrics.AddCounter("cmd_incr_delete_errors_l1", nil)
+	MetricCmdDecrDeleteL1       = metrics.AddCounter("cmd_decr_delete_l1", nil)
+	MetricCmdDecrDeleteHitsL1   = metrics.AddCounter("cmd_decr_delete_hits_l1", nil)
+	MetricCmdDecrDeleteMissesL1 = metrics.AddCounter("cmd_decr_delete_misses_l1", nil)
+	MetricCmdDecrDeleteErrorsL1 = metrics.AddCounter("cmd_decr_delete_errors_l1", nil)
+
+	MetricCmdFlushL1       = metrics.AddCounter("cmd_flush_l1", nil)
+	MetricCmdFlushL2       = metrics.AddCounter("cmd_flush_l2", nil)
+	MetricCmdFlushErrors   = metrics.AddCounter("cmd_flush_errors", nil)
+	MetricCmdFlushErrorsL1 = metrics.AddCounter("cmd_flush_errors_l1", nil)
+	MetricCmdFlushErrorsL2 = metrics.AddCounter("cmd_flush_errors_l2", nil)
+	MetricCmdFlushRejected = metrics.AddCounter("cmd_flush_rejected", nil)
+
+	MetricACLDenied  = metrics.AddCounter("acl_denied", nil)
+	MetricACLReloads = metrics.AddCounter("acl_reloads", nil)
+
 	MetricCmdGatL1       = metrics.AddCounter("cmd_gat_l1", nil)
 	MetricCmdGatL2       = metrics.AddCounter("cmd_gat_l2", nil)
 	MetricCmdGatHits     = metrics.AddCounter("cmd_gat_hits", nil)
@@ -245,6 +310,12 @@ var (
 	HistDeleteL2  = metrics.AddHistogram("delete_l2", false, nil)
 	HistTouchL1   = metrics.AddHistogram("touch_l1", false, nil)
 	HistTouchL2   = metrics.AddHistogram("touch_l2", false, nil)
+	HistIncrL1    = metrics.AddHistogram("incr_l1", false, nil)
+	HistIncrL2    = metrics.AddHistogram("incr_l2", false, nil)
+	HistDecrL1    = metrics.AddHistogram("decr_l1", false, nil)
+	HistDecrL2    = metrics.AddHistogram("decr_l2", false, nil)
+	HistFlushL1   = metrics.AddHistogram("flush_l1", false, nil)
+	HistFlushL2   = metrics.AddHistogram("flush_l2", false, nil)
 
 	HistGetL1 = metrics.AddHistogram("get_l1", false, nil) // not sampled until configurable
 	HistGetL2 = metrics.AddHistogram("get_l2", false, nil) // not sampled until configurable
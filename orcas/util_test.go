@@ -15,6 +15,7 @@
 package orcas_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/netflix/rend/common"
@@ -24,6 +25,7 @@ type testHandler struct {
 	errors     []error
 	responses  []common.GetResponse
 	eresponses []common.GetEResponse
+	values     []uint64
 }
 
 func (h *testHandler) verifyEmpty(t *testing.T) {
@@ -36,6 +38,9 @@ func (h *testHandler) verifyEmpty(t *testing.T) {
 	if len(h.eresponses) > 0 {
 		t.Fatalf("Expected errors to be empty. Left over: %#v", h.eresponses)
 	}
+	if len(h.values) > 0 {
+		t.Fatalf("Expected values to be empty. Left over: %#v", h.values)
+	}
 }
 
 func (h *testHandler) Set(cmd common.SetRequest) error {
@@ -113,10 +118,8 @@ func (h *testHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <
 
 	return reschan, errchan
 }
-func (h *testHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
-	ret := h.errors[0]
-	h.errors = h.errors[1:]
-	return common.GetResponse{}, ret
+func (h *testHandler) GAT(cmd common.GATRequest) (<-chan common.GetResponse, <-chan error) {
+	return h.Get(common.GetRequest{})
 }
 func (h *testHandler) Delete(cmd common.DeleteRequest) error {
 	ret := h.errors[0]
@@ -128,8 +131,73 @@ func (h *testHandler) Touch(cmd common.TouchRequest) error {
 	h.errors = h.errors[1:]
 	return ret
 }
+func (h *testHandler) Increment(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecr()
+}
+func (h *testHandler) Decrement(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecr()
+}
+func (h *testHandler) incrDecr() (uint64, error) {
+	if len(h.values) > 0 {
+		ret := h.values[0]
+		h.values = h.values[1:]
+		return ret, nil
+	}
+
+	ret := h.errors[0]
+	h.errors = h.errors[1:]
+	return 0, ret
+}
+func (h *testHandler) Flush(cmd common.FlushRequest) error {
+	ret := h.errors[0]
+	h.errors = h.errors[1:]
+	return ret
+}
 func (h *testHandler) Close() error {
 	ret := h.errors[0]
 	h.errors = h.errors[1:]
 	return ret
 }
+
+// cancelingHandler cancels a context after each get or set, like a client that hangs up while the
+// request is in flight
+type cancelingHandler struct {
+	*testHandler
+	cancel context.CancelFunc
+}
+
+func (h cancelingHandler) Set(cmd common.SetRequest) error {
+	defer h.cancel()
+	return h.testHandler.Set(cmd)
+}
+
+func (h cancelingHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	defer h.cancel()
+	return h.testHandler.Get(cmd)
+}
+
+// gatHandler answers every key of a GAT with a hit and counts the GAT calls
+type gatHandler struct {
+	*testHandler
+	gats int
+}
+
+func (h *gatHandler) GAT(cmd common.GATRequest) (<-chan common.GetResponse, <-chan error) {
+	h.gats++
+
+	reschan := make(chan common.GetResponse, len(cmd.Keys))
+	for i, key := range cmd.Keys {
+		reschan <- common.GetResponse{
+			Key:    key,
+			Opaque: cmd.Opaques[i],
+			Quiet:  cmd.Quiet[i],
+			Data:   []byte("foo"),
+		}
+	}
+	close(reschan)
+
+	errchan := make(chan error)
+	close(errchan)
+
+	return reschan, errchan
+}
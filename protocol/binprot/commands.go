@@ -23,12 +23,12 @@ import (
 )
 
 // Data commands are those that send a header, key, exptime, and data
-func writeDataCmdCommon(w io.Writer, opcode uint8, key []byte, flags, exptime, dataSize, opaque uint32) error {
+func writeDataCmdCommon(w io.Writer, opcode uint8, key []byte, flags, exptime, dataSize, opaque uint32, cas uint64) error {
 	// opcode, keyLength, extraLength, totalBodyLength
 	// key + extras + body
 	extrasLen := 8
 	totalBodyLength := len(key) + extrasLen + int(dataSize)
-	header := makeRequestHeader(opcode, len(key), extrasLen, totalBodyLength, opaque)
+	header := makeRequestHeader(opcode, len(key), extrasLen, totalBodyLength, opaque, cas)
 
 	writeRequestHeader(w, header)
 
@@ -46,31 +46,31 @@ func writeDataCmdCommon(w io.Writer, opcode uint8, key []byte, flags, exptime, d
 }
 
 // WriteSetCmd writes out the binary representation of a set request header to the given io.Writer
-func WriteSetCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32) error {
+func WriteSetCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32, cas uint64) error {
 	//fmt.Printf("Set: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
 	//string(key), flags, exptime, dataSize, totalBodyLength)
-	return writeDataCmdCommon(w, OpcodeSet, key, flags, exptime, dataSize, opaque)
+	return writeDataCmdCommon(w, OpcodeSet, key, flags, exptime, dataSize, opaque, cas)
 }
 
 // WriteAddCmd writes out the binary representation of an add request header to the given io.Writer
-func WriteAddCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32) error {
+func WriteAddCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32, cas uint64) error {
 	//fmt.Printf("Add: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
 	//string(key), flags, exptime, dataSize, totalBodyLength)
-	return writeDataCmdCommon(w, OpcodeAdd, key, flags, exptime, dataSize, opaque)
+	return writeDataCmdCommon(w, OpcodeAdd, key, flags, exptime, dataSize, opaque, cas)
 }
 
 // WriteReplaceCmd writes out the binary representation of a replace request header to the given io.Writer
-func WriteReplaceCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32) error {
+func WriteReplaceCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32, cas uint64) error {
 	//fmt.Printf("Replace: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
 	//string(key), flags, exptime, dataSize, totalBodyLength)
-	return writeDataCmdCommon(w, OpcodeReplace, key, flags, exptime, dataSize, opaque)
+	return writeDataCmdCommon(w, OpcodeReplace, key, flags, exptime, dataSize, opaque, cas)
 }
 
-func writeAppendPrependCmdCommon(w io.Writer, opcode uint8, key []byte, flags, exptime, dataSize, opaque uint32) error {
+func writeAppendPrependCmdCommon(w io.Writer, opcode uint8, key []byte, flags, exptime, dataSize, opaque uint32, cas uint64) error {
 	// opcode, keyLength, extraLength, totalBodyLength
 	// key + body
 	totalBodyLength := len(key) + int(dataSize)
-	header := makeRequestHeader(opcode, len(key), 0, totalBodyLength, opaque)
+	header := makeRequestHeader(opcode, len(key), 0, totalBodyLength, opaque, cas)
 
 	writeRequestHeader(w, header)
 
@@ -83,23 +83,23 @@ func writeAppendPrependCmdCommon(w io.Writer, opcode uint8, key []byte, flags, e
 }
 
 // WriteAppendCmd writes out the binary representation of an append request header to the given io.Writer
-func WriteAppendCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32) error {
+func WriteAppendCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32, cas uint64) error {
 	//fmt.Printf("Append: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
 	//string(key), flags, exptime, dataSize, totalBodyLength)
-	return writeAppendPrependCmdCommon(w, OpcodeAppend, key, flags, exptime, dataSize, opaque)
+	return writeAppendPrependCmdCommon(w, OpcodeAppend, key, flags, exptime, dataSize, opaque, cas)
 }
 
 // WritePrependCmd writes out the binary representation of a prepend request header to the given io.Writer
-func WritePrependCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32) error {
+func WritePrependCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32, cas uint64) error {
 	//fmt.Printf("Prepend: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
 	//string(key), flags, exptime, dataSize, totalBodyLength)
-	return writeAppendPrependCmdCommon(w, OpcodePrepend, key, flags, exptime, dataSize, opaque)
+	return writeAppendPrependCmdCommon(w, OpcodePrepend, key, flags, exptime, dataSize, opaque, cas)
 }
 
 // Key commands send the header and key only
 func writeKeyCmd(w io.Writer, opcode uint8, key []byte, opaque uint32) error {
 	// opcode, keyLength, extraLength, totalBodyLength
-	header := makeRequestHeader(opcode, len(key), 0, len(key), opaque)
+	header := makeRequestHeader(opcode, len(key), 0, len(key), opaque, 0)
 	writeRequestHeader(w, header)
 
 	n, err := w.Write(key)
@@ -146,7 +146,7 @@ func writeKeyExptimeCmd(w io.Writer, opcode uint8, key []byte, exptime, opaque u
 	// key + extras + body
 	extrasLen := 4
 	totalBodyLength := len(key) + extrasLen
-	header := makeRequestHeader(opcode, len(key), extrasLen, totalBodyLength, opaque)
+	header := makeRequestHeader(opcode, len(key), extrasLen, totalBodyLength, opaque, 0)
 
 	writeRequestHeader(w, header)
 
@@ -183,10 +183,98 @@ func WriteGATQCmd(w io.Writer, key []byte, exptime, opaque uint32) error {
 	return writeKeyExptimeCmd(w, OpcodeGatQ, key, exptime, opaque)
 }
 
+func writeIncrDecrCmdCommon(w io.Writer, opcode uint8, key []byte, delta, initial uint64, exptime, opaque uint32, noCreate bool) error {
+	// opcode, keyLength, extraLength, totalBodyLength
+	// key + extras
+	extrasLen := 20
+	totalBodyLength := len(key) + extrasLen
+	header := makeRequestHeader(opcode, len(key), extrasLen, totalBodyLength, opaque, 0)
+
+	writeRequestHeader(w, header)
+
+	if noCreate {
+		exptime = incrDecrNoCreate
+	}
+
+	buf := make([]byte, len(key)+20)
+	binary.BigEndian.PutUint64(buf[0:8], delta)
+	binary.BigEndian.PutUint64(buf[8:16], initial)
+	binary.BigEndian.PutUint32(buf[16:20], exptime)
+	copy(buf[20:], key)
+
+	n, err := w.Write(buf)
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
+
+	reqHeadPool.Put(header)
+
+	return err
+}
+
+// WriteIncrementCmd writes out the binary representation of an increment request header to the given io.Writer
+func WriteIncrementCmd(w io.Writer, key []byte, delta, initial uint64, exptime, opaque uint32, noCreate bool) error {
+	//fmt.Printf("Increment: key: %v | delta: %v | initial: %v | exptime: %v\n", string(key),
+	//delta, initial, exptime)
+	return writeIncrDecrCmdCommon(w, OpcodeIncrement, key, delta, initial, exptime, opaque, noCreate)
+}
+
+// WriteDecrementCmd writes out the binary representation of a decrement request header to the given io.Writer
+func WriteDecrementCmd(w io.Writer, key []byte, delta, initial uint64, exptime, opaque uint32, noCreate bool) error {
+	//fmt.Printf("Decrement: key: %v | delta: %v | initial: %v | exptime: %v\n", string(key),
+	//delta, initial, exptime)
+	return writeIncrDecrCmdCommon(w, OpcodeDecrement, key, delta, initial, exptime, opaque, noCreate)
+}
+
+// WriteFlushCmd writes out the binary representation of a flush request header to the given io.Writer
+func WriteFlushCmd(w io.Writer, delay, opaque uint32) error {
+	// opcode, keyLength, extraLength, totalBodyLength
+	// extras only
+	header := makeRequestHeader(OpcodeFlush, 0, 4, 4, opaque, 0)
+	//fmt.Printf("Flush: delay: %v\n", delay)
+
+	writeRequestHeader(w, header)
+
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, delay)
+
+	n, err := w.Write(buf)
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(ReqHeaderLen+n))
+
+	reqHeadPool.Put(header)
+
+	return err
+}
+
+// WriteStatCmd writes out the binary representation of a stats request header to the given
+// io.Writer. An empty group requests the general stats.
+func WriteStatCmd(w io.Writer, group string, opaque uint32) error {
+	//fmt.Printf("Stat: group: %v\n", group)
+	return writeKeyCmd(w, OpcodeStat, []byte(group), opaque)
+}
+
+// WriteSASLAuthCmd writes out the binary representation of a SASL auth request header and the
+// auth data to the given io.Writer
+func WriteSASLAuthCmd(w io.Writer, mech string, data []byte, opaque uint32) error {
+	// opcode, keyLength, extraLength, totalBodyLength
+	header := makeRequestHeader(OpcodeSASLAuth, len(mech), 0, len(mech)+len(data), opaque, 0)
+	writeRequestHeader(w, header)
+
+	n, err := io.WriteString(w, mech)
+	if err == nil {
+		var n2 int
+		n2, err = w.Write(data)
+		n += n2
+	}
+
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(ReqHeaderLen+n))
+	reqHeadPool.Put(header)
+
+	return err
+}
+
 // WriteNoopCmd writes out the binary representation of a noop request header to the given io.Writer
 func WriteNoopCmd(w io.Writer, opaque uint32) error {
 	// opcode, keyLength, extraLength, totalBodyLength
-	header := makeRequestHeader(OpcodeNoop, 0, 0, 0, opaque)
+	header := makeRequestHeader(OpcodeNoop, 0, 0, 0, opaque, 0)
 	//fmt.Printf("Delete: key: %v | totalBodyLength: %v\n", string(key), len(key))
 
 	err := writeRequestHeader(w, header)
@@ -23,6 +23,12 @@ import (
 // Components is the holder for all the different protocol components in the binprot package
 var Components protocol.Components = comps{}
 
+func init() {
+	protocol.Register("binary", protocol.Factory{
+		New: func(interface{}) (protocol.Components, error) { return Components, nil },
+	})
+}
+
 type comps struct{}
 
 func (c comps) NewRequestParser(r *bufio.Reader) protocol.RequestParser {
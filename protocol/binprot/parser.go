@@ -18,6 +18,7 @@ import (
 	"bufio"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"log"
 
 	"github.com/netflix/rend/common"
@@ -103,6 +104,43 @@ import (
 //     Key                 : The textual string "Hello"
 //     Value               : None
 
+// Example Increment request
+// Field        (offset) (value)
+//     Magic        (0)    : 0x80
+//     Opcode       (1)    : 0x05
+//     Key length   (2,3)  : 0x0007
+//     Extra length (4)    : 0x14
+//     Data type    (5)    : 0x00
+//     VBucket      (6,7)  : 0x0000
+//     Total body   (8-11) : 0x0000001b
+//     Opaque       (12-15): 0x00000000
+//     CAS          (16-23): 0x0000000000000000
+//     Extras              :
+//       Delta      (24-31): 0x0000000000000001
+//       Initial    (32-39): 0x0000000000000000
+//       Expiry     (40-43): 0x00000e10
+//     Key          (44-50): The textual string "counter"
+//     Value               : None
+
+// Example Flush request
+// Field        (offset) (value)
+//     Magic        (0)    : 0x80
+//     Opcode       (1)    : 0x08
+//     Key length   (2,3)  : 0x0000
+//     Extra length (4)    : 0x04 (may be 0x00 with no extras)
+//     Data type    (5)    : 0x00
+//     VBucket      (6,7)  : 0x0000
+//     Total body   (8-11) : 0x00000004
+//     Opaque       (12-15): 0x00000000
+//     CAS          (16-23): 0x0000000000000000
+//     Extras              :
+//       Expiry     (24-27): 0x0000000a
+//     Key                 : None
+//     Value               : None
+
+// maxSASLDataLen is the largest amount of SASL auth data accepted in a single step
+const maxSASLDataLen = 4096
+
 type BinaryParser struct {
 	reader *bufio.Reader
 }
@@ -163,7 +201,7 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 		return appendPrependRequest(b.reader, reqHeader, common.RequestPrepend, true, start)
 
 	case OpcodeGetQ:
-		req, err := readBatchGet(b.reader, reqHeader)
+		req, err := readBatchGet(b.reader, reqHeader, OpcodeGetQ, OpcodeGet)
 		if err != nil {
 			log.Println("Error reading batch get")
 			return nil, common.RequestGet, start, err
@@ -171,7 +209,17 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 
 		return req, common.RequestGet, start, nil
 
-	case OpcodeGet:
+	case OpcodeGetKQ:
+		req, err := readBatchGet(b.reader, reqHeader, OpcodeGetKQ, OpcodeGetK)
+		if err != nil {
+			log.Println("Error reading batch getk")
+			return nil, common.RequestGet, start, err
+		}
+
+		req.ReturnKey = true
+		return req, common.RequestGet, start, nil
+
+	case OpcodeGet, OpcodeGetK:
 		// key
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
@@ -180,10 +228,11 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 		}
 
 		return common.GetRequest{
-			Keys:    [][]byte{key},
-			Opaques: []uint32{reqHeader.OpaqueToken},
-			Quiet:   []bool{false},
-			NoopEnd: false,
+			Keys:      [][]byte{key},
+			Opaques:   []uint32{reqHeader.OpaqueToken},
+			Quiet:     []bool{false},
+			NoopEnd:   false,
+			ReturnKey: reqHeader.Opcode == OpcodeGetK,
 		}, common.RequestGet, start, nil
 
 	// Expected only in applications behind Rend that reuse this parsing code
@@ -212,27 +261,43 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 			NoopEnd: false,
 		}, common.RequestGetE, start, nil
 
-	case OpcodeGat:
-		// exptime, key
-		exptime, err := readUInt32(b.reader)
+	case OpcodeGatQ:
+		req, err := readBatchGAT(b.reader, reqHeader, OpcodeGatQ, OpcodeGat)
 		if err != nil {
-			log.Println("Error reading exptime")
+			log.Println("Error reading batch gat")
 			return nil, common.RequestGat, start, err
 		}
 
-		key, err := readString(b.reader, reqHeader.KeyLength)
+		return req, common.RequestGat, start, nil
+
+	case OpcodeGatKQ:
+		req, err := readBatchGAT(b.reader, reqHeader, OpcodeGatKQ, OpcodeGatK)
 		if err != nil {
-			log.Println("Error reading key")
+			log.Println("Error reading batch gatk")
+			return nil, common.RequestGat, start, err
+		}
+
+		req.ReturnKey = true
+		return req, common.RequestGat, start, nil
+
+	case OpcodeGat, OpcodeGatK:
+		// exptime, key
+		exptime, key, err := readGAT(b.reader, reqHeader)
+		if err != nil {
+			log.Println("Error reading gat")
 			return nil, common.RequestGat, start, err
 		}
 
 		return common.GATRequest{
-			Key:     key,
-			Exptime: exptime,
-			Opaque:  reqHeader.OpaqueToken,
+			Keys:      [][]byte{key},
+			Exptimes:  []uint32{exptime},
+			Opaques:   []uint32{reqHeader.OpaqueToken},
+			Quiet:     []bool{false},
+			NoopEnd:   false,
+			ReturnKey: reqHeader.Opcode == OpcodeGatK,
 		}, common.RequestGat, start, nil
 
-	case OpcodeDelete:
+	case OpcodeDelete, OpcodeDeleteQ:
 		// key
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
@@ -243,6 +308,7 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 		return common.DeleteRequest{
 			Key:    key,
 			Opaque: reqHeader.OpaqueToken,
+			Quiet:  reqHeader.Opcode == OpcodeDeleteQ,
 		}, common.RequestDelete, start, nil
 
 	case OpcodeTouch:
@@ -265,6 +331,44 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 			Opaque:  reqHeader.OpaqueToken,
 		}, common.RequestTouch, start, nil
 
+	case OpcodeIncrement:
+		return incrDecrRequest(b.reader, reqHeader, common.RequestIncrement, false, start)
+	case OpcodeIncrementQ:
+		return incrDecrRequest(b.reader, reqHeader, common.RequestIncrement, true, start)
+
+	case OpcodeDecrement:
+		return incrDecrRequest(b.reader, reqHeader, common.RequestDecrement, false, start)
+	case OpcodeDecrementQ:
+		return incrDecrRequest(b.reader, reqHeader, common.RequestDecrement, true, start)
+
+	case OpcodeFlush:
+		return flushRequest(b.reader, reqHeader, false, start)
+	case OpcodeFlushQ:
+		return flushRequest(b.reader, reqHeader, true, start)
+
+	case OpcodeStat:
+		// The key, if any, is the name of the stats group
+		group, err := readString(b.reader, reqHeader.KeyLength)
+		if err != nil {
+			log.Println("Error reading stats group")
+			return nil, common.RequestStats, start, err
+		}
+
+		return common.StatsRequest{
+			Group:  string(group),
+			Opaque: reqHeader.OpaqueToken,
+		}, common.RequestStats, start, nil
+
+	case OpcodeSASLList:
+		return common.SASLListMechsRequest{
+			Opaque: reqHeader.OpaqueToken,
+		}, common.RequestSASLListMechs, start, nil
+
+	case OpcodeSASLAuth:
+		return saslAuthRequest(b.reader, reqHeader, common.RequestSASLAuth, start)
+	case OpcodeSASLStep:
+		return saslAuthRequest(b.reader, reqHeader, common.RequestSASLStep, start)
+
 	case OpcodeNoop:
 		return common.NoopRequest{
 			Opaque: reqHeader.OpaqueToken,
@@ -292,7 +396,9 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 	return nil, common.RequestUnknown, start, common.ErrUnknownCmd
 }
 
-func readBatchGet(r io.Reader, header *RequestHeader) (common.GetRequest, error) {
+// readBatchGet reads a pipeline of quiet gets terminated by either a loud get or a noop. The
+// opcodes are passed in so the same code reads both GetQ/Get and GetKQ/GetK pipelines.
+func readBatchGet(r io.Reader, header *RequestHeader, quietOp, loudOp uint8) (common.GetRequest, error) {
 	var keys [][]byte
 	var opaques []uint32
 	var quiet []bool
@@ -303,7 +409,7 @@ func readBatchGet(r io.Reader, header *RequestHeader) (common.GetRequest, error)
 
 	// while GETQ
 	// read key, read header
-	for header.Opcode == OpcodeGetQ {
+	for header.Opcode == quietOp {
 		// key
 		key, err := readString(r, header.KeyLength)
 		if err != nil {
@@ -326,7 +432,7 @@ func readBatchGet(r io.Reader, header *RequestHeader) (common.GetRequest, error)
 		}
 	}
 
-	if header.Opcode == OpcodeGet {
+	if header.Opcode == loudOp {
 		// key
 		key, err := readString(r, header.KeyLength)
 		if err != nil {
@@ -344,9 +450,14 @@ func readBatchGet(r io.Reader, header *RequestHeader) (common.GetRequest, error)
 		noopOpaque = header.OpaqueToken
 
 	} else {
-		// no idea... this is a problem though.
-		// unexpected patterns shouldn't come over the wire, so maybe it will
-		// be OK to simply discount this situation. Probably not.
+		// Anything else in the middle of the pipeline is a client bug. Its body is skipped so the
+		// next header lines up and the whole batch is rejected.
+		err := discardBody(r, header)
+		reqHeadPool.Put(header)
+		if err != nil {
+			return common.GetRequest{}, err
+		}
+		return common.GetRequest{}, common.ErrBadRequest
 	}
 
 	// Regardless of the header, we want to put it back here
@@ -361,6 +472,98 @@ func readBatchGet(r io.Reader, header *RequestHeader) (common.GetRequest, error)
 	}, nil
 }
 
+func readGAT(r io.Reader, header *RequestHeader) (uint32, []byte, error) {
+	exptime, err := readUInt32(r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	key, err := readString(r, header.KeyLength)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return exptime, key, nil
+}
+
+// readBatchGAT is the same as readBatchGet but for GatQ/Gat and GatKQ/GatK pipelines.
+func readBatchGAT(r io.Reader, header *RequestHeader, quietOp, loudOp uint8) (common.GATRequest, error) {
+	var keys [][]byte
+	var exptimes []uint32
+	var opaques []uint32
+	var quiet []bool
+	var noopOpaque uint32
+	var noopEnd bool
+
+	first := true
+
+	// while GATQ
+	// read exptime and key, read header
+	for header.Opcode == quietOp {
+		exptime, key, err := readGAT(r, header)
+		if err != nil {
+			return common.GATRequest{}, err
+		}
+
+		keys = append(keys, key)
+		exptimes = append(exptimes, exptime)
+		opaques = append(opaques, header.OpaqueToken)
+		quiet = append(quiet, true)
+
+		// read in the next header
+		if !first {
+			reqHeadPool.Put(header)
+		} else {
+			first = false
+		}
+
+		header, err = readRequestHeader(r)
+		if err != nil {
+			return common.GATRequest{}, err
+		}
+	}
+
+	if header.Opcode == loudOp {
+		exptime, key, err := readGAT(r, header)
+		if err != nil {
+			return common.GATRequest{}, err
+		}
+
+		keys = append(keys, key)
+		exptimes = append(exptimes, exptime)
+		opaques = append(opaques, header.OpaqueToken)
+		quiet = append(quiet, false)
+		noopEnd = false
+
+	} else if header.Opcode == OpcodeNoop {
+		// nothing to do, header is read already
+		noopEnd = true
+		noopOpaque = header.OpaqueToken
+
+	} else {
+		// Anything else in the middle of the pipeline is a client bug. Its body is skipped so the
+		// next header lines up and the whole batch is rejected.
+		err := discardBody(r, header)
+		reqHeadPool.Put(header)
+		if err != nil {
+			return common.GATRequest{}, err
+		}
+		return common.GATRequest{}, common.ErrBadRequest
+	}
+
+	// Regardless of the header, we want to put it back here
+	reqHeadPool.Put(header)
+
+	return common.GATRequest{
+		Keys:       keys,
+		Exptimes:   exptimes,
+		Opaques:    opaques,
+		Quiet:      quiet,
+		NoopOpaque: noopOpaque,
+		NoopEnd:    noopEnd,
+	}, nil
+}
+
 func readBatchGetE(r io.Reader, header *RequestHeader) (common.GetRequest, error) {
 	var keys [][]byte
 	var opaques []uint32
@@ -413,9 +616,14 @@ func readBatchGetE(r io.Reader, header *RequestHeader) (common.GetRequest, error
 		noopOpaque = header.OpaqueToken
 
 	} else {
-		// no idea... this is a problem though.
-		// unexpected patterns shouldn't come over the wire, so maybe it will
-		// be OK to simply discount this situation. Probably not.
+		// Anything else in the middle of the pipeline is a client bug. Its body is skipped so the
+		// next header lines up and the whole batch is rejected.
+		err := discardBody(r, header)
+		reqHeadPool.Put(header)
+		if err != nil {
+			return common.GetRequest{}, err
+		}
+		return common.GetRequest{}, common.ErrBadRequest
 	}
 
 	// Regardless of the header, we want to put it back here
@@ -430,6 +638,39 @@ func readBatchGetE(r io.Reader, header *RequestHeader) (common.GetRequest, error
 	}, nil
 }
 
+func saslAuthRequest(r io.Reader, reqHeader *RequestHeader, reqType common.RequestType, start uint64) (common.SASLAuthRequest, common.RequestType, uint64, error) {
+	// SASL requests have no extras and the auth data is tiny for any real mechanism. Anything else
+	// means the stream is broken or someone is probing, so the connection is dropped instead of
+	// allocating whatever was asked.
+	keyLen := uint32(reqHeader.KeyLength)
+	if reqHeader.ExtraLength != 0 || reqHeader.TotalBodyLength < keyLen || reqHeader.TotalBodyLength-keyLen > maxSASLDataLen {
+		log.Println("Invalid SASL request lengths")
+		return common.SASLAuthRequest{}, reqType, start, common.ErrInvalidArgs
+	}
+
+	// key is the mechanism, value is the auth data for this step
+	mech, err := readString(r, reqHeader.KeyLength)
+	if err != nil {
+		log.Println("Error reading SASL mechanism")
+		return common.SASLAuthRequest{}, reqType, start, err
+	}
+
+	dataLen := reqHeader.TotalBodyLength - keyLen
+	data := make([]byte, dataLen)
+	n, err := io.ReadAtLeast(r, data, int(dataLen))
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	if err != nil {
+		log.Println("Error reading SASL data")
+		return common.SASLAuthRequest{}, reqType, start, err
+	}
+
+	return common.SASLAuthRequest{
+		Mechanism: string(mech),
+		Data:      data,
+		Opaque:    reqHeader.OpaqueToken,
+	}, reqType, start, nil
+}
+
 func setRequest(r io.Reader, reqHeader *RequestHeader, reqType common.RequestType, quiet bool, start uint64) (common.SetRequest, common.RequestType, uint64, error) {
 	// flags, exptime, key, value
 	flags, err := readUInt32(r)
@@ -468,6 +709,7 @@ func setRequest(r io.Reader, reqHeader *RequestHeader, reqType common.RequestTyp
 		Flags:   flags,
 		Exptime: exptime,
 		Opaque:  reqHeader.OpaqueToken,
+		Cas:     reqHeader.CASToken,
 		Data:    dataBuf,
 	}, reqType, start, nil
 }
@@ -496,10 +738,92 @@ func appendPrependRequest(r io.Reader, reqHeader *RequestHeader, reqType common.
 		Flags:   0,
 		Exptime: 0,
 		Opaque:  reqHeader.OpaqueToken,
+		Cas:     reqHeader.CASToken,
 		Data:    dataBuf,
 	}, reqType, start, nil
 }
 
+func incrDecrRequest(r io.Reader, reqHeader *RequestHeader, reqType common.RequestType, quiet bool, start uint64) (common.IncrDecrRequest, common.RequestType, uint64, error) {
+	// delta, initial, exptime, key
+	delta, err := readUInt64(r)
+	if err != nil {
+		log.Println("Error reading delta")
+		return common.IncrDecrRequest{}, reqType, start, err
+	}
+
+	initial, err := readUInt64(r)
+	if err != nil {
+		log.Println("Error reading initial value")
+		return common.IncrDecrRequest{}, reqType, start, err
+	}
+
+	exptime, err := readUInt32(r)
+	if err != nil {
+		log.Println("Error reading exptime")
+		return common.IncrDecrRequest{}, reqType, start, err
+	}
+
+	key, err := readString(r, reqHeader.KeyLength)
+	if err != nil {
+		log.Println("Error reading key")
+		return common.IncrDecrRequest{}, reqType, start, err
+	}
+
+	// An expiration of all 1's means the item should not be created if it does not exist
+	noCreate := exptime == incrDecrNoCreate
+	if noCreate {
+		exptime = 0
+	}
+
+	return common.IncrDecrRequest{
+		Key:      key,
+		Delta:    delta,
+		Initial:  initial,
+		Exptime:  exptime,
+		Opaque:   reqHeader.OpaqueToken,
+		NoCreate: noCreate,
+		Quiet:    quiet,
+	}, reqType, start, nil
+}
+
+func flushRequest(r io.Reader, reqHeader *RequestHeader, quiet bool, start uint64) (common.FlushRequest, common.RequestType, uint64, error) {
+	// The delay is optional in the binary protocol. Anything else in the body has no meaning for
+	// a flush, so it is skipped to keep the stream in sync.
+	var delay uint32
+	rest := reqHeader.TotalBodyLength
+	if reqHeader.ExtraLength == 4 && rest >= 4 {
+		var err error
+		delay, err = readUInt32(r)
+		if err != nil {
+			log.Println("Error reading flush delay")
+			return common.FlushRequest{}, common.RequestFlush, start, err
+		}
+		rest -= 4
+	}
+
+	if err := discard(r, rest); err != nil {
+		log.Println("Error reading flush extras")
+		return common.FlushRequest{}, common.RequestFlush, start, err
+	}
+
+	return common.FlushRequest{
+		Delay:  delay,
+		Opaque: reqHeader.OpaqueToken,
+		Quiet:  quiet,
+	}, common.RequestFlush, start, nil
+}
+
+// discardBody skips over the body of a request that can't be used
+func discardBody(r io.Reader, header *RequestHeader) error {
+	return discard(r, header.TotalBodyLength)
+}
+
+func discard(r io.Reader, l uint32) error {
+	n, err := io.CopyN(ioutil.Discard, r, int64(l))
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	return err
+}
+
 func readString(r io.Reader, l uint16) ([]byte, error) {
 	buf := make([]byte, l)
 	n, err := io.ReadAtLeast(r, buf, int(l))
@@ -522,3 +846,15 @@ func readUInt32(r io.Reader) (uint32, error) {
 
 	return binary.BigEndian.Uint32(buf), nil
 }
+
+func readUInt64(r io.Reader) (uint64, error) {
+	buf := make([]byte, 8)
+
+	n, err := io.ReadAtLeast(r, buf, 8)
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	if err != nil {
+		return uint64(0), err
+	}
+
+	return binary.BigEndian.Uint64(buf), nil
+}
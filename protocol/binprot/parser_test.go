@@ -17,6 +17,8 @@ package binprot
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"reflect"
 	"testing"
 
 	"github.com/netflix/rend/common"
@@ -48,6 +50,337 @@ func TestUnknownCommand(t *testing.T) {
 	}
 }
 
+func TestSetCAS(t *testing.T) {
+	buf := &bytes.Buffer{}
+	WriteSetCmd(buf, []byte("key"), 0, 0, 3, 0xA5, 0xDEADBEEFCAFEBABE)
+	buf.WriteString("foo")
+
+	req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reqType != common.RequestSet {
+		t.Fatal("Expected request type to be Set")
+	}
+	if cas := req.(common.SetRequest).Cas; cas != 0xDEADBEEFCAFEBABE {
+		t.Fatalf("Expected CAS to be carried through, got %X", cas)
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	t.Run("Create", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		WriteIncrementCmd(buf, []byte("key"), 2, 10, 3600, 0xA5, false)
+
+		req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if reqType != common.RequestIncrement {
+			t.Fatal("Expected request type to be Increment")
+		}
+
+		gold := common.IncrDecrRequest{
+			Key:     []byte("key"),
+			Delta:   2,
+			Initial: 10,
+			Exptime: 3600,
+			Opaque:  0xA5,
+		}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+	})
+	t.Run("NoCreate", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		WriteDecrementCmd(buf, []byte("key"), 2, 0, 0, 0xA5, true)
+
+		req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if reqType != common.RequestDecrement {
+			t.Fatal("Expected request type to be Decrement")
+		}
+		if r := req.(common.IncrDecrRequest); !r.NoCreate || r.Exptime != 0 {
+			t.Fatalf("Expected NoCreate with no exptime, got %#v", r)
+		}
+	})
+}
+
+func TestStats(t *testing.T) {
+	for _, group := range []string{"", "settings"} {
+		buf := &bytes.Buffer{}
+		WriteStatCmd(buf, group, 0xA5)
+
+		req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if reqType != common.RequestStats {
+			t.Fatal("Expected request type to be Stats")
+		}
+
+		gold := common.StatsRequest{
+			Group:  group,
+			Opaque: 0xA5,
+		}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+	}
+}
+
+func TestBatchGAT(t *testing.T) {
+	buf := &bytes.Buffer{}
+	WriteGATQCmd(buf, []byte("foo"), 10, 1)
+	WriteGATQCmd(buf, []byte("bar"), 20, 2)
+	WriteNoopCmd(buf, 3)
+
+	req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reqType != common.RequestGat {
+		t.Fatal("Expected request type to be Gat")
+	}
+
+	gold := common.GATRequest{
+		Keys:       [][]byte{[]byte("foo"), []byte("bar")},
+		Exptimes:   []uint32{10, 20},
+		Opaques:    []uint32{1, 2},
+		Quiet:      []bool{true, true},
+		NoopOpaque: 3,
+		NoopEnd:    true,
+	}
+	if !reflect.DeepEqual(req, gold) {
+		t.Fatalf("Expected %#v, got %#v", gold, req)
+	}
+}
+
+func TestGetK(t *testing.T) {
+	t.Run("Single", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		writeKeyCmd(buf, OpcodeGetK, []byte("foo"), 1)
+
+		req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if reqType != common.RequestGet {
+			t.Fatal("Expected request type to be Get")
+		}
+		if !req.(common.GetRequest).ReturnKey {
+			t.Fatal("Expected ReturnKey to be set")
+		}
+	})
+	t.Run("Batch", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		writeKeyCmd(buf, OpcodeGetKQ, []byte("foo"), 1)
+		writeKeyCmd(buf, OpcodeGetKQ, []byte("bar"), 2)
+		writeKeyCmd(buf, OpcodeGetK, []byte("baz"), 3)
+
+		req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if reqType != common.RequestGet {
+			t.Fatal("Expected request type to be Get")
+		}
+
+		gold := common.GetRequest{
+			Keys:      [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")},
+			Opaques:   []uint32{1, 2, 3},
+			Quiet:     []bool{true, true, false},
+			ReturnKey: true,
+		}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+	})
+	t.Run("GatBatch", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		writeKeyExptimeCmd(buf, OpcodeGatKQ, []byte("foo"), 10, 1)
+		WriteNoopCmd(buf, 2)
+
+		req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if reqType != common.RequestGat {
+			t.Fatal("Expected request type to be Gat")
+		}
+
+		gold := common.GATRequest{
+			Keys:       [][]byte{[]byte("foo")},
+			Exptimes:   []uint32{10},
+			Opaques:    []uint32{1},
+			Quiet:      []bool{true},
+			NoopOpaque: 2,
+			NoopEnd:    true,
+			ReturnKey:  true,
+		}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+	})
+}
+
+func TestBatchUnexpectedOpcode(t *testing.T) {
+	// The bad request is rejected and the parser picks up again at the next header
+	expectNextGet := func(t *testing.T, p BinaryParser) {
+		req, reqType, _, err := p.Parse()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if reqType != common.RequestGet {
+			t.Fatal("Expected request type to be Get")
+		}
+		if key := string(req.(common.GetRequest).Keys[0]); key != "next" {
+			t.Fatalf("Expected key next, got %q", key)
+		}
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		writeKeyCmd(buf, OpcodeGetKQ, []byte("foo"), 1)
+		writeKeyCmd(buf, OpcodeGetQ, []byte("bar"), 2)
+		WriteNoopCmd(buf, 3)
+		WriteGetCmd(buf, []byte("next"), 4)
+
+		p := NewBinaryParser(bufio.NewReader(buf))
+
+		if _, _, _, err := p.Parse(); err != common.ErrBadRequest {
+			t.Fatalf("Expected ErrBadRequest, got %v", err)
+		}
+		// the noop that ended the rejected pipeline is read on its own
+		if _, reqType, _, err := p.Parse(); err != nil || reqType != common.RequestNoop {
+			t.Fatalf("Expected a noop, got %v %v", reqType, err)
+		}
+		expectNextGet(t, p)
+	})
+	t.Run("Gat", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		WriteGATQCmd(buf, []byte("foo"), 10, 1)
+		writeKeyExptimeCmd(buf, OpcodeGatKQ, []byte("bar"), 20, 2)
+		WriteGetCmd(buf, []byte("next"), 3)
+
+		p := NewBinaryParser(bufio.NewReader(buf))
+
+		if _, _, _, err := p.Parse(); err != common.ErrBadRequest {
+			t.Fatalf("Expected ErrBadRequest, got %v", err)
+		}
+		expectNextGet(t, p)
+	})
+}
+
+func TestFlush(t *testing.T) {
+	// flushHeader writes a flush header with the given extras length, followed by that many
+	// bytes with the delay in the first four
+	flushHeader := func(buf *bytes.Buffer, extras int) {
+		header := makeRequestHeader(OpcodeFlush, 0, extras, extras, 1, 0)
+		writeRequestHeader(buf, header)
+		reqHeadPool.Put(header)
+
+		body := make([]byte, extras)
+		if extras >= 4 {
+			binary.BigEndian.PutUint32(body, 10)
+		}
+		buf.Write(body)
+	}
+
+	for _, c := range []struct {
+		name   string
+		extras int
+		delay  uint32
+	}{
+		{"NoDelay", 0, 0},
+		{"Delay", 4, 10},
+		// Anything other than the delay is skipped
+		{"OtherExtras", 8, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			flushHeader(buf, c.extras)
+			WriteNoopCmd(buf, 2)
+
+			p := NewBinaryParser(bufio.NewReader(buf))
+
+			req, reqType, _, err := p.Parse()
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if reqType != common.RequestFlush {
+				t.Fatal("Expected request type to be Flush")
+			}
+
+			gold := common.FlushRequest{Delay: c.delay, Opaque: 1}
+			if !reflect.DeepEqual(req, gold) {
+				t.Fatalf("Expected %#v, got %#v", gold, req)
+			}
+
+			// The next request starts in the right place
+			if _, reqType, _, err := p.Parse(); err != nil || reqType != common.RequestNoop {
+				t.Fatalf("Expected a noop, got %v %v", reqType, err)
+			}
+		})
+	}
+}
+
+func TestDeleteQ(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeKeyCmd(buf, OpcodeDeleteQ, []byte("key"), 0xA5)
+
+	req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reqType != common.RequestDelete {
+		t.Fatal("Expected request type to be Delete")
+	}
+
+	gold := common.DeleteRequest{
+		Key:    []byte("key"),
+		Opaque: 0xA5,
+		Quiet:  true,
+	}
+	if !reflect.DeepEqual(req, gold) {
+		t.Fatalf("Expected %#v, got %#v", gold, req)
+	}
+}
+
+func TestSASLAuth(t *testing.T) {
+	buf := &bytes.Buffer{}
+	WriteSASLAuthCmd(buf, "PLAIN", []byte("\x00user\x00pass"), 0xA5)
+
+	req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reqType != common.RequestSASLAuth {
+		t.Fatal("Expected request type to be SASLAuth")
+	}
+
+	gold := common.SASLAuthRequest{
+		Mechanism: "PLAIN",
+		Data:      []byte("\x00user\x00pass"),
+		Opaque:    0xA5,
+	}
+	if !reflect.DeepEqual(req, gold) {
+		t.Fatalf("Expected %#v, got %#v", gold, req)
+	}
+}
+
 type dummyIO struct{}
 
 func (d dummyIO) Read(p []byte) (int, error) {
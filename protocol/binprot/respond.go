@@ -17,6 +17,7 @@ package binprot
 import (
 	"bufio"
 	"encoding/binary"
+	"strings"
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
@@ -116,6 +117,36 @@ import (
 //     Key                 : None
 //     Value               : None
 
+// Sample Increment response
+// Field        (offset) (value)
+//     Magic        (0)    : 0x81
+//     Opcode       (1)    : 0x05
+//     Key length   (2,3)  : 0x0000
+//     Extra length (4)    : 0x00
+//     Data type    (5)    : 0x00
+//     Status       (6,7)  : 0x0000
+//     Total body   (8-11) : 0x00000008
+//     Opaque       (12-15): 0x00000000
+//     CAS          (16-23): 0x0000000000000000
+//     Extras              : None
+//     Key                 : None
+//     Value        (24-31): 0x0000000000000005
+
+// Sample Stat response (one per stat, followed by one with no key and no value)
+// Field        (offset) (value)
+//     Magic        (0)    : 0x81
+//     Opcode       (1)    : 0x10
+//     Key length   (2,3)  : 0x0003
+//     Extra length (4)    : 0x00
+//     Data type    (5)    : 0x00
+//     Status       (6,7)  : 0x0000
+//     Total body   (8-11) : 0x00000007
+//     Opaque       (12-15): 0x00000000
+//     CAS          (16-23): 0x0000000000000000
+//     Extras              : None
+//     Key          (24-26): The textual string "pid"
+//     Value        (27-30): The textual string "3498"
+
 type BinaryResponder struct {
 	writer *bufio.Writer
 }
@@ -127,41 +158,38 @@ func NewBinaryResponder(writer *bufio.Writer) BinaryResponder {
 }
 
 func (b BinaryResponder) Set(opaque uint32, quiet bool) error {
-	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeSet, 0, 0, 0, opaque, true)
-	}
-	return nil
+	return b.Stored(common.RequestSet, opaque, 0, quiet)
 }
 
 func (b BinaryResponder) Add(opaque uint32, quiet bool) error {
-	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeAdd, 0, 0, 0, opaque, true)
-	}
-	return nil
+	return b.Stored(common.RequestAdd, opaque, 0, quiet)
 }
 
 func (b BinaryResponder) Replace(opaque uint32, quiet bool) error {
-	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeReplace, 0, 0, 0, opaque, true)
-	}
-	return nil
+	return b.Stored(common.RequestReplace, opaque, 0, quiet)
 }
 
 func (b BinaryResponder) Append(opaque uint32, quiet bool) error {
-	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeAppend, 0, 0, 0, opaque, true)
-	}
-	return nil
+	return b.Stored(common.RequestAppend, opaque, 0, quiet)
 }
 
 func (b BinaryResponder) Prepend(opaque uint32, quiet bool) error {
+	return b.Stored(common.RequestPrepend, opaque, 0, quiet)
+}
+
+// Stored implements protocol.CasResponder. The new CAS value goes in the response header.
+func (b BinaryResponder) Stored(reqType common.RequestType, opaque uint32, cas uint64, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodePrepend, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer, reqTypeToOpcode(reqType, false), 0, 0, 0, opaque, cas, true)
 	}
 	return nil
 }
 
 func (b BinaryResponder) Get(response common.GetResponse) error {
+	if response.ReturnKey {
+		return getKCommon(b.writer, response, OpcodeGetK, OpcodeGetKQ)
+	}
+
 	if response.Miss {
 		if !response.Quiet {
 			return b.Error(response.Opaque, common.RequestGet, common.ErrKeyNotFound, false)
@@ -176,13 +204,17 @@ func (b BinaryResponder) GetEnd(opaque uint32, noopEnd bool) error {
 	// if Noop was the end of the pipelined batch gets, respond with a Noop header
 	// otherwise, stay quiet as the last get would be a GET and not a GETQ
 	if noopEnd {
-		return writeSuccessResponseHeader(b.writer, OpcodeNoop, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer, OpcodeNoop, 0, 0, 0, opaque, 0, true)
 	}
 
 	return nil
 }
 
 func (b BinaryResponder) GAT(response common.GetResponse) error {
+	if response.ReturnKey {
+		return getKCommon(b.writer, response, OpcodeGatK, OpcodeGatKQ)
+	}
+
 	if response.Miss {
 		if !response.Quiet {
 			return b.Error(response.Opaque, common.RequestGat, common.ErrKeyNotFound, false)
@@ -203,7 +235,7 @@ func (b BinaryResponder) GetE(response common.GetEResponse) error {
 
 	// total body length = extras (flags & exptime, 8 bytes) + data length
 	totalBodyLength := len(response.Data) + 8
-	writeSuccessResponseHeader(b.writer, OpcodeGetE, 0, 8, totalBodyLength, response.Opaque, false)
+	writeSuccessResponseHeader(b.writer, OpcodeGetE, 0, 8, totalBodyLength, response.Opaque, response.Cas, false)
 	binary.Write(b.writer, binary.BigEndian, response.Flags)
 	binary.Write(b.writer, binary.BigEndian, response.Exptime)
 	b.writer.Write(response.Data)
@@ -215,27 +247,71 @@ func (b BinaryResponder) GetE(response common.GetEResponse) error {
 	return nil
 }
 
-func (b BinaryResponder) Delete(opaque uint32) error {
-	return writeSuccessResponseHeader(b.writer, OpcodeDelete, 0, 0, 0, opaque, true)
+func (b BinaryResponder) Delete(opaque uint32, quiet bool) error {
+	if !quiet {
+		return writeSuccessResponseHeader(b.writer, OpcodeDelete, 0, 0, 0, opaque, 0, true)
+	}
+	return nil
+}
+
+func (b BinaryResponder) Touch(opaque uint32, quiet bool) error {
+	if !quiet {
+		return writeSuccessResponseHeader(b.writer, OpcodeTouch, 0, 0, 0, opaque, 0, true)
+	}
+	return nil
+}
+
+func (b BinaryResponder) Increment(opaque uint32, value uint64, quiet bool) error {
+	return b.IncrDecr(common.RequestIncrement, opaque, value, 0, quiet)
+}
+
+func (b BinaryResponder) Decrement(opaque uint32, value uint64, quiet bool) error {
+	return b.IncrDecr(common.RequestDecrement, opaque, value, 0, quiet)
 }
 
-func (b BinaryResponder) Touch(opaque uint32) error {
-	return writeSuccessResponseHeader(b.writer, OpcodeTouch, 0, 0, 0, opaque, true)
+// IncrDecr implements protocol.CasResponder. The new CAS value goes in the response header.
+func (b BinaryResponder) IncrDecr(reqType common.RequestType, opaque uint32, value, cas uint64, quiet bool) error {
+	if !quiet {
+		return incrDecrCommon(b.writer, reqTypeToOpcode(reqType, false), opaque, value, cas)
+	}
+	return nil
+}
+
+func (b BinaryResponder) Flush(opaque uint32, quiet bool) error {
+	if !quiet {
+		return writeSuccessResponseHeader(b.writer, OpcodeFlush, 0, 0, 0, opaque, 0, true)
+	}
+	return nil
+}
+
+func (b BinaryResponder) Stats(opaque uint32, stats []common.Stat) error {
+	for _, s := range stats {
+		totalBodyLength := len(s.Name) + len(s.Value)
+		if err := writeSuccessResponseHeader(b.writer, OpcodeStat, len(s.Name), 0, totalBodyLength, opaque, 0, false); err != nil {
+			return err
+		}
+		b.writer.WriteString(s.Name)
+		b.writer.WriteString(s.Value)
+		metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(totalBodyLength))
+	}
+
+	// An empty stat terminates the list
+	return writeSuccessResponseHeader(b.writer, OpcodeStat, 0, 0, 0, opaque, 0, true)
 }
 
 func (b BinaryResponder) Noop(opaque uint32) error {
-	return writeSuccessResponseHeader(b.writer, OpcodeNoop, 0, 0, 0, opaque, true)
+	return writeSuccessResponseHeader(b.writer, OpcodeNoop, 0, 0, 0, opaque, 0, true)
 }
 
 func (b BinaryResponder) Quit(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeQuit, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer, OpcodeQuit, 0, 0, 0, opaque, 0, true)
 	}
 	return nil
 }
 
 func (b BinaryResponder) Version(opaque uint32) error {
-	if err := writeSuccessResponseHeader(b.writer, OpcodeVersion, 0, 0, len(common.VersionString), opaque, false); err != nil {
+	if err := writeSuccessResponseHeader(b.writer, OpcodeVersion, 0, 0, len(common.VersionString), opaque, 0, false); err != nil {
 		return err
 	}
 	n, _ := b.writer.WriteString(common.VersionString)
@@ -243,6 +319,27 @@ func (b BinaryResponder) Version(opaque uint32) error {
 	return b.writer.Flush()
 }
 
+func (b BinaryResponder) SASLMechs(opaque uint32, mechs []string) error {
+	// The mechanisms are sent back as a space separated list in the value
+	list := strings.Join(mechs, " ")
+	if err := writeSuccessResponseHeader(b.writer, OpcodeSASLList, 0, 0, len(list), opaque, 0, false); err != nil {
+		return err
+	}
+	n, _ := b.writer.WriteString(list)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	return b.writer.Flush()
+}
+
+func (b BinaryResponder) SASLAuth(opaque uint32) error {
+	const authenticated = "Authenticated"
+	if err := writeSuccessResponseHeader(b.writer, OpcodeSASLAuth, 0, 0, len(authenticated), opaque, 0, false); err != nil {
+		return err
+	}
+	n, _ := b.writer.WriteString(authenticated)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	return b.writer.Flush()
+}
+
 func (b BinaryResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
 	// TODO: proper opcode
 	return writeErrorResponseHeader(b.writer, reqTypeToOpcode(reqType, quiet), errorToCode(err), opaque)
@@ -285,6 +382,26 @@ func reqTypeToOpcode(rt common.RequestType, quiet bool) uint8 {
 		return OpcodeDelete
 	case rt == common.RequestTouch:
 		return OpcodeTouch
+	case rt == common.RequestIncrement && quiet:
+		return OpcodeIncrementQ
+	case rt == common.RequestIncrement && !quiet:
+		return OpcodeIncrement
+	case rt == common.RequestDecrement && quiet:
+		return OpcodeDecrementQ
+	case rt == common.RequestDecrement && !quiet:
+		return OpcodeDecrement
+	case rt == common.RequestFlush && quiet:
+		return OpcodeFlushQ
+	case rt == common.RequestFlush && !quiet:
+		return OpcodeFlush
+	case rt == common.RequestStats:
+		return OpcodeStat
+	case rt == common.RequestSASLListMechs:
+		return OpcodeSASLList
+	case rt == common.RequestSASLAuth:
+		return OpcodeSASLAuth
+	case rt == common.RequestSASLStep:
+		return OpcodeSASLStep
 	default:
 		return OpcodeInvalid
 	}
@@ -293,7 +410,7 @@ func reqTypeToOpcode(rt common.RequestType, quiet bool) uint8 {
 func getCommon(w *bufio.Writer, response common.GetResponse, opcode uint8) error {
 	// total body length = extras (flags, 4 bytes) + data length
 	totalBodyLength := len(response.Data) + 4
-	writeSuccessResponseHeader(w, opcode, 0, 4, totalBodyLength, response.Opaque, false)
+	writeSuccessResponseHeader(w, opcode, 0, 4, totalBodyLength, response.Opaque, response.Cas, false)
 	buf := make([]byte, 4)
 	binary.BigEndian.PutUint32(buf, response.Flags)
 	w.Write(buf)
@@ -305,8 +422,76 @@ func getCommon(w *bufio.Writer, response common.GetResponse, opcode uint8) error
 	return nil
 }
 
+// getKCommon responds to the key-returning variants of get and gat. These respond with the
+// opcode of the request, which for the quiet variants is the quiet opcode, and carry the key
+// on both hits and misses so clients can match up pipelined responses without the opaque.
+func getKCommon(w *bufio.Writer, response common.GetResponse, opcode, quietOpcode uint8) error {
+	if response.Quiet {
+		if response.Miss {
+			return nil
+		}
+		opcode = quietOpcode
+	}
+
+	keyLength := len(response.Key)
+
+	if response.Miss {
+		header := resHeadPool.Get().(*ResponseHeader)
+
+		header.Magic = MagicResponse
+		header.Opcode = opcode
+		header.KeyLength = uint16(keyLength)
+		header.ExtraLength = uint8(0)
+		header.DataType = uint8(0)
+		header.Status = StatusKeyEnoent
+		header.TotalBodyLength = uint32(keyLength)
+		header.OpaqueToken = response.Opaque
+		header.CASToken = uint64(0)
+
+		if err := writeResponseHeader(w, header); err != nil {
+			resHeadPool.Put(header)
+			return err
+		}
+		resHeadPool.Put(header)
+
+		w.Write(response.Key)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(resHeaderLen+keyLength))
+		return nil
+	}
+
+	// total body length = extras (flags, 4 bytes) + key length + data length
+	totalBodyLength := 4 + keyLength + len(response.Data)
+	writeSuccessResponseHeader(w, opcode, keyLength, 4, totalBodyLength, response.Opaque, response.Cas, false)
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, response.Flags)
+	w.Write(buf)
+	w.Write(response.Key)
+	w.Write(response.Data)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(totalBodyLength))
+	return nil
+}
+
+func incrDecrCommon(w *bufio.Writer, opcode uint8, opaque uint32, value, cas uint64) error {
+	// total body length = value (8 bytes)
+	writeSuccessResponseHeader(w, opcode, 0, 0, 8, opaque, cas, false)
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	w.Write(buf)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, 8)
+	return nil
+}
+
 func writeSuccessResponseHeader(w *bufio.Writer, opcode uint8, keyLength, extraLength,
-	totalBodyLength int, opaque uint32, flush bool) error {
+	totalBodyLength int, opaque uint32, cas uint64, flush bool) error {
 
 	header := resHeadPool.Get().(*ResponseHeader)
 
@@ -318,7 +503,7 @@ func writeSuccessResponseHeader(w *bufio.Writer, opcode uint8, keyLength, extraL
 	header.Status = StatusSuccess
 	header.TotalBodyLength = uint32(totalBodyLength)
 	header.OpaqueToken = opaque
-	header.CASToken = uint64(0)
+	header.CASToken = cas
 
 	if err := writeResponseHeader(w, header); err != nil {
 		resHeadPool.Put(header)
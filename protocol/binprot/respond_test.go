@@ -0,0 +1,67 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package binprot
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestDeleteQResponse(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		w := bufio.NewWriter(out)
+
+		if err := NewBinaryResponder(w).Delete(0xA5, true); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		w.Flush()
+
+		if out.Len() != 0 {
+			t.Fatalf("Expected nothing to be written, got %v", out.Bytes())
+		}
+	})
+
+	t.Run("Miss", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		w := bufio.NewWriter(out)
+
+		if err := NewBinaryResponder(w).Error(0xA5, common.RequestDelete, common.ErrKeyNotFound, true); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		res, err := ReadResponseHeader(out)
+		if err != nil {
+			t.Fatalf("Expected no error reading the response, got %v", err)
+		}
+		defer PutResponseHeader(res)
+
+		if res.Opcode != OpcodeDeleteQ {
+			t.Fatalf("Expected opcode %x, got %x", OpcodeDeleteQ, res.Opcode)
+		}
+		if res.Status != StatusKeyEnoent {
+			t.Fatalf("Expected status %x, got %x", StatusKeyEnoent, res.Status)
+		}
+		if res.OpaqueToken != 0xA5 {
+			t.Fatalf("Expected opaque 0xA5, got %x", res.OpaqueToken)
+		}
+		if res.TotalBodyLength != 0 || out.Len() != 0 {
+			t.Fatalf("Expected only a header, got a body length of %d and %d more bytes", res.TotalBodyLength, out.Len())
+		}
+	})
+}
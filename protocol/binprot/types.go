@@ -27,7 +27,7 @@ const (
 	MagicResponse = uint8(0x81)
 
 	// All opcodes as defined in memcached
-	// Minus SASL and range ops
+	// Minus range ops
 	OpcodeGet        = uint8(0x00)
 	OpcodeSet        = uint8(0x01)
 	OpcodeAdd        = uint8(0x02)
@@ -58,6 +58,9 @@ const (
 	OpcodeTouch      = uint8(0x1c)
 	OpcodeGat        = uint8(0x1d)
 	OpcodeGatQ       = uint8(0x1e)
+	OpcodeSASLList   = uint8(0x20)
+	OpcodeSASLAuth   = uint8(0x21)
+	OpcodeSASLStep   = uint8(0x22)
 	OpcodeGatK       = uint8(0x23)
 	OpcodeGatKQ      = uint8(0x24)
 	OpcodeInvalid    = uint8(0xFF)
@@ -65,6 +68,10 @@ const (
 	OpcodeGetE  = uint8(0x40)
 	OpcodeGetEQ = uint8(0x41)
 
+	// incrDecrNoCreate is the expiration value for increment and decrement
+	// requests that tells the server to fail instead of creating the item
+	incrDecrNoCreate = uint32(0xffffffff)
+
 	StatusSuccess        = uint16(0x00)
 	StatusKeyEnoent      = uint16(0x01)
 	StatusKeyExists      = uint16(0x02)
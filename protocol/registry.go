@@ -0,0 +1,51 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import "github.com/netflix/rend/common"
+
+// Factory creates the Components for a protocol by name. It works the same way as
+// handlers.Factory. The binprot and textprot packages register themselves as "binary" and "text".
+type Factory struct {
+	// Options returns a pointer to a new options value with the defaults set, or is nil if the
+	// protocol has no options
+	Options func() interface{}
+
+	// New returns the Components for the decoded options
+	New func(opts interface{}) (Components, error)
+}
+
+var registry = common.NewRegistry("protocol")
+
+// Register makes a protocol available by name. It panics if the name is already registered.
+func Register(name string, f Factory) {
+	registry.Register(name, f.Options, func(opts interface{}) (interface{}, error) {
+		return f.New(opts)
+	})
+}
+
+// New returns the Components for the named protocol with the given JSON options
+func New(name string, options []byte) (Components, error) {
+	c, err := registry.Build(name, options)
+	if err != nil {
+		return nil, err
+	}
+	return c.(Components), nil
+}
+
+// Registered returns the names of all registered protocols
+func Registered() []string {
+	return registry.Names()
+}
@@ -23,6 +23,12 @@ import (
 // Components is the holder for all the different protocol components in the textprot package
 var Components protocol.Components = comps{}
 
+func init() {
+	protocol.Register("text", protocol.Factory{
+		New: func(interface{}) (protocol.Components, error) { return Components, nil },
+	})
+}
+
 type comps struct{}
 
 func (c comps) NewRequestParser(r *bufio.Reader) protocol.RequestParser {
@@ -33,6 +39,10 @@ func (c comps) NewResponder(w *bufio.Writer) protocol.Responder {
 	return NewTextResponder(w)
 }
 
+func (c comps) NewParserResponder(r *bufio.Reader, w *bufio.Writer) (protocol.RequestParser, protocol.Responder) {
+	return NewTextParserResponder(r, w)
+}
+
 func (c comps) NewDisambiguator(p protocol.Peeker) protocol.Disambiguator {
 	return disam{p}
 }
@@ -0,0 +1,476 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+// The meta protocol is an extension of the text protocol where each command carries a set of
+// single character flags, some of which take a token directly after the flag character. The
+// response echoes back the flags that were asked for, so the responder needs to know what the
+// request looked like. The parser records that in the connState shared with the responder for the
+// same connection. This works because a connection handles one request at a time.
+//
+// Supported commands and flags:
+//
+// mg <key> <flags>*
+//     v: return the value                 t: return the TTL remaining (-1 for none)
+//     c: return the CAS value             f: return the client flags
+//     s: return the size of the value     k: return the key
+//     O(token): opaque value, echoed back
+//     T(ttl): update the TTL (uses the GAT path)
+//     q: quiet mode, a miss (EN) is not sent
+//
+// ms <key> <datalen> <flags>*\r\n<data>\r\n
+//     T(ttl), F(flags), C(cas), O(token), k, q
+//     M(mode): S set (default), E add, A append, P prepend, R replace
+//
+// md <key> <flags>*
+//     O(token), k, q
+//
+// ma <key> <flags>*
+//     N(ttl): create the item on a miss with the given TTL
+//     J(initial): initial value when created, D(delta): default 1
+//     M(mode): I or + increment (default), D or - decrement
+//     O(token), k, q, v
+//
+// mn
+//
+// The h (hit before) and l (last access) flags of mg are not supported because the backends, which
+// speak the binary protocol, don't keep track of either. They are rejected like any unknown flag.
+
+type metaRequest struct {
+	cmd    string
+	key    []byte
+	opaque string
+	quiet  bool
+
+	// The return flags requested, in the order they were given
+	ret []byte
+
+	// mg only, the TTL set by the T flag
+	touch    bool
+	touchTTL uint32
+}
+
+func (m *metaRequest) wants(flag byte) bool {
+	return strings.IndexByte(string(m.ret), flag) != -1
+}
+
+func isMetaCmd(cmd string) bool {
+	switch cmd {
+	case "mg", "ms", "md", "ma", "mn":
+		return true
+	}
+	return false
+}
+
+func (t TextParser) metaRequest(clParts []string, start uint64) (common.Request, common.RequestType, uint64, error) {
+	if clParts[0] == "mn" {
+		if len(clParts) != 1 {
+			return nil, common.RequestNoop, start, common.ErrBadRequest
+		}
+
+		t.state.meta = &metaRequest{cmd: "mn"}
+
+		return common.NoopRequest{
+			Opaque: 0,
+		}, common.RequestNoop, start, nil
+	}
+
+	if len(clParts) < 2 || len(clParts[1]) == 0 {
+		return nil, common.RequestUnknown, start, common.ErrBadRequest
+	}
+
+	m := &metaRequest{
+		cmd: clParts[0],
+		key: []byte(clParts[1]),
+	}
+
+	switch m.cmd {
+	case "mg":
+		return t.metaGet(m, clParts[2:], start)
+	case "ms":
+		return t.metaSet(m, clParts[2:], start)
+	case "md":
+		return t.metaDelete(m, clParts[2:], start)
+	default: // "ma"
+		return t.metaArithmetic(m, clParts[2:], start)
+	}
+}
+
+func (t TextParser) metaGet(m *metaRequest, flags []string, start uint64) (common.Request, common.RequestType, uint64, error) {
+	for _, f := range flags {
+		if len(f) == 0 {
+			continue
+		}
+
+		switch f[0] {
+		case 'v', 't', 'c', 'f', 's', 'k':
+			m.ret = append(m.ret, f[0])
+		case 'O':
+			m.opaque = f[1:]
+		case 'q':
+			m.quiet = true
+		case 'T':
+			ttl, err := parseMetaUint32(f, "TTL")
+			if err != nil {
+				return nil, common.RequestGet, start, err
+			}
+			m.touch = true
+			m.touchTTL = ttl
+		default:
+			return nil, common.RequestGet, start, common.ErrBadRequest
+		}
+	}
+
+	t.state.meta = m
+
+	// Touching goes through GAT, which returns everything but the TTL. Since the TTL was just set,
+	// it's known without asking.
+	if m.touch {
+		return common.GATRequest{
+			Keys:      [][]byte{m.key},
+			Exptimes:  []uint32{m.touchTTL},
+			Opaques:   []uint32{0},
+			Quiet:     []bool{m.quiet},
+			NoopEnd:   false,
+			ReturnCas: m.wants('c'),
+		}, common.RequestGat, start, nil
+	}
+
+	req := common.GetRequest{
+		Keys:      [][]byte{m.key},
+		Opaques:   []uint32{0},
+		Quiet:     []bool{m.quiet},
+		NoopEnd:   false,
+		ReturnCas: m.wants('c'),
+	}
+
+	if m.wants('t') {
+		return req, common.RequestGetE, start, nil
+	}
+
+	return req, common.RequestGet, start, nil
+}
+
+func (t TextParser) metaSet(m *metaRequest, flags []string, start uint64) (common.Request, common.RequestType, uint64, error) {
+	if len(flags) < 1 {
+		return nil, common.RequestSet, start, common.ErrBadRequest
+	}
+
+	length, err := strconv.ParseUint(flags[0], 10, 32)
+	if err != nil {
+		log.Printf("Error parsing length for ms command: %s\n", err.Error())
+		return nil, common.RequestSet, start, common.ErrBadLength
+	}
+
+	req := common.SetRequest{
+		Key:    m.key,
+		Opaque: uint32(0),
+	}
+	reqType, ferr := metaSetFlags(m, &req, flags[1:])
+
+	// The data has to be consumed even if the flags were bad, otherwise it would be read as the
+	// next command line.
+	if req.Data, err = readDataBlock(t.reader, length); err != nil {
+		return nil, reqType, start, err
+	}
+	if ferr != nil {
+		return nil, reqType, start, ferr
+	}
+
+	req.Quiet = m.quiet
+	t.state.meta = m
+
+	return req, reqType, start, nil
+}
+
+func metaSetFlags(m *metaRequest, req *common.SetRequest, flags []string) (common.RequestType, error) {
+	reqType := common.RequestSet
+
+	var err error
+	for _, f := range flags {
+		if len(f) == 0 {
+			continue
+		}
+
+		switch f[0] {
+		case 'k':
+			m.ret = append(m.ret, f[0])
+		case 'O':
+			m.opaque = f[1:]
+		case 'q':
+			m.quiet = true
+		case 'T':
+			if req.Exptime, err = parseMetaUint32(f, "TTL"); err != nil {
+				return reqType, err
+			}
+		case 'F':
+			if req.Flags, err = parseMetaUint32(f, "flags"); err != nil {
+				return reqType, common.ErrBadFlags
+			}
+		case 'C':
+			// A zero CAS value would silently turn this into an unconditional set
+			req.Cas, err = strconv.ParseUint(f[1:], 10, 64)
+			if err != nil || req.Cas == 0 {
+				log.Printf("Error parsing CAS for ms command: %v\n", err)
+				return reqType, common.ErrBadRequest
+			}
+		case 'M':
+			if len(f) != 2 {
+				return reqType, common.ErrBadRequest
+			}
+			switch f[1] {
+			case 'S', 's':
+				reqType = common.RequestSet
+			case 'E', 'e':
+				reqType = common.RequestAdd
+			case 'A', 'a':
+				reqType = common.RequestAppend
+			case 'P', 'p':
+				reqType = common.RequestPrepend
+			case 'R', 'r':
+				reqType = common.RequestReplace
+			default:
+				return reqType, common.ErrBadRequest
+			}
+		default:
+			return reqType, common.ErrBadRequest
+		}
+	}
+
+	// Only a set can be made conditional on the CAS value
+	if req.Cas != 0 && reqType != common.RequestSet {
+		return reqType, common.ErrBadRequest
+	}
+
+	return reqType, nil
+}
+
+func (t TextParser) metaDelete(m *metaRequest, flags []string, start uint64) (common.Request, common.RequestType, uint64, error) {
+	for _, f := range flags {
+		if len(f) == 0 {
+			continue
+		}
+
+		switch f[0] {
+		case 'k':
+			m.ret = append(m.ret, f[0])
+		case 'O':
+			m.opaque = f[1:]
+		case 'q':
+			m.quiet = true
+		default:
+			return nil, common.RequestDelete, start, common.ErrBadRequest
+		}
+	}
+
+	t.state.meta = m
+
+	return common.DeleteRequest{
+		Key:    m.key,
+		Opaque: uint32(0),
+		Quiet:  m.quiet,
+	}, common.RequestDelete, start, nil
+}
+
+func (t TextParser) metaArithmetic(m *metaRequest, flags []string, start uint64) (common.Request, common.RequestType, uint64, error) {
+	req := common.IncrDecrRequest{
+		Key:      m.key,
+		Delta:    1,
+		Opaque:   uint32(0),
+		NoCreate: true,
+	}
+	reqType := common.RequestIncrement
+
+	var err error
+	for _, f := range flags {
+		if len(f) == 0 {
+			continue
+		}
+
+		switch f[0] {
+		case 'v', 'k':
+			m.ret = append(m.ret, f[0])
+		case 'O':
+			m.opaque = f[1:]
+		case 'q':
+			m.quiet = true
+		case 'N':
+			if req.Exptime, err = parseMetaUint32(f, "TTL"); err != nil {
+				return nil, reqType, start, err
+			}
+			req.NoCreate = false
+		case 'J':
+			if req.Initial, err = strconv.ParseUint(f[1:], 10, 64); err != nil {
+				return nil, reqType, start, common.ErrBadIncDecValue
+			}
+		case 'D':
+			if req.Delta, err = strconv.ParseUint(f[1:], 10, 64); err != nil {
+				return nil, reqType, start, common.ErrBadIncDecValue
+			}
+		case 'M':
+			if len(f) != 2 {
+				return nil, reqType, start, common.ErrBadRequest
+			}
+			switch f[1] {
+			case 'I', 'i', '+':
+				reqType = common.RequestIncrement
+			case 'D', 'd', '-':
+				reqType = common.RequestDecrement
+			default:
+				return nil, reqType, start, common.ErrBadRequest
+			}
+		default:
+			return nil, reqType, start, common.ErrBadRequest
+		}
+	}
+
+	req.Quiet = m.quiet
+	t.state.meta = m
+
+	return req, reqType, start, nil
+}
+
+func parseMetaUint32(f, name string) (uint32, error) {
+	v, err := strconv.ParseUint(f[1:], 10, 32)
+	if err != nil {
+		log.Printf("Error parsing %s for meta command: %s\n", name, err.Error())
+		return 0, common.ErrBadRequest
+	}
+	return uint32(v), nil
+}
+
+// metaStatus writes a meta status line with the flags that apply to every response
+func (t TextResponder) metaStatus(m *metaRequest, status string) error {
+	return t.metaResp(status + metaBaseFlags(m))
+}
+
+func metaBaseFlags(m *metaRequest) string {
+	var s string
+	if m.opaque != "" {
+		s += " O" + m.opaque
+	}
+	if m.wants('k') {
+		s += " k" + string(m.key)
+	}
+	return s
+}
+
+type metaItem struct {
+	data  []byte
+	flags uint32
+	cas   uint64
+	ttl   int64
+}
+
+// metaValue writes a meta hit, with the value if it was requested
+func (t TextResponder) metaValue(m *metaRequest, item metaItem) error {
+	status := "HD"
+	if m.wants('v') {
+		status = "VA " + strconv.Itoa(len(item.data))
+	}
+
+	line := status
+	for _, f := range m.ret {
+		switch f {
+		case 't':
+			line += " t" + strconv.FormatInt(item.ttl, 10)
+		case 'c':
+			line += " c" + strconv.FormatUint(item.cas, 10)
+		case 'f':
+			line += " f" + strconv.FormatUint(uint64(item.flags), 10)
+		case 's':
+			line += " s" + strconv.Itoa(len(item.data))
+		}
+	}
+	line += metaBaseFlags(m)
+
+	if !m.wants('v') {
+		return t.metaResp(line)
+	}
+
+	n, err := t.writer.WriteString(line + "\r\n")
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	n, err = t.writer.Write(item.data)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	return t.metaResp("")
+}
+
+// metaResp writes a single response line. Unlike resp, the line is not used as a format string
+// since it can contain keys and opaque tokens from the client.
+func (t TextResponder) metaResp(s string) error {
+	n, err := t.writer.WriteString(s + "\r\n")
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	return t.writer.Flush()
+}
+
+// metaError maps errors to meta status codes. Anything without a meta equivalent is sent the same
+// way as the classic text protocol.
+func (t TextResponder) metaError(m *metaRequest, err error) (bool, error) {
+	switch err {
+	case common.ErrKeyNotFound:
+		// A store that needs an existing item was not stored
+		if m.cmd == "ms" {
+			return true, t.metaStatus(m, "NS")
+		}
+		// md and ma hide NF in quiet mode just like a miss in mg
+		if m.quiet {
+			return true, nil
+		}
+		return true, t.metaStatus(m, "NF")
+	case common.ErrKeyExists:
+		return true, t.metaStatus(m, "EX")
+	case common.ErrItemNotStored:
+		return true, t.metaStatus(m, "NS")
+	}
+	return false, nil
+}
+
+// metaGet responds to an mg, which can come back as a get, GAT or GetE response
+func (t TextResponder) metaGet(m *metaRequest, response common.GetResponse, ttl int64) error {
+	if response.Miss {
+		if m.quiet {
+			return nil
+		}
+		return t.metaStatus(m, "EN")
+	}
+
+	return t.metaValue(m, metaItem{
+		data:  response.Data,
+		flags: response.Flags,
+		cas:   response.Cas,
+		ttl:   ttl,
+	})
+}
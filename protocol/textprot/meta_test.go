@@ -0,0 +1,320 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+// newConn returns a parser and responder for one connection that reads the given input. The
+// responses end up in the returned buffer.
+func newConn(input string) (TextParser, TextResponder, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	p, r := NewTextParserResponder(bufio.NewReader(strings.NewReader(input)), bufio.NewWriter(out))
+	return p, r, out
+}
+
+func parseOK(t *testing.T, p TextParser, reqType common.RequestType) common.Request {
+	req, rt, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if rt != reqType {
+		t.Fatalf("Expected request type %v, got %v", reqType, rt)
+	}
+	return req
+}
+
+func parseErr(t *testing.T, p TextParser, expected error) {
+	if _, _, _, err := p.Parse(); err != expected {
+		t.Fatalf("Expected error %v, got %v", expected, err)
+	}
+}
+
+func expectOutput(t *testing.T, out *bytes.Buffer, expected string) {
+	if out.String() != expected {
+		t.Fatalf("Expected response %q, got %q", expected, out.String())
+	}
+}
+
+func TestMetaGet(t *testing.T) {
+	t.Run("Flags", func(t *testing.T) {
+		p, r, out := newConn("mg foo v t c f s k Oabc\r\n")
+
+		// t needs the expiration time, so it becomes a gete
+		req := parseOK(t, p, common.RequestGetE)
+		gold := common.GetRequest{
+			Keys:      [][]byte{[]byte("foo")},
+			Opaques:   []uint32{0},
+			Quiet:     []bool{false},
+			ReturnCas: true,
+		}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+
+		r.GetE(common.GetEResponse{
+			Key:   []byte("foo"),
+			Data:  []byte("bar"),
+			Flags: 5,
+			Cas:   7,
+		})
+		expectOutput(t, out, "VA 3 t-1 c7 f5 s3 Oabc kfoo\r\nbar\r\n")
+	})
+	t.Run("NoValue", func(t *testing.T) {
+		p, r, out := newConn("mg foo s\r\n")
+		parseOK(t, p, common.RequestGet)
+
+		r.Get(common.GetResponse{Key: []byte("foo"), Data: []byte("bar")})
+		expectOutput(t, out, "HD s3\r\n")
+	})
+	t.Run("Miss", func(t *testing.T) {
+		p, r, out := newConn("mg foo v Oabc k\r\n")
+		parseOK(t, p, common.RequestGet)
+
+		r.Get(common.GetResponse{Key: []byte("foo"), Miss: true})
+		expectOutput(t, out, "EN Oabc kfoo\r\n")
+	})
+	t.Run("QuietMiss", func(t *testing.T) {
+		p, r, out := newConn("mg foo v q\r\n")
+		req := parseOK(t, p, common.RequestGet)
+		if !req.(common.GetRequest).Quiet[0] {
+			t.Fatal("Expected the get to be quiet")
+		}
+
+		r.Get(common.GetResponse{Key: []byte("foo"), Miss: true, Quiet: true})
+		expectOutput(t, out, "")
+	})
+	t.Run("Touch", func(t *testing.T) {
+		p, r, out := newConn("mg foo T30 t v\r\n")
+
+		req := parseOK(t, p, common.RequestGat)
+		if exp := req.(common.GATRequest).Exptimes; !reflect.DeepEqual(exp, []uint32{30}) {
+			t.Fatalf("Expected exptime 30, got %v", exp)
+		}
+
+		r.GAT(common.GetResponse{Key: []byte("foo"), Data: []byte("x")})
+		expectOutput(t, out, "VA 1 t30\r\nx\r\n")
+	})
+	t.Run("Errors", func(t *testing.T) {
+		for _, line := range []string{
+			"mg\r\n",
+			"mg foo Tx\r\n",
+			"mg foo z\r\n",
+			// hit before and last access are not supported
+			"mg foo h\r\n",
+			"mg foo l\r\n",
+		} {
+			p, _, _ := newConn(line)
+			parseErr(t, p, common.ErrBadRequest)
+		}
+	})
+}
+
+func TestMetaSet(t *testing.T) {
+	t.Run("Flags", func(t *testing.T) {
+		p, r, out := newConn("ms foo 3 T10 F5 Oxy k MA\r\nbar\r\n")
+
+		req := parseOK(t, p, common.RequestAppend)
+		gold := common.SetRequest{
+			Key:     []byte("foo"),
+			Data:    []byte("bar"),
+			Flags:   5,
+			Exptime: 10,
+		}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+
+		r.Append(0, false)
+		expectOutput(t, out, "HD Oxy kfoo\r\n")
+	})
+	t.Run("Quiet", func(t *testing.T) {
+		p, r, out := newConn("ms foo 3 q\r\nbar\r\n")
+		req := parseOK(t, p, common.RequestSet)
+		if !req.(common.SetRequest).Quiet {
+			t.Fatal("Expected the set to be quiet")
+		}
+
+		r.Set(0, true)
+		expectOutput(t, out, "")
+	})
+	t.Run("CasMismatch", func(t *testing.T) {
+		p, r, out := newConn("ms foo 3 C12\r\nbar\r\n")
+		req := parseOK(t, p, common.RequestSet)
+		if cas := req.(common.SetRequest).Cas; cas != 12 {
+			t.Fatalf("Expected CAS 12, got %d", cas)
+		}
+
+		r.Error(0, common.RequestSet, common.ErrKeyExists, false)
+		expectOutput(t, out, "EX\r\n")
+	})
+	t.Run("NotStored", func(t *testing.T) {
+		p, r, out := newConn("ms foo 3 MR Oab\r\nbar\r\n")
+		parseOK(t, p, common.RequestReplace)
+
+		// Not stored is sent even in quiet mode since it's a failure
+		r.Error(0, common.RequestReplace, common.ErrKeyNotFound, false)
+		expectOutput(t, out, "NS Oab\r\n")
+	})
+	t.Run("BadLength", func(t *testing.T) {
+		p, _, _ := newConn("ms foo x\r\n")
+		parseErr(t, p, common.ErrBadLength)
+	})
+	t.Run("BadFlags", func(t *testing.T) {
+		p, _, _ := newConn("ms foo 3 Fx\r\nbar\r\n")
+		parseErr(t, p, common.ErrBadFlags)
+	})
+	t.Run("Errors", func(t *testing.T) {
+		for _, flags := range []string{
+			"Z",
+			"Tx",
+			"MX",
+			// a CAS of 0 would make the set unconditional
+			"C0",
+			// only a plain set can have a CAS value
+			"C5 ME",
+		} {
+			// The data is skipped even after a bad flag, so the next command is read properly
+			p, _, _ := newConn("ms foo 3 " + flags + "\r\nbar\r\nmn\r\n")
+			parseErr(t, p, common.ErrBadRequest)
+			parseOK(t, p, common.RequestNoop)
+		}
+	})
+}
+
+func TestMetaDelete(t *testing.T) {
+	t.Run("Hit", func(t *testing.T) {
+		p, r, out := newConn("md foo Oab k\r\n")
+
+		req := parseOK(t, p, common.RequestDelete)
+		gold := common.DeleteRequest{Key: []byte("foo")}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+
+		r.Delete(0, false)
+		expectOutput(t, out, "HD Oab kfoo\r\n")
+	})
+	t.Run("Miss", func(t *testing.T) {
+		p, r, out := newConn("md foo\r\n")
+		parseOK(t, p, common.RequestDelete)
+
+		r.Error(0, common.RequestDelete, common.ErrKeyNotFound, false)
+		expectOutput(t, out, "NF\r\n")
+	})
+	t.Run("QuietMiss", func(t *testing.T) {
+		p, r, out := newConn("md foo q\r\n")
+		parseOK(t, p, common.RequestDelete)
+
+		r.Error(0, common.RequestDelete, common.ErrKeyNotFound, true)
+		expectOutput(t, out, "")
+	})
+	t.Run("BadFlag", func(t *testing.T) {
+		p, _, _ := newConn("md foo v\r\n")
+		parseErr(t, p, common.ErrBadRequest)
+	})
+}
+
+func TestMetaArithmetic(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		p, r, out := newConn("ma foo\r\n")
+
+		req := parseOK(t, p, common.RequestIncrement)
+		gold := common.IncrDecrRequest{
+			Key:      []byte("foo"),
+			Delta:    1,
+			NoCreate: true,
+		}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+
+		r.Increment(0, 2, false)
+		expectOutput(t, out, "HD\r\n")
+	})
+	t.Run("Flags", func(t *testing.T) {
+		p, r, out := newConn("ma foo N60 J10 D5 MD v Ox k\r\n")
+
+		req := parseOK(t, p, common.RequestDecrement)
+		gold := common.IncrDecrRequest{
+			Key:     []byte("foo"),
+			Delta:   5,
+			Initial: 10,
+			Exptime: 60,
+		}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+
+		r.Decrement(0, 5, false)
+		expectOutput(t, out, "VA 1 Ox kfoo\r\n5\r\n")
+	})
+	t.Run("Miss", func(t *testing.T) {
+		p, r, out := newConn("ma foo Oab\r\n")
+		parseOK(t, p, common.RequestIncrement)
+
+		r.Error(0, common.RequestIncrement, common.ErrKeyNotFound, false)
+		expectOutput(t, out, "NF Oab\r\n")
+	})
+	t.Run("Quiet", func(t *testing.T) {
+		p, r, out := newConn("ma foo q\r\nma foo q\r\n")
+
+		parseOK(t, p, common.RequestIncrement)
+		r.Increment(0, 2, true)
+
+		parseOK(t, p, common.RequestIncrement)
+		r.Error(0, common.RequestIncrement, common.ErrKeyNotFound, true)
+
+		expectOutput(t, out, "")
+	})
+	t.Run("Errors", func(t *testing.T) {
+		for _, c := range []struct {
+			flags string
+			err   error
+		}{
+			{"Dx", common.ErrBadIncDecValue},
+			{"Jx", common.ErrBadIncDecValue},
+			{"Nx", common.ErrBadRequest},
+			{"MX", common.ErrBadRequest},
+			{"Z", common.ErrBadRequest},
+		} {
+			p, _, _ := newConn("ma foo " + c.flags + "\r\n")
+			parseErr(t, p, c.err)
+		}
+	})
+}
+
+func TestMetaNoop(t *testing.T) {
+	p, r, out := newConn("mn\r\nmn foo\r\n")
+
+	parseOK(t, p, common.RequestNoop)
+	r.Noop(0)
+	expectOutput(t, out, "MN\r\n")
+
+	parseErr(t, p, common.ErrBadRequest)
+}
+
+func TestMetaNotInClassicParser(t *testing.T) {
+	// Parsers made without a responder don't know the meta commands
+	p := NewTextParser(bufio.NewReader(strings.NewReader("mn\r\n")))
+	parseOK(t, p, common.RequestUnknown)
+}
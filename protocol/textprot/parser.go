@@ -28,15 +28,44 @@ import (
 
 type TextParser struct {
 	reader *bufio.Reader
+	state  *connState
 }
 
+// connState is shared between the parser and responder of a single connection for the commands
+// whose responses depend on more than what the orca passes to the responder. Connections handle one
+// request at a time, so the responder always sees the state for the request it is responding to.
+type connState struct {
+	// The meta command being handled, nil for classic commands
+	meta *metaRequest
+}
+
+// NewTextParser creates a parser for the classic text protocol. Meta commands are only understood
+// by parsers created through NewTextParserResponder, since they need a matching responder.
 func NewTextParser(reader *bufio.Reader) TextParser {
 	return TextParser{
 		reader: reader,
 	}
 }
 
+// NewTextParserResponder creates a parser and responder pair for a single connection that
+// understands both the classic and the meta text protocols.
+func NewTextParserResponder(reader *bufio.Reader, writer *bufio.Writer) (TextParser, TextResponder) {
+	state := &connState{}
+	return TextParser{
+		reader: reader,
+		state:  state,
+	}, TextResponder{
+		writer: writer,
+		state:  state,
+	}
+}
+
 func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	if t.state != nil {
+		// Response options only apply to the meta request that set them
+		t.state.meta = nil
+	}
+
 	data, err := t.reader.ReadString('\n')
 	start := timer.Now()
 	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(len(data)))
@@ -52,23 +81,33 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 
 	clParts := strings.Split(strings.TrimSpace(data), " ")
 
+	if t.state != nil && isMetaCmd(clParts[0]) {
+		return t.metaRequest(clParts, start)
+	}
+
+	// Any of the write commands can end in noreply, which becomes the Quiet flag on the request
+	clParts, quiet := noreply(clParts)
+
 	switch clParts[0] {
 	case "set":
-		return setRequest(t.reader, clParts, common.RequestSet, start)
+		return setRequest(t.reader, clParts, common.RequestSet, quiet, start)
 
 	case "add":
-		return setRequest(t.reader, clParts, common.RequestAdd, start)
+		return setRequest(t.reader, clParts, common.RequestAdd, quiet, start)
 
 	case "replace":
-		return setRequest(t.reader, clParts, common.RequestReplace, start)
+		return setRequest(t.reader, clParts, common.RequestReplace, quiet, start)
 
 	case "append":
-		return setRequest(t.reader, clParts, common.RequestAppend, start)
+		return setRequest(t.reader, clParts, common.RequestAppend, quiet, start)
 
 	case "prepend":
-		return setRequest(t.reader, clParts, common.RequestPrepend, start)
+		return setRequest(t.reader, clParts, common.RequestPrepend, quiet, start)
 
-	case "get":
+	case "cas":
+		return casRequest(t.reader, clParts, quiet, start)
+
+	case "get", "gets":
 		if len(clParts) < 2 {
 			return nil, common.RequestGet, start, common.ErrBadRequest
 		}
@@ -81,12 +120,60 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 		opaques := make([]uint32, len(keys))
 		quiet := make([]bool, len(keys))
 
+		return common.GetRequest{
+			Keys:      keys,
+			Opaques:   opaques,
+			Quiet:     quiet,
+			NoopEnd:   false,
+			ReturnCas: clParts[0] == "gets",
+		}, common.RequestGet, start, nil
+
+	case "gete":
+		// gete <key>*
+		if len(clParts) < 2 {
+			return nil, common.RequestGetE, start, common.ErrBadRequest
+		}
+
+		var keys [][]byte
+		for _, key := range clParts[1:] {
+			keys = append(keys, []byte(key))
+		}
+
 		return common.GetRequest{
 			Keys:    keys,
-			Opaques: opaques,
-			Quiet:   quiet,
+			Opaques: make([]uint32, len(keys)),
+			Quiet:   make([]bool, len(keys)),
 			NoopEnd: false,
-		}, common.RequestGet, start, nil
+		}, common.RequestGetE, start, nil
+
+	case "gat", "gats":
+		// gat <exptime> <key>*
+		// gats <exptime> <key>*
+		if len(clParts) < 3 {
+			return nil, common.RequestGat, start, common.ErrBadRequest
+		}
+
+		exptime, err := strconv.ParseUint(strings.TrimSpace(clParts[1]), 10, 32)
+		if err != nil {
+			log.Printf("Error parsing ttl for gat command: %s\n", err.Error())
+			return nil, common.RequestGat, start, common.ErrBadExptime
+		}
+
+		var keys [][]byte
+		var exptimes []uint32
+		for _, key := range clParts[2:] {
+			keys = append(keys, []byte(key))
+			exptimes = append(exptimes, uint32(exptime))
+		}
+
+		return common.GATRequest{
+			Keys:      keys,
+			Exptimes:  exptimes,
+			Opaques:   make([]uint32, len(keys)),
+			Quiet:     make([]bool, len(keys)),
+			NoopEnd:   false,
+			ReturnCas: clParts[0] == "gats",
+		}, common.RequestGat, start, nil
 
 	case "delete":
 		if len(clParts) != 2 {
@@ -96,6 +183,7 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 		return common.DeleteRequest{
 			Key:    []byte(clParts[1]),
 			Opaque: uint32(0),
+			Quiet:  quiet,
 		}, common.RequestDelete, start, nil
 
 	// TODO: Error handling for invalid cmd line
@@ -116,7 +204,51 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 			Key:     key,
 			Exptime: uint32(exptime),
 			Opaque:  uint32(0),
+			Quiet:   quiet,
 		}, common.RequestTouch, start, nil
+	case "incr":
+		return incrDecrRequest(clParts, common.RequestIncrement, quiet, start)
+
+	case "decr":
+		return incrDecrRequest(clParts, common.RequestDecrement, quiet, start)
+
+	case "flush_all":
+		// flush_all [delay]
+		if len(clParts) > 2 {
+			return nil, common.RequestFlush, start, common.ErrBadRequest
+		}
+
+		var delay uint64
+		if len(clParts) == 2 {
+			delay, err = strconv.ParseUint(strings.TrimSpace(clParts[1]), 10, 32)
+			if err != nil {
+				log.Printf("Error parsing delay for flush_all command: %s\n", err.Error())
+				return nil, common.RequestFlush, start, common.ErrBadRequest
+			}
+		}
+
+		return common.FlushRequest{
+			Delay:  uint32(delay),
+			Opaque: uint32(0),
+			Quiet:  quiet,
+		}, common.RequestFlush, start, nil
+
+	case "stats":
+		// stats [group]
+		if len(clParts) > 2 {
+			return nil, common.RequestStats, start, common.ErrBadRequest
+		}
+
+		var group string
+		if len(clParts) == 2 {
+			group = clParts[1]
+		}
+
+		return common.StatsRequest{
+			Group:  group,
+			Opaque: uint32(0),
+		}, common.RequestStats, start, nil
+
 	case "noop":
 		if len(clParts) != 1 {
 			return nil, common.RequestNoop, start, common.ErrBadRequest
@@ -147,7 +279,20 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 	}
 }
 
-func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, start uint64) (common.SetRequest, common.RequestType, uint64, error) {
+// noreply strips a trailing noreply off of the command lines that allow it and reports whether it
+// was there. Reads don't take noreply, so on those it would just be a key that happens to be named
+// "noreply".
+func noreply(clParts []string) ([]string, bool) {
+	switch clParts[0] {
+	case "set", "add", "replace", "append", "prepend", "cas", "delete", "touch", "incr", "decr", "flush_all":
+		if len(clParts) > 1 && clParts[len(clParts)-1] == "noreply" {
+			return clParts[:len(clParts)-1], true
+		}
+	}
+	return clParts, false
+}
+
+func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, quiet bool, start uint64) (common.SetRequest, common.RequestType, uint64, error) {
 	// sanity check
 	if len(clParts) != 5 {
 		return common.SetRequest{}, reqType, start, common.ErrBadRequest
@@ -173,23 +318,84 @@ func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, s
 		return common.SetRequest{}, reqType, start, common.ErrBadLength
 	}
 
-	// Read in data
-	dataBuf := make([]byte, length)
-	n, err := io.ReadAtLeast(r, dataBuf, int(length))
-	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	dataBuf, err := readDataBlock(r, length)
 	if err != nil {
-		return common.SetRequest{}, reqType, start, common.ErrInternal
+		return common.SetRequest{}, reqType, start, err
 	}
 
-	// Consume the last two bytes "\r\n"
-	r.ReadString(byte('\n'))
-	metrics.IncCounterBy(common.MetricBytesReadRemote, 2)
-
 	return common.SetRequest{
 		Key:     key,
 		Flags:   uint32(flags),
 		Exptime: uint32(exptime),
 		Opaque:  uint32(0),
+		Quiet:   quiet,
 		Data:    dataBuf,
 	}, reqType, start, nil
 }
+
+func casRequest(r *bufio.Reader, clParts []string, quiet bool, start uint64) (common.SetRequest, common.RequestType, uint64, error) {
+	// cas <key> <flags> <exptime> <bytes> <cas unique>
+	if len(clParts) < 5 {
+		return common.SetRequest{}, common.RequestSet, start, common.ErrBadRequest
+	}
+
+	// Once the length is known the data block has to be read even if the rest of the command
+	// is bad, or the data would be parsed as the next command
+	req, reqType, start, err := setRequest(r, clParts[:5], common.RequestSet, quiet, start)
+	if err != nil {
+		return req, reqType, start, err
+	}
+
+	if len(clParts) != 6 {
+		return common.SetRequest{}, common.RequestSet, start, common.ErrBadRequest
+	}
+
+	// A zero CAS value would silently turn this into an unconditional set
+	cas, err := strconv.ParseUint(strings.TrimSpace(clParts[5]), 10, 64)
+	if err != nil || cas == 0 {
+		log.Printf("Error parsing cas unique for cas command: %v\n", err)
+		return common.SetRequest{}, common.RequestSet, start, common.ErrBadRequest
+	}
+
+	req.Cas = cas
+	return req, reqType, start, nil
+}
+
+func incrDecrRequest(clParts []string, reqType common.RequestType, quiet bool, start uint64) (common.IncrDecrRequest, common.RequestType, uint64, error) {
+	// incr <key> <value>
+	// decr <key> <value>
+	if len(clParts) != 3 {
+		return common.IncrDecrRequest{}, reqType, start, common.ErrBadRequest
+	}
+
+	delta, err := strconv.ParseUint(strings.TrimSpace(clParts[2]), 10, 64)
+	if err != nil {
+		log.Printf("Error parsing delta for incr/decr command: %s\n", err.Error())
+		return common.IncrDecrRequest{}, reqType, start, common.ErrBadIncDecValue
+	}
+
+	// The text protocol never creates items that don't exist
+	return common.IncrDecrRequest{
+		Key:      []byte(clParts[1]),
+		Delta:    delta,
+		Opaque:   uint32(0),
+		Quiet:    quiet,
+		NoCreate: true,
+	}, reqType, start, nil
+}
+
+// readDataBlock reads a data block of the given length plus the trailing "\r\n"
+func readDataBlock(r *bufio.Reader, length uint64) ([]byte, error) {
+	dataBuf := make([]byte, length)
+	n, err := io.ReadAtLeast(r, dataBuf, int(length))
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	if err != nil {
+		return nil, common.ErrInternal
+	}
+
+	// Consume the last two bytes "\r\n"
+	r.ReadString(byte('\n'))
+	metrics.IncCounterBy(common.MetricBytesReadRemote, 2)
+
+	return dataBuf, nil
+}
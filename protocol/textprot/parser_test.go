@@ -0,0 +1,215 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestNoreply(t *testing.T) {
+	// Nothing is written for a command sent with noreply, success or not, so the response to
+	// the next command is the first thing the client sees
+	version := "VERSION " + common.VersionString + "\r\n"
+
+	cases := []struct {
+		name    string
+		input   string
+		reqType common.RequestType
+
+		// respond answers the request the way an orca would and returns whether it was quiet
+		respond func(r TextResponder, req common.Request) bool
+
+		// fail is an error the orca could respond with instead
+		fail error
+	}{
+		{
+			name:    "Set",
+			input:   "set foo 0 0 3 noreply\r\nbar\r\n",
+			reqType: common.RequestSet,
+			respond: func(r TextResponder, req common.Request) bool {
+				q := req.(common.SetRequest).Quiet
+				r.Set(0, q)
+				return q
+			},
+			fail: common.ErrNoMem,
+		},
+		{
+			name:    "Delete",
+			input:   "delete foo noreply\r\n",
+			reqType: common.RequestDelete,
+			respond: func(r TextResponder, req common.Request) bool {
+				q := req.(common.DeleteRequest).Quiet
+				r.Delete(0, q)
+				return q
+			},
+			fail: common.ErrKeyNotFound,
+		},
+		{
+			name:    "Incr",
+			input:   "incr foo 2 noreply\r\n",
+			reqType: common.RequestIncrement,
+			respond: func(r TextResponder, req common.Request) bool {
+				q := req.(common.IncrDecrRequest).Quiet
+				r.Increment(0, 3, q)
+				return q
+			},
+			fail: common.ErrKeyNotFound,
+		},
+		{
+			name:    "Touch",
+			input:   "touch foo 10 noreply\r\n",
+			reqType: common.RequestTouch,
+			respond: func(r TextResponder, req common.Request) bool {
+				q := req.(common.TouchRequest).Quiet
+				r.Touch(0, q)
+				return q
+			},
+			fail: common.ErrKeyNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Run("Success", func(t *testing.T) {
+				p, r, out := newConn(c.input + "version\r\n")
+
+				req := parseOK(t, p, c.reqType)
+				if !c.respond(r, req) {
+					t.Fatal("Expected the request to be quiet")
+				}
+
+				parseOK(t, p, common.RequestVersion)
+				r.Version(0)
+				expectOutput(t, out, version)
+			})
+			t.Run("Error", func(t *testing.T) {
+				p, r, out := newConn(c.input + "version\r\n")
+
+				parseOK(t, p, c.reqType)
+				r.Error(0, c.reqType, c.fail, true)
+
+				parseOK(t, p, common.RequestVersion)
+				r.Version(0)
+				expectOutput(t, out, version)
+			})
+		})
+	}
+
+	t.Run("NotOnGets", func(t *testing.T) {
+		// A get for a key named noreply is just a get
+		p, _, _ := newConn("get noreply\r\n")
+
+		req := parseOK(t, p, common.RequestGet)
+		if keys := req.(common.GetRequest).Keys; !reflect.DeepEqual(keys, [][]byte{[]byte("noreply")}) {
+			t.Fatalf("Expected the key noreply, got %q", keys)
+		}
+	})
+}
+
+func TestGat(t *testing.T) {
+	t.Run("Gat", func(t *testing.T) {
+		p, _, _ := newConn("gat 10 foo bar\r\n")
+
+		req := parseOK(t, p, common.RequestGat)
+		gold := common.GATRequest{
+			Keys:     [][]byte{[]byte("foo"), []byte("bar")},
+			Exptimes: []uint32{10, 10},
+			Opaques:  []uint32{0, 0},
+			Quiet:    []bool{false, false},
+		}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+	})
+	t.Run("Gats", func(t *testing.T) {
+		p, _, _ := newConn("gats 10 foo\r\n")
+
+		req := parseOK(t, p, common.RequestGat)
+		if !req.(common.GATRequest).ReturnCas {
+			t.Fatal("Expected gats to return CAS values")
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		for _, c := range []struct {
+			line string
+			err  error
+		}{
+			{"gat\r\n", common.ErrBadRequest},
+			{"gats\r\n", common.ErrBadRequest},
+			// an exptime with no keys
+			{"gat 10\r\n", common.ErrBadRequest},
+			{"gats 10\r\n", common.ErrBadRequest},
+			{"gat x foo\r\n", common.ErrBadExptime},
+			{"gats -1 foo\r\n", common.ErrBadExptime},
+			{"gat 4294967296 foo\r\n", common.ErrBadExptime},
+		} {
+			p, _, _ := newConn(c.line)
+			parseErr(t, p, c.err)
+		}
+	})
+}
+
+func TestCas(t *testing.T) {
+	t.Run("Cas", func(t *testing.T) {
+		p, _, _ := newConn("cas foo 1 2 3 5\r\nbar\r\n")
+
+		req := parseOK(t, p, common.RequestSet)
+		gold := common.SetRequest{
+			Key:     []byte("foo"),
+			Flags:   1,
+			Exptime: 2,
+			Data:    []byte("bar"),
+			Cas:     5,
+		}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		// The data block is skipped so the next command is parsed normally
+		for _, line := range []string{
+			"cas foo 0 0 3 0\r\nbar\r\n",
+			"cas foo 0 0 3 x\r\nbar\r\n",
+			"cas foo 0 0 3\r\nbar\r\n",
+		} {
+			p, _, _ := newConn(line + "version\r\n")
+			parseErr(t, p, common.ErrBadRequest)
+			parseOK(t, p, common.RequestVersion)
+		}
+	})
+}
+
+func TestGetE(t *testing.T) {
+	t.Run("Keys", func(t *testing.T) {
+		p, _, _ := newConn("gete foo bar\r\n")
+
+		req := parseOK(t, p, common.RequestGetE)
+		gold := common.GetRequest{
+			Keys:    [][]byte{[]byte("foo"), []byte("bar")},
+			Opaques: []uint32{0, 0},
+			Quiet:   []bool{false, false},
+		}
+		if !reflect.DeepEqual(req, gold) {
+			t.Fatalf("Expected %#v, got %#v", gold, req)
+		}
+	})
+	t.Run("NoKeys", func(t *testing.T) {
+		p, _, _ := newConn("gete\r\n")
+		parseErr(t, p, common.ErrBadRequest)
+	})
+}
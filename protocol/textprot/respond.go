@@ -17,6 +17,8 @@ package textprot
 import (
 	"bufio"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
@@ -24,6 +26,7 @@ import (
 
 type TextResponder struct {
 	writer *bufio.Writer
+	state  *connState
 }
 
 func NewTextResponder(writer *bufio.Writer) TextResponder {
@@ -32,43 +35,75 @@ func NewTextResponder(writer *bufio.Writer) TextResponder {
 	}
 }
 
+// metaReq returns the meta request currently being responded to, or nil for classic commands
+func (t TextResponder) metaReq() *metaRequest {
+	if t.state == nil {
+		return nil
+	}
+	return t.state.meta
+}
+
+// stored is the common response for all the storage commands
+func (t TextResponder) stored(quiet bool) error {
+	if m := t.metaReq(); m != nil {
+		if m.quiet {
+			return nil
+		}
+		return t.metaStatus(m, "HD")
+	}
+	return t.respUnlessQuiet("STORED", quiet)
+}
+
 func (t TextResponder) Set(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	return t.stored(quiet)
 }
 
 func (t TextResponder) Add(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	return t.stored(quiet)
 }
 
 func (t TextResponder) Replace(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	return t.stored(quiet)
 }
 
 func (t TextResponder) Append(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	return t.stored(quiet)
 }
 
 func (t TextResponder) Prepend(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	return t.stored(quiet)
 }
 
 func (t TextResponder) Get(response common.GetResponse) error {
+	if m := t.metaReq(); m != nil {
+		return t.metaGet(m, response, -1)
+	}
+
 	if response.Miss {
 		// A miss is a no-op in the text world
 		return nil
 	}
 
 	// Write data out to client
-	// [VALUE <key> <flags> <bytes>\r\n
+	// [VALUE <key> <flags> <bytes> [<cas unique>]\r\n
 	// <data block>\r\n]*
 	// END\r\n
-	n, err := fmt.Fprintf(t.writer, "VALUE %s %d %d\r\n", response.Key, response.Flags, len(response.Data))
+	if response.ReturnCas {
+		return t.value(response.Key, response.Flags, response.Data, " "+strconv.FormatUint(response.Cas, 10))
+	}
+	return t.value(response.Key, response.Flags, response.Data, "")
+}
+
+// value writes out a single VALUE line and data block. The suffix is appended to the VALUE line
+// for the commands that return more than the standard fields.
+func (t TextResponder) value(key []byte, flags uint32, data []byte, suffix string) error {
+	n, err := fmt.Fprintf(t.writer, "VALUE %s %d %d%s\r\n", key, flags, len(data), suffix)
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
 	if err != nil {
 		return err
 	}
 
-	n, err = t.writer.Write(response.Data)
+	n, err = t.writer.Write(data)
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
 	if err != nil {
 		return err
@@ -80,38 +115,115 @@ func (t TextResponder) Get(response common.GetResponse) error {
 		return err
 	}
 
-	t.writer.Flush()
-	return nil
+	return t.writer.Flush()
 }
 
 func (t TextResponder) GetEnd(opaque uint32, noopEnd bool) error {
+	// mg is a single key get with no terminator
+	if t.metaReq() != nil {
+		return nil
+	}
 	return t.resp("END")
 }
 
 func (t TextResponder) GetE(response common.GetEResponse) error {
-	panic("GetE command in text protocol")
+	// Only mg with the t flag turns into a GetE
+	if m := t.metaReq(); m != nil {
+		return t.metaGet(m, common.GetResponse{
+			Key:    response.Key,
+			Data:   response.Data,
+			Opaque: response.Opaque,
+			Flags:  response.Flags,
+			Cas:    response.Cas,
+			Miss:   response.Miss,
+			Quiet:  response.Quiet,
+		}, remainingTTL(response.Exptime))
+	}
+
+	if response.Miss {
+		return nil
+	}
+
+	// VALUE <key> <flags> <bytes> <ttl remaining>\r\n
+	// <data block>\r\n
+	// The TTL is -1 if the item does not expire
+	return t.value(response.Key, response.Flags, response.Data, " "+strconv.FormatInt(remainingTTL(response.Exptime), 10))
 }
 
 func (t TextResponder) GAT(response common.GetResponse) error {
-	// There's two options here.
-	// 1) panic() because this is never supposed to be called
-	// 2) Respond as a normal get
-	//
-	// I chose to panic, since this means we are in a bad state.
-	// The text parser will never return a GAT command because
-	// it does not exist in the text protocol.
-	panic("GAT command in text protocol")
+	// mg with the T flag is a GAT, and the TTL is the one that was just set
+	if m := t.metaReq(); m != nil {
+		ttl := int64(m.touchTTL)
+		if ttl == 0 {
+			ttl = -1
+		}
+		return t.metaGet(m, response, ttl)
+	}
+
+	// gat and gats respond exactly like get and gets
+	return t.Get(response)
+}
+
+func (t TextResponder) Delete(opaque uint32, quiet bool) error {
+	if m := t.metaReq(); m != nil {
+		if m.quiet {
+			return nil
+		}
+		return t.metaStatus(m, "HD")
+	}
+	return t.respUnlessQuiet("DELETED", quiet)
+}
+
+func (t TextResponder) Touch(opaque uint32, quiet bool) error {
+	return t.respUnlessQuiet("TOUCHED", quiet)
 }
 
-func (t TextResponder) Delete(opaque uint32) error {
-	return t.resp("DELETED")
+func (t TextResponder) Increment(opaque uint32, value uint64, quiet bool) error {
+	return t.incrDecr(value, quiet)
 }
 
-func (t TextResponder) Touch(opaque uint32) error {
-	return t.resp("TOUCHED")
+func (t TextResponder) Decrement(opaque uint32, value uint64, quiet bool) error {
+	return t.incrDecr(value, quiet)
+}
+
+func (t TextResponder) incrDecr(value uint64, quiet bool) error {
+	v := strconv.FormatUint(value, 10)
+
+	if m := t.metaReq(); m != nil {
+		if m.wants('v') {
+			return t.metaResp("VA " + strconv.Itoa(len(v)) + metaBaseFlags(m) + "\r\n" + v)
+		}
+		if m.quiet {
+			return nil
+		}
+		return t.metaStatus(m, "HD")
+	}
+
+	return t.respUnlessQuiet(v, quiet)
+}
+
+func (t TextResponder) Flush(opaque uint32, quiet bool) error {
+	return t.respUnlessQuiet("OK", quiet)
+}
+
+func (t TextResponder) Stats(opaque uint32, stats []common.Stat) error {
+	// STAT <name> <value>\r\n for each stat
+	// END\r\n
+	for _, s := range stats {
+		n, err := fmt.Fprintf(t.writer, "STAT %s %s\r\n", s.Name, s.Value)
+		metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.resp("END")
 }
 
 func (t TextResponder) Noop(opaque uint32) error {
+	if t.metaReq() != nil {
+		return t.resp("MN")
+	}
 	return t.resp("Yep, it works.")
 }
 
@@ -126,11 +238,34 @@ func (t TextResponder) Version(opaque uint32) error {
 	return t.resp("VERSION " + common.VersionString)
 }
 
+// SASL is only part of the binary protocol, so the text parser never produces these requests
+func (t TextResponder) SASLMechs(opaque uint32, mechs []string) error {
+	panic("SASL is not supported in the text protocol")
+}
+
+func (t TextResponder) SASLAuth(opaque uint32) error {
+	panic("SASL is not supported in the text protocol")
+}
+
 func (t TextResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
+	if m := t.metaReq(); m != nil {
+		if handled, merr := t.metaError(m, err); handled {
+			return merr
+		}
+	} else if quiet {
+		// A client that sent noreply is not going to read anything back, so even errors are
+		// dropped or they would be mistaken for the response to the next command.
+		return nil
+	}
+
 	switch err {
 	case common.ErrKeyNotFound:
 		return t.resp("NOT_FOUND")
 	case common.ErrKeyExists:
+		// A set can only fail this way when it carried a CAS value
+		if reqType == common.RequestSet {
+			return t.resp("EXISTS")
+		}
 		return t.resp("NOT_STORED")
 	case common.ErrItemNotStored:
 		return t.resp("NOT_STORED")
@@ -141,7 +276,11 @@ func (t TextResponder) Error(opaque uint32, reqType common.RequestType, err erro
 	case common.ErrBadIncDecValue:
 		return t.resp("CLIENT_ERROR invalid numeric delta argument")
 	case common.ErrAuth:
-		return t.resp("CLIENT_ERROR")
+		return t.resp("CLIENT_ERROR unauthorized")
+	case common.ErrBusy:
+		return t.resp("SERVER_ERROR busy")
+	case common.ErrTempFailure:
+		return t.resp("SERVER_ERROR temporary failure")
 	case common.ErrUnknownCmd:
 		fallthrough
 	case common.ErrNoMem:
@@ -151,8 +290,32 @@ func (t TextResponder) Error(opaque uint32, reqType common.RequestType, err erro
 	}
 }
 
+// remainingTTL converts an expiration time from a GetE response to the TTL remaining. Following the
+// memcached convention, values over 30 days are absolute unix timestamps.
+func remainingTTL(exptime uint32) int64 {
+	if exptime == 0 {
+		return -1
+	}
+	if exptime > 60*60*24*30 {
+		ttl := int64(exptime) - time.Now().Unix()
+		if ttl < 0 {
+			ttl = 0
+		}
+		return ttl
+	}
+	return int64(exptime)
+}
+
+// respUnlessQuiet writes out the response unless the command was sent with noreply
+func (t TextResponder) respUnlessQuiet(s string, quiet bool) error {
+	if quiet {
+		return nil
+	}
+	return t.resp(s)
+}
+
 func (t TextResponder) resp(s string) error {
-	n, err := fmt.Fprintf(t.writer, s+"\r\n")
+	n, err := t.writer.WriteString(s + "\r\n")
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
 	if err != nil {
 		return err
@@ -0,0 +1,132 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestGatResponse(t *testing.T) {
+	res := common.GetResponse{
+		Key:   []byte("foo"),
+		Data:  []byte("bar"),
+		Flags: 5,
+		Cas:   12,
+	}
+
+	t.Run("Gat", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		r := NewTextResponder(bufio.NewWriter(out))
+
+		r.GAT(res)
+		r.GetEnd(0, false)
+		expectOutput(t, out, "VALUE foo 5 3\r\nbar\r\nEND\r\n")
+	})
+	t.Run("Gats", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		r := NewTextResponder(bufio.NewWriter(out))
+
+		res := res
+		res.ReturnCas = true
+		r.GAT(res)
+		r.GAT(common.GetResponse{Key: []byte("baz"), Miss: true, ReturnCas: true})
+		r.GetEnd(0, false)
+		expectOutput(t, out, "VALUE foo 5 3 12\r\nbar\r\nEND\r\n")
+	})
+}
+
+func TestGetEResponse(t *testing.T) {
+	out := &bytes.Buffer{}
+	r := NewTextResponder(bufio.NewWriter(out))
+
+	r.GetE(common.GetEResponse{
+		Key:     []byte("foo"),
+		Data:    []byte("bar"),
+		Flags:   5,
+		Exptime: 100,
+	})
+	expectOutput(t, out, "VALUE foo 5 3 100\r\nbar\r\n")
+}
+
+func TestRemainingTTL(t *testing.T) {
+	const thirtyDays = 60 * 60 * 24 * 30
+
+	t.Run("None", func(t *testing.T) {
+		if ttl := remainingTTL(0); ttl != -1 {
+			t.Fatalf("Expected -1, got %d", ttl)
+		}
+	})
+	t.Run("Relative", func(t *testing.T) {
+		// 30 days exactly is still relative
+		if ttl := remainingTTL(thirtyDays); ttl != thirtyDays {
+			t.Fatalf("Expected %d, got %d", thirtyDays, ttl)
+		}
+	})
+	t.Run("Absolute", func(t *testing.T) {
+		exptime := uint32(time.Now().Unix() + 3600)
+		ttl := remainingTTL(exptime)
+
+		// Allow for the clock ticking over between the two calls
+		if ttl < 3599 || ttl > 3600 {
+			t.Fatalf("Expected about 3600, got %d", ttl)
+		}
+	})
+	t.Run("AbsoluteInThePast", func(t *testing.T) {
+		// Past the 30 day cutoff but long gone as a unix time
+		if ttl := remainingTTL(thirtyDays + 1); ttl != 0 {
+			t.Fatalf("Expected 0, got %d", ttl)
+		}
+	})
+	t.Run("Response", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		r := NewTextResponder(bufio.NewWriter(out))
+
+		exptime := uint32(time.Now().Unix() + 3600)
+		r.GetE(common.GetEResponse{
+			Key:     []byte("foo"),
+			Data:    []byte("bar"),
+			Exptime: exptime,
+		})
+
+		// Same allowance for the clock as above
+		got := out.String()
+		if got != "VALUE foo 0 3 3600\r\nbar\r\n" && got != "VALUE foo 0 3 3599\r\nbar\r\n" {
+			t.Fatalf("Expected a TTL of about 3600, got %q", got)
+		}
+	})
+}
+
+func TestAuthError(t *testing.T) {
+	out := &bytes.Buffer{}
+	r := NewTextResponder(bufio.NewWriter(out))
+
+	r.Error(0, common.RequestGet, common.ErrAuth, false)
+	expectOutput(t, out, "CLIENT_ERROR unauthorized\r\n")
+}
+
+func TestErrorText(t *testing.T) {
+	out := &bytes.Buffer{}
+	r := NewTextResponder(bufio.NewWriter(out))
+
+	// Other errors are sent as is, so a % in them must not be read as a format verb
+	r.Error(0, common.RequestGet, errors.New("SERVER_ERROR 100% full"), false)
+	expectOutput(t, out, "SERVER_ERROR 100% full\r\n")
+}
@@ -18,6 +18,7 @@ package protocol
 
 import (
 	"bufio"
+	"context"
 
 	"github.com/netflix/rend/common"
 )
@@ -31,6 +32,49 @@ type RequestParser interface {
 	Parse() (common.Request, common.RequestType, uint64, error)
 }
 
+// ContextRequestParser is the context-aware version of RequestParser. The context is the one for
+// the connection, which is canceled once the client is gone.
+type ContextRequestParser interface {
+	Parse(ctx context.Context) (common.Request, common.RequestType, uint64, error)
+}
+
+// WithContext returns a ContextRequestParser for a RequestParser. The adapted parser returns the
+// context's error instead of parsing if the context is already done.
+func WithContext(rp RequestParser) ContextRequestParser {
+	if nc, ok := rp.(noContextParser); ok {
+		return nc.crp
+	}
+	return contextParser{rp: rp}
+}
+
+// WithoutContext returns a RequestParser for a ContextRequestParser. Every call is made with
+// context.Background().
+func WithoutContext(crp ContextRequestParser) RequestParser {
+	if c, ok := crp.(contextParser); ok {
+		return c.rp
+	}
+	return noContextParser{crp: crp}
+}
+
+type contextParser struct {
+	rp RequestParser
+}
+
+func (c contextParser) Parse(ctx context.Context) (common.Request, common.RequestType, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, common.RequestUnknown, 0, err
+	}
+	return c.rp.Parse()
+}
+
+type noContextParser struct {
+	crp ContextRequestParser
+}
+
+func (n noContextParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	return n.crp.Parse(context.Background())
+}
+
 // Responder is the interface for a protocol to respond to different commands. It responds in
 // whatever way is appropriate, including doing nothing or panic()-ing for unsupported interactions.
 // Unsupported interactions are OK to panic() on because they should never be returned from the
@@ -45,14 +89,29 @@ type Responder interface {
 	GetEnd(opaque uint32, noopEnd bool) error
 	GetE(response common.GetEResponse) error
 	GAT(response common.GetResponse) error
-	Delete(opaque uint32) error
-	Touch(opaque uint32) error
+	Delete(opaque uint32, quiet bool) error
+	Touch(opaque uint32, quiet bool) error
+	Increment(opaque uint32, value uint64, quiet bool) error
+	Decrement(opaque uint32, value uint64, quiet bool) error
+	Flush(opaque uint32, quiet bool) error
+	Stats(opaque uint32, stats []common.Stat) error
 	Noop(opaque uint32) error
 	Quit(opaque uint32, quiet bool) error
 	Version(opaque uint32) error
+	SASLMechs(opaque uint32, mechs []string) error
+	SASLAuth(opaque uint32) error
 	Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error
 }
 
+// CasResponder is implemented by responders for protocols that send the client the new CAS value
+// of an item after it is stored or changed, like the binary protocol. Orchestrators that know the
+// CAS the backend gave the item call Stored in place of Set, Add, Replace, Append, and Prepend,
+// and IncrDecr in place of Increment and Decrement.
+type CasResponder interface {
+	Stored(reqType common.RequestType, opaque uint32, cas uint64, quiet bool) error
+	IncrDecr(reqType common.RequestType, opaque uint32, value, cas uint64, quiet bool) error
+}
+
 // Peeker is an interface that is designed to restrict the functionality of a bufio.Reader for the
 // purposes of protocol disambiguation. A bufio.Reader must be cast to a protocol.Peeker to be used
 // in
@@ -76,3 +135,21 @@ type Components interface {
 	NewRequestParser(r *bufio.Reader) RequestParser
 	NewResponder(w *bufio.Writer) Responder
 }
+
+// ConnectionComponents is an optional interface for protocols whose RequestParser and Responder
+// need to share state for the lifetime of a connection, e.g. to carry per-request response options
+// from the parser to the responder. When a Components implements it, NewParserResponder is used
+// instead of NewRequestParser and NewResponder.
+type ConnectionComponents interface {
+	Components
+	NewParserResponder(r *bufio.Reader, w *bufio.Writer) (RequestParser, Responder)
+}
+
+// NewParserResponder creates the RequestParser and Responder for a single connection using the
+// given Components, pairing them if the protocol requires it.
+func NewParserResponder(c Components, r *bufio.Reader, w *bufio.Writer) (RequestParser, Responder) {
+	if cc, ok := c.(ConnectionComponents); ok {
+		return cc.NewParserResponder(r, w)
+	}
+	return c.NewRequestParser(r), c.NewResponder(w)
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/netflix/rend/common"
+)
+
+// MechPlain is the only SASL mechanism supported. The username and password are sent in the clear,
+// so it should only be used on trusted networks or over TLS.
+const MechPlain = "PLAIN"
+
+// Credentials is a source of usernames and passwords used to authenticate connections. A listener
+// that is given a Credentials requires every connection to authenticate before doing anything else.
+type Credentials interface {
+	// Verify returns true if the password is the correct one for the user
+	Verify(user, password string) bool
+}
+
+// StaticCredentials is a fixed map of usernames to passwords
+type StaticCredentials map[string]string
+
+// Verify implements Credentials
+func (c StaticCredentials) Verify(user, password string) bool {
+	expected, ok := c[user]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// FileCredentials reads a credentials file with one user:password pair per line. Blank lines and
+// lines starting with # are ignored.
+func FileCredentials(path string) (Credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening credentials file %s: %v", path, err)
+	}
+	defer f.Close()
+
+	creds := make(StaticCredentials)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Error parsing credentials file %s: line %d is not user:password", path, lineNum)
+		}
+
+		creds[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading credentials file %s: %v", path, err)
+	}
+
+	return creds, nil
+}
+
+// parsePlain splits the data from a SASL PLAIN auth request into the username and password. The
+// format is [authzid] NUL authcid NUL passwd. Acting as another user is not supported, so the
+// authzid must be empty or the same as the authcid.
+func parsePlain(data []byte) (string, string, error) {
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		return "", "", common.ErrAuth
+	}
+
+	authzid, user, password := string(parts[0]), string(parts[1]), string(parts[2])
+
+	if authzid != "" && authzid != user {
+		return "", "", common.ErrAuth
+	}
+
+	return user, password, nil
+}
+
+// allowedUnauthenticated returns true for the requests that can be made before a connection
+// has authenticated on a listener that requires it.
+func allowedUnauthenticated(reqType common.RequestType) bool {
+	switch reqType {
+	case common.RequestSASLListMechs,
+		common.RequestSASLAuth,
+		common.RequestSASLStep,
+		common.RequestVersion,
+		common.RequestQuit:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/std"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/protocol/binprot"
+	"github.com/netflix/rend/server"
+)
+
+type casItem struct {
+	data  []byte
+	flags uint32
+	cas   uint64
+}
+
+// casBackend is a fake memcached backend that supports just enough of the binary protocol (set,
+// get, and gete) to check CAS values. Each backend numbers its CAS values from its own base so
+// values from different backends can be told apart.
+type casBackend struct {
+	lock  sync.Mutex
+	items map[string]casItem
+	cas   uint64
+}
+
+func newCasBackend(base uint64) *casBackend {
+	return &casBackend{
+		items: make(map[string]casItem),
+		cas:   base,
+	}
+}
+
+func (b *casBackend) handler() (handlers.Handler, error) {
+	client, backend := net.Pipe()
+	go b.serve(backend)
+	return std.NewHandler(client), nil
+}
+
+func (b *casBackend) serve(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 24)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		opcode := header[1]
+		extraLen := int(header[4])
+		key := string(body[extraLen : extraLen+int(binary.BigEndian.Uint16(header[2:4]))])
+		reqCas := binary.BigEndian.Uint64(header[16:24])
+
+		var status uint16
+		var extras, value []byte
+		var cas uint64
+
+		b.lock.Lock()
+		item, ok := b.items[key]
+
+		switch opcode {
+		case binprot.OpcodeSet:
+			switch {
+			case reqCas != 0 && !ok:
+				status = binprot.StatusKeyEnoent
+			case reqCas != 0 && reqCas != item.cas:
+				status = binprot.StatusKeyExists
+			default:
+				b.cas++
+				cas = b.cas
+				b.items[key] = casItem{
+					data:  body[extraLen+len(key):],
+					flags: binary.BigEndian.Uint32(body[0:4]),
+					cas:   cas,
+				}
+			}
+
+		case binprot.OpcodeGet, binprot.OpcodeGetE:
+			if !ok {
+				status = binprot.StatusKeyEnoent
+				break
+			}
+			extras = make([]byte, 4)
+			if opcode == binprot.OpcodeGetE {
+				extras = make([]byte, 8)
+			}
+			binary.BigEndian.PutUint32(extras, item.flags)
+			value = item.data
+			cas = item.cas
+
+		default:
+			status = binprot.StatusUnknownCommand
+		}
+		b.lock.Unlock()
+
+		res := make([]byte, 24)
+		res[0] = binprot.MagicResponse
+		res[1] = opcode
+		res[4] = byte(len(extras))
+		binary.BigEndian.PutUint16(res[6:8], status)
+		binary.BigEndian.PutUint32(res[8:12], uint32(len(extras)+len(value)))
+		copy(res[12:16], header[12:16])
+		binary.BigEndian.PutUint64(res[16:24], cas)
+
+		res = append(res, extras...)
+		res = append(res, value...)
+		if _, err := conn.Write(res); err != nil {
+			return
+		}
+	}
+}
+
+func TestBinaryCas(t *testing.T) {
+	l1 := newCasBackend(1000)
+	l2 := newCasBackend(0)
+
+	i := server.NewInstance(
+		server.TCPListener(0),
+		[]protocol.Components{binprot.Components},
+		server.Default,
+		orcas.L1L2,
+		l1.handler,
+		l2.handler,
+	)
+	if err := i.Start(context.Background()); err != nil {
+		t.Fatalf("Error starting: %v", err)
+	}
+	defer i.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", i.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// read returns the status, CAS, and value of the next response
+	read := func() (uint16, uint64, []byte) {
+		res, err := binprot.ReadResponseHeader(r)
+		if err != nil {
+			t.Fatalf("Error reading response: %v", err)
+		}
+		defer binprot.PutResponseHeader(res)
+
+		body := make([]byte, res.TotalBodyLength)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatalf("Error reading response body: %v", err)
+		}
+		return res.Status, res.CASToken, body[int(res.ExtraLength)+int(res.KeyLength):]
+	}
+
+	set := func(value string, cas uint64) (uint16, uint64) {
+		binprot.WriteSetCmd(conn, []byte("key"), 0, 0, uint32(len(value)), 0, cas)
+		conn.Write([]byte(value))
+		status, cas, _ := read()
+		return status, cas
+	}
+
+	get := func() (uint64, string) {
+		binprot.WriteGetCmd(conn, []byte("key"), 0)
+		status, cas, value := read()
+		if status != binprot.StatusSuccess {
+			t.Fatalf("Expected a hit, got status %#x", status)
+		}
+		return cas, string(value)
+	}
+
+	status, setCas := set("foo", 0)
+	if status != binprot.StatusSuccess || setCas == 0 {
+		t.Fatalf("Expected the set to succeed with a CAS value, got status %#x, CAS %d", status, setCas)
+	}
+
+	// The set also put the data in L1, and binary gets are served from there without a CAS value
+	getCas, value := get()
+	if value != "foo" || getCas != 0 {
+		t.Fatalf("Expected foo with no CAS from L1, got %q with CAS %d", value, getCas)
+	}
+
+	status, newCas := set("bar", setCas)
+	if status != binprot.StatusSuccess || newCas == 0 || newCas == setCas {
+		t.Fatalf("Expected the CAS set to succeed with a new CAS value, got status %#x, CAS %d", status, newCas)
+	}
+
+	if status, _ := set("baz", setCas); status != binprot.StatusKeyExists {
+		t.Fatalf("Expected a set with the old CAS to fail, got status %#x", status)
+	}
+
+	if _, value = get(); value != "bar" {
+		t.Fatalf("Expected bar, got %q", value)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is a read deadline that has already passed, used to interrupt a read in progress
+var aLongTimeAgo = time.Unix(1, 0)
+
+// clientConn wraps an external connection to apply the idle, read, and write timeouts and to
+// notice when the client hangs up while a request is being handled.
+//
+// It starts out waiting for a request. The idle deadline applies until some of the request has
+// been read, and then the read deadline applies until the server calls awaitRequest for the next
+// one.
+type clientConn struct {
+	net.Conn
+	t       Timeouts
+	waiting bool
+
+	// readDeadline is the last read deadline that was set, which is put back after watching
+	readDeadline time.Time
+
+	// done is closed when the read started by watch returns. The result of that read is kept for
+	// the next call to Read.
+	done    chan struct{}
+	stashed bool
+	stash   [1]byte
+	stashN  int
+	stashE  error
+}
+
+func newClientConn(conn net.Conn, t Timeouts) *clientConn {
+	c := &clientConn{
+		Conn: conn,
+		t:    t,
+	}
+	c.awaitRequest()
+	return c
+}
+
+func (c *clientConn) awaitRequest() {
+	c.waiting = true
+	c.setReadDeadline(deadline(c.t.Idle))
+}
+
+func (c *clientConn) setReadDeadline(t time.Time) {
+	c.readDeadline = t
+	c.Conn.SetReadDeadline(t)
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	var n int
+	var err error
+
+	if c.stashed && len(b) > 0 {
+		c.stashed = false
+		n, err = copy(b, c.stash[:c.stashN]), c.stashE
+	} else {
+		n, err = c.Conn.Read(b)
+	}
+
+	if n > 0 && c.waiting {
+		c.waiting = false
+		c.setReadDeadline(deadline(c.t.Read))
+	}
+	return n, err
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	if c.t.Write > 0 {
+		c.Conn.SetWriteDeadline(deadline(c.t.Write))
+	}
+	return c.Conn.Write(b)
+}
+
+// watch starts a read in the background while a request is being handled. If the read fails
+// because the client closed the connection or it was reset, onHangup is called from the reading
+// goroutine. The read stops at the first byte since clients may send their next request before
+// the current one is done. Whatever the read returns is kept for the next Read. Every call to
+// watch must be followed by a call to unwatch before the connection is read again.
+func (c *clientConn) watch(onHangup func()) {
+	if c.stashed {
+		return
+	}
+
+	done := make(chan struct{})
+	c.done = done
+
+	go func() {
+		defer close(done)
+
+		n, err := c.Conn.Read(c.stash[:])
+		if n == 0 && isTimeout(err) {
+			// Interrupted by unwatch or the read deadline ran out, neither of which means the
+			// client is gone
+			return
+		}
+
+		c.stashed = true
+		c.stashN = n
+		c.stashE = err
+
+		if n == 0 && err != nil {
+			onHangup()
+		}
+	}()
+}
+
+// unwatch stops the read started by watch, if any, and waits for it to return
+func (c *clientConn) unwatch() {
+	if c.done == nil {
+		return
+	}
+
+	c.Conn.SetReadDeadline(aLongTimeAgo)
+	<-c.done
+	c.done = nil
+	c.Conn.SetReadDeadline(c.readDeadline)
+}
@@ -15,11 +15,16 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/orcas"
 	"github.com/netflix/rend/protocol"
@@ -29,18 +34,64 @@ import (
 // DefaultServer is the default server implementation that implements a server
 // REPL for a single external connection.
 type DefaultServer struct {
-	rp    protocol.RequestParser
-	orca  orcas.Orca
+	rp    protocol.ContextRequestParser
+	res   protocol.Responder
+	orca  orcas.ContextOrca
 	conns []io.Closer
+
+	// ctx is the context for the connection, which is canceled when the client hangs up or the
+	// connection is closed. Each request's context is derived from it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// creds is nil when the listener does not require authentication
+	creds         Credentials
+	authenticated bool
+	user          string
+
+	// identity is the common name of the verified TLS client certificate, if any
+	identity string
+
+	// remoteAddr is the address of the client, which may be nil if it was never set
+	remoteAddr net.Addr
+
+	// requestTimeout is the deadline given to the handlers for each request, if not zero
+	requestTimeout time.Duration
+
+	// draining is set to 1 by Drain. busy is 1 while a request is being handled and 0 while
+	// waiting for the next one. Both are accessed atomically.
+	draining int32
+	busy     int32
 }
 
 // Default creates a new *DefaultServer instance with the given connections,
 // request parser, and request orchestrator.
 func Default(conns []io.Closer, rp protocol.RequestParser, o orcas.Orca) Server {
+	return newDefaultServer(conns, rp, o, nil)
+}
+
+// Authenticated returns a ServerConst for DefaultServer instances that require each connection
+// to authenticate using SASL PLAIN against the given credentials. Until a connection has
+// authenticated, every request other than SASL, version, and quit is rejected with an auth error
+// before it gets to the orchestrator. The SASL responses need the connection's responder, which
+// is given to the server through SetResponder.
+func Authenticated(creds Credentials) ServerConst {
+	return func(conns []io.Closer, rp protocol.RequestParser, o orcas.Orca) Server {
+		return newDefaultServer(conns, rp, o, creds)
+	}
+}
+
+func newDefaultServer(conns []io.Closer, rp protocol.RequestParser, o orcas.Orca, creds Credentials) *DefaultServer {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &DefaultServer{
-		rp:    rp,
-		orca:  o,
-		conns: conns,
+		rp:             protocol.WithContext(rp),
+		orca:           orcas.WithContext(o),
+		conns:          conns,
+		ctx:            ctx,
+		cancel:         cancel,
+		creds:          creds,
+		requestTimeout: currentTimeouts().Request,
 	}
 }
 
@@ -48,10 +99,14 @@ func Default(conns []io.Closer, rp protocol.RequestParser, o orcas.Orca) Server
 // read using the given protocol.RequestParser and performed by the given orcas.Orca.
 // The connections will all be closed upon an unrecoverable error.
 func (s *DefaultServer) Loop() {
+	defer s.cancel()
 	defer func() {
 		if r := recover(); r != nil {
 			if r != io.EOF {
 				log.Println("Recovered from runtime panic:", r)
+				if s.remoteAddr != nil {
+					log.Println("Panic on connection from:", s.remoteAddr)
+				}
 				log.Println("Panic location: ", identifyPanic())
 			}
 
@@ -59,15 +114,49 @@ func (s *DefaultServer) Loop() {
 		}
 	}()
 
+	// The connection starts out waiting for the first request, which may have been partly read
+	// already to find out which protocol it uses
+	first := true
+
 	for {
-		request, reqType, start, err := s.rp.Parse()
+		// This has to happen before busy is stored so it can't undo the deadline set by Drain
+		if cc, ok := s.clientConn(); ok && !first {
+			cc.awaitRequest()
+		}
+		first = false
+
+		// Between requests is the only time it's safe to stop when draining. See Drain for how
+		// this works together with busy.
+		atomic.StoreInt32(&s.busy, 0)
+		if atomic.LoadInt32(&s.draining) == 1 {
+			metrics.IncCounter(MetricConnectionsDrained)
+			abort(s.conns, nil)
+			return
+		}
+
+		request, reqType, start, err := s.rp.Parse(s.ctx)
+		atomic.StoreInt32(&s.busy, 1)
+
 		if err != nil {
+			if atomic.LoadInt32(&s.draining) == 1 {
+				// The read was interrupted by Drain
+				metrics.IncCounter(MetricConnectionsDrained)
+				abort(s.conns, nil)
+				return
+			}
+
 			if err == common.ErrBadRequest ||
 				err == common.ErrBadLength ||
 				err == common.ErrBadFlags ||
-				err == common.ErrBadExptime {
-				s.orca.Error(nil, common.RequestUnknown, err)
+				err == common.ErrBadExptime ||
+				err == common.ErrBadIncDecValue {
+				s.orca.Error(s.ctx, nil, common.RequestUnknown, err)
 				continue
+			} else if isTimeout(err) {
+				// The client was idle for too long or took too long to send a request
+				metrics.IncCounter(MetricConnectionsTimedOut)
+				abort(s.conns, nil)
+				return
 			} else {
 				// Otherwise IO error. Abort!
 				abort(s.conns, err)
@@ -77,52 +166,103 @@ func (s *DefaultServer) Loop() {
 
 		metrics.IncCounter(MetricCmdTotal)
 
+		if s.creds != nil && !s.authenticated && !allowedUnauthenticated(reqType) {
+			metrics.IncCounter(MetricAuthRejected)
+			if err := s.respondError(request, reqType, common.ErrAuth); err != nil {
+				abort(s.conns, err)
+				return
+			}
+			continue
+		}
+
+		ctx, cancel := s.requestContext()
+
+		// Handlers that aren't used through a context-aware orchestrator still get the deadline
+		if d, ok := ctx.Deadline(); ok {
+			s.setHandlerDeadline(d)
+		}
+
+		cc, watch := s.clientConn()
+		if watch && watchable(reqType) {
+			cc.watch(s.hangup)
+		}
+
 		// TODO: handle nil
 		switch reqType {
 		case common.RequestSet:
 			metrics.IncCounter(MetricCmdSet)
-			err = s.orca.Set(request.(common.SetRequest))
+			err = s.orca.Set(ctx, request.(common.SetRequest))
 		case common.RequestAdd:
 			metrics.IncCounter(MetricCmdAdd)
-			err = s.orca.Add(request.(common.SetRequest))
+			err = s.orca.Add(ctx, request.(common.SetRequest))
 		case common.RequestReplace:
 			metrics.IncCounter(MetricCmdReplace)
-			err = s.orca.Replace(request.(common.SetRequest))
+			err = s.orca.Replace(ctx, request.(common.SetRequest))
 		case common.RequestAppend:
 			metrics.IncCounter(MetricCmdAppend)
-			err = s.orca.Append(request.(common.SetRequest))
+			err = s.orca.Append(ctx, request.(common.SetRequest))
 		case common.RequestPrepend:
 			metrics.IncCounter(MetricCmdPrepend)
-			err = s.orca.Prepend(request.(common.SetRequest))
+			err = s.orca.Prepend(ctx, request.(common.SetRequest))
 		case common.RequestDelete:
 			metrics.IncCounter(MetricCmdDelete)
-			err = s.orca.Delete(request.(common.DeleteRequest))
+			err = s.orca.Delete(ctx, request.(common.DeleteRequest))
 		case common.RequestTouch:
 			metrics.IncCounter(MetricCmdTouch)
-			err = s.orca.Touch(request.(common.TouchRequest))
+			err = s.orca.Touch(ctx, request.(common.TouchRequest))
+		case common.RequestIncrement:
+			metrics.IncCounter(MetricCmdIncr)
+			err = s.orca.Increment(ctx, request.(common.IncrDecrRequest))
+		case common.RequestDecrement:
+			metrics.IncCounter(MetricCmdDecr)
+			err = s.orca.Decrement(ctx, request.(common.IncrDecrRequest))
+		case common.RequestFlush:
+			metrics.IncCounter(MetricCmdFlush)
+			err = s.orca.Flush(ctx, request.(common.FlushRequest))
+		case common.RequestStats:
+			metrics.IncCounter(MetricCmdStats)
+			err = s.orca.Stats(ctx, request.(common.StatsRequest))
 		case common.RequestGet:
 			metrics.IncCounter(MetricCmdGet)
-			err = s.orca.Get(request.(common.GetRequest))
+			err = s.orca.Get(ctx, request.(common.GetRequest))
 		case common.RequestGetE:
 			metrics.IncCounter(MetricCmdGetE)
-			err = s.orca.GetE(request.(common.GetRequest))
+			err = s.orca.GetE(ctx, request.(common.GetRequest))
 		case common.RequestGat:
 			metrics.IncCounter(MetricCmdGat)
-			err = s.orca.Gat(request.(common.GATRequest))
+			err = s.orca.Gat(ctx, request.(common.GATRequest))
 		case common.RequestNoop:
 			metrics.IncCounter(MetricCmdNoop)
-			err = s.orca.Noop(request.(common.NoopRequest))
+			err = s.orca.Noop(ctx, request.(common.NoopRequest))
 		case common.RequestQuit:
 			metrics.IncCounter(MetricCmdQuit)
-			s.orca.Quit(request.(common.QuitRequest))
+			s.orca.Quit(ctx, request.(common.QuitRequest))
+			cancel()
 			abort(s.conns, err)
 			return
 		case common.RequestVersion:
 			metrics.IncCounter(MetricCmdVersion)
-			err = s.orca.Version(request.(common.VersionRequest))
+			err = s.orca.Version(ctx, request.(common.VersionRequest))
+		case common.RequestSASLListMechs:
+			metrics.IncCounter(MetricCmdSASLListMechs)
+			err = s.saslListMechs(request.(common.SASLListMechsRequest))
+		case common.RequestSASLAuth, common.RequestSASLStep:
+			metrics.IncCounter(MetricCmdSASLAuth)
+			err = s.saslAuth(request.(common.SASLAuthRequest), reqType)
 		case common.RequestUnknown:
 			metrics.IncCounter(MetricCmdUnknown)
-			err = s.orca.Unknown(request)
+			err = s.orca.Unknown(ctx, request)
+		}
+
+		if watch {
+			cc.unwatch()
+		}
+
+		// Nobody is left to respond to once the client hangs up
+		if s.ctx.Err() != nil {
+			cancel()
+			abort(s.conns, nil)
+			return
 		}
 
 		if err != nil {
@@ -130,14 +270,23 @@ func (s *DefaultServer) Loop() {
 				if err != common.ErrKeyNotFound {
 					metrics.IncCounter(MetricErrAppError)
 				}
-				s.orca.Error(request, reqType, err)
+				s.orca.Error(ctx, request, reqType, err)
+			} else if isTimeout(err) {
+				// The client stopped reading responses
+				metrics.IncCounter(MetricConnectionsTimedOut)
+				cancel()
+				abort(s.conns, nil)
+				return
 			} else {
 				metrics.IncCounter(MetricErrUnrecoverable)
+				cancel()
 				abort(s.conns, err)
 				return
 			}
 		}
 
+		cancel()
+
 		dur := timer.Since(start)
 		switch reqType {
 		case common.RequestSet:
@@ -150,6 +299,12 @@ func (s *DefaultServer) Loop() {
 			metrics.ObserveHist(HistDelete, dur)
 		case common.RequestTouch:
 			metrics.ObserveHist(HistTouch, dur)
+		case common.RequestIncrement:
+			metrics.ObserveHist(HistIncr, dur)
+		case common.RequestDecrement:
+			metrics.ObserveHist(HistDecr, dur)
+		case common.RequestFlush:
+			metrics.ObserveHist(HistFlush, dur)
 		case common.RequestGet:
 			metrics.ObserveHist(HistGet, dur)
 		case common.RequestGetE:
@@ -159,3 +314,168 @@ func (s *DefaultServer) Loop() {
 		}
 	}
 }
+
+// The SASL commands are handled entirely by the server since the authentication state belongs
+// to the connection. Failures are responded to directly and only I/O errors are returned.
+func (s *DefaultServer) saslListMechs(req common.SASLListMechsRequest) error {
+	// Same as memcached without SASL enabled, these commands are unknown
+	if s.creds == nil {
+		return s.respondError(req, common.RequestSASLListMechs, common.ErrUnknownCmd)
+	}
+	return s.res.SASLMechs(req.Opaque, []string{MechPlain})
+}
+
+func (s *DefaultServer) saslAuth(req common.SASLAuthRequest, reqType common.RequestType) error {
+	if s.creds == nil {
+		return s.respondError(req, reqType, common.ErrUnknownCmd)
+	}
+
+	// PLAIN finishes in a single step, so a step request is just another attempt with the same data
+	user, password, err := parsePlain(req.Data)
+	if req.Mechanism != MechPlain || err != nil || !s.creds.Verify(user, password) {
+		metrics.IncCounter(MetricAuthFailure)
+		s.setUser("")
+		return s.respondError(req, reqType, common.ErrAuth)
+	}
+
+	metrics.IncCounter(MetricAuthSuccess)
+	s.setUser(user)
+
+	return s.res.SASLAuth(req.Opaque)
+}
+
+// Drain implements Drainer. If the connection is waiting for a request, the read is interrupted
+// by setting a deadline on the external connection so Loop can return right away. Otherwise Loop
+// returns once the current request is done. A request that is only partially received when the
+// read is interrupted is dropped.
+func (s *DefaultServer) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+
+	// Loop stores busy before it checks draining, and this stores draining before it checks busy,
+	// so at least one side will see the other.
+	if atomic.LoadInt32(&s.busy) == 1 || len(s.conns) == 0 {
+		return
+	}
+
+	if d, ok := s.conns[0].(interface {
+		SetReadDeadline(time.Time) error
+	}); ok {
+		d.SetReadDeadline(time.Now())
+	}
+}
+
+// clientConn returns the external connection if it was wrapped by the Instance serving it
+func (s *DefaultServer) clientConn() (*clientConn, bool) {
+	if len(s.conns) == 0 {
+		return nil, false
+	}
+	cc, ok := s.conns[0].(*clientConn)
+	return cc, ok
+}
+
+// requestContext returns the context for the next request, which carries the authenticated user
+// and the request timeout if there is one
+func (s *DefaultServer) requestContext() (context.Context, context.CancelFunc) {
+	ctx := s.ctx
+	if s.user != "" {
+		ctx = common.ContextWithUser(ctx, s.user)
+	}
+
+	if s.requestTimeout > 0 {
+		return context.WithTimeout(ctx, s.requestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// watchable returns true for the requests that are worth watching for the client hanging up
+// while they are handled. Only reads are interrupted: a client that pipelines quiet or noreply
+// writes may close its side of the connection without waiting, and those writes still have to
+// run to completion.
+func watchable(reqType common.RequestType) bool {
+	switch reqType {
+	case common.RequestGet,
+		common.RequestGetE,
+		common.RequestGat,
+		common.RequestStats:
+		return true
+	}
+	return false
+}
+
+// hangup is called from the goroutine watching the external connection when the client hangs up
+// in the middle of a request. The request's context is canceled, and the handlers are interrupted
+// in case they are waiting on a backend.
+func (s *DefaultServer) hangup() {
+	metrics.IncCounter(MetricConnectionsHungUp)
+	s.cancel()
+	s.setHandlerDeadline(time.Now())
+}
+
+// setHandlerDeadline passes the deadline for a request to the handlers that want it. The handlers
+// are the rest of the connections after the external one.
+func (s *DefaultServer) setHandlerDeadline(t time.Time) {
+	if len(s.conns) < 2 {
+		return
+	}
+	for _, c := range s.conns[1:] {
+		if da, ok := c.(handlers.DeadlineAware); ok {
+			da.SetDeadline(t)
+		}
+	}
+}
+
+// SetIdentity implements IdentityAware. The identity is passed on to the orchestrator in the
+// request context (common.IdentityFromContext). It does not authenticate the connection: SASL
+// users and certificate names are separate namespaces, so a connection that needs auth still has
+// to log in over SASL.
+func (s *DefaultServer) SetIdentity(identity string) {
+	s.identity = identity
+	s.ctx = common.ContextWithIdentity(s.ctx, identity)
+	metrics.IncCounter(MetricAuthClientCert)
+}
+
+// SetRemoteAddr implements RemoteAddrAware and passes the address on to the orchestrator if it
+// wants to know.
+func (s *DefaultServer) SetRemoteAddr(addr net.Addr) {
+	s.remoteAddr = addr
+	s.ctx = common.ContextWithRemoteAddr(s.ctx, addr)
+
+	if ra, ok := s.orca.(orcas.RemoteAddrAware); ok {
+		ra.SetRemoteAddr(addr)
+	}
+}
+
+// setUser records the user the connection is authenticated as, or that it is not authenticated if
+// the user is empty, and passes it on to the orchestrator if it wants to know.
+func (s *DefaultServer) setUser(user string) {
+	s.authenticated = user != ""
+	s.user = user
+
+	if ua, ok := s.orca.(orcas.UserAware); ok {
+		ua.SetUser(user)
+	}
+}
+
+// SetResponder implements ResponderAware
+func (s *DefaultServer) SetResponder(res protocol.Responder) {
+	s.res = res
+}
+
+// respondError sends an error straight back through the responder without involving the
+// orchestrator. Without a responder the orchestrator has to send it instead.
+func (s *DefaultServer) respondError(req common.Request, reqType common.RequestType, err error) error {
+	if s.res == nil {
+		s.orca.Error(s.ctx, req, reqType, err)
+		return nil
+	}
+
+	var opaque uint32
+	var quiet bool
+
+	if req != nil {
+		opaque = req.GetOpaque()
+		quiet = req.IsQuiet()
+	}
+
+	return s.res.Error(opaque, reqType, err, quiet)
+}
@@ -20,6 +20,7 @@ import (
 	"testing"
 
 	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/protocol"
 	"github.com/netflix/rend/server"
 )
 
@@ -52,6 +53,40 @@ func (f *testRequestParser) Parse() (common.Request, common.RequestType, uint64,
 	return f.req, f.reqType, f.startTime, f.err
 }
 
+// Returns each of the given requests in order, then io.EOF
+type testMultiRequestParser struct {
+	reqs     []common.Request
+	reqTypes []common.RequestType
+}
+
+func (f *testMultiRequestParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	if len(f.reqs) == 0 {
+		return nil, 0, 0, io.EOF
+	}
+
+	req, reqType := f.reqs[0], f.reqTypes[0]
+	f.reqs, f.reqTypes = f.reqs[1:], f.reqTypes[1:]
+	return req, reqType, 0, nil
+}
+
+// Only the methods the server uses directly are implemented. The rest will panic.
+type testResponder struct {
+	protocol.Responder
+
+	errors []error
+	authed bool
+}
+
+func (t *testResponder) SASLAuth(opaque uint32) error {
+	t.authed = true
+	return nil
+}
+
+func (t *testResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
+	t.errors = append(t.errors, err)
+	return nil
+}
+
 type testOrca struct {
 	setRes,
 	addRes,
@@ -60,6 +95,10 @@ type testOrca struct {
 	prependRes,
 	deleteRes,
 	touchRes,
+	incrRes,
+	decrRes,
+	flushRes,
+	statsRes,
 	getRes,
 	geteRes,
 	gatRes,
@@ -69,6 +108,12 @@ type testOrca struct {
 	unknownRes error
 
 	called map[string]interface{}
+	user   string
+}
+
+// SetUser is kept out of called so the tests checking for no orca calls still work
+func (t *testOrca) SetUser(user string) {
+	t.user = user
 }
 
 func (t *testOrca) Set(req common.SetRequest) error {
@@ -99,6 +144,22 @@ func (t *testOrca) Touch(req common.TouchRequest) error {
 	t.called["Touch"] = nil
 	return t.touchRes
 }
+func (t *testOrca) Increment(req common.IncrDecrRequest) error {
+	t.called["Increment"] = nil
+	return t.incrRes
+}
+func (t *testOrca) Decrement(req common.IncrDecrRequest) error {
+	t.called["Decrement"] = nil
+	return t.decrRes
+}
+func (t *testOrca) Flush(req common.FlushRequest) error {
+	t.called["Flush"] = nil
+	return t.flushRes
+}
+func (t *testOrca) Stats(req common.StatsRequest) error {
+	t.called["Stats"] = nil
+	return t.statsRes
+}
 func (t *testOrca) Get(req common.GetRequest) error {
 	t.called["Get"] = nil
 	return t.getRes
@@ -131,20 +192,24 @@ func (t *testOrca) Error(req common.Request, reqType common.RequestType, err err
 
 type testPanicOrca struct{}
 
-func (t testPanicOrca) Set(req common.SetRequest) error         { panic("test") }
-func (t testPanicOrca) Add(req common.SetRequest) error         { panic("test") }
-func (t testPanicOrca) Replace(req common.SetRequest) error     { panic("test") }
-func (t testPanicOrca) Append(req common.SetRequest) error      { panic("test") }
-func (t testPanicOrca) Prepend(req common.SetRequest) error     { panic("test") }
-func (t testPanicOrca) Delete(req common.DeleteRequest) error   { panic("test") }
-func (t testPanicOrca) Touch(req common.TouchRequest) error     { panic("test") }
-func (t testPanicOrca) Get(req common.GetRequest) error         { panic("test") }
-func (t testPanicOrca) GetE(req common.GetRequest) error        { panic("test") }
-func (t testPanicOrca) Gat(req common.GATRequest) error         { panic("test") }
-func (t testPanicOrca) Noop(req common.NoopRequest) error       { panic("test") }
-func (t testPanicOrca) Quit(req common.QuitRequest) error       { panic("test") }
-func (t testPanicOrca) Version(req common.VersionRequest) error { panic("test") }
-func (t testPanicOrca) Unknown(req common.Request) error        { panic("test") }
+func (t testPanicOrca) Set(req common.SetRequest) error            { panic("test") }
+func (t testPanicOrca) Add(req common.SetRequest) error            { panic("test") }
+func (t testPanicOrca) Replace(req common.SetRequest) error        { panic("test") }
+func (t testPanicOrca) Append(req common.SetRequest) error         { panic("test") }
+func (t testPanicOrca) Prepend(req common.SetRequest) error        { panic("test") }
+func (t testPanicOrca) Delete(req common.DeleteRequest) error      { panic("test") }
+func (t testPanicOrca) Touch(req common.TouchRequest) error        { panic("test") }
+func (t testPanicOrca) Increment(req common.IncrDecrRequest) error { panic("test") }
+func (t testPanicOrca) Decrement(req common.IncrDecrRequest) error { panic("test") }
+func (t testPanicOrca) Flush(req common.FlushRequest) error        { panic("test") }
+func (t testPanicOrca) Stats(req common.StatsRequest) error        { panic("test") }
+func (t testPanicOrca) Get(req common.GetRequest) error            { panic("test") }
+func (t testPanicOrca) GetE(req common.GetRequest) error           { panic("test") }
+func (t testPanicOrca) Gat(req common.GATRequest) error            { panic("test") }
+func (t testPanicOrca) Noop(req common.NoopRequest) error          { panic("test") }
+func (t testPanicOrca) Quit(req common.QuitRequest) error          { panic("test") }
+func (t testPanicOrca) Version(req common.VersionRequest) error    { panic("test") }
+func (t testPanicOrca) Unknown(req common.Request) error           { panic("test") }
 
 func (t testPanicOrca) Error(req common.Request, reqType common.RequestType, err error) {}
 
@@ -235,6 +300,27 @@ func TestDefaultServer(t *testing.T) {
 			})
 		})
 
+		t.Run("Increment", func(t *testing.T) {
+			testSuccess(t, "Increment", common.RequestIncrement, common.IncrDecrRequest{
+				Key:   []byte("key"),
+				Delta: 1,
+			})
+		})
+
+		t.Run("Decrement", func(t *testing.T) {
+			testSuccess(t, "Decrement", common.RequestDecrement, common.IncrDecrRequest{
+				Key:   []byte("key"),
+				Delta: 1,
+			})
+		})
+
+		t.Run("Flush", func(t *testing.T) {
+			testSuccess(t, "Flush", common.RequestFlush, common.FlushRequest{})
+		})
+		t.Run("Stats", func(t *testing.T) {
+			testSuccess(t, "Stats", common.RequestStats, common.StatsRequest{})
+		})
+
 		t.Run("Get", func(t *testing.T) {
 			testSuccess(t, "Get", common.RequestGet, common.GetRequest{
 				Keys:    [][]byte{[]byte("key")},
@@ -253,7 +339,10 @@ func TestDefaultServer(t *testing.T) {
 
 		t.Run("Gat", func(t *testing.T) {
 			testSuccess(t, "Gat", common.RequestGat, common.GATRequest{
-				Key: []byte("key"),
+				Keys:     [][]byte{[]byte("key")},
+				Exptimes: []uint32{0},
+				Opaques:  []uint32{0},
+				Quiet:    []bool{false},
 			})
 		})
 
@@ -314,6 +403,10 @@ func TestDefaultServer(t *testing.T) {
 		t.Run("Prepend", func(t *testing.T) { testPanic(t, common.RequestPrepend, common.SetRequest{}) })
 		t.Run("Delete", func(t *testing.T) { testPanic(t, common.RequestDelete, common.DeleteRequest{}) })
 		t.Run("Touch", func(t *testing.T) { testPanic(t, common.RequestTouch, common.TouchRequest{}) })
+		t.Run("Increment", func(t *testing.T) { testPanic(t, common.RequestIncrement, common.IncrDecrRequest{}) })
+		t.Run("Decrement", func(t *testing.T) { testPanic(t, common.RequestDecrement, common.IncrDecrRequest{}) })
+		t.Run("Flush", func(t *testing.T) { testPanic(t, common.RequestFlush, common.FlushRequest{}) })
+		t.Run("Stats", func(t *testing.T) { testPanic(t, common.RequestStats, common.StatsRequest{}) })
 		t.Run("Get", func(t *testing.T) { testPanic(t, common.RequestGet, common.GetRequest{}) })
 		t.Run("GetE", func(t *testing.T) { testPanic(t, common.RequestGetE, common.GetRequest{}) })
 		t.Run("Gat", func(t *testing.T) { testPanic(t, common.RequestGat, common.GATRequest{}) })
@@ -323,3 +416,169 @@ func TestDefaultServer(t *testing.T) {
 		t.Run("Unknown", func(t *testing.T) { testPanic(t, common.RequestUnknown, nil) })
 	})
 }
+
+func TestAuthenticated(t *testing.T) {
+	creds := server.StaticCredentials{"user": "pass"}
+
+	run := func(reqs []common.Request, reqTypes []common.RequestType) (*testOrca, *testResponder) {
+		closers := []io.Closer{&ioCloserSpy{}, &ioCloserSpy{}}
+		orca := &testOrca{called: make(map[string]interface{})}
+		res := &testResponder{}
+		rp := &testMultiRequestParser{
+			reqs:     reqs,
+			reqTypes: reqTypes,
+		}
+
+		s := server.Authenticated(creds)(closers, rp, orca)
+		s.(server.ResponderAware).SetResponder(res)
+		s.Loop()
+
+		return orca, res
+	}
+
+	get := common.GetRequest{
+		Keys:    [][]byte{[]byte("key")},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	}
+
+	t.Run("RejectsUnauthenticated", func(t *testing.T) {
+		orca, res := run([]common.Request{get}, []common.RequestType{common.RequestGet})
+
+		if len(orca.called) != 0 {
+			t.Fatalf("Expected no orca calls, got %v", orca.called)
+		}
+		if len(res.errors) != 1 || res.errors[0] != common.ErrAuth {
+			t.Fatalf("Expected a single auth error, got %v", res.errors)
+		}
+	})
+
+	t.Run("AllowsAfterAuth", func(t *testing.T) {
+		auth := common.SASLAuthRequest{
+			Mechanism: server.MechPlain,
+			Data:      []byte("\x00user\x00pass"),
+		}
+
+		orca, res := run(
+			[]common.Request{auth, get},
+			[]common.RequestType{common.RequestSASLAuth, common.RequestGet},
+		)
+
+		if !res.authed {
+			t.Fatal("Expected successful auth response")
+		}
+		if len(res.errors) != 0 {
+			t.Fatalf("Expected no errors, got %v", res.errors)
+		}
+		if _, ok := orca.called["Get"]; !ok {
+			t.Fatal("Expected Get orca function to be called")
+		}
+		if orca.user != "user" {
+			t.Fatalf("Expected orca to be told the user, got %q", orca.user)
+		}
+	})
+
+	t.Run("BadPassword", func(t *testing.T) {
+		auth := common.SASLAuthRequest{
+			Mechanism: server.MechPlain,
+			Data:      []byte("\x00user\x00wrong"),
+		}
+
+		orca, res := run(
+			[]common.Request{auth, get},
+			[]common.RequestType{common.RequestSASLAuth, common.RequestGet},
+		)
+
+		if res.authed {
+			t.Fatal("Expected auth to fail")
+		}
+		if len(res.errors) != 2 || res.errors[0] != common.ErrAuth || res.errors[1] != common.ErrAuth {
+			t.Fatalf("Expected two auth errors, got %v", res.errors)
+		}
+		if len(orca.called) != 0 {
+			t.Fatalf("Expected no orca calls, got %v", orca.called)
+		}
+	})
+
+	t.Run("ClientCertIsNotALogin", func(t *testing.T) {
+		closers := []io.Closer{&ioCloserSpy{}, &ioCloserSpy{}}
+		orca := &testOrca{called: make(map[string]interface{})}
+		res := &testResponder{}
+		rp := &testMultiRequestParser{
+			reqs:     []common.Request{get},
+			reqTypes: []common.RequestType{common.RequestGet},
+		}
+
+		// A certificate name that happens to match a SASL user doesn't log in as that user
+		s := server.Authenticated(creds)(closers, rp, orca)
+		s.(server.ResponderAware).SetResponder(res)
+		s.(server.IdentityAware).SetIdentity("user")
+		s.Loop()
+
+		if len(orca.called) != 0 {
+			t.Fatalf("Expected no orca calls, got %v", orca.called)
+		}
+		if len(res.errors) != 1 || res.errors[0] != common.ErrAuth {
+			t.Fatalf("Expected a single auth error, got %v", res.errors)
+		}
+	})
+}
+
+// Drains the server as soon as it gets a get request
+type testDrainingOrca struct {
+	*testOrca
+	server server.Drainer
+}
+
+func (t *testDrainingOrca) Get(req common.GetRequest) error {
+	t.server.Drain()
+	return t.testOrca.Get(req)
+}
+
+func TestDrain(t *testing.T) {
+	get := common.GetRequest{
+		Keys:    [][]byte{[]byte("key")},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	}
+
+	t.Run("BeforeLoop", func(t *testing.T) {
+		spy := &ioCloserSpy{}
+		orca := &testOrca{called: make(map[string]interface{})}
+		rp := &testRequestParser{req: get, reqType: common.RequestGet}
+
+		s := server.Default([]io.Closer{spy}, rp, orca)
+		s.(server.Drainer).Drain()
+		s.Loop()
+
+		if len(orca.called) != 0 {
+			t.Fatalf("Expected no orca calls, got %v", orca.called)
+		}
+		if !spy.closed {
+			t.Fatal("Expected connection to be closed")
+		}
+	})
+
+	t.Run("FinishesCurrentRequest", func(t *testing.T) {
+		spy := &ioCloserSpy{}
+		orca := &testDrainingOrca{testOrca: &testOrca{called: make(map[string]interface{})}}
+		rp := &testMultiRequestParser{
+			reqs:     []common.Request{get, common.SetRequest{}},
+			reqTypes: []common.RequestType{common.RequestGet, common.RequestSet},
+		}
+
+		s := server.Default([]io.Closer{spy}, rp, orca)
+		orca.server = s.(server.Drainer)
+		s.Loop()
+
+		if _, ok := orca.called["Get"]; !ok {
+			t.Fatal("Expected the in-flight Get to finish")
+		}
+		if _, ok := orca.called["Set"]; ok {
+			t.Fatal("Expected no requests after draining")
+		}
+		if !spy.closed {
+			t.Fatal("Expected connection to be closed")
+		}
+	})
+}
@@ -0,0 +1,298 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Listening sockets can be inherited from systemd socket activation or from a previous Rend
+// process that called Handoff. Both pass the sockets as consecutive file descriptors starting at
+// 3. The TCP and unix ListenConsts check for an inherited socket with a matching address before
+// creating a new one.
+const (
+	inheritedFDStart = 3
+
+	envSystemdFDs = "LISTEN_FDS"
+	envSystemdPID = "LISTEN_PID"
+	envSystemdFDN = "LISTEN_FDNAMES"
+
+	// Rend's own handoff can't use LISTEN_PID since the pid of the new process isn't known until
+	// after it is started.
+	envHandoffFDs = "REND_LISTEN_FDS"
+	envReadyFD    = "REND_READY_FD"
+)
+
+var (
+	inheritedLock = new(sync.Mutex)
+	inheritedOnce = new(sync.Once)
+	inherited     []net.Listener
+
+	errHandoffNotSupported = errors.New("Listener can not be handed off to a new process")
+)
+
+// fileListener is implemented by listeners whose socket can be passed to another process
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// listenerFile returns a dup of the socket of a TCP or unix listener. Unix listeners stop removing
+// their socket file when closed so the new process can keep using it.
+func listenerFile(l net.Listener) (*os.File, error) {
+	switch l := l.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	}
+	return nil, errHandoffNotSupported
+}
+
+func loadInherited() {
+	var n int
+	var err error
+
+	if fds := os.Getenv(envHandoffFDs); fds != "" {
+		n, err = strconv.Atoi(fds)
+	} else if fds := os.Getenv(envSystemdFDs); fds != "" {
+		// The sockets are only meant for us if systemd started this exact process
+		if os.Getenv(envSystemdPID) == strconv.Itoa(os.Getpid()) {
+			n, err = strconv.Atoi(fds)
+		}
+	}
+
+	// Child processes should not think these are meant for them
+	os.Unsetenv(envHandoffFDs)
+	os.Unsetenv(envSystemdFDs)
+	os.Unsetenv(envSystemdPID)
+	os.Unsetenv(envSystemdFDN)
+
+	if err != nil {
+		log.Println("Error parsing inherited listener count:", err.Error())
+		return
+	}
+
+	for fd := inheritedFDStart; fd < inheritedFDStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("inherited-%d", fd))
+		l, err := net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			log.Printf("Error using inherited file descriptor %d as a listener: %v", fd, err)
+			continue
+		}
+
+		inherited = append(inherited, l)
+	}
+}
+
+// takeInherited removes and returns the first inherited listener that matches, or nil if there
+// isn't one.
+func takeInherited(match func(net.Addr) bool) net.Listener {
+	inheritedLock.Lock()
+	defer inheritedLock.Unlock()
+
+	inheritedOnce.Do(loadInherited)
+
+	for i, l := range inherited {
+		if match(l.Addr()) {
+			inherited = append(inherited[:i], inherited[i+1:]...)
+			return l
+		}
+	}
+
+	return nil
+}
+
+func remainingInherited() int {
+	inheritedLock.Lock()
+	defer inheritedLock.Unlock()
+
+	inheritedOnce.Do(loadInherited)
+	return len(inherited)
+}
+
+// listenTCP returns an inherited listener on the given port if there is one, otherwise it binds a
+// new one on all interfaces.
+func listenTCP(port int) (net.Listener, error) {
+	l := takeInherited(func(addr net.Addr) bool {
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		return ok && tcpAddr.Port == port
+	})
+	if l != nil {
+		return l, nil
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("Error binding to port %d: %v", port, err.Error())
+	}
+	return l, nil
+}
+
+// listenUnix returns an inherited listener on the given path if there is one, otherwise it
+// replaces whatever is at the path with a new socket.
+func listenUnix(path string) (net.Listener, error) {
+	l := takeInherited(func(addr net.Addr) bool {
+		unixAddr, ok := addr.(*net.UnixAddr)
+		return ok && unixAddr.Name == path
+	})
+	if l != nil {
+		return l, nil
+	}
+
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Error removing previous unix socket file at %s", path)
+	}
+
+	l, err = net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Error binding to unix socket at %s: %v", path, err.Error())
+	}
+	return l, nil
+}
+
+// Handoff starts a new copy of the running program with the same arguments and passes it every
+// listener started by ListenAndServe. It returns once the new process has called NotifyReady, at
+// which point it is accepting connections and the caller can Shutdown to drain its own. If the new
+// process doesn't become ready within the timeout it is killed and an error is returned, and the
+// current process keeps serving as before.
+func Handoff(timeout time.Duration) (*os.Process, error) {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	connsLock.Lock()
+	for l := range listeners {
+		fl, ok := l.(fileListener)
+		if !ok {
+			connsLock.Unlock()
+			return nil, errHandoffNotSupported
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			connsLock.Unlock()
+			return nil, fmt.Errorf("Error getting listener file for handoff: %v", err)
+		}
+
+		files = append(files, f)
+	}
+	connsLock.Unlock()
+
+	path, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("Error finding executable for handoff: %v", err)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating ready pipe for handoff: %v", err)
+	}
+	defer readyR.Close()
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, envHandoffFDs+"=") && !strings.HasPrefix(e, envReadyFD+"=") {
+			env = append(env, e)
+		}
+	}
+	env = append(env,
+		fmt.Sprintf("%s=%d", envHandoffFDs, len(files)),
+		fmt.Sprintf("%s=%d", envReadyFD, inheritedFDStart+len(files)),
+	)
+
+	procFiles := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	procFiles = append(procFiles, files...)
+	procFiles = append(procFiles, readyW)
+
+	proc, err := os.StartProcess(path, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: procFiles,
+	})
+	readyW.Close()
+
+	if err != nil {
+		return nil, fmt.Errorf("Error starting new process for handoff: %v", err)
+	}
+
+	// The read fails if the new process exits without writing to the pipe
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = fmt.Errorf("Timed out after %v", timeout)
+	}
+
+	if err != nil {
+		proc.Kill()
+		proc.Wait()
+		return nil, fmt.Errorf("New process did not become ready: %v", err)
+	}
+
+	return proc, nil
+}
+
+// NotifyReady tells the process that started this one with Handoff that it is ready to take over.
+// It waits until all of the handed off listeners have been picked up by ListenAndServe, or until
+// the timeout passes, in which case an error is returned and the old process keeps serving. It
+// does nothing if this process was not started by Handoff.
+func NotifyReady(timeout time.Duration) error {
+	fdStr := os.Getenv(envReadyFD)
+	if fdStr == "" {
+		return nil
+	}
+	os.Unsetenv(envReadyFD)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return fmt.Errorf("Error parsing ready file descriptor: %v", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+
+	deadline := time.Now().Add(timeout)
+	for remainingInherited() > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for %d inherited listeners to be used", remainingInherited())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = f.Write([]byte{1})
+	return err
+}
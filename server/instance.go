@@ -0,0 +1,393 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+var (
+	// ErrInstanceStarted is returned when Start is called on an Instance more than once
+	ErrInstanceStarted = errors.New("Instance has already been started")
+
+	// ErrInstanceNotStarted is returned when Stop is called on an Instance that was never started
+	ErrInstanceNotStarted = errors.New("Instance has not been started")
+
+	// ErrShuttingDown is returned when an Instance is started after Shutdown has been called
+	ErrShuttingDown = errors.New("Server is shutting down")
+)
+
+// addrListener is implemented by listeners that can report the address they are listening on
+type addrListener interface {
+	Addr() net.Addr
+}
+
+// Instance is a single listener along with everything needed to serve the connections it
+// accepts. It is the same as ListenAndServe, but it can be stopped on its own and reports errors
+// instead of panicking, so Rend can be embedded in another program or run inside a test:
+//
+//	i := server.NewInstance(server.TCPListener(0), protocols, server.Default, orcas.L1Only, inmem.New, handlers.NilHandler)
+//	if err := i.Start(ctx); err != nil {
+//		return err
+//	}
+//	defer i.Stop(ctx)
+//
+//	conn, err := net.Dial("tcp", i.Addr().String())
+//
+// Connections served by an Instance are also included in the process-wide stats and Shutdown.
+// Limits and Timeouts are process-wide too: SetLimits and SetTimeouts apply to every Instance at
+// once, and MaxConns counts the connections of all of them together. There is no way to give one
+// Instance its own.
+type Instance struct {
+	l  ListenConst
+	ps []protocol.Components
+	s  ServerConst
+	o  orcas.OrcaConst
+	h1 handlers.HandlerConst
+	h2 handlers.HandlerConst
+
+	// done is closed when the accept loop returns
+	done chan struct{}
+
+	// The rest is protected by connsLock in stats.go, since it has to be consistent with the
+	// process-wide connection tracking.
+	listener      Listener
+	started       bool
+	stopped       bool
+	conns         map[uint64]struct{}
+	drained       chan struct{}
+	drainedClosed bool
+}
+
+// NewInstance returns an Instance that serves connections from the given listener the same way as
+// ListenAndServe. Nothing happens until Start is called.
+func NewInstance(l ListenConst, ps []protocol.Components, s ServerConst, o orcas.OrcaConst, h1, h2 handlers.HandlerConst) *Instance {
+	return &Instance{
+		l:       l,
+		ps:      ps,
+		s:       s,
+		o:       o,
+		h1:      h1,
+		h2:      h2,
+		done:    make(chan struct{}),
+		conns:   make(map[uint64]struct{}),
+		drained: make(chan struct{}),
+	}
+}
+
+// Start creates the listener and starts accepting connections in the background. It returns an
+// error if the listener can't be created, e.g. because the port is in use. The context only
+// applies to starting up; use Stop to stop the Instance.
+func (i *Instance) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	connsLock.Lock()
+	if i.started {
+		connsLock.Unlock()
+		return ErrInstanceStarted
+	}
+	i.started = true
+	connsLock.Unlock()
+
+	listener, err := i.l()
+	if err != nil {
+		close(i.done)
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		listener.Close()
+		close(i.done)
+		return err
+	}
+
+	if !trackListener(listener) {
+		close(i.done)
+		return ErrShuttingDown
+	}
+
+	connsLock.Lock()
+	i.listener = listener
+	connsLock.Unlock()
+
+	go i.serve(listener)
+
+	return nil
+}
+
+// Addr returns the address the Instance is listening on, which is useful to find out which port
+// was picked when listening on port 0. It returns nil if the Instance hasn't been started or the
+// listener can't report its address.
+func (i *Instance) Addr() net.Addr {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	if al, ok := i.listener.(addrListener); ok {
+		return al.Addr()
+	}
+	return nil
+}
+
+// ActiveConns returns the number of connections the Instance is currently serving
+func (i *Instance) ActiveConns() int {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	return len(i.conns)
+}
+
+// Stop closes the listener and lets each open connection finish the request it is working on, the
+// same way as Shutdown but only for this Instance. If the context is done before every connection
+// has finished, the remaining connections are closed along with their handlers and the context's
+// error is returned. Either way, anything the handlers share (see handlers.SharedCloser), like a
+// pool of backend connections, is closed afterwards, so a HandlerConst like that can't be shared
+// with another Instance.
+func (i *Instance) Stop(ctx context.Context) error {
+	connsLock.Lock()
+
+	if !i.started {
+		connsLock.Unlock()
+		return ErrInstanceNotStarted
+	}
+
+	if !i.stopped {
+		i.stopped = true
+
+		if i.listener != nil {
+			delete(listeners, i.listener)
+			if err := i.listener.Close(); err != nil {
+				log.Println("Error closing listener:", err.Error())
+			}
+		}
+
+		for id := range i.conns {
+			c := conns[id]
+			if c.server == nil {
+				abort(c.closers, nil)
+				continue
+			}
+			drainConn(c)
+		}
+
+		i.checkDrained()
+	}
+
+	connsLock.Unlock()
+
+	select {
+	case <-i.drained:
+		closeShared(i)
+	case <-ctx.Done():
+		connsLock.Lock()
+		for id := range i.conns {
+			metrics.IncCounter(MetricConnectionsForceClosed)
+			abort(conns[id].closers, nil)
+		}
+		connsLock.Unlock()
+
+		closeShared(i)
+		return ctx.Err()
+	}
+
+	select {
+	case <-i.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkDrained closes the drained channel once the Instance is stopped and has no connections
+// left. It must be called with connsLock held.
+func (i *Instance) checkDrained() {
+	if i.stopped && len(i.conns) == 0 && !i.drainedClosed {
+		i.drainedClosed = true
+		close(i.drained)
+	}
+}
+
+func (i *Instance) isStopped() bool {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	return i.stopped
+}
+
+// serve is the accept loop. It returns once the listener is closed by Stop or Shutdown.
+func (i *Instance) serve(listener Listener) {
+	defer close(i.done)
+
+	for {
+		remote, err := listener.Accept()
+		if err != nil {
+			if isShuttingDown() || i.isStopped() {
+				return
+			}
+			log.Println("Error accepting connection from remote:", err.Error())
+			continue
+		}
+		metrics.IncCounter(MetricConnectionsEstablishedExt)
+
+		remote, err = listener.Configure(remote)
+		if err != nil {
+			log.Println("Error configuring connection after accept:", err.Error())
+			remote.Close()
+			continue
+		}
+
+		if !acceptAllowed() {
+			metrics.IncCounter(MetricConnectionsRejectedRate)
+			rejectConn(remote, i.ps)
+			continue
+		}
+
+		id, err := trackConn([]io.Closer{remote}, i)
+		if err == errTooManyConns {
+			metrics.IncCounter(MetricConnectionsRejectedMax)
+			rejectConn(remote, i.ps)
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		// spin off a goroutine here to handle determining the protocol used for the connection.
+		// The server loop can't be started until the protocol is known. Another goroutine is
+		// necessary here because we don't want to block accepting new connections if the current
+		// new connection doesn't send data immediately.
+		go i.serveConn(id, remote)
+	}
+}
+
+// newParserResponder determines the protocol used on a connection by trying the protocols'
+// disambiguators in order and returns the parser and responder for it
+func newParserResponder(conn net.Conn, ps []protocol.Components) (protocol.RequestParser, protocol.Responder, error) {
+	remoteReader := bufio.NewReader(conn)
+	remoteWriter := bufio.NewWriter(conn)
+
+	var reqParser protocol.RequestParser
+	var responder protocol.Responder
+	var matched bool
+
+	peeker := protocol.Peeker(remoteReader)
+
+	for _, p := range ps {
+		match, err := p.NewDisambiguator(peeker).CanParse()
+
+		if err != nil {
+			if err == io.EOF {
+				metrics.IncCounter(MetricProtocolsAssignedErrorEOF)
+			} else {
+				metrics.IncCounter(MetricProtocolsAssignedError)
+			}
+			return nil, nil, err
+		}
+
+		if match {
+			reqParser, responder = protocol.NewParserResponder(p, remoteReader, remoteWriter)
+			matched = true
+		}
+	}
+
+	// if none of the protocols matched, just use the last one in the list
+	if !matched {
+		p := ps[len(ps)-1]
+		reqParser, responder = protocol.NewParserResponder(p, remoteReader, remoteWriter)
+		metrics.IncCounter(MetricProtocolsAssignedFallback)
+	}
+
+	metrics.IncCounter(MetricProtocolsAssigned)
+
+	return reqParser, responder, nil
+}
+
+func (i *Instance) serveConn(id uint64, remoteConn net.Conn) {
+	defer untrackConn(id)
+
+	// The TLS identity has to come from the connection itself, so the wrapped connection is only
+	// used for reading and writing
+	conn := newClientConn(remoteConn, currentTimeouts())
+
+	reqParser, responder, err := newParserResponder(conn, i.ps)
+	if err != nil {
+		if isTimeout(err) {
+			metrics.IncCounter(MetricConnectionsTimedOut)
+			err = nil
+		}
+		abort([]io.Closer{remoteConn}, err)
+		return
+	}
+
+	// The protocol check above has read from the connection, so any PROXY header has been read
+	// and the client's real address is known
+	if !admitIP(id, remoteConn.RemoteAddr()) {
+		metrics.IncCounter(MetricConnectionsRejectedIP)
+		replyBusy(remoteConn, responder)
+		return
+	}
+
+	// The handlers aren't made until the connection is known to be allowed so a flood of
+	// connections can't use up the connections to the backends
+	l1, err := i.h1()
+	if err != nil {
+		log.Println("Error opening connection to L1:", err.Error())
+		remoteConn.Close()
+		return
+	}
+	metrics.IncCounter(MetricConnectionsEstablishedL1)
+
+	l2, err := i.h2()
+	if err != nil {
+		log.Println("Error opening connection to L2:", err.Error())
+		l1.Close()
+		remoteConn.Close()
+		return
+	}
+	metrics.IncCounter(MetricConnectionsEstablishedL2)
+
+	if !addHandlers(id, l1, l2) {
+		abort([]io.Closer{remoteConn, l1, l2}, nil)
+		return
+	}
+
+	server := i.s([]io.Closer{conn, l1, l2}, reqParser, i.o(l1, l2, responder))
+
+	if ra, ok := server.(ResponderAware); ok {
+		ra.SetResponder(responder)
+	}
+
+	// Any TLS handshake is done as well
+	if ra, ok := server.(RemoteAddrAware); ok {
+		ra.SetRemoteAddr(remoteConn.RemoteAddr())
+	}
+	if identity := connIdentity(remoteConn); identity != "" {
+		if ia, ok := server.(IdentityAware); ok {
+			ia.SetIdentity(identity)
+		}
+	}
+
+	serveConn(id, remoteConn.RemoteAddr().String(), server)
+	server.Loop()
+}
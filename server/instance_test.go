@@ -0,0 +1,694 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/handlers/memcached"
+	"github.com/netflix/rend/handlers/memcached/pooled"
+	"github.com/netflix/rend/handlers/memcached/std"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/protocol/textprot"
+	"github.com/netflix/rend/server"
+)
+
+func testInstance() *server.Instance {
+	return server.NewInstance(
+		server.TCPListener(0),
+		[]protocol.Components{textprot.Components},
+		server.Default,
+		orcas.L1Only,
+		inmem.New,
+		handlers.NilHandler,
+	)
+}
+
+func TestInstance(t *testing.T) {
+	t.Run("ServeAndStop", func(t *testing.T) {
+		i := testInstance()
+		if err := i.Start(context.Background()); err != nil {
+			t.Fatalf("Error starting: %v", err)
+		}
+
+		addr, ok := i.Addr().(*net.TCPAddr)
+		if !ok || addr.Port == 0 {
+			t.Fatalf("Expected an ephemeral TCP port, got %v", i.Addr())
+		}
+
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("set instance 0 0 1\r\nx\r\n"))
+		if line, err := r.ReadString('\n'); err != nil || line != "STORED\r\n" {
+			t.Fatalf("Expected STORED, got %q, %v", line, err)
+		}
+
+		if n := i.ActiveConns(); n != 1 {
+			t.Fatalf("Expected 1 active connection, got %d", n)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := i.Stop(ctx); err != nil {
+			t.Fatalf("Error stopping: %v", err)
+		}
+
+		// The idle connection is closed by the drain
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Fatalf("Expected the connection to be closed, got %v", err)
+		}
+		if n := i.ActiveConns(); n != 0 {
+			t.Fatalf("Expected no active connections, got %d", n)
+		}
+
+		if _, err := net.Dial("tcp", addr.String()); err == nil {
+			t.Fatal("Expected the listener to be closed")
+		}
+	})
+
+	t.Run("StartTwice", func(t *testing.T) {
+		i := testInstance()
+		if err := i.Start(context.Background()); err != nil {
+			t.Fatalf("Error starting: %v", err)
+		}
+		defer i.Stop(context.Background())
+
+		if err := i.Start(context.Background()); err != server.ErrInstanceStarted {
+			t.Fatalf("Expected ErrInstanceStarted, got %v", err)
+		}
+	})
+
+	t.Run("StopNotStarted", func(t *testing.T) {
+		if err := testInstance().Stop(context.Background()); err != server.ErrInstanceNotStarted {
+			t.Fatalf("Expected ErrInstanceNotStarted, got %v", err)
+		}
+	})
+
+	t.Run("PortInUse", func(t *testing.T) {
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		defer l.Close()
+
+		i := server.NewInstance(
+			server.TCPListener(l.Addr().(*net.TCPAddr).Port),
+			[]protocol.Components{textprot.Components},
+			server.Default,
+			orcas.L1Only,
+			inmem.New,
+			handlers.NilHandler,
+		)
+
+		if err := i.Start(context.Background()); err == nil {
+			t.Fatal("Expected an error binding to a port in use")
+		}
+	})
+}
+
+// testLimitsConn connects to the instance and sends a set, returning the response line
+func testLimitsConn(t *testing.T, i *server.Instance) (net.Conn, string) {
+	conn, err := net.Dial("tcp", i.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("set limits 0 0 1\r\nx\r\n"))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+
+	return conn, line
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits server.Limits
+	}{
+		{"MaxConns", server.Limits{MaxConns: 1}},
+		{"MaxConnsPerIP", server.Limits{MaxConnsPerIP: 1}},
+		{"AcceptRate", server.Limits{AcceptRate: 0.001, AcceptBurst: 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server.SetLimits(test.limits)
+			defer server.SetLimits(server.Limits{})
+
+			i := testInstance()
+			if err := i.Start(context.Background()); err != nil {
+				t.Fatalf("Error starting: %v", err)
+			}
+			defer i.Stop(context.Background())
+
+			first, line := testLimitsConn(t, i)
+			defer first.Close()
+			if line != "STORED\r\n" {
+				t.Fatalf("Expected the first connection to be served, got %q", line)
+			}
+
+			second, line := testLimitsConn(t, i)
+			defer second.Close()
+			if line != "SERVER_ERROR busy\r\n" {
+				t.Fatalf("Expected the second connection to be rejected, got %q", line)
+			}
+
+			if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("Expected the rejected connection to be closed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLimitsRejectingCap(t *testing.T) {
+	server.SetLimits(server.Limits{MaxConns: 1})
+	defer server.SetLimits(server.Limits{})
+
+	i := testInstance()
+	if err := i.Start(context.Background()); err != nil {
+		t.Fatalf("Error starting: %v", err)
+	}
+	defer i.Stop(context.Background())
+
+	first, line := testLimitsConn(t, i)
+	defer first.Close()
+	if line != "STORED\r\n" {
+		t.Fatalf("Expected the first connection to be served, got %q", line)
+	}
+
+	// Rejected connections that never send anything hold their place until RejectTimeout
+	for n := 0; n < 256; n++ {
+		idle, err := net.Dial("tcp", i.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer idle.Close()
+	}
+
+	conn, err := net.Dial("tcp", i.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("set limits 0 0 1\r\nx\r\n"))
+
+	line, err = bufio.NewReader(conn).ReadString('\n')
+	if nerr, ok := err.(net.Error); err == nil || ok && nerr.Timeout() {
+		t.Fatalf("Expected the connection past the cap to be closed without a reply, got %q, %v", line, err)
+	}
+}
+
+// hangingBackend is a memcached handler whose backend reads requests but never responds
+func hangingBackend() (handlers.Handler, error) {
+	client, backend := net.Pipe()
+	go io.Copy(ioutil.Discard, backend)
+	return std.NewHandler(client), nil
+}
+
+func TestTimeouts(t *testing.T) {
+	start := func(t *testing.T, timeouts server.Timeouts, h1 handlers.HandlerConst) (*server.Instance, net.Conn) {
+		server.SetTimeouts(timeouts)
+
+		i := server.NewInstance(
+			server.TCPListener(0),
+			[]protocol.Components{textprot.Components},
+			server.Default,
+			orcas.L1Only,
+			h1,
+			handlers.NilHandler,
+		)
+		if err := i.Start(context.Background()); err != nil {
+			t.Fatalf("Error starting: %v", err)
+		}
+
+		conn, err := net.Dial("tcp", i.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		return i, conn
+	}
+
+	t.Run("Idle", func(t *testing.T) {
+		defer server.SetTimeouts(server.Timeouts{})
+		i, conn := start(t, server.Timeouts{Idle: 100 * time.Millisecond}, inmem.New)
+		defer i.Stop(context.Background())
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("set idle 0 0 1\r\nx\r\n"))
+		if line, err := r.ReadString('\n'); err != nil || line != "STORED\r\n" {
+			t.Fatalf("Expected STORED, got %q, %v", line, err)
+		}
+
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Fatalf("Expected the idle connection to be closed, got %v", err)
+		}
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		defer server.SetTimeouts(server.Timeouts{})
+		i, conn := start(t, server.Timeouts{Read: 100 * time.Millisecond}, inmem.New)
+		defer i.Stop(context.Background())
+		defer conn.Close()
+
+		// The data for the set never comes
+		conn.Write([]byte("set read 0 0 1\r\n"))
+
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected the connection to be closed, got %v", err)
+		}
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		defer server.SetTimeouts(server.Timeouts{})
+		i, conn := start(t, server.Timeouts{Request: 100 * time.Millisecond}, hangingBackend)
+		defer i.Stop(context.Background())
+		defer conn.Close()
+
+		// The connection stays open after a request times out
+		r := bufio.NewReader(conn)
+		for n := 0; n < 2; n++ {
+			conn.Write([]byte("set request 0 0 1\r\nx\r\n"))
+			if line, err := r.ReadString('\n'); err != nil || line != "SERVER_ERROR temporary failure\r\n" {
+				t.Fatalf("Expected a temporary failure, got %q, %v", line, err)
+			}
+		}
+	})
+}
+
+func TestClientHangup(t *testing.T) {
+	start := func(t *testing.T, h1 handlers.HandlerConst) (*server.Instance, net.Conn) {
+		i := server.NewInstance(
+			server.TCPListener(0),
+			[]protocol.Components{textprot.Components},
+			server.Default,
+			orcas.L1Only,
+			h1,
+			handlers.NilHandler,
+		)
+		if err := i.Start(context.Background()); err != nil {
+			t.Fatalf("Error starting: %v", err)
+		}
+
+		conn, err := net.Dial("tcp", i.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		return i, conn
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		i, conn := start(t, hangingBackend)
+
+		conn.Write([]byte("get hangup\r\n"))
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+
+		// There's no request timeout, so the connection only goes away if the server notices the
+		// client is gone and interrupts the backend
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := i.Stop(ctx); err != nil {
+			t.Fatalf("Error stopping: %v", err)
+		}
+		if n := i.ActiveConns(); n != 0 {
+			t.Fatalf("Expected no active connections, got %d", n)
+		}
+	})
+	t.Run("NoreplySet", func(t *testing.T) {
+		// The backend takes a while to store the data and reports whether the handler was still
+		// around to read the response
+		stored := make(chan error, 1)
+		slowBackend := func() (handlers.Handler, error) {
+			client, backend := net.Pipe()
+			go func() {
+				header := make([]byte, 24)
+				if _, err := io.ReadFull(backend, header); err != nil {
+					stored <- err
+					return
+				}
+				if _, err := io.CopyN(ioutil.Discard, backend, int64(binary.BigEndian.Uint32(header[8:12]))); err != nil {
+					stored <- err
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+
+				res := make([]byte, 24)
+				res[0] = 0x81
+				res[1] = header[1]
+				copy(res[12:16], header[12:16])
+				_, err := backend.Write(res)
+				stored <- err
+			}()
+			return std.NewHandler(client), nil
+		}
+
+		i, conn := start(t, slowBackend)
+		defer i.Stop(context.Background())
+		defer conn.Close()
+
+		// A client that doesn't wait for responses may close its side as soon as it's done
+		// writing. The set still has to run to completion.
+		conn.Write([]byte("set noreply 0 0 1 noreply\r\nx\r\n"))
+		conn.(*net.TCPConn).CloseWrite()
+
+		select {
+		case err := <-stored:
+			if err != nil {
+				t.Fatalf("Expected the set to complete, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the set")
+		}
+	})
+}
+
+// missingBackend is a fake memcached backend that answers every request with key not found
+func missingBackend(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 24)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if _, err := io.CopyN(ioutil.Discard, conn, int64(binary.BigEndian.Uint32(header[8:12]))); err != nil {
+			return
+		}
+
+		res := make([]byte, 24)
+		res[0] = 0x81
+		res[1] = header[1]
+		binary.BigEndian.PutUint16(res[6:8], 0x0001)
+		copy(res[12:16], header[12:16])
+		if _, err := conn.Write(res); err != nil {
+			return
+		}
+	}
+}
+
+func TestBackendReconnect(t *testing.T) {
+	// The first connection to the backend is already broken and the ones after it work
+	var dials int
+	dial := func() (net.Conn, error) {
+		client, backend := net.Pipe()
+		if dials == 0 {
+			backend.Close()
+		} else {
+			go missingBackend(backend)
+		}
+		dials++
+		return client, nil
+	}
+
+	h1 := func() (handlers.Handler, error) {
+		h, err := std.NewReconnectingHandler(dial)
+		if err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+
+	i := server.NewInstance(
+		server.TCPListener(0),
+		[]protocol.Components{textprot.Components},
+		server.Default,
+		orcas.L1Only,
+		h1,
+		handlers.NilHandler,
+	)
+	if err := i.Start(context.Background()); err != nil {
+		t.Fatalf("Error starting: %v", err)
+	}
+	defer i.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", i.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{"SERVER_ERROR temporary failure\r\n", "NOT_FOUND\r\n"} {
+		conn.Write([]byte("delete reconnect\r\n"))
+		if line, err := r.ReadString('\n'); err != nil || line != expected {
+			t.Fatalf("Expected %q, got %q, %v", expected, line, err)
+		}
+	}
+
+	if dials != 2 {
+		t.Fatalf("Expected 2 connections to the backend, got %d", dials)
+	}
+}
+
+func TestPool(t *testing.T) {
+	start := func(t *testing.T, h1 handlers.HandlerConst) *server.Instance {
+		i := server.NewInstance(
+			server.TCPListener(0),
+			[]protocol.Components{textprot.Components},
+			server.Default,
+			orcas.L1Only,
+			h1,
+			handlers.NilHandler,
+		)
+		if err := i.Start(context.Background()); err != nil {
+			t.Fatalf("Error starting: %v", err)
+		}
+		return i
+	}
+
+	connect := func(t *testing.T, i *server.Instance) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", i.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+
+	t.Run("Shared", func(t *testing.T) {
+		var dials int
+		dial := func() (net.Conn, error) {
+			client, backend := net.Pipe()
+			go missingBackend(backend)
+			dials++
+			return client, nil
+		}
+
+		p := pooled.NewPool(func() (handlers.Handler, error) {
+			h, err := std.NewReconnectingHandler(dial)
+			if err != nil {
+				return nil, err
+			}
+			return h, nil
+		}, pooled.Opts{Size: 1})
+
+		i := start(t, func() (handlers.Handler, error) { return pooled.NewHandler(p), nil })
+		defer i.Stop(context.Background())
+
+		// Both clients use the one connection to the backend
+		for n := 0; n < 2; n++ {
+			conn, r := connect(t, i)
+			defer conn.Close()
+
+			conn.Write([]byte("delete pool\r\n"))
+			if line, err := r.ReadString('\n'); err != nil || line != "NOT_FOUND\r\n" {
+				t.Fatalf("Expected NOT_FOUND, got %q, %v", line, err)
+			}
+		}
+
+		if dials != 1 {
+			t.Fatalf("Expected 1 connection to the backend, got %d", dials)
+		}
+	})
+
+	t.Run("ClosedOnStop", func(t *testing.T) {
+		backendClosed := make(chan struct{})
+		dial := func() (net.Conn, error) {
+			client, backend := net.Pipe()
+			go func() {
+				missingBackend(backend)
+				close(backendClosed)
+			}()
+			return client, nil
+		}
+
+		p := pooled.NewPool(func() (handlers.Handler, error) {
+			h, err := std.NewReconnectingHandler(dial)
+			if err != nil {
+				return nil, err
+			}
+			return h, nil
+		}, pooled.Opts{Size: 1})
+
+		i := start(t, func() (handlers.Handler, error) { return pooled.NewHandler(p), nil })
+
+		conn, r := connect(t, i)
+		conn.Write([]byte("delete pool\r\n"))
+		if line, err := r.ReadString('\n'); err != nil || line != "NOT_FOUND\r\n" {
+			t.Fatalf("Expected NOT_FOUND, got %q, %v", line, err)
+		}
+		conn.Close()
+
+		if err := i.Stop(context.Background()); err != nil {
+			t.Fatalf("Error stopping: %v", err)
+		}
+
+		// The idle connection in the pool is closed along with the Instance
+		select {
+		case <-backendClosed:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the pooled backend connection to be closed")
+		}
+	})
+
+	t.Run("Full", func(t *testing.T) {
+		server.SetTimeouts(server.Timeouts{Request: 300 * time.Millisecond})
+		defer server.SetTimeouts(server.Timeouts{})
+
+		p := pooled.NewPool(hangingBackend, pooled.Opts{Size: 1, WaitMillis: 50})
+		i := start(t, func() (handlers.Handler, error) { return pooled.NewHandler(p), nil })
+		defer i.Stop(context.Background())
+
+		// The first client holds the only connection until its request times out, so the
+		// second one gives up waiting for it
+		first, r1 := connect(t, i)
+		defer first.Close()
+		first.Write([]byte("set full 0 0 1\r\nx\r\n"))
+		time.Sleep(50 * time.Millisecond)
+
+		second, r2 := connect(t, i)
+		defer second.Close()
+		second.Write([]byte("delete full\r\n"))
+
+		for _, r := range []*bufio.Reader{r2, r1} {
+			if line, err := r.ReadString('\n'); err != nil || line != "SERVER_ERROR temporary failure\r\n" {
+				t.Fatalf("Expected a temporary failure, got %q, %v", line, err)
+			}
+		}
+	})
+}
+
+func TestBackendAddr(t *testing.T) {
+	serve := func(l net.Listener) {
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go missingBackend(conn)
+			}
+		}()
+	}
+
+	check := func(t *testing.T, addr string) {
+		i := server.NewInstance(
+			server.TCPListener(0),
+			[]protocol.Components{textprot.Components},
+			server.Default,
+			orcas.L1Only,
+			memcached.Regular(addr),
+			handlers.NilHandler,
+		)
+		if err := i.Start(context.Background()); err != nil {
+			t.Fatalf("Error starting: %v", err)
+		}
+		defer i.Stop(context.Background())
+
+		conn, err := net.Dial("tcp", i.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		conn.Write([]byte("delete addr\r\n"))
+		if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "NOT_FOUND\r\n" {
+			t.Fatalf("Expected NOT_FOUND, got %q, %v", line, err)
+		}
+	}
+
+	t.Run("TCP", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		defer l.Close()
+		serve(l)
+
+		check(t, "tcp://"+l.Addr().String()+"?dial_timeout=1s&keepalive=30s&nodelay=true")
+	})
+
+	t.Run("Unix", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "rend")
+		if err != nil {
+			t.Fatalf("Error making temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		sock := filepath.Join(dir, "memcached.sock")
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		defer l.Close()
+		serve(l)
+
+		check(t, "unix://"+sock)
+		check(t, sock)
+	})
+
+	t.Run("Bad", func(t *testing.T) {
+		for _, addr := range []string{
+			"udp://127.0.0.1:11211",
+			"tcp://127.0.0.1",
+			"tcp://127.0.0.1:11211?bogus=1",
+			"unix:///tmp/memcached.sock?keepalive=30s",
+		} {
+			if _, err := memcached.Regular(addr)(); err == nil {
+				t.Fatalf("Expected an error for %q", addr)
+			}
+		}
+	})
+}
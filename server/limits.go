@@ -0,0 +1,202 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/protocol"
+)
+
+// Limits restrict how many external connections are served at once and how quickly new ones are
+// accepted, across every listener in the process. A connection over a limit is answered with a
+// busy error in its own protocol as soon as it sends anything and is then closed, without any L1
+// or L2 connections being made for it. Zero values mean no limit.
+type Limits struct {
+	// MaxConns is the most connections served at once
+	MaxConns int
+
+	// MaxConnsPerIP is the most connections served at once from a single client IP address. When
+	// the PROXY protocol is used, this is the address from the PROXY header. Connections that
+	// aren't over IP, like unix domain sockets, are not limited.
+	MaxConnsPerIP int
+
+	// AcceptRate is the number of new connections accepted per second on average, with bursts of
+	// up to AcceptBurst. The burst defaults to the rate, or 1 if the rate is less than 1.
+	AcceptRate  float64
+	AcceptBurst int
+}
+
+// RejectTimeout is how long a rejected connection has to show which protocol it speaks so it can be
+// answered before it is closed.
+var RejectTimeout = time.Second
+
+// maxRejecting is the most rejected connections that are answered at once
+const maxRejecting = 256
+
+// rejectDrain is how much of a rejected client's request is read and dropped before closing
+const rejectDrain = 64 * 1024
+
+var (
+	errTooManyConns = errors.New("Too many connections")
+
+	// limitsLock protects the limits and the accept rate token bucket. It can be taken while
+	// holding connsLock, but not the other way around.
+	limitsLock   = new(sync.Mutex)
+	limits       Limits
+	acceptTokens float64
+	acceptLast   time.Time
+
+	rejecting = make(chan struct{}, maxRejecting)
+
+	// ipConns is the number of connections from each client IP. It is protected by connsLock.
+	ipConns = make(map[string]int)
+)
+
+// SetLimits replaces the current connection limits for every listener and Instance. Connections that are already being served are
+// not affected.
+func SetLimits(l Limits) {
+	if l.AcceptRate > 0 && l.AcceptBurst <= 0 {
+		l.AcceptBurst = int(l.AcceptRate)
+		if l.AcceptBurst < 1 {
+			l.AcceptBurst = 1
+		}
+	}
+
+	limitsLock.Lock()
+	limits = l
+	acceptTokens = float64(l.AcceptBurst)
+	acceptLast = time.Now()
+	limitsLock.Unlock()
+}
+
+func currentLimits() Limits {
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+	return limits
+}
+
+// acceptAllowed takes a token from the accept rate bucket, returning false if there are none left
+func acceptAllowed() bool {
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+
+	if limits.AcceptRate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	acceptTokens += now.Sub(acceptLast).Seconds() * limits.AcceptRate
+	acceptLast = now
+
+	if burst := float64(limits.AcceptBurst); acceptTokens > burst {
+		acceptTokens = burst
+	}
+
+	if acceptTokens < 1 {
+		return false
+	}
+
+	acceptTokens--
+	return true
+}
+
+// addrIP returns the IP address of a client, or an empty string for connections that aren't over IP
+func addrIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return ""
+}
+
+// admitIP checks the per IP limit for a tracked connection now that its real address is known. If
+// it is under the limit, the connection is counted against its IP until it is untracked.
+func admitIP(id uint64, addr net.Addr) bool {
+	max := currentLimits().MaxConnsPerIP
+
+	ip := addrIP(addr)
+	if ip == "" {
+		return true
+	}
+
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	if max > 0 && ipConns[ip] >= max {
+		return false
+	}
+
+	ipConns[ip]++
+
+	c := conns[id]
+	c.ip = ip
+	conns[id] = c
+
+	return true
+}
+
+// rejectConn answers a connection that was over a limit before anything was read from it. The
+// protocol still has to be determined to know how to answer. Only maxRejecting connections are
+// answered at once so a flood can't pile up goroutines; any more are closed right away.
+func rejectConn(conn net.Conn, ps []protocol.Components) {
+	select {
+	case rejecting <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+
+	go func() {
+		defer func() { <-rejecting }()
+
+		timer := time.AfterFunc(RejectTimeout, func() { conn.Close() })
+		_, responder, err := newParserResponder(conn, ps)
+		timer.Stop()
+
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		replyBusy(conn, responder)
+	}()
+}
+
+// replyBusy answers a rejected connection with a busy error and closes it. The request is never
+// parsed, so nothing the client sent is buffered and binary clients get an opaque of 0.
+func replyBusy(conn net.Conn, responder protocol.Responder) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(RejectTimeout))
+
+	if err := responder.Error(0, common.RequestUnknown, common.ErrBusy, false); err != nil {
+		return
+	}
+
+	// Closing with unread data makes the kernel reset the connection, which can throw away the
+	// reply before the client reads it. Signal the end of the reply and drop a little of what the
+	// client sent before closing.
+	if cw, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+	}
+	io.CopyN(ioutil.Discard, conn, rejectDrain)
+}
@@ -15,16 +15,12 @@
 package server
 
 import (
-	"bufio"
-	"fmt"
-	"io"
-	"log"
+	"context"
 	"net"
 	"os"
 	"time"
 
 	"github.com/netflix/rend/handlers"
-	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/orcas"
 	"github.com/netflix/rend/protocol"
 )
@@ -37,8 +33,27 @@ func (l *tcpListener) Accept() (net.Conn, error) {
 	return l.listener.Accept()
 }
 
+func (l *tcpListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *tcpListener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *tcpListener) File() (*os.File, error) {
+	return listenerFile(l.listener)
+}
+
+// keepAliveConn is satisfied by *net.TCPConn and by connections wrapping one, like the ones
+// created by ProxyProtocol
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
 func (l *tcpListener) Configure(conn net.Conn) (net.Conn, error) {
-	tcpRemote := conn.(*net.TCPConn)
+	tcpRemote := conn.(keepAliveConn)
 
 	if err := tcpRemote.SetKeepAlive(true); err != nil {
 		return conn, err
@@ -51,12 +66,13 @@ func (l *tcpListener) Configure(conn net.Conn) (net.Conn, error) {
 	return conn, nil
 }
 
-// TCPListener is a ListenConst that returns a tcp listener for the given port
+// TCPListener is a ListenConst that returns a tcp listener for the given port. A listening socket
+// for the port inherited through systemd socket activation or Handoff is used if there is one.
 func TCPListener(port int) ListenConst {
 	return func() (Listener, error) {
-		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		listener, err := listenTCP(port)
 		if err != nil {
-			return nil, fmt.Errorf("Error binding to port %d: %v", port, err.Error())
+			return nil, err
 		}
 		return &tcpListener{listener: listener}, nil
 	}
@@ -70,23 +86,31 @@ func (l *unixListener) Accept() (net.Conn, error) {
 	return l.listener.Accept()
 }
 
+func (l *unixListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *unixListener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *unixListener) File() (*os.File, error) {
+	return listenerFile(l.listener)
+}
+
 func (l *unixListener) Configure(conn net.Conn) (net.Conn, error) {
 	return conn, nil
 }
 
-// UnixListener is a ListenConst that returns a unix domain socket listener for the given path
+// UnixListener is a ListenConst that returns a unix domain socket listener for the given path. A
+// listening socket for the path inherited through systemd socket activation or Handoff is used if
+// there is one.
 func UnixListener(path string) ListenConst {
 	return func() (Listener, error) {
-		err := os.Remove(path)
-		if err != nil && !os.IsNotExist(err) {
-			return nil, fmt.Errorf("Error removing previous unix socket file at %s", path)
-		}
-
-		listener, err := net.Listen("unix", path)
+		listener, err := listenUnix(path)
 		if err != nil {
-			return nil, fmt.Errorf("Error binding to unix socket at %s: %v", path, err.Error())
+			return nil, err
 		}
-
 		return &unixListener{listener: listener}, nil
 	}
 }
@@ -111,95 +135,19 @@ func UnixListener(path string) ListenConst {
 //
 // h1, h2 handlers.HandlerConst
 //   - Used to create the handlers.Handler instances as needed when the connection is established.
+//
+// ListenAndServe blocks until the listener is closed by Shutdown. It panics if the listener can't
+// be created. Use an Instance to get errors back and to stop the server on its own.
 func ListenAndServe(l ListenConst, ps []protocol.Components, s ServerConst, o orcas.OrcaConst, h1, h2 handlers.HandlerConst) {
-	listener, err := l()
-	if err != nil {
+	i := NewInstance(l, ps, s, o, h1, h2)
+
+	if err := i.Start(context.Background()); err != nil {
+		if err == ErrShuttingDown {
+			return
+		}
 		// At this point the server would be useless since we can't talk to the outside world.
 		panic(err)
 	}
 
-	for {
-		remote, err := listener.Accept()
-		if err != nil {
-			log.Println("Error accepting connection from remote:", err.Error())
-			remote.Close()
-			continue
-		}
-		metrics.IncCounter(MetricConnectionsEstablishedExt)
-
-		remote, err = listener.Configure(remote)
-		if err != nil {
-			log.Println("Error configuring connection after accept:", err.Error())
-			remote.Close()
-			continue
-		}
-
-		// construct L1 handler using given constructor
-		l1, err := h1()
-		if err != nil {
-			log.Println("Error opening connection to L1:", err.Error())
-			remote.Close()
-			continue
-		}
-		metrics.IncCounter(MetricConnectionsEstablishedL1)
-
-		// construct l2
-		l2, err := h2()
-		if err != nil {
-			log.Println("Error opening connection to L2:", err.Error())
-			l1.Close()
-			remote.Close()
-			continue
-		}
-		metrics.IncCounter(MetricConnectionsEstablishedL2)
-
-		// spin off a goroutine here to handle determining the protocol used for the connection.
-		// The server loop can't be started until the protocol is known. Another goroutine is
-		// necessary here because we don't want to block accepting new connections if the current
-		// new connection doesn't send data immediately.
-		go func(remoteConn net.Conn) {
-			remoteReader := bufio.NewReader(remoteConn)
-			remoteWriter := bufio.NewWriter(remoteConn)
-
-			var reqParser protocol.RequestParser
-			var responder protocol.Responder
-			var matched bool
-
-			peeker := protocol.Peeker(remoteReader)
-
-			for _, p := range ps {
-				match, err := p.NewDisambiguator(peeker).CanParse()
-
-				if err != nil {
-					abort([]io.Closer{remoteConn, l1, l2}, err)
-					if err == io.EOF {
-						metrics.IncCounter(MetricProtocolsAssignedErrorEOF)
-					} else {
-						metrics.IncCounter(MetricProtocolsAssignedError)
-					}
-					return
-				}
-
-				if match {
-					reqParser = p.NewRequestParser(remoteReader)
-					responder = p.NewResponder(remoteWriter)
-					matched = true
-				}
-			}
-
-			// if none of the protocols matched, just use the last one in the list
-			if !matched {
-				p := ps[len(ps)-1]
-				reqParser = p.NewRequestParser(remoteReader)
-				responder = p.NewResponder(remoteWriter)
-				metrics.IncCounter(MetricProtocolsAssignedFallback)
-			}
-
-			metrics.IncCounter(MetricProtocolsAssigned)
-
-			server := s([]io.Closer{remoteConn, l1, l2}, reqParser, o(l1, l2, responder))
-
-			go server.Loop()
-		}(remote)
-	}
+	<-i.done
 }
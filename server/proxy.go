@@ -0,0 +1,308 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+// ProxyHeaderTimeout is how long a connection has to send its PROXY protocol header after it is
+// accepted before it is closed.
+var ProxyHeaderTimeout = 10 * time.Second
+
+var (
+	errBadProxyHeader = errors.New("Invalid PROXY protocol header")
+
+	proxyV1Prefix  = []byte("PROXY ")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	proxyV1MaxLen  = 107
+	proxyV2HdrLen  = 16
+	proxyV2Version = byte(0x20)
+)
+
+type proxyListener struct {
+	wrapped Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	return l.wrapped.Accept()
+}
+
+func (l *proxyListener) Addr() net.Addr {
+	if al, ok := l.wrapped.(addrListener); ok {
+		return al.Addr()
+	}
+	return nil
+}
+
+func (l *proxyListener) Close() error {
+	return l.wrapped.Close()
+}
+
+func (l *proxyListener) File() (*os.File, error) {
+	if fl, ok := l.wrapped.(fileListener); ok {
+		return fl.File()
+	}
+	return nil, errHandoffNotSupported
+}
+
+// Configure wraps the raw connection so the PROXY header is stripped before the wrapped listener
+// sees any data. This matters for TLS, where the header comes before the handshake.
+func (l *proxyListener) Configure(conn net.Conn) (net.Conn, error) {
+	return l.wrapped.Configure(newProxyConn(conn))
+}
+
+// ProxyProtocol wraps a ListenConst so every connection it accepts must start with an HAProxy
+// PROXY protocol v1 or v2 header. The address in the header is returned by the connection's
+// RemoteAddr method in place of the load balancer's address. Connections without a valid header
+// are closed.
+//
+// The header is read lazily on the first Read or RemoteAddr call so a slow client doesn't hold up
+// the accept loop.
+func ProxyProtocol(l ListenConst) ListenConst {
+	return func() (Listener, error) {
+		listener, err := l()
+		if err != nil {
+			return nil, err
+		}
+		return &proxyListener{wrapped: listener}, nil
+	}
+}
+
+// proxyConn is a net.Conn that reads and removes the PROXY header from the start of the stream
+type proxyConn struct {
+	net.Conn
+
+	reader *bufio.Reader
+	once   sync.Once
+	src    net.Addr
+	err    error
+
+	// readDeadline is the read deadline set by the user of the connection. The header has its own
+	// deadline, and this one is put back once the header has been read.
+	lock         sync.Mutex
+	readDeadline time.Time
+}
+
+func newProxyConn(conn net.Conn) *proxyConn {
+	return &proxyConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+func (p *proxyConn) Read(b []byte) (int, error) {
+	p.once.Do(p.readHeader)
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the address of the connection
+// itself if the header didn't have one (e.g. a health check from the load balancer).
+func (p *proxyConn) RemoteAddr() net.Addr {
+	p.once.Do(p.readHeader)
+	if p.src != nil {
+		return p.src
+	}
+	return p.Conn.RemoteAddr()
+}
+
+// SetKeepAlive and SetKeepAlivePeriod let the TCP listeners configure the underlying connection
+func (p *proxyConn) SetKeepAlive(keepalive bool) error {
+	if ka, ok := p.Conn.(keepAliveConn); ok {
+		return ka.SetKeepAlive(keepalive)
+	}
+	return nil
+}
+
+func (p *proxyConn) SetKeepAlivePeriod(d time.Duration) error {
+	if ka, ok := p.Conn.(keepAliveConn); ok {
+		return ka.SetKeepAlivePeriod(d)
+	}
+	return nil
+}
+
+func (p *proxyConn) SetDeadline(t time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.readDeadline = t
+	return p.Conn.SetDeadline(t)
+}
+
+func (p *proxyConn) SetReadDeadline(t time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.readDeadline = t
+	return p.Conn.SetReadDeadline(t)
+}
+
+func (p *proxyConn) readHeader() {
+	p.lock.Lock()
+	d := time.Now().Add(ProxyHeaderTimeout)
+	if !p.readDeadline.IsZero() && p.readDeadline.Before(d) {
+		d = p.readDeadline
+	}
+	p.Conn.SetReadDeadline(d)
+	p.lock.Unlock()
+
+	defer func() {
+		p.lock.Lock()
+		p.Conn.SetReadDeadline(p.readDeadline)
+		p.lock.Unlock()
+	}()
+
+	first, err := p.reader.Peek(1)
+	if err != nil {
+		p.err = err
+		return
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		p.src, p.err = readProxyV1(p.reader)
+	case proxyV2Sig[0]:
+		p.src, p.err = readProxyV2(p.reader)
+	default:
+		p.err = errBadProxyHeader
+	}
+
+	// The connection closing partway through the header is an error, not a clean close
+	if p.err == io.EOF {
+		p.err = io.ErrUnexpectedEOF
+	}
+
+	if p.err != nil {
+		metrics.IncCounter(MetricProxyHeaderError)
+	} else {
+		metrics.IncCounter(MetricProxyHeader)
+	}
+}
+
+// readProxyV1 reads a text header like "PROXY TCP4 1.2.3.4 5.6.7.8 1234 11211\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasPrefix(line, proxyV1Prefix) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errBadProxyHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errBadProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, errBadProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errBadProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header. Only the source address is used; the TLVs after the
+// addresses are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, proxyV2HdrLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(hdr[:len(proxyV2Sig)], proxyV2Sig) || hdr[12]&0xF0 != proxyV2Version {
+		return nil, errBadProxyHeader
+	}
+
+	command := hdr[12] & 0x0F
+	family := hdr[13]
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections come from the proxy itself, e.g. health checks
+	if command == 0x0 {
+		return nil, nil
+	}
+	if command != 0x1 {
+		return nil, errBadProxyHeader
+	}
+
+	switch family >> 4 {
+	case 0x1: // IPv4
+		if len(body) < 12 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+
+	case 0x2: // IPv6
+		if len(body) < 36 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+
+	case 0x3: // unix
+		if len(body) < 216 {
+			return nil, errBadProxyHeader
+		}
+		return &net.UnixAddr{
+			Name: string(bytes.TrimRight(body[0:108], "\x00")),
+			Net:  "unix",
+		}, nil
+	}
+
+	// AF_UNSPEC or something unknown, so there's no address to use
+	return nil, nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/server"
+)
+
+// testPassthroughListener only configures connections, which it leaves alone
+type testPassthroughListener struct{}
+
+func (testPassthroughListener) Accept() (net.Conn, error)              { panic("not used") }
+func (testPassthroughListener) Configure(c net.Conn) (net.Conn, error) { return c, nil }
+func (testPassthroughListener) Close() error                           { return nil }
+
+// proxyConn runs the given bytes through a PROXY protocol listener and returns the configured
+// connection and everything that could be read from it after the header.
+func proxyConn(t *testing.T, data []byte) (net.Conn, []byte, error) {
+	l, err := server.ProxyProtocol(func() (server.Listener, error) {
+		return testPassthroughListener{}, nil
+	})()
+	if err != nil {
+		t.Fatalf("Error creating listener: %v", err)
+	}
+
+	client, remote := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+
+	conn, err := l.Configure(remote)
+	if err != nil {
+		t.Fatalf("Error configuring connection: %v", err)
+	}
+
+	rest, err := ioutil.ReadAll(conn)
+	return conn, rest, err
+}
+
+func proxyV2Header(cmd, family byte, body []byte) []byte {
+	hdr := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	hdr = append(hdr, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:16], uint16(len(body)))
+	return append(hdr, body...)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	t.Run("V1TCP4", func(t *testing.T) {
+		conn, rest, err := proxyConn(t, []byte("PROXY TCP4 10.1.2.3 10.0.0.1 5555 11211\r\nget foo\r\n"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if conn.RemoteAddr().String() != "10.1.2.3:5555" {
+			t.Fatalf("Expected the address from the header, got %v", conn.RemoteAddr())
+		}
+		if string(rest) != "get foo\r\n" {
+			t.Fatalf("Expected the header to be stripped, got %q", rest)
+		}
+	})
+
+	t.Run("V1TCP6", func(t *testing.T) {
+		conn, _, err := proxyConn(t, []byte("PROXY TCP6 ::1 ::2 5555 11211\r\n"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if conn.RemoteAddr().String() != "[::1]:5555" {
+			t.Fatalf("Expected the address from the header, got %v", conn.RemoteAddr())
+		}
+	})
+
+	t.Run("V1Unknown", func(t *testing.T) {
+		conn, rest, err := proxyConn(t, []byte("PROXY UNKNOWN\r\nversion\r\n"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if conn.RemoteAddr().String() != "pipe" {
+			t.Fatalf("Expected the connection's own address, got %v", conn.RemoteAddr())
+		}
+		if string(rest) != "version\r\n" {
+			t.Fatalf("Expected the header to be stripped, got %q", rest)
+		}
+	})
+
+	t.Run("V2TCP4", func(t *testing.T) {
+		body := []byte{10, 1, 2, 3, 10, 0, 0, 1, 0x15, 0xB3, 0x2B, 0xCB}
+		// A TLV after the addresses that should be skipped
+		body = append(body, 0x04, 0x00, 0x01, 0xFF)
+
+		data := append(proxyV2Header(0x1, 0x11, body), []byte("\x80payload")...)
+
+		conn, rest, err := proxyConn(t, data)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if conn.RemoteAddr().String() != "10.1.2.3:5555" {
+			t.Fatalf("Expected the address from the header, got %v", conn.RemoteAddr())
+		}
+		if string(rest) != "\x80payload" {
+			t.Fatalf("Expected the header to be stripped, got %q", rest)
+		}
+	})
+
+	t.Run("V2Local", func(t *testing.T) {
+		conn, _, err := proxyConn(t, proxyV2Header(0x0, 0x00, nil))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if conn.RemoteAddr().String() != "pipe" {
+			t.Fatalf("Expected the connection's own address, got %v", conn.RemoteAddr())
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		_, _, err := proxyConn(t, []byte("get foo\r\n"))
+		if err == nil {
+			t.Fatal("Expected an error without a PROXY header")
+		}
+	})
+
+	t.Run("V1Truncated", func(t *testing.T) {
+		_, _, err := proxyConn(t, []byte("PROXY TCP4 10.1.2.3"))
+		if err == nil {
+			t.Fatal("Expected an error for a truncated header")
+		}
+	})
+
+	t.Run("V2ShortAddress", func(t *testing.T) {
+		_, _, err := proxyConn(t, proxyV2Header(0x1, 0x11, []byte{10, 1, 2, 3}))
+		if err == nil {
+			t.Fatal("Expected an error for a short address block")
+		}
+	})
+
+	t.Run("KeepsReadDeadline", func(t *testing.T) {
+		l, err := server.ProxyProtocol(func() (server.Listener, error) {
+			return testPassthroughListener{}, nil
+		})()
+		if err != nil {
+			t.Fatalf("Error creating listener: %v", err)
+		}
+
+		// The client sends the header and then sits idle without closing the connection
+		client, remote := net.Pipe()
+		defer client.Close()
+		go client.Write([]byte("PROXY TCP4 10.1.2.3 10.0.0.1 5555 11211\r\n"))
+
+		conn, err := l.Configure(remote)
+		if err != nil {
+			t.Fatalf("Error configuring connection: %v", err)
+		}
+
+		// The idle deadline set by the server has to outlast reading the header
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := conn.Read(make([]byte, 1))
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.Fatalf("Expected a timeout, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Read deadline was lost after reading the header")
+		}
+	})
+}
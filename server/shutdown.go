@@ -0,0 +1,149 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// All of the state here is protected by connsLock in stats.go, since a shutdown has to look at
+// the listeners and the connections together.
+var (
+	listeners    = make(map[Listener]struct{})
+	shuttingDown bool
+	drained      = make(chan struct{})
+	drainedOnce  = new(sync.Once)
+
+	// shared has what the handlers of each Instance share between themselves, like pools of
+	// backend connections, keyed to the Instance. It is closed when the Instance stops.
+	shared = make(map[io.Closer]*Instance)
+)
+
+// addShared records anything the handlers share so it is closed when the Instance stops. It must
+// be called with connsLock held.
+func addShared(inst *Instance, hs ...io.Closer) {
+	for _, h := range hs {
+		if sc, ok := h.(handlers.SharedCloser); ok {
+			shared[sc.Shared()] = inst
+		}
+	}
+}
+
+// closeShared closes what the handlers of an Instance share, or of every Instance if inst is nil
+func closeShared(inst *Instance) {
+	connsLock.Lock()
+	var cs []io.Closer
+	for c, owner := range shared {
+		if inst == nil || owner == inst {
+			cs = append(cs, c)
+			delete(shared, c)
+		}
+	}
+	connsLock.Unlock()
+
+	for _, c := range cs {
+		if err := c.Close(); err != nil {
+			log.Println("Error closing shared handler resources:", err.Error())
+		}
+	}
+}
+
+// trackListener records a listener so Shutdown can close it. If a shutdown is already in progress
+// the listener is closed right away and false is returned.
+func trackListener(l Listener) bool {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	if shuttingDown {
+		l.Close()
+		return false
+	}
+
+	listeners[l] = struct{}{}
+	return true
+}
+
+func isShuttingDown() bool {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	return shuttingDown
+}
+
+// drainConn asks the server for a connection to finish up, or closes the connection if there is
+// nothing in progress on it. It must be called with connsLock held.
+func drainConn(c connInfo) {
+	if d, ok := c.server.(Drainer); ok {
+		d.Drain()
+		return
+	}
+	abort(c.closers, nil)
+}
+
+// Shutdown stops every listener started by ListenAndServe or an Instance from accepting new
+// connections and then lets the existing connections finish the request they are working on.
+// Connections still open after the timeout are closed along with their handlers, and then anything
+// the handlers share, like pools of backend connections. It returns true if every connection
+// finished on its own.
+//
+// Shutdown can only be called once. ListenAndServe returns once its listener is closed.
+func Shutdown(timeout time.Duration) bool {
+	connsLock.Lock()
+
+	shuttingDown = true
+
+	for l := range listeners {
+		if err := l.Close(); err != nil {
+			log.Println("Error closing listener:", err.Error())
+		}
+	}
+
+	for _, c := range conns {
+		if c.server == nil {
+			// The protocol is still being determined, so no request has been read yet
+			abort(c.closers, nil)
+			continue
+		}
+		drainConn(c)
+	}
+
+	if len(conns) == 0 {
+		drainedOnce.Do(func() { close(drained) })
+	}
+
+	connsLock.Unlock()
+
+	select {
+	case <-drained:
+		closeShared(nil)
+		return true
+
+	case <-time.After(timeout):
+		connsLock.Lock()
+		for _, c := range conns {
+			metrics.IncCounter(MetricConnectionsForceClosed)
+			abort(c.closers, nil)
+		}
+		connsLock.Unlock()
+
+		closeShared(nil)
+		return false
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+const (
+	// StatsGroupConns is the stats group that lists the currently open external connections.
+	StatsGroupConns = "conns"
+
+	// StatsGroupRend is the stats group with every Rend metric under its own name. The general
+	// group only has the stats that memcached itself reports.
+	StatsGroupRend = "rend"
+)
+
+// memcachedStats are the memcached stats in the general group that are made from Rend's own
+// counters. Each one is the sum of the counters listed for it.
+var memcachedStats = []struct {
+	name     string
+	counters []string
+}{
+	{"cmd_get", []string{"cmd_get_keys"}},
+	{"cmd_set", []string{"cmd_set", "cmd_add", "cmd_replace", "cmd_append", "cmd_prepend"}},
+	{"cmd_flush", []string{"cmd_flush"}},
+	{"cmd_touch", []string{"cmd_touch", "cmd_gat"}},
+	{"get_hits", []string{"cmd_get_hits"}},
+	{"get_misses", []string{"cmd_get_misses"}},
+	{"delete_hits", []string{"cmd_delete_hits"}},
+	{"delete_misses", []string{"cmd_delete_misses"}},
+	{"incr_hits", []string{"cmd_incr_hits"}},
+	{"incr_misses", []string{"cmd_incr_misses"}},
+	{"decr_hits", []string{"cmd_decr_hits"}},
+	{"decr_misses", []string{"cmd_decr_misses"}},
+	{"touch_hits", []string{"cmd_touch_hits", "cmd_gat_hits"}},
+	{"touch_misses", []string{"cmd_touch_misses", "cmd_gat_misses"}},
+	{"bytes_read", []string{"bytes_read_remote"}},
+	{"bytes_written", []string{"bytes_written_remote"}},
+	{"rejected_connections", []string{"conn_rejected_max", "conn_rejected_ip", "conn_rejected_rate"}},
+}
+
+type connInfo struct {
+	addr  string
+	start time.Time
+
+	// closers are the external connection and its handlers. server is nil until the protocol has
+	// been determined and the server for the connection created.
+	closers []io.Closer
+	server  Server
+
+	// inst is the Instance that accepted the connection
+	inst *Instance
+
+	// ip is the client IP the connection is counted against for the per IP limit, if any
+	ip string
+}
+
+var (
+	startTime = time.Now()
+
+	connsLock  = new(sync.Mutex)
+	conns      = make(map[uint64]connInfo)
+	nextConnID uint64
+	totalConns uint64
+)
+
+func init() {
+	common.RegisterStats("", generalStats)
+	common.RegisterStats(StatsGroupConns, connStats)
+	common.RegisterStats(StatsGroupRend, rendStats)
+}
+
+// trackConn records a newly accepted external connection and returns the id used to untrack it.
+// If a shutdown is already in progress or the Instance has been stopped, the connection is closed
+// right away and ErrShuttingDown is returned. If the process is already serving as many
+// connections as it is allowed, errTooManyConns is returned and the caller has to reject the
+// connection.
+func trackConn(closers []io.Closer, inst *Instance) (uint64, error) {
+	max := currentLimits().MaxConns
+
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	if shuttingDown || inst.stopped {
+		abort(closers, nil)
+		return 0, ErrShuttingDown
+	}
+
+	if max > 0 && len(conns) >= max {
+		return 0, errTooManyConns
+	}
+
+	id := nextConnID
+	nextConnID++
+	totalConns++
+	conns[id] = connInfo{
+		start:   time.Now(),
+		closers: closers,
+		inst:    inst,
+	}
+	inst.conns[id] = struct{}{}
+
+	return id, nil
+}
+
+// addHandlers records the handlers made for a tracked connection so they are closed along with
+// it. If a shutdown or Stop started while they were being made, false is returned and the caller
+// has to close everything.
+func addHandlers(id uint64, l1, l2 io.Closer) bool {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	c := conns[id]
+	if shuttingDown || c.inst.stopped {
+		return false
+	}
+
+	c.closers = append(c.closers, l1, l2)
+	conns[id] = c
+	addShared(c.inst, l1, l2)
+
+	return true
+}
+
+// serveConn records the server handling a tracked connection and the client's address. If a
+// shutdown or Stop started while the protocol was being determined, the server is told to drain
+// before it starts.
+func serveConn(id uint64, addr string, s Server) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	c := conns[id]
+	c.addr = addr
+	c.server = s
+	conns[id] = c
+
+	if shuttingDown || c.inst.stopped {
+		drainConn(c)
+	}
+}
+
+func untrackConn(id uint64) {
+	connsLock.Lock()
+	if c, ok := conns[id]; ok {
+		delete(c.inst.conns, id)
+		c.inst.checkDrained()
+
+		if c.ip != "" {
+			ipConns[c.ip]--
+			if ipConns[c.ip] == 0 {
+				delete(ipConns, c.ip)
+			}
+		}
+	}
+	delete(conns, id)
+	if shuttingDown && len(conns) == 0 {
+		drainedOnce.Do(func() { close(drained) })
+	}
+	connsLock.Unlock()
+}
+
+func generalStats() []common.Stat {
+	now := time.Now()
+
+	connsLock.Lock()
+	curr, total := len(conns), totalConns
+	connsLock.Unlock()
+
+	ret := []common.Stat{
+		{Name: "pid", Value: strconv.Itoa(os.Getpid())},
+		{Name: "uptime", Value: strconv.FormatInt(int64(now.Sub(startTime)/time.Second), 10)},
+		{Name: "time", Value: strconv.FormatInt(now.Unix(), 10)},
+		{Name: "version", Value: common.VersionString},
+		{Name: "threads", Value: strconv.Itoa(runtime.GOMAXPROCS(0))},
+		{Name: "curr_connections", Value: strconv.Itoa(curr)},
+		{Name: "total_connections", Value: strconv.FormatUint(total, 10)},
+	}
+
+	// Only plain counters are used, so any with tags of their own are left out
+	im, _ := metrics.Snapshot()
+	counters := make(map[string]uint64)
+	for _, m := range im {
+		if m.Tgs[metrics.TagMetricType] == metrics.MetricTypeCounter && statName(m.Name, m.Tgs) == m.Name {
+			counters[m.Name] += m.Val
+		}
+	}
+
+	for _, ms := range memcachedStats {
+		var val uint64
+		for _, c := range ms.counters {
+			val += counters[c]
+		}
+		ret = append(ret, common.Stat{Name: ms.name, Value: strconv.FormatUint(val, 10)})
+	}
+
+	return ret
+}
+
+func rendStats() []common.Stat {
+	im, fm := metrics.Snapshot()
+
+	ret := make([]common.Stat, 0, len(im)+len(fm))
+	for _, m := range im {
+		ret = append(ret, common.Stat{Name: statName(m.Name, m.Tgs), Value: strconv.FormatUint(m.Val, 10)})
+	}
+	for _, m := range fm {
+		ret = append(ret, common.Stat{Name: statName(m.Name, m.Tgs), Value: strconv.FormatFloat(m.Val, 'f', -1, 64)})
+	}
+
+	return ret
+}
+
+func connStats() []common.Stat {
+	now := time.Now()
+
+	connsLock.Lock()
+	ids := make([]uint64, 0, len(conns))
+	for id := range conns {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	ret := make([]common.Stat, 0, 2*len(ids))
+	for _, id := range ids {
+		c := conns[id]
+		if c.server == nil {
+			// still determining the protocol
+			continue
+		}
+		ret = append(ret,
+			common.Stat{Name: fmt.Sprintf("%d:addr", id), Value: c.addr},
+			common.Stat{Name: fmt.Sprintf("%d:secs_since_connect", id), Value: strconv.FormatInt(int64(now.Sub(c.start)/time.Second), 10)},
+		)
+	}
+	connsLock.Unlock()
+
+	return ret
+}
+
+// statName flattens the tags on a metric into its stat name. The type and data type tags are
+// implied by the value, so only the remaining ones are kept, sorted by key to keep names stable.
+func statName(name string, tgs metrics.Tags) string {
+	var keys []string
+	for k := range tgs {
+		if k == metrics.TagMetricType || k == metrics.TagDataType {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name += ":" + k + "=" + tgs[k]
+	}
+
+	return name
+}
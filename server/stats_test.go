@@ -0,0 +1,98 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/server"
+)
+
+func statsMap(t *testing.T, group string) map[string]string {
+	stats, err := common.GetStats(group)
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+
+	ret := make(map[string]string)
+	for _, s := range stats {
+		ret[s.Name] = s.Value
+	}
+	return ret
+}
+
+func TestStats(t *testing.T) {
+	i := testInstance()
+	if err := i.Start(context.Background()); err != nil {
+		t.Fatalf("Error starting: %v", err)
+	}
+	defer i.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", i.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	before := statsMap(t, "")
+
+	conn.Write([]byte("set stats 0 0 1\r\nx\r\nget stats\r\nget nostats\r\n"))
+	for _, expected := range []string{"STORED", "VALUE stats 0 1", "x", "END", "END"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading response: %v", err)
+		}
+		if line != expected+"\r\n" {
+			t.Fatalf("Expected %q, got %q", expected, line)
+		}
+	}
+
+	t.Run("General", func(t *testing.T) {
+		after := statsMap(t, "")
+
+		for name := range after {
+			if strings.Contains(name, ":") {
+				t.Fatalf("Expected only memcached stat names, got %s", name)
+			}
+		}
+
+		for name, delta := range map[string]uint64{"cmd_set": 1, "cmd_get": 2, "get_hits": 1, "get_misses": 1} {
+			b, _ := strconv.ParseUint(before[name], 10, 64)
+			a, err := strconv.ParseUint(after[name], 10, 64)
+			if err != nil {
+				t.Fatalf("Expected a number for %s, got %q", name, after[name])
+			}
+			if a-b != delta {
+				t.Fatalf("Expected %s to go up by %d, went from %d to %d", name, delta, b, a)
+			}
+		}
+	})
+
+	t.Run("Rend", func(t *testing.T) {
+		rend := statsMap(t, server.StatsGroupRend)
+		if _, ok := rend["cmd_get_hits"]; !ok {
+			t.Fatal("Expected the Rend metrics in the rend group")
+		}
+	})
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Timeouts limit how long external connections and the requests on them can take, across every
+// listener in the process. Zero values mean no timeout.
+type Timeouts struct {
+	// Idle is how long a connection can wait between requests, or before its first request,
+	// before it is closed
+	Idle time.Duration
+
+	// Read is how long a client has to send the rest of a request once the first part of it
+	// has been received
+	Read time.Duration
+
+	// Write is how long each write of a response can take. Clients that stop reading their
+	// responses are disconnected once it runs out.
+	Write time.Duration
+
+	// Request is how long the handlers have to do the work for each request. It is the deadline
+	// of the context each request is handled with, and it is also passed to handlers that
+	// implement handlers.DeadlineAware. A request that runs past it is answered with a temporary
+	// failure and the connection stays open.
+	Request time.Duration
+}
+
+var (
+	timeoutsLock = new(sync.Mutex)
+	timeouts     Timeouts
+)
+
+// SetTimeouts replaces the current timeouts for every listener and Instance. Connections that are already being served keep the
+// timeouts they started with.
+func SetTimeouts(t Timeouts) {
+	timeoutsLock.Lock()
+	timeouts = t
+	timeoutsLock.Unlock()
+}
+
+func currentTimeouts() Timeouts {
+	timeoutsLock.Lock()
+	defer timeoutsLock.Unlock()
+	return timeouts
+}
+
+// deadline returns the time d from now, or no deadline if d is zero
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// isTimeout returns true if err is from a read or write that ran past its deadline
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
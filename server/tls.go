@@ -0,0 +1,159 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+
+	"github.com/netflix/rend/metrics"
+)
+
+// TLSConfig is the set of files used to set up a TLS listener
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded server certificate (chain) and private key
+	CertFile string
+	KeyFile  string
+
+	// CAFile is a PEM bundle of the CAs that client certificates are verified against. If it is
+	// empty, client certificates are not requested.
+	CAFile string
+
+	// RequireClientCert rejects connections that don't present a client certificate signed by one
+	// of the CAs in CAFile. If it is false, a client certificate is verified if given but optional.
+	RequireClientCert bool
+}
+
+// TLSCerts holds the currently loaded certificate and CA pool for TLS listeners. Reloading it
+// changes what new connections see; connections that have already done their handshake are not
+// affected.
+type TLSCerts struct {
+	conf   TLSConfig
+	config atomic.Value // *tls.Config
+}
+
+// LoadTLSCerts reads the files in the given config and returns a TLSCerts that can be reloaded
+// later by calling Reload.
+func LoadTLSCerts(conf TLSConfig) (*TLSCerts, error) {
+	if conf.RequireClientCert && conf.CAFile == "" {
+		return nil, fmt.Errorf("Requiring client certificates needs a CA file to verify them")
+	}
+
+	c := &TLSCerts{conf: conf}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload re-reads the certificate, key, and CA files. If any of them are invalid the current
+// certificates are kept and the error is returned.
+func (c *TLSCerts) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.conf.CertFile, c.conf.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading TLS certificate %s and key %s: %v", c.conf.CertFile, c.conf.KeyFile, err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.conf.CAFile)
+		if err != nil {
+			return fmt.Errorf("Error reading TLS CA file %s: %v", c.conf.CAFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("Error parsing TLS CA file %s: no certificates found", c.conf.CAFile)
+		}
+
+		config.ClientCAs = pool
+		if c.conf.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	c.config.Store(config)
+	metrics.IncCounter(MetricTLSReloads)
+
+	return nil
+}
+
+// configForClient is used as the GetConfigForClient callback so every handshake uses the most
+// recently loaded certificates.
+func (c *TLSCerts) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return c.config.Load().(*tls.Config), nil
+}
+
+type tlsListener struct {
+	tcpListener
+	config *tls.Config
+}
+
+// Configure sets up the underlying TCP connection the same way as a TCP listener and then wraps
+// it in TLS. The handshake is not done here so a slow client can't hold up the accept loop. It
+// happens on the first read, which is when the protocol is being determined.
+func (l *tlsListener) Configure(conn net.Conn) (net.Conn, error) {
+	conn, err := l.tcpListener.Configure(conn)
+	if err != nil {
+		return conn, err
+	}
+
+	return tls.Server(conn, l.config), nil
+}
+
+// TLSListener is a ListenConst that returns a TLS over tcp listener for the given port. Inherited
+// sockets are used the same way as TCPListener. The certificates are shared with anything else
+// using the same TLSCerts, and a reload is picked up by the next handshake.
+func TLSListener(port int, certs *TLSCerts) ListenConst {
+	return func() (Listener, error) {
+		listener, err := listenTCP(port)
+		if err != nil {
+			return nil, err
+		}
+		return &tlsListener{
+			tcpListener: tcpListener{listener: listener},
+			config: &tls.Config{
+				GetConfigForClient: certs.configForClient,
+			},
+		}, nil
+	}
+}
+
+// connIdentity returns the common name of the verified client certificate on a TLS connection,
+// or an empty string if the connection isn't TLS or the client didn't give a certificate. It
+// must only be called after the handshake is done.
+func connIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
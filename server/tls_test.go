@@ -0,0 +1,139 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/server"
+)
+
+// writeTestCert writes a self signed certificate and its key to dir and returns their paths
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rend-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshaling key: %v", err)
+	}
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatalf("Error writing certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+
+	return certPath, keyPath
+}
+
+func TestLoadTLSCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rend-tls")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := writeTestCert(t, dir)
+
+	t.Run("Valid", func(t *testing.T) {
+		_, err := server.LoadTLSCerts(server.TLSConfig{
+			CertFile: certPath,
+			KeyFile:  keyPath,
+			CAFile:   certPath,
+		})
+		if err != nil {
+			t.Fatalf("Expected certs to load, got %v", err)
+		}
+	})
+
+	t.Run("RequireClientCertWithoutCA", func(t *testing.T) {
+		_, err := server.LoadTLSCerts(server.TLSConfig{
+			CertFile:          certPath,
+			KeyFile:           keyPath,
+			RequireClientCert: true,
+		})
+		if err == nil {
+			t.Fatal("Expected an error requiring client certs without a CA")
+		}
+	})
+
+	t.Run("BadCA", func(t *testing.T) {
+		_, err := server.LoadTLSCerts(server.TLSConfig{
+			CertFile: certPath,
+			KeyFile:  keyPath,
+			CAFile:   keyPath,
+		})
+		if err == nil {
+			t.Fatal("Expected an error using a key as the CA bundle")
+		}
+	})
+
+	t.Run("ReloadFailure", func(t *testing.T) {
+		reloadDir, err := ioutil.TempDir(dir, "reload")
+		if err != nil {
+			t.Fatalf("Error creating temp dir: %v", err)
+		}
+
+		cert, key := writeTestCert(t, reloadDir)
+		certs, err := server.LoadTLSCerts(server.TLSConfig{CertFile: cert, KeyFile: key})
+		if err != nil {
+			t.Fatalf("Expected certs to load, got %v", err)
+		}
+
+		if err := os.Remove(key); err != nil {
+			t.Fatalf("Error removing key: %v", err)
+		}
+		if err := certs.Reload(); err == nil {
+			t.Fatal("Expected an error reloading with a missing key")
+		}
+	})
+}
@@ -35,6 +35,34 @@ type Server interface {
 	Loop()
 }
 
+// Drainer is implemented by servers that can stop serving a connection gracefully. Drain is called
+// from another goroutine while Loop is running; Loop should return after the request it is working
+// on, if any, is done.
+type Drainer interface {
+	Drain()
+}
+
+// ResponderAware is implemented by servers that answer some requests themselves instead of passing
+// them to the orchestrator, such as SASL authentication. It is called before Loop with the same
+// responder the orchestrator was given.
+type ResponderAware interface {
+	SetResponder(res protocol.Responder)
+}
+
+// IdentityAware is implemented by servers that want to know the identity a connection proved
+// while it was being set up, such as the common name of a verified TLS client certificate. It is
+// called before Loop and only if there is an identity.
+type IdentityAware interface {
+	SetIdentity(identity string)
+}
+
+// RemoteAddrAware is implemented by servers that want to know the address of the client. It is
+// called before Loop. For listeners wrapped with ProxyProtocol this is the real client address
+// from the PROXY header rather than the load balancer's.
+type RemoteAddrAware interface {
+	SetRemoteAddr(addr net.Addr)
+}
+
 // ListenConst is a constructor function for listener implementations
 type ListenConst func() (Listener, error)
 
@@ -42,6 +70,7 @@ type ListenConst func() (Listener, error)
 type Listener interface {
 	Accept() (net.Conn, error)
 	Configure(net.Conn) (net.Conn, error)
+	Close() error
 }
 
 var (
@@ -55,6 +84,20 @@ var (
 	MetricCmdTotal                  = metrics.AddCounter("cmd_total", nil)
 	MetricErrAppError               = metrics.AddCounter("err_app_err", nil)
 	MetricErrUnrecoverable          = metrics.AddCounter("err_unrecoverable", nil)
+	MetricAuthSuccess               = metrics.AddCounter("auth_success", nil)
+	MetricAuthFailure               = metrics.AddCounter("auth_failure", nil)
+	MetricAuthRejected              = metrics.AddCounter("auth_rejected_unauthenticated", nil)
+	MetricAuthClientCert            = metrics.AddCounter("auth_client_cert", nil)
+	MetricTLSReloads                = metrics.AddCounter("tls_reloads", nil)
+	MetricProxyHeader               = metrics.AddCounter("proxy_header", nil)
+	MetricProxyHeaderError          = metrics.AddCounter("proxy_header_error", nil)
+	MetricConnectionsDrained        = metrics.AddCounter("conn_drained", nil)
+	MetricConnectionsForceClosed    = metrics.AddCounter("conn_force_closed", nil)
+	MetricConnectionsRejectedMax    = metrics.AddCounter("conn_rejected_max", nil)
+	MetricConnectionsRejectedIP     = metrics.AddCounter("conn_rejected_ip", nil)
+	MetricConnectionsRejectedRate   = metrics.AddCounter("conn_rejected_rate", nil)
+	MetricConnectionsTimedOut       = metrics.AddCounter("conn_timed_out", nil)
+	MetricConnectionsHungUp         = metrics.AddCounter("conn_hung_up", nil)
 
 	MetricCmdGet     = metrics.AddCounter("cmd_get", nil)
 	MetricCmdGetE    = metrics.AddCounter("cmd_gete", nil)
@@ -66,11 +109,18 @@ var (
 	MetricCmdDelete  = metrics.AddCounter("cmd_delete", nil)
 	MetricCmdTouch   = metrics.AddCounter("cmd_touch", nil)
 	MetricCmdGat     = metrics.AddCounter("cmd_gat", nil)
+	MetricCmdIncr    = metrics.AddCounter("cmd_incr", nil)
+	MetricCmdDecr    = metrics.AddCounter("cmd_decr", nil)
+	MetricCmdFlush   = metrics.AddCounter("cmd_flush", nil)
+	MetricCmdStats   = metrics.AddCounter("cmd_stats", nil)
 	MetricCmdUnknown = metrics.AddCounter("cmd_unknown", nil)
 	MetricCmdNoop    = metrics.AddCounter("cmd_noop", nil)
 	MetricCmdQuit    = metrics.AddCounter("cmd_quit", nil)
 	MetricCmdVersion = metrics.AddCounter("cmd_version", nil)
 
+	MetricCmdSASLListMechs = metrics.AddCounter("cmd_sasl_list_mechs", nil)
+	MetricCmdSASLAuth      = metrics.AddCounter("cmd_sasl_auth", nil)
+
 	HistSet     = metrics.AddHistogram("set", false, nil)
 	HistAdd     = metrics.AddHistogram("add", false, nil)
 	HistReplace = metrics.AddHistogram("replace", false, nil)
@@ -78,6 +128,9 @@ var (
 	HistPrepend = metrics.AddHistogram("prepend", false, nil)
 	HistDelete  = metrics.AddHistogram("delete", false, nil)
 	HistTouch   = metrics.AddHistogram("touch", false, nil)
+	HistIncr    = metrics.AddHistogram("incr", false, nil)
+	HistDecr    = metrics.AddHistogram("decr", false, nil)
+	HistFlush   = metrics.AddHistogram("flush", false, nil)
 	HistGet     = metrics.AddHistogram("get", false, nil)  // not sampled until configurable
 	HistGetE    = metrics.AddHistogram("gete", false, nil) // not sampled until configurable
 	HistGat     = metrics.AddHistogram("gat", false, nil)  // not sampled until configurable